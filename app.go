@@ -13,10 +13,10 @@ specific language governing permissions and limitations under the License.
 package weblogin
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"html/template"
+	"log/slog"
 	"strings"
 )
 
@@ -29,9 +29,13 @@ var (
 
 // App contains common variables to avoid using global variables.
 type App struct {
-	DB    *sql.DB
-	Tmpls *template.Template
-	Cfg   Config
+	Store    Store
+	Tmpls    *template.Template
+	Cfg      Config
+	OIDC     *OIDCProvider // nil if no OIDC clients are configured
+	Limiter  Limiter       // used by RateLimitHandler
+	Breached *BreachedList // nil if no breached password list is configured
+	Mailer   Mailer        // sends email, SMTPMailer with Cfg.SMTP if nil
 }
 
 // NewApp returns a new App based on the config filename provided.
@@ -58,12 +62,51 @@ func NewApp(configFilename string) (*App, error) {
 		app.Cfg.SessionExpiresHours = 24
 	}
 
-	// init database connection
-	app.DB, err = InitDB(app.Cfg.SQL.DriverName, app.Cfg.SQL.DataSourceName)
+	// ensure TOTP key is valid, if provided
+	if app.Cfg.TOTP.Key != "" {
+		_, err = DecodeKey(app.Cfg.TOTP.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: TOTP.Key: %v", fn, ErrAppInvalidConfig, err)
+		}
+	}
+
+	// default to Title if no TOTP issuer
+	if app.Cfg.TOTP.Issuer == "" {
+		app.Cfg.TOTP.Issuer = app.Cfg.Title
+	}
+
+	// init OpenID Connect provider, if clients are configured
+	if len(app.Cfg.OIDC.Clients) > 0 {
+		app.OIDC, err = NewOIDCProvider(app.Cfg.OIDC, app.Cfg.BaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: OIDC: %v", fn, ErrAppInvalidConfig, err)
+		}
+	}
+
+	app.Limiter = NewMemLimiter()
+
+	// load breached passwords, if configured
+	if app.Cfg.Password.BreachedFile != "" {
+		app.Breached, err = LoadBreachedList(app.Cfg.Password.BreachedFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: Password: %v", fn, ErrAppInvalidConfig, err)
+		}
+	}
+
+	// init store based on the driver
+	app.Store, err = NewStore(app.Cfg.SQL.DriverName, app.Cfg.SQL.DataSourceName)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w: %v", fn, ErrAppInitDB, err)
 	}
 
+	// apply migrations and refuse a schema newer than known
+	if s, ok := app.Store.(*SQLStore); ok {
+		err = initSchema(s, app.Cfg.SQL.AutoMigrate)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", fn, ErrAppInitDB, err)
+		}
+	}
+
 	// init HTML templates
 	app.Tmpls, err = InitTemplates(app.Cfg.ParseGlobPattern)
 	if err != nil {
@@ -72,3 +115,32 @@ func NewApp(configFilename string) (*App, error) {
 
 	return &app, err
 }
+
+// initSchema applies pending migrations to s if autoMigrate is true and
+// returns an error if the schema is newer than the latest migration. If
+// autoMigrate is false, ErrSchemaPending is returned for pending migrations,
+// since the code requires the latest schema.
+func initSchema(s *SQLStore, autoMigrate bool) error {
+	fn := "initSchema"
+
+	current, latest, err := s.CheckSchema()
+	if err != nil {
+		return err
+	}
+
+	if current < latest {
+		if !autoMigrate {
+			return fmt.Errorf("%s: %w: version %d, latest %d, run migrate up or set AutoMigrate",
+				fn, ErrSchemaPending, current, latest)
+		}
+
+		var applied strings.Builder
+		err = s.Migrate(latest, false, &applied)
+		if err != nil {
+			return err
+		}
+		slog.Info("applied schema migrations", "migrations", applied.String())
+	}
+
+	return nil
+}
@@ -16,9 +16,11 @@ import (
 	"errors"
 	"log/slog"
 	"testing"
+	"time"
 
 	weblogin "github.com/bnixon67/go-weblogin"
 	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
 )
 
 const (
@@ -40,11 +42,60 @@ func AppForTest(t *testing.T) *weblogin.App {
 
 			t.Fatalf("cannot create NewApp, %v", err)
 		}
+
+		err = seedStore(app.Store)
+		if err != nil {
+			app = nil
+
+			t.Fatalf("cannot seed Store, %v", err)
+		}
+
+		// the test config does not have a real SMTP server
+		app.Mailer = &testMailer{}
 	}
 
 	return app
 }
 
+// TestPasswordHash is the hash of the password "password" for test users.
+const TestPasswordHash = "$2a$10$2bLycFqUmc6m6iLkaeUgKOGwzekGd9IoAPMbXRNNuJ8Sv9ItgV29O"
+
+// seedStore adds the users and events expected by the tests to s.
+func seedStore(s weblogin.Store) error {
+	users := []weblogin.User{
+		{UserName: "test", FullName: "Test User", Email: "test@email", EmailVerified: true},
+		{UserName: "admin", FullName: "Admin User", Email: "admin@email", IsAdmin: true, EmailVerified: true},
+	}
+	for _, user := range users {
+		err := s.CreateUser(user, TestPasswordHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	logins := map[string][]int{
+		"test1": {1},
+		"test2": {1, 2},
+		"test3": {3, 2, 1},
+		"test4": {1, 4, 2, 3},
+	}
+	for userName, hours := range logins {
+		for _, hour := range hours {
+			err := s.SaveEvent(weblogin.Event{
+				Name:     weblogin.EventLogin,
+				Result:   true,
+				UserName: userName,
+				Created:  time.Date(2023, time.January, 15, hour, 0, 0, 0, time.UTC),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // TestNewApp provides tests for the NewApp function.
 func TestNewApp(t *testing.T) {
 	testCases := []struct {
@@ -77,6 +128,12 @@ func TestNewApp(t *testing.T) {
 			wantErr:        weblogin.ErrAppInitDB,
 			isAppExpected:  false,
 		},
+		{
+			name:           "pendingSchema",
+			configFileName: "testdata/pending_schema.json",
+			wantErr:        weblogin.ErrAppInitDB,
+			isAppExpected:  false,
+		},
 		{
 			name:           "invalidTemplates",
 			configFileName: "testdata/invalid_tmpl.json",
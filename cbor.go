@@ -0,0 +1,189 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// This is a minimal CBOR (RFC 8949) decoder that supports the subset used by
+// WebAuthn attestation objects and COSE keys. Integers are decoded as int64,
+// byte strings as []byte, text strings as string, arrays as []any, maps as
+// map[any]any, and simple values as bool, nil, or float64.
+
+var ErrCBOR = errors.New("invalid CBOR")
+
+// maxCBORDepth limits nesting to prevent excessive recursion.
+const maxCBORDepth = 16
+
+// cborDecode decodes the first CBOR item in b and returns it with the
+// remaining bytes.
+func cborDecode(b []byte) (any, []byte, error) {
+	return cborDecodeItem(b, 0)
+}
+
+// cborHead decodes the initial byte and argument of an item.
+func cborHead(b []byte) (major byte, arg uint64, info byte, rest []byte, err error) {
+	if len(b) < 1 {
+		return 0, 0, 0, nil, ErrCBOR
+	}
+
+	major, info, b = b[0]>>5, b[0]&0x1f, b[1:]
+
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24:
+		if len(b) < 1 {
+			return 0, 0, 0, nil, ErrCBOR
+		}
+		arg, b = uint64(b[0]), b[1:]
+	case info == 25:
+		if len(b) < 2 {
+			return 0, 0, 0, nil, ErrCBOR
+		}
+		arg, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26:
+		if len(b) < 4 {
+			return 0, 0, 0, nil, ErrCBOR
+		}
+		arg, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27:
+		if len(b) < 8 {
+			return 0, 0, 0, nil, ErrCBOR
+		}
+		arg, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		// indefinite lengths are not used by WebAuthn
+		return 0, 0, 0, nil, ErrCBOR
+	}
+
+	return major, arg, info, b, nil
+}
+
+// cborDecodeItem decodes a single item at the given nesting depth.
+func cborDecodeItem(b []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, ErrCBOR
+	}
+
+	major, arg, info, b, err := cborHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0: // unsigned integer
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrCBOR
+		}
+		return int64(arg), b, nil
+
+	case 1: // negative integer
+		if arg > math.MaxInt64 {
+			return nil, nil, ErrCBOR
+		}
+		return -1 - int64(arg), b, nil
+
+	case 2, 3: // byte string, text string
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrCBOR
+		}
+		data := b[:arg]
+		if major == 3 {
+			return string(data), b[arg:], nil
+		}
+		return append([]byte(nil), data...), b[arg:], nil
+
+	case 4: // array
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrCBOR
+		}
+		arr := make([]any, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var v any
+			v, b, err = cborDecodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, b, nil
+
+	case 5: // map
+		if arg > uint64(len(b)) {
+			return nil, nil, ErrCBOR
+		}
+		m := make(map[any]any, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v any
+			k, b, err = cborDecodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, ErrCBOR
+			}
+			v, b, err = cborDecodeItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+
+	case 6: // tag, which is ignored
+		return cborDecodeItem(b, depth+1)
+
+	default: // simple values and floats
+		switch {
+		case info == 20:
+			return false, b, nil
+		case info == 21:
+			return true, b, nil
+		case info == 22 || info == 23:
+			return nil, b, nil
+		case info == 25:
+			return float64(float16(uint16(arg))), b, nil
+		case info == 26:
+			return float64(math.Float32frombits(uint32(arg))), b, nil
+		case info == 27:
+			return math.Float64frombits(arg), b, nil
+		}
+		return nil, nil, ErrCBOR
+	}
+}
+
+// float16 converts an IEEE 754 half precision value to float32.
+func float16(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+
+	switch exp {
+	case 0:
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | frac<<13)
+	}
+
+	return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+}
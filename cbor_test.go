@@ -0,0 +1,85 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestCBORDecode(t *testing.T) {
+	// examples from RFC 8949 Appendix A
+	testCases := []struct {
+		in   string
+		want any
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"f93c00", float64(1)},
+		{"fa47c35000", float64(100000)},
+		{"fb3ff199999999999a", 1.1},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"6449455446", "IETF"},
+		{"83010203", []any{int64(1), int64(2), int64(3)}},
+		{"a201020304", map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+	}
+
+	for _, tc := range testCases {
+		b, _ := hex.DecodeString(tc.in)
+		got, rest, err := cborDecode(b)
+		if err != nil {
+			t.Errorf("cborDecode(%s) got err %v", tc.in, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("cborDecode(%s) got rest %x", tc.in, rest)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("cborDecode(%s) = %#v, want %#v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestCBORDecodeInvalid(t *testing.T) {
+	testCases := []string{
+		"",                   // empty
+		"18",                 // missing argument
+		"1b800000",           // truncated
+		"1b8000000000000000", // overflows int64
+		"5f",                 // indefinite length
+		"4401",               // short byte string
+		"9a7fffffff",         // array longer than input
+		"a1f401",             // map with bool key
+		"fc",                 // reserved simple value
+		"818181818181818181818181818181818181818100", // too deep
+	}
+
+	for _, tc := range testCases {
+		b, _ := hex.DecodeString(tc)
+		_, _, err := cborDecode(b)
+		if err == nil {
+			t.Errorf("cborDecode(%s) got nil err", tc)
+		}
+	}
+}
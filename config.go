@@ -25,9 +25,15 @@ var (
 )
 
 // ConfigSQL contains SQL related configuration values.
+//
+// DriverName selects the Store and is one of mysql, postgres, sqlite, or
+// memory. DataSourceName is not used by the memory store. If AutoMigrate is
+// true, pending schema migrations are applied by NewApp, otherwise NewApp
+// fails if migrations are pending.
 type ConfigSQL struct {
 	DriverName     string
 	DataSourceName string
+	AutoMigrate    bool
 }
 
 // ConfigSMTP contains SMTP related configuration values.
@@ -44,15 +50,140 @@ type ConfigServer struct {
 	Port string
 }
 
+// ConfigTOTP contains TOTP two-factor authentication configuration values.
+type ConfigTOTP struct {
+	Issuer string // issuer shown in authenticator apps, defaults to Title
+	Key    string // base64 encoded 32 byte key used to encrypt TOTP secrets
+}
+
+// ConfigOIDCClient contains the registration of an OpenID Connect client.
+type ConfigOIDCClient struct {
+	ID           string   // client_id
+	Secret       string   // client_secret, empty for a public client that must use PKCE
+	Name         string   // name shown on the consent page
+	RedirectURIs []string // allowed redirect_uri values, which must match exactly
+	SkipConsent  bool     // do not ask the user for consent, e.g., for internal apps
+}
+
+// ConfigOIDC contains OpenID Connect provider configuration values.
+type ConfigOIDC struct {
+	Issuer              string   // issuer identifier, defaults to BaseURL
+	KeyFiles            []string // PEM private keys, the first signs and all are published
+	TokenExpiresMinutes int      // lifetime of ID and access tokens, defaults to 60
+	Clients             []ConfigOIDCClient
+}
+
+// ConfigAuthRule restricts access to matching requests of ForwardAuthHandler.
+type ConfigAuthRule struct {
+	Host              string // host to match, empty matches any host
+	PathPrefix        string // path segments to match, empty matches any path
+	RequireAdmin      bool   // only admin users are allowed
+	RequireGroup      string // only members of the group are allowed, if set
+	RequirePermission string // only users with the permission are allowed, if set
+}
+
+// ConfigForwardAuth contains reverse proxy forward authentication values.
+type ConfigForwardAuth struct {
+	Rules []ConfigAuthRule // the most specific matching rule applies
+}
+
+// ConfigHeader is a response header that is sent with Value, or a default
+// value if Value is empty, unless Disabled.
+type ConfigHeader struct {
+	Disabled bool
+	Value    string
+}
+
+// ConfigHeaders contains the security headers set by SecurityHeadersHandler.
+type ConfigHeaders struct {
+	HSTS               ConfigHeader // Strict-Transport-Security
+	CSP                ConfigHeader // Content-Security-Policy, {nonce} is replaced by the nonce
+	FrameOptions       ConfigHeader // X-Frame-Options
+	ReferrerPolicy     ConfigHeader // Referrer-Policy
+	PermissionsPolicy  ConfigHeader // Permissions-Policy
+	ContentTypeOptions ConfigHeader // X-Content-Type-Options
+	NoStore            ConfigHeader // Cache-Control for requests with a session
+}
+
+// ConfigLimit is a token bucket limit that allows Burst events at once
+// and refills at PerMinute events per minute.
+type ConfigLimit struct {
+	PerMinute float64
+	Burst     int
+}
+
+// Enabled returns true if the limit should be applied.
+func (c ConfigLimit) Enabled() bool {
+	return c.PerMinute > 0 && c.Burst > 0
+}
+
+// ConfigRouteLimit contains the rate limits for a route.
+type ConfigRouteLimit struct {
+	PerIP      ConfigLimit // keyed by client IP address
+	PerAccount ConfigLimit // keyed by submitted username or email
+}
+
+// ConfigLockout contains account lockout configuration values.
+type ConfigLockout struct {
+	MaxFailures        int  // failed logins within the window to lock, 0 to disable
+	WindowMinutes      int  // window to count failed logins
+	DurationMinutes    int  // duration of the first lock
+	Backoff            bool // double the duration for each consecutive lock
+	MaxDurationMinutes int  // maximum duration of a lock with Backoff
+}
+
+// ConfigVerifyEmail contains email address verification configuration values.
+type ConfigVerifyEmail struct {
+	Required      bool // require a verified email address to login
+	ExpiresHours  int  // number of hours a verification link is valid
+	ResendMinutes int  // minimum minutes between verification emails for a user
+}
+
+// ConfigPassword contains the password policy.
+type ConfigPassword struct {
+	MinLength     int    // minimum characters, defaults to PasswordDefaultMinLength
+	MaxLength     int    // maximum bytes, at most PasswordMaxBytes
+	RequireUpper  bool   // require an uppercase letter
+	RequireLower  bool   // require a lowercase letter
+	RequireDigit  bool   // require a digit
+	RequireSymbol bool   // require a character that is not a letter or digit
+	AllowUserInfo bool   // allow the username or email in the password
+	History       int    // number of recent passwords, including the current, that cannot be reused
+	MinAgeHours   int    // hours before a password can be changed again
+	MaxAgeDays    int    // days before a password expires, 0 to disable
+	WarnDays      int    // days before expiration to warn the user
+	BreachedFile  string // optional file of breached password hashes, see LoadBreachedList
+}
+
+// ConfigMagicLink contains passwordless login link configuration values.
+type ConfigMagicLink struct {
+	Enabled        bool // allow a login with a link sent by email
+	ExpiresMinutes int  // minutes a link is valid, defaults to MagicLinkDefaultExpiresMinutes
+	BindBrowser    bool // only accept a link in the browser that requested it
+}
+
 // Config represents the configuration values.
 type Config struct {
 	Title               string // title of the application
 	BaseURL             string // base URL, e.g., https://host:port
 	ParseGlobPattern    string // pattern to use with template.ParseGlob
 	SessionExpiresHours int    // number of hours user session is valid
+	SessionIdleMinutes  int    // minutes an unused session is valid, 0 to disable
+	SessionMaxHours     int    // maximum hours with SessionIdleMinutes, default SessionExpiresHours
+	RememberDays        int    // days a remember me login is valid, 0 to disable
+	PrivacyMode         bool   // respond the same whether or not an account exists
 	Server              ConfigServer
 	SQL                 ConfigSQL
 	SMTP                ConfigSMTP
+	TOTP                ConfigTOTP
+	OIDC                ConfigOIDC
+	ForwardAuth         ConfigForwardAuth
+	Lockout             ConfigLockout
+	RateLimit           map[string]ConfigRouteLimit // limits by route, e.g., /login
+	Headers             ConfigHeaders
+	VerifyEmail         ConfigVerifyEmail
+	Password            ConfigPassword
+	MagicLink           ConfigMagicLink
 }
 
 // GetConfigFromFile returns the Config from filename.
@@ -96,7 +227,9 @@ func (c *Config) IsValid() (bool, []string) {
 	missing = appendIfEmpty(missing, c.Server.Host, "Server.Host")
 	missing = appendIfEmpty(missing, c.Server.Port, "Server.Port")
 	missing = appendIfEmpty(missing, c.SQL.DriverName, "SQL.DriverName")
-	missing = appendIfEmpty(missing, c.SQL.DataSourceName, "SQL.DataSourceName")
+	if c.SQL.DriverName != MemoryDriverName {
+		missing = appendIfEmpty(missing, c.SQL.DataSourceName, "SQL.DataSourceName")
+	}
 	missing = appendIfEmpty(missing, c.SMTP.Host, "SMTP.Host")
 	missing = appendIfEmpty(missing, c.SMTP.Port, "SMTP.Port")
 	missing = appendIfEmpty(missing, c.SMTP.User, "SMTP.User")
@@ -108,18 +241,32 @@ func (c *Config) IsValid() (bool, []string) {
 // RedactedConfig is a copy of Config used to redact values on output.
 type RedactedConfig Config
 
-// MarshalJSON is a custom Marshaler to redact some fields.
-func (c Config) MarshalJSON() ([]byte, error) {
+// redacted returns a copy of c with sensitive values redacted.
+func (c Config) redacted() RedactedConfig {
 	r := RedactedConfig(c)
 	r.SQL.DataSourceName = "[REDACTED]"
 	r.SMTP.Password = "[REDACTED]"
-	return json.Marshal(r)
+	r.TOTP.Key = "[REDACTED]"
+
+	// copy clients to avoid modifying c
+	if c.OIDC.Clients != nil {
+		r.OIDC.Clients = append([]ConfigOIDCClient(nil), c.OIDC.Clients...)
+		for i := range r.OIDC.Clients {
+			if r.OIDC.Clients[i].Secret != "" {
+				r.OIDC.Clients[i].Secret = "[REDACTED]"
+			}
+		}
+	}
+
+	return r
+}
+
+// MarshalJSON is a custom Marshaler to redact some fields.
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.redacted())
 }
 
 // String is a custom Stringer to redact some fields.
 func (c Config) String() string {
-	r := RedactedConfig(c)
-	r.SQL.DataSourceName = "[REDACTED]"
-	r.SMTP.Password = "[REDACTED]"
-	return fmt.Sprintf("%+v", r)
+	return fmt.Sprintf("%+v", c.redacted())
 }
@@ -140,6 +140,11 @@ func TestConfigIsValid(t *testing.T) {
 	// last case should be true since all required fields are present
 	cases[len(cases)-1].expected = true
 
+	// memory store does not require a DataSourceName
+	memory := cases[len(cases)-1].config
+	memory.SQL = weblogin.ConfigSQL{DriverName: weblogin.MemoryDriverName}
+	cases = append(cases, tcase{memory, true})
+
 	for _, testCase := range cases {
 		got, _ := testCase.config.IsValid()
 		if got != testCase.expected {
@@ -165,7 +170,19 @@ func TestConfigMarshalJSON(t *testing.T) {
 					Password: "supersecret",
 				},
 			},
-			want: `{"Title":"AppConfig","BaseURL":"","ParseGlobPattern":"","SessionExpiresHours":0,"Server":{"Host":"","Port":""},"SQL":{"DriverName":"","DataSourceName":"[REDACTED]"},"SMTP":{"Host":"","Port":"","User":"","Password":"[REDACTED]"}}`,
+			want: `{"Title":"AppConfig","BaseURL":"","ParseGlobPattern":"","SessionExpiresHours":0,"SessionIdleMinutes":0,"SessionMaxHours":0,"RememberDays":0,"PrivacyMode":false,"Server":{"Host":"","Port":""},"SQL":{"DriverName":"","DataSourceName":"[REDACTED]","AutoMigrate":false},"SMTP":{"Host":"","Port":"","User":"","Password":"[REDACTED]"},"TOTP":{"Issuer":"","Key":"[REDACTED]"},"OIDC":{"Issuer":"","KeyFiles":null,"TokenExpiresMinutes":0,"Clients":null},"ForwardAuth":{"Rules":null},"Lockout":{"MaxFailures":0,"WindowMinutes":0,"DurationMinutes":0,"Backoff":false,"MaxDurationMinutes":0},"RateLimit":null,"Headers":{"HSTS":{"Disabled":false,"Value":""},"CSP":{"Disabled":false,"Value":""},"FrameOptions":{"Disabled":false,"Value":""},"ReferrerPolicy":{"Disabled":false,"Value":""},"PermissionsPolicy":{"Disabled":false,"Value":""},"ContentTypeOptions":{"Disabled":false,"Value":""},"NoStore":{"Disabled":false,"Value":""}},"VerifyEmail":{"Required":false,"ExpiresHours":0,"ResendMinutes":0},"Password":{"MinLength":0,"MaxLength":0,"RequireUpper":false,"RequireLower":false,"RequireDigit":false,"RequireSymbol":false,"AllowUserInfo":false,"History":0,"MinAgeHours":0,"MaxAgeDays":0,"WarnDays":0,"BreachedFile":""},"MagicLink":{"Enabled":false,"ExpiresMinutes":0,"BindBrowser":false}}`,
+		},
+		{
+			name: "oidcClientSecret",
+			input: weblogin.Config{
+				OIDC: weblogin.ConfigOIDC{
+					Clients: []weblogin.ConfigOIDCClient{
+						{ID: "app", Secret: "supersecret"},
+						{ID: "spa"},
+					},
+				},
+			},
+			want: `{"Title":"","BaseURL":"","ParseGlobPattern":"","SessionExpiresHours":0,"SessionIdleMinutes":0,"SessionMaxHours":0,"RememberDays":0,"PrivacyMode":false,"Server":{"Host":"","Port":""},"SQL":{"DriverName":"","DataSourceName":"[REDACTED]","AutoMigrate":false},"SMTP":{"Host":"","Port":"","User":"","Password":"[REDACTED]"},"TOTP":{"Issuer":"","Key":"[REDACTED]"},"OIDC":{"Issuer":"","KeyFiles":null,"TokenExpiresMinutes":0,"Clients":[{"ID":"app","Secret":"[REDACTED]","Name":"","RedirectURIs":null,"SkipConsent":false},{"ID":"spa","Secret":"","Name":"","RedirectURIs":null,"SkipConsent":false}]},"ForwardAuth":{"Rules":null},"Lockout":{"MaxFailures":0,"WindowMinutes":0,"DurationMinutes":0,"Backoff":false,"MaxDurationMinutes":0},"RateLimit":null,"Headers":{"HSTS":{"Disabled":false,"Value":""},"CSP":{"Disabled":false,"Value":""},"FrameOptions":{"Disabled":false,"Value":""},"ReferrerPolicy":{"Disabled":false,"Value":""},"PermissionsPolicy":{"Disabled":false,"Value":""},"ContentTypeOptions":{"Disabled":false,"Value":""},"NoStore":{"Disabled":false,"Value":""}},"VerifyEmail":{"Required":false,"ExpiresHours":0,"ResendMinutes":0},"Password":{"MinLength":0,"MaxLength":0,"RequireUpper":false,"RequireLower":false,"RequireDigit":false,"RequireSymbol":false,"AllowUserInfo":false,"History":0,"MinAgeHours":0,"MaxAgeDays":0,"WarnDays":0,"BreachedFile":""},"MagicLink":{"Enabled":false,"ExpiresMinutes":0,"BindBrowser":false}}`,
 		},
 	}
 
@@ -200,7 +217,7 @@ func TestConfigString(t *testing.T) {
 					Password: "supersecret",
 				},
 			},
-			want: `{Title:AppConfig BaseURL: ParseGlobPattern: SessionExpiresHours:0 Server:{Host: Port:} SQL:{DriverName: DataSourceName:[REDACTED]} SMTP:{Host: Port: User: Password:[REDACTED]}}`,
+			want: `{Title:AppConfig BaseURL: ParseGlobPattern: SessionExpiresHours:0 SessionIdleMinutes:0 SessionMaxHours:0 RememberDays:0 PrivacyMode:false Server:{Host: Port:} SQL:{DriverName: DataSourceName:[REDACTED] AutoMigrate:false} SMTP:{Host: Port: User: Password:[REDACTED]} TOTP:{Issuer: Key:[REDACTED]} OIDC:{Issuer: KeyFiles:[] TokenExpiresMinutes:0 Clients:[]} ForwardAuth:{Rules:[]} Lockout:{MaxFailures:0 WindowMinutes:0 DurationMinutes:0 Backoff:false MaxDurationMinutes:0} RateLimit:map[] Headers:{HSTS:{Disabled:false Value:} CSP:{Disabled:false Value:} FrameOptions:{Disabled:false Value:} ReferrerPolicy:{Disabled:false Value:} PermissionsPolicy:{Disabled:false Value:} ContentTypeOptions:{Disabled:false Value:} NoStore:{Disabled:false Value:}} VerifyEmail:{Required:false ExpiresHours:0 ResendMinutes:0} Password:{MinLength:0 MaxLength:0 RequireUpper:false RequireLower:false RequireDigit:false RequireSymbol:false AllowUserInfo:false History:0 MinAgeHours:0 MaxAgeDays:0 WarnDays:0 BreachedFile:} MagicLink:{Enabled:false ExpiresMinutes:0 BindBrowser:false}}`,
 		},
 	}
 
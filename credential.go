@@ -0,0 +1,37 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"time"
+)
+
+// Credential represents a WebAuthn credential stored in the Store.
+type Credential struct {
+	ID         []byte    // credential ID from the authenticator
+	UserName   string    // user that registered the credential
+	Name       string    // name provided by the user
+	PublicKey  []byte    // COSE encoded public key
+	SignCount  uint32    // last signature counter
+	Transports []string  // transports reported by the authenticator
+	Created    time.Time // time the credential was registered
+	LastUsed   time.Time // time the credential was last used, if ever
+}
+
+// EncodedID returns the base64url encoded credential ID.
+func (c Credential) EncodedID() string {
+	return base64URL(c.ID)
+}
+
+var ErrCredentialNotFound = errors.New("credential not found")
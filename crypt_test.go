@@ -0,0 +1,76 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, weblogin.EncryptionKeySize)
+	otherKey := bytes.Repeat([]byte{2}, weblogin.EncryptionKeySize)
+
+	ciphertext, err := weblogin.Encrypt(key, "secret")
+	if err != nil {
+		t.Fatalf("Encrypt() got err %v", err)
+	}
+
+	got, err := weblogin.Decrypt(key, ciphertext)
+	if err != nil || got != "secret" {
+		t.Errorf("Decrypt() = %q, %v, want %q, nil", got, err, "secret")
+	}
+
+	_, err = weblogin.Decrypt(otherKey, ciphertext)
+	if !errors.Is(err, weblogin.ErrInvalidCiphertext) {
+		t.Errorf("Decrypt() with wrong key got err %v, want %v", err, weblogin.ErrInvalidCiphertext)
+	}
+
+	_, err = weblogin.Decrypt(key, "invalid")
+	if !errors.Is(err, weblogin.ErrInvalidCiphertext) {
+		t.Errorf("Decrypt() with invalid ciphertext got err %v, want %v", err, weblogin.ErrInvalidCiphertext)
+	}
+
+	_, err = weblogin.Encrypt([]byte("short"), "secret")
+	if !errors.Is(err, weblogin.ErrInvalidKey) {
+		t.Errorf("Encrypt() with short key got err %v, want %v", err, weblogin.ErrInvalidKey)
+	}
+}
+
+func TestDecodeKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, weblogin.EncryptionKeySize))
+
+	testCases := []struct {
+		name    string
+		key     string
+		wantErr error
+	}{
+		{"valid", valid, nil},
+		{"empty", "", weblogin.ErrInvalidKey},
+		{"notBase64", "not base64!", weblogin.ErrInvalidKey},
+		{"short", base64.StdEncoding.EncodeToString([]byte("short")), weblogin.ErrInvalidKey},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := weblogin.DecodeKey(tc.key)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("DecodeKey(%q) got err %v, want %v", tc.key, err, tc.wantErr)
+			}
+		})
+	}
+}
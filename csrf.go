@@ -0,0 +1,116 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+const (
+	CSRFCookieName = "csrf"         // cookie with the token
+	CSRFFieldName  = "csrf_token"   // form field with the token
+	CSRFHeaderName = "X-CSRF-Token" // header with the token for JSON requests
+)
+
+// Key to use when setting the CSRF token.
+type ctxCSRFKey int
+
+// CSRFKey is the key for the CSRF token in a request context.
+const CSRFKey ctxCSRFKey = 0
+
+// CSRFToken returns the CSRF token from the context of r if present,
+// otherwise "". Handlers provide it to templates in the page data.
+func CSRFToken(r *http.Request) string {
+	token, ok := r.Context().Value(CSRFKey).(string)
+	if !ok {
+		return ""
+	}
+	return token
+}
+
+// safeMethod returns true if method does not change state.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// CSRFHandler is middleware that protects against cross-site request forgery
+// using a double-submit cookie, which also works before a user has logged in.
+//
+// A random token is set in a cookie if not already present and added to the
+// request context for CSRFToken. Requests with unsafe methods must provide
+// the same token in the csrf_token form field or the X-CSRF-Token header,
+// otherwise a 403 is returned. Paths in exempt, such as endpoints called by
+// other servers, are not checked.
+func (app *App) CSRFHandler(next http.Handler, exempt ...string) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.Group("request",
+			slog.String("id", GetReqID(r.Context())),
+			slog.String("remoteAddr", GetRealRemoteAddr(r)),
+			slog.String("method", r.Method),
+			slog.String("url", r.RequestURI),
+		))
+
+		if slices.Contains(exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookieToken, err := GetCookieValue(r, CSRFCookieName)
+		if err != nil {
+			logger.Error("failed to GetCookieValue", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !safeMethod(r.Method) {
+			token := r.Header.Get(CSRFHeaderName)
+			if token == "" {
+				token = r.PostFormValue(CSRFFieldName)
+			}
+
+			if cookieToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cookieToken)) != 1 {
+				logger.Warn("invalid CSRF token", "missingCookie", cookieToken == "")
+				WriteEvent(app.Store, EventCSRF, false, "", r.URL.Path)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+
+		if cookieToken == "" {
+			cookieToken, err = GenerateRandomString(32)
+			if err != nil {
+				logger.Error("failed to GenerateRandomString", "err", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     CSRFCookieName,
+				Value:    cookieToken,
+				Path:     "/",
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		ctx := context.WithValue(r.Context(), CSRFKey, cookieToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
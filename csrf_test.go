@@ -0,0 +1,120 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestCSRFHandler(t *testing.T) {
+	app := AppForTest(t)
+
+	var gotToken string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotToken = weblogin.CSRFToken(r)
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := app.CSRFHandler(next, "/exempt")
+
+	const token = "token"
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		cookie     string
+		field      string
+		header     string
+		want       int
+		wantCookie bool
+	}{
+		{name: "get sets cookie", method: http.MethodGet, path: "/", want: http.StatusOK, wantCookie: true},
+		{name: "get with cookie", method: http.MethodGet, path: "/", cookie: token, want: http.StatusOK},
+		{name: "post missing", method: http.MethodPost, path: "/", cookie: token, want: http.StatusForbidden},
+		{name: "post no cookie", method: http.MethodPost, path: "/", field: token, want: http.StatusForbidden},
+		{name: "post mismatch", method: http.MethodPost, path: "/", cookie: token, field: "other", want: http.StatusForbidden},
+		{name: "post field", method: http.MethodPost, path: "/", cookie: token, field: token, want: http.StatusOK},
+		{name: "post header", method: http.MethodPost, path: "/", cookie: token, header: token, want: http.StatusOK},
+		{name: "post exempt", method: http.MethodPost, path: "/exempt", want: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gotToken = ""
+
+			d := url.Values{weblogin.CSRFFieldName: {tc.field}}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(d.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: weblogin.CSRFCookieName, Value: tc.cookie})
+			}
+			if tc.header != "" {
+				r.Header.Set(weblogin.CSRFHeaderName, tc.header)
+			}
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+
+			var cookie string
+			for _, c := range w.Result().Cookies() {
+				if c.Name == weblogin.CSRFCookieName {
+					cookie = c.Value
+				}
+			}
+			if (cookie != "") != tc.wantCookie {
+				t.Errorf("got cookie %q, want cookie %v", cookie, tc.wantCookie)
+			}
+
+			if w.Code == http.StatusOK && tc.path != "/exempt" {
+				want := tc.cookie
+				if tc.wantCookie {
+					want = cookie
+				}
+				if gotToken != want {
+					t.Errorf("got CSRFToken %q, want %q", gotToken, want)
+				}
+			}
+		})
+	}
+
+	count, err := app.Store.CountEvents(weblogin.EventCSRF, false, "", time.Now().Add(-time.Minute))
+	if err != nil || count != 3 {
+		t.Errorf("got %d csrf events, %v, want 3", count, err)
+	}
+}
+
+func TestCSRFTokenInLoginPage(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.AddCookie(&http.Cookie{Name: weblogin.CSRFCookieName, Value: "logintoken"})
+
+	app.CSRFHandler(http.HandlerFunc(app.LoginHandler)).ServeHTTP(w, r)
+
+	want := `name="csrf_token" value="logintoken"`
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got body %q, want %q in body", w.Body, want)
+	}
+}
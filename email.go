@@ -68,3 +68,37 @@ func SendEmail(smtpUser, smtpPassword, smtpHost, smtpPort, to, subject, body str
 
 	return err
 }
+
+// Mailer sends an email message to the address to.
+type Mailer interface {
+	SendEmail(to, subject, body string) error
+}
+
+// SMTPMailer is a Mailer that uses SendEmail with an SMTP server.
+type SMTPMailer struct {
+	User     string
+	Password string
+	Host     string
+	Port     string
+}
+
+// SendEmail sends an email to the address to with the SMTP server.
+func (m SMTPMailer) SendEmail(to, subject, body string) error {
+	return SendEmail(m.User, m.Password, m.Host, m.Port, to, subject, body)
+}
+
+// sendEmail sends an email with app.Mailer, or with the SMTP server of the
+// config if there is no Mailer.
+func (app *App) sendEmail(to, subject, body string) error {
+	mailer := app.Mailer
+	if mailer == nil {
+		mailer = SMTPMailer{
+			User:     app.Cfg.SMTP.User,
+			Password: app.Cfg.SMTP.Password,
+			Host:     app.Cfg.SMTP.Host,
+			Port:     app.Cfg.SMTP.Port,
+		}
+	}
+
+	return mailer.SendEmail(to, subject, body)
+}
@@ -1,6 +1,7 @@
 package weblogin_test
 
 import (
+	"sync"
 	"testing"
 
 	weblogin "github.com/bnixon67/go-weblogin"
@@ -43,3 +44,39 @@ func TestSendEmail(t *testing.T) {
 		})
 	}
 }
+
+// testMailer is a Mailer that records the messages instead of sending them.
+type testMailer struct {
+	mu       sync.Mutex
+	messages []testMessage
+}
+
+// testMessage is a message sent with testMailer.
+type testMessage struct {
+	To, Subject, Body string
+}
+
+// SendEmail records the message.
+func (m *testMailer) SendEmail(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, testMessage{To: to, Subject: subject, Body: body})
+
+	return nil
+}
+
+// sent returns the messages sent to the address to.
+func (m *testMailer) sent(to string) []testMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var msgs []testMessage
+	for _, msg := range m.messages {
+		if msg.To == to {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs
+}
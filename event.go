@@ -1,18 +1,49 @@
 package weblogin
 
 import (
-	"database/sql"
 	"log/slog"
 	"time"
 )
 
 const (
-	EventLogin     = "login"
-	EventLogout    = "logout"
-	EventRegister  = "register"
-	EventSaveToken = "save_token"
-	EventReset     = "reset_pass"
-	EventMax       = "1234567890"
+	EventLogin         = "login"
+	EventLoginDeny     = "login_deny"
+	EventLogout        = "logout"
+	EventRegister      = "register"
+	EventSaveToken     = "save_token"
+	EventReset         = "reset_pass"
+	EventMFAEnroll     = "mfa_enroll"
+	EventMFAVerify     = "mfa_verify"
+	EventMFARemove     = "mfa_remove"
+	EventRecovGen      = "recov_gen"
+	EventRecovUse      = "recov_use"
+	EventWebAuthnReg   = "wa_reg"
+	EventWebAuthnLogin = "wa_login"
+	EventWebAuthnDel   = "wa_revoke"
+	EventOIDCAuth      = "oidc_auth"
+	EventOIDCToken     = "oidc_token"
+	EventLock          = "lock"
+	EventUnlock        = "unlock"
+	EventCSRF          = "csrf"
+	EventVerify        = "verify"
+	EventVerifySend    = "verify_req"
+	EventPassReuse     = "pass_reuse"
+	EventPassAge       = "pass_age"
+	EventPassExp       = "pass_exp"
+	EventPassChange    = "pass_chg"
+	EventProfile       = "profile"
+	EventEmailReq      = "email_req"
+	EventEmailChange   = "email_chg"
+	EventEmailRevert   = "email_rev"
+	EventSessRevoke    = "sess_rev"
+	EventRemember      = "remember"
+	EventRememberReuse = "rem_reuse"
+	EventResetExpired  = "reset_exp"
+	EventResetReuse    = "rst_reuse"
+	EventMagicSend     = "magic_req"
+	EventMagicLogin    = "magic"
+	EventAccess        = "access"
+	EventMax           = "1234567890"
 )
 
 type Event struct {
@@ -23,8 +54,8 @@ type Event struct {
 	Created  time.Time
 }
 
-// WriteEvent will write an event to the database. There is no return value and if an error is encountered, it will be logged.
-func WriteEvent(db *sql.DB, name string, result bool, user, message string) {
+// WriteEvent will write an event to the Store. There is no return value and if an error is encountered, it will be logged.
+func WriteEvent(s Store, name string, result bool, user, message string) {
 	logger := slog.With(slog.Group("event",
 		slog.String("Name", name),
 		slog.Bool("Result", result),
@@ -32,8 +63,7 @@ func WriteEvent(db *sql.DB, name string, result bool, user, message string) {
 		slog.String("UserName", user),
 	))
 
-	qry := `INSERT INTO events(name, result, userName, message) VALUES(?, ?, ?, ?)`
-	_, err := db.Exec(qry, name, result, user, message)
+	err := s.SaveEvent(Event{Name: name, Result: result, UserName: user, Message: message})
 	if err != nil {
 		logger.Error("could not WriteEvent", "err", err)
 	}
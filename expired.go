@@ -0,0 +1,261 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	PasswordChangeTokenType  = "pwchange"       // token type for a required password change
+	PasswordChangeCookieName = "pwchange"       // cookie name for a required password change
+	PasswordChangeExpires    = 10 * time.Minute // time to change the password
+)
+
+var (
+	ErrLoginPasswordExpired = errors.New("password expired")
+	ErrPasswordChangeToken  = errors.New("invalid password change token")
+)
+
+const (
+	MsgPasswordExpired = "Your password has expired. Please choose a new password to continue."
+	MsgUserExpired     = "User must change password at next login"
+)
+
+// ExpiredPageData contains data passed to the HTML template.
+type ExpiredPageData struct {
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+}
+
+// PasswordExpires returns the time the password of user expires, or zero if
+// passwords do not expire or the time the password changed is unknown.
+func (c ConfigPassword) PasswordExpires(user User) time.Time {
+	if c.MaxAgeDays == 0 || user.PasswordChanged.IsZero() {
+		return time.Time{}
+	}
+
+	return user.PasswordChanged.AddDate(0, 0, c.MaxAgeDays)
+}
+
+// PasswordExpiresSoon returns the time the password of user expires if it is
+// within WarnDays, otherwise zero.
+func (c ConfigPassword) PasswordExpiresSoon(user User) time.Time {
+	expires := c.PasswordExpires(user)
+	if expires.IsZero() || time.Now().AddDate(0, 0, c.WarnDays).Before(expires) {
+		return time.Time{}
+	}
+
+	return expires
+}
+
+// passwordExpired returns true if the password of userName has expired or
+// an admin requires it to be changed.
+func (app *App) passwordExpired(userName string) (bool, error) {
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		return false, err
+	}
+
+	if user.MustChangePassword {
+		return true, nil
+	}
+
+	expires := app.Cfg.Password.PasswordExpires(user)
+	return !expires.IsZero() && time.Now().After(expires), nil
+}
+
+// ExpirePassword requires userName to change their password at the next
+// login. The admin is recorded in the event.
+func (app *App) ExpirePassword(userName, admin string) error {
+	err := app.Store.SetMustChangePassword(userName, true)
+	if err != nil {
+		WriteEvent(app.Store, EventPassExp, false, userName, err.Error())
+		return err
+	}
+
+	WriteEvent(app.Store, EventPassExp, true, userName, "by "+admin)
+
+	return nil
+}
+
+// ChangeExpiredPassword changes the password for the user of a "pwchange"
+// token from LoginUser and continues the login, returning a session Token or
+// an "mfa" Token and ErrLoginMFARequired.
+//
+// The caller is responsible for checking the password with CheckPassword.
+func (app *App) ChangeExpiredPassword(tokenValue, password string) (Token, error) {
+	userName, err := app.Store.GetUserNameForToken(PasswordChangeTokenType, tokenValue)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired) {
+			return Token{}, ErrPasswordChangeToken
+		}
+		return Token{}, err
+	}
+
+	err = app.ChangePassword(userName, password)
+	if err != nil {
+		return Token{}, err
+	}
+
+	err = app.Store.RemoveToken(PasswordChangeTokenType, tokenValue)
+	if err != nil {
+		slog.Error("failed to RemoveToken", "err", err, "userName", userName)
+	}
+
+	WriteEvent(app.Store, EventReset, true, userName, "expired password changed")
+
+	return app.completeLogin(userName)
+}
+
+// setPasswordChangeCookie sets the cookie for a required password change to token.
+func setPasswordChangeCookie(w http.ResponseWriter, token Token) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     PasswordChangeCookieName,
+		Value:    token.Value,
+		Path:     "/",
+		Expires:  token.Expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ExpiredHandler handles /expired requests, which is where a user must
+// change an expired password to continue a login.
+func (app *App) ExpiredHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	// a pending password change token is required
+	changeToken, err := GetCookieValue(r, PasswordChangeCookieName)
+	if err != nil || changeToken == "" {
+		logger.Warn("missing password change token", "err", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		err := RenderTemplate(app.Tmpls, w, "expired.html",
+			ExpiredPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), Message: MsgPasswordExpired})
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+			return
+		}
+		logger.Info("ExpiredHandler")
+
+	case http.MethodPost:
+		app.expiredPost(w, r, changeToken)
+	}
+}
+
+// expiredPost is called for the POST method of the ExpiredHandler.
+func (app *App) expiredPost(w http.ResponseWriter, r *http.Request, changeToken string) {
+	password1 := strings.TrimSpace(r.PostFormValue("password1"))
+	password2 := strings.TrimSpace(r.PostFormValue("password2"))
+
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	render := func(msg string) {
+		err := RenderTemplate(app.Tmpls, w, "expired.html",
+			ExpiredPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), Message: msg})
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+		}
+	}
+
+	userName, err := app.Store.GetUserNameForToken(PasswordChangeTokenType, changeToken)
+	if err != nil {
+		logger.Warn("invalid password change token", "err", err)
+		http.SetCookie(w, &http.Cookie{Name: PasswordChangeCookieName, Value: "", Path: "/", MaxAge: -1})
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch {
+	case password1 == "" || password2 == "":
+		render(MsgMissingRequired)
+		return
+	case password1 != password2:
+		render(MsgPasswordsDifferent)
+		return
+	}
+
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		logger.Error("failed GetUserForName", "userName", userName, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if msgs := app.CheckPassword(password1, userName, user.Email); msgs != nil {
+		logger.Warn("password violates policy", "userName", userName, "violations", len(msgs))
+		render(strings.Join(msgs, " "))
+		return
+	}
+
+	token, err := app.ChangeExpiredPassword(changeToken, password1)
+	if msg := passwordChangeMessage(err, app.Cfg.Password); msg != "" {
+		logger.Warn("password change refused", "userName", userName, "err", err)
+		render(msg)
+		return
+	}
+
+	if err != nil && !errors.Is(err, ErrLoginMFARequired) {
+		logger.Error("failed to ChangeExpiredPassword", "userName", userName, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// the password changed, so replace the pwchange cookie to continue the login
+	http.SetCookie(w, &http.Cookie{Name: PasswordChangeCookieName, Value: "", Path: "/", MaxAge: -1})
+
+	redirect := r.URL.Query().Get("r")
+
+	if errors.Is(err, ErrLoginMFARequired) {
+		setMFACookie(w, token)
+		http.Redirect(w, r, "/mfa?r="+url.QueryEscape(redirect), http.StatusSeeOther)
+		logger.Info("password changed, login requires second factor", "userName", userName)
+		return
+	}
+
+	SetSessionCookie(w, token)
+
+	if redirect == "" {
+		redirect = "/"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+
+	logger.Info("password changed, login successful", "userName", userName)
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// expiredAppForTest returns an App with a new Store, passwords that expire
+// after 30 days, and a user "old" whose password changed 40 days ago.
+func expiredAppForTest(t *testing.T) *weblogin.App {
+	a := *AppForTest(t)
+	a.Store = weblogin.NewMemStore()
+	a.Cfg.Password = weblogin.ConfigPassword{MaxAgeDays: 30, WarnDays: 7}
+
+	err := seedStore(a.Store)
+	if err != nil {
+		t.Fatalf("cannot seed Store, %v", err)
+	}
+
+	user := weblogin.User{UserName: "old", Email: "old@email", Created: time.Now().AddDate(0, 0, -40)}
+	err = a.Store.CreateUser(user, TestPasswordHash)
+	if err != nil {
+		t.Fatalf("cannot create user, %v", err)
+	}
+
+	return &a
+}
+
+func TestPasswordExpiresSoon(t *testing.T) {
+	cfg := weblogin.ConfigPassword{MaxAgeDays: 30, WarnDays: 7}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		cfg     weblogin.ConfigPassword
+		changed time.Time
+		want    bool
+	}{
+		{"disabled", weblogin.ConfigPassword{}, now.AddDate(0, 0, -100), false},
+		{"unknown", cfg, time.Time{}, false},
+		{"recent", cfg, now.AddDate(0, 0, -1), false},
+		{"soon", cfg, now.AddDate(0, 0, -25), true},
+		{"expired", cfg, now.AddDate(0, 0, -31), true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.cfg.PasswordExpiresSoon(weblogin.User{PasswordChanged: tc.changed})
+			if got.IsZero() == tc.want {
+				t.Errorf("got %v, want expiring %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoginPasswordExpired(t *testing.T) {
+	app := expiredAppForTest(t)
+
+	token, err := app.LoginUser("old", "password")
+	if !errors.Is(err, weblogin.ErrLoginPasswordExpired) || token.Type != weblogin.PasswordChangeTokenType {
+		t.Fatalf("LoginUser got %v, %v, want %v", token, err, weblogin.ErrLoginPasswordExpired)
+	}
+
+	_, err = app.ChangeExpiredPassword("invalid", "new password")
+	if !errors.Is(err, weblogin.ErrPasswordChangeToken) {
+		t.Errorf("ChangeExpiredPassword invalid got err %v, want %v", err, weblogin.ErrPasswordChangeToken)
+	}
+
+	session, err := app.ChangeExpiredPassword(token.Value, "new password")
+	if err != nil || session.Type != "session" {
+		t.Errorf("ChangeExpiredPassword got %v, %v", session, err)
+	}
+
+	_, err = app.ChangeExpiredPassword(token.Value, "another password")
+	if !errors.Is(err, weblogin.ErrPasswordChangeToken) {
+		t.Errorf("ChangeExpiredPassword reused got err %v, want %v", err, weblogin.ErrPasswordChangeToken)
+	}
+
+	_, err = app.LoginUser("old", "new password")
+	if err != nil {
+		t.Errorf("LoginUser after change got err %v", err)
+	}
+}
+
+func TestExpirePassword(t *testing.T) {
+	app := expiredAppForTest(t)
+	app.Cfg.Password.MinAgeHours = 24
+
+	token, err := weblogin.SaveNewToken(app.Store, "session", "admin", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+
+	d := url.Values{"action": {"expire"}, "username": {"test"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(d.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+
+	app.UsersHandler(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgUserExpired) {
+		t.Errorf("got status %d, body %q", w.Code, w.Body)
+	}
+
+	change, err := app.LoginUser("test", "password")
+	if !errors.Is(err, weblogin.ErrLoginPasswordExpired) {
+		t.Fatalf("LoginUser got err %v, want %v", err, weblogin.ErrLoginPasswordExpired)
+	}
+
+	// a required change is allowed within MinAgeHours
+	_, err = app.ChangeExpiredPassword(change.Value, "new password")
+	if err != nil {
+		t.Errorf("ChangeExpiredPassword got err %v", err)
+	}
+}
+
+func TestExpiredHandler(t *testing.T) {
+	app := expiredAppForTest(t)
+	app.Cfg.Password.History = 1
+
+	// login redirects to the change password page
+	d := url.Values{"username": {"old"}, "password": {"password"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(d.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.LoginHandler(w, r)
+
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), "/expired") {
+		t.Fatalf("login got status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	var changeToken string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == weblogin.PasswordChangeCookieName {
+			changeToken = c.Value
+			if c.Path != "/" {
+				t.Errorf("got %s cookie Path %q, want /", c.Name, c.Path)
+			}
+		}
+	}
+	if changeToken == "" {
+		t.Fatalf("missing %s cookie", weblogin.PasswordChangeCookieName)
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		cookie    string
+		password1 string
+		password2 string
+		want      int
+		location  string
+		inBody    string
+	}{
+		{name: "no cookie", method: http.MethodGet, want: http.StatusSeeOther, location: "/login"},
+		{name: "get", method: http.MethodGet, cookie: changeToken, want: http.StatusOK, inBody: weblogin.MsgPasswordExpired},
+		{name: "mismatch", method: http.MethodPost, cookie: changeToken, password1: "new password", password2: "other", want: http.StatusOK, inBody: weblogin.MsgPasswordsDifferent},
+		{name: "reused", method: http.MethodPost, cookie: changeToken, password1: "password", password2: "password", want: http.StatusOK, inBody: fmt.Sprintf(weblogin.MsgPasswordReused, 1)},
+		{name: "valid", method: http.MethodPost, cookie: changeToken, password1: "new password", password2: "new password", want: http.StatusSeeOther, location: "/"},
+		{name: "used", method: http.MethodPost, cookie: changeToken, password1: "new password", password2: "new password", want: http.StatusSeeOther, location: "/login"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := url.Values{"password1": {tc.password1}, "password2": {tc.password2}}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, "/expired", strings.NewReader(d.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: weblogin.PasswordChangeCookieName, Value: tc.cookie})
+			}
+
+			app.ExpiredHandler(w, r)
+
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+			if got := w.Header().Get("Location"); got != tc.location {
+				t.Errorf("got location %q, want %q", got, tc.location)
+			}
+			if !strings.Contains(w.Body.String(), tc.inBody) {
+				t.Errorf("got body %q, want %q in body", w.Body, tc.inBody)
+			}
+		})
+	}
+}
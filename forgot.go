@@ -23,6 +23,7 @@ import (
 type ForgotPageData struct {
 	Title     string
 	Message   string
+	CSRFToken string // see CSRFHandler
 	EmailFrom string
 }
 
@@ -46,7 +47,7 @@ func (app *App) ForgotHandler(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodGet:
 		err := RenderTemplate(app.Tmpls, w, "forgot.html",
-			ForgotPageData{Title: app.Cfg.Title})
+			ForgotPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r)})
 		if err != nil {
 			logger.Error("unable to execute template", "err", err)
 			return
@@ -103,6 +104,7 @@ func (app *App) forgotPost(w http.ResponseWriter, r *http.Request) {
 		logger.Warn("error", "display", msg)
 		pageData := ForgotPageData{
 			Title: app.Cfg.Title, Message: msg,
+			CSRFToken: CSRFToken(r),
 		}
 		err := RenderTemplate(app.Tmpls, w, "forgot.html", pageData)
 		if err != nil {
@@ -116,7 +118,7 @@ func (app *App) forgotPost(w http.ResponseWriter, r *http.Request) {
 	var userName string
 	if email != "" {
 		var err error
-		userName, err = GetUserNameForEmail(app.DB, email)
+		userName, err = app.Store.GetUserNameForEmail(email)
 		if err != nil || userName == "" {
 			logger.Error("failed to GetUserNameForEmail",
 				"email", email,
@@ -133,7 +135,7 @@ func (app *App) forgotPost(w http.ResponseWriter, r *http.Request) {
 	case action == "password":
 		// create and save a new session token
 		// TODO: use config value for ResetExpiresHours
-		resetToken, err := SaveNewToken(app.DB, "reset", userName, 12, 1)
+		resetToken, err := SaveNewToken(app.Store, ResetTokenType, userName, 12, 1)
 		if err != nil {
 			logger.Error("unable to save reset token", "err", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -145,8 +147,11 @@ func (app *App) forgotPost(w http.ResponseWriter, r *http.Request) {
 		emailText = fmt.Sprintf("Your User Name is %s for %s", userName, app.Cfg.Title)
 	}
 
+	// an email is sent for an unknown address too, so the response is the same
 	subj := app.Cfg.Title + " " + action
-	err := SendEmail(app.Cfg.SMTP.User, app.Cfg.SMTP.Password, app.Cfg.SMTP.Host, app.Cfg.SMTP.Port, email, subj, emailText)
+	err := app.deliver(func() error {
+		return app.sendEmail(email, subj, emailText)
+	})
 	if err != nil {
 		logger.Error("unable to SendEmail", "err", err)
 		http.Error(w,
@@ -165,6 +170,7 @@ func (app *App) forgotPost(w http.ResponseWriter, r *http.Request) {
 	err = RenderTemplate(app.Tmpls, w, "forgot_sent.html",
 		ForgotPageData{
 			Title:     app.Cfg.Title,
+			CSRFToken: CSRFToken(r),
 			EmailFrom: app.Cfg.SMTP.User,
 		})
 	if err != nil {
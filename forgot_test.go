@@ -78,7 +78,9 @@ func TestForgotHandlerPostMissingEmail(t *testing.T) {
 }
 
 func TestForgotHandlerPostValidEmail(t *testing.T) {
-	app := AppForTest(t)
+	app := profileAppForTest(t)
+	mailer := &testMailer{}
+	app.Mailer = mailer
 
 	d := url.Values{"email": {"test@email"}, "action": {"user"}}
 	w := httptest.NewRecorder()
@@ -97,6 +99,11 @@ func TestForgotHandlerPostValidEmail(t *testing.T) {
 	if !strings.Contains(w.Body.String(), expectedInBody) {
 		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
 	}
+
+	sent := mailer.sent("test@email")
+	if len(sent) != 1 || !strings.Contains(sent[0].Body, "test") {
+		t.Errorf("got sent %+v, want user name email", sent)
+	}
 }
 
 func TestForgotHandlerPostMissingAction(t *testing.T) {
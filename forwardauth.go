@@ -0,0 +1,200 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Headers set by ForwardAuthHandler for an authenticated user.
+const (
+	HeaderAuthUser  = "X-Auth-User"
+	HeaderAuthEmail = "X-Auth-Email"
+	HeaderAuthAdmin = "X-Auth-Admin"
+)
+
+// forwardedURL returns the URL of the original request from the headers set
+// by the reverse proxy. Traefik and Caddy set X-Forwarded-Uri, while nginx
+// must be configured to set X-Original-URI.
+func forwardedURL(r *http.Request) *url.URL {
+	u := &url.URL{
+		Scheme: r.Header.Get("X-Forwarded-Proto"),
+		Host:   r.Header.Get("X-Forwarded-Host"),
+	}
+
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		uri = r.Header.Get("X-Original-URI")
+	}
+	if uri == "" {
+		uri = "/"
+	}
+
+	ref, err := url.ParseRequestURI(uri)
+	if err != nil {
+		ref = &url.URL{Path: "/"}
+	}
+	u.Path, u.RawPath, u.RawQuery = ref.Path, ref.RawPath, ref.RawQuery
+
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+
+	return u
+}
+
+// pathHasPrefix returns true if the segments of p begin with the segments of
+// prefix, so "/admin" matches "/admin" and "/admin/users", but not
+// "/administrator".
+func pathHasPrefix(p, prefix string) bool {
+	prefix = strings.TrimRight(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// matchAuthRule returns the rule with the longest PathPrefix matching u or
+// nil if no rule matches. The path of u is cleaned before matching, so dot
+// segments cannot be used to avoid a rule.
+func matchAuthRule(rules []ConfigAuthRule, u *url.URL) *ConfigAuthRule {
+	var match *ConfigAuthRule
+
+	// Path is already decoded, so only dot segments must be removed
+	p := path.Clean("/" + u.Path)
+
+	for i, rule := range rules {
+		if rule.Host != "" && !strings.EqualFold(rule.Host, u.Hostname()) {
+			continue
+		}
+		if !pathHasPrefix(p, rule.PathPrefix) {
+			continue
+		}
+		if match == nil || len(rule.PathPrefix) > len(match.PathPrefix) {
+			match = &rules[i]
+		}
+	}
+
+	return match
+}
+
+// allowedByRule returns true if user meets the requirements of rule, which
+// may be nil.
+func (app *App) allowedByRule(rule *ConfigAuthRule, user User) (bool, error) {
+	if rule == nil {
+		return true, nil
+	}
+	if rule.RequireAdmin && !user.IsAdmin {
+		return false, nil
+	}
+	if rule.RequireGroup != "" {
+		ok, err := app.InGroup(user, rule.RequireGroup)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if rule.RequirePermission != "" {
+		ok, err := app.HasPermission(user, rule.RequirePermission)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// ForwardAuthHandler handles /auth requests from a reverse proxy, such as
+// nginx auth_request, Traefik ForwardAuth, or Caddy forward_auth.
+//
+// If the session cookie is for a valid user, the response is 200 with the
+// user in the X-Auth-* headers, which the proxy can pass to the application.
+// Otherwise, the response is 401 with Location set to the login page, which
+// returns to the original URL after a login. If the query parameter
+// redirect=true is provided, a 303 redirect is returned instead, which is
+// useful for proxies that return the response to the browser. If the user
+// does not meet the requirements of the matching rule, the response is 403.
+//
+// The session cookie must be sent to the proxied application, so it must be
+// served from the same host as weblogin.
+func (app *App) ForwardAuthHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	// any method is allowed since some proxies use the original method
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	original := forwardedURL(r)
+
+	var user User
+	sessionToken, err := GetCookieValue(r, SessionTokenCookieName)
+	if err == nil && sessionToken != "" {
+		var token Token
+		user, token, err = app.GetUserForSessionToken(sessionToken)
+		if errors.Is(err, ErrUserSessionNotFound) || errors.Is(err, ErrUserSessionExpired) {
+			err = nil
+		}
+		// the proxy must pass Set-Cookie to the client for the extended session
+		if token.Value != "" {
+			SetSessionCookie(w, token)
+		}
+	}
+	if err != nil {
+		logger.Error("failed to GetUserForSessionToken", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if user.UserName == "" {
+		loginURL := strings.TrimRight(app.Cfg.BaseURL, "/") + "/login?r=" + url.QueryEscape(original.String())
+		w.Header().Set("Location", loginURL)
+
+		code := http.StatusUnauthorized
+		if r.URL.Query().Get("redirect") == "true" {
+			code = http.StatusSeeOther
+		}
+		w.WriteHeader(code)
+		fmt.Fprintf(w, "<a href=\"%s\">Login</a>\n", loginURL)
+
+		logger.Info("not logged in", "original", original.String())
+		return
+	}
+
+	rule := matchAuthRule(app.Cfg.ForwardAuth.Rules, original)
+	allowed, err := app.allowedByRule(rule, user)
+	if err != nil {
+		logger.Error("failed to check rule", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		logger.Warn("forbidden", "user", user, "original", original.String())
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set(HeaderAuthUser, user.UserName)
+	w.Header().Set(HeaderAuthEmail, user.Email)
+	w.Header().Set(HeaderAuthAdmin, strconv.FormatBool(user.IsAdmin))
+	w.WriteHeader(http.StatusOK)
+
+	logger.Info("authorized", "user", user, "original", original.String())
+}
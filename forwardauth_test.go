@@ -0,0 +1,185 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestForwardAuthHandlerWithoutCookie(t *testing.T) {
+	app := &weblogin.App{Cfg: weblogin.Config{BaseURL: "https://login.example.com/"}}
+
+	testCases := []struct {
+		name         string
+		target       string
+		header       map[string]string
+		wantStatus   int
+		wantLocation string
+	}{
+		{
+			name:   "traefik",
+			target: "/auth",
+			header: map[string]string{
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "app.example.com",
+				"X-Forwarded-Uri":   "/path?a=b",
+			},
+			wantStatus:   http.StatusUnauthorized,
+			wantLocation: "https://login.example.com/login?r=https%3A%2F%2Fapp.example.com%2Fpath%3Fa%3Db",
+		},
+		{
+			name:   "nginx",
+			target: "/auth",
+			header: map[string]string{
+				"X-Forwarded-Host": "app.example.com",
+				"X-Original-URI":   "/legacy",
+			},
+			wantStatus:   http.StatusUnauthorized,
+			wantLocation: "https://login.example.com/login?r=https%3A%2F%2Fapp.example.com%2Flegacy",
+		},
+		{
+			name:   "redirect",
+			target: "/auth?redirect=true",
+			header: map[string]string{
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "app.example.com",
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://login.example.com/login?r=http%3A%2F%2Fapp.example.com%2F",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+
+			app.ForwardAuthHandler(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), tc.wantStatus, http.StatusText(tc.wantStatus))
+			}
+
+			if got := w.Header().Get("Location"); got != tc.wantLocation {
+				t.Errorf("got Location %q, expected %q", got, tc.wantLocation)
+			}
+
+			if got := w.Header().Get(weblogin.HeaderAuthUser); got != "" {
+				t.Errorf("got %s %q, expected empty", weblogin.HeaderAuthUser, got)
+			}
+		})
+	}
+}
+
+func TestForwardAuthHandlerWithGoodSessionToken(t *testing.T) {
+	app := *AppForTest(t)
+	app.Cfg.ForwardAuth.Rules = []weblogin.ConfigAuthRule{
+		{PathPrefix: "/admin", RequireAdmin: true},
+		{PathPrefix: "/admin/public"},
+	}
+
+	token, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("could not login user to get session token")
+	}
+
+	testCases := []struct {
+		uri        string
+		wantStatus int
+	}{
+		{"/", http.StatusOK},
+		{"/admin", http.StatusForbidden},
+		{"/admin/users", http.StatusForbidden},
+		{"/admin/public/index.html", http.StatusOK},
+		{"/administrator", http.StatusOK},
+		{"/x/../admin/users", http.StatusForbidden},
+		{"/%61dmin/users", http.StatusForbidden},
+		{"//admin/users", http.StatusForbidden},
+		{"/admin/public/../users", http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/auth", nil)
+		r.Header.Set("X-Forwarded-Host", "app.example.com")
+		r.Header.Set("X-Forwarded-Uri", tc.uri)
+		r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+
+		app.ForwardAuthHandler(w, r)
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s: got status %d %q, expected %d %q", tc.uri, w.Code, http.StatusText(w.Code), tc.wantStatus, http.StatusText(tc.wantStatus))
+		}
+
+		if w.Code == http.StatusOK && w.Header().Get(weblogin.HeaderAuthUser) != "test" {
+			t.Errorf("%s: got %s %q, expected %q", tc.uri, weblogin.HeaderAuthUser, w.Header().Get(weblogin.HeaderAuthUser), "test")
+		}
+	}
+}
+
+func TestForwardAuthHandlerRequireGroupAndPermission(t *testing.T) {
+	app := rbacAppForTest(t)
+	app.Cfg.ForwardAuth.Rules = []weblogin.ConfigAuthRule{
+		{PathPrefix: "/team", RequireGroup: "team"},
+		{PathPrefix: "/users", RequirePermission: weblogin.PermUsersRead},
+	}
+
+	testCases := []struct {
+		userName   string
+		uri        string
+		wantStatus int
+	}{
+		{"member", "/team/index.html", http.StatusOK},
+		{"member", "/users", http.StatusOK},
+		{"test", "/team/index.html", http.StatusOK},
+		{"test", "/users", http.StatusOK}, // through the team group
+		{"admin", "/team/index.html", http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		r := requestAs(t, app, http.MethodGet, "/auth", nil, tc.userName)
+		r.Header.Set("X-Forwarded-Uri", tc.uri)
+
+		app.ForwardAuthHandler(w, r)
+
+		if w.Code != tc.wantStatus {
+			t.Errorf("%s %s: got status %d, expected %d", tc.userName, tc.uri, w.Code, tc.wantStatus)
+		}
+	}
+
+	// removed from the group, so no longer allowed
+	err := app.Store.RemoveGroupMember("team", "member")
+	if err != nil {
+		t.Fatalf("RemoveGroupMember failed: %v", err)
+	}
+
+	for _, uri := range []string{"/team/index.html", "/users"} {
+		w := httptest.NewRecorder()
+		r := requestAs(t, app, http.MethodGet, "/auth", nil, "member")
+		r.Header.Set("X-Forwarded-Uri", uri)
+
+		app.ForwardAuthHandler(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("removed member %s: got status %d, expected %d", uri, w.Code, http.StatusForbidden)
+		}
+	}
+}
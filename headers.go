@@ -0,0 +1,122 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Default values of the security headers.
+const (
+	DefaultHSTS               = "max-age=63072000; includeSubDomains"
+	DefaultCSP                = "default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self'; img-src 'self' data:; object-src 'none'; base-uri 'none'; frame-ancestors 'none'"
+	DefaultFrameOptions       = "DENY"
+	DefaultReferrerPolicy     = "same-origin"
+	DefaultPermissionsPolicy  = "camera=(), microphone=(), geolocation=(), payment=()"
+	DefaultContentTypeOptions = "nosniff"
+	DefaultNoStore            = "no-store"
+)
+
+// CSPNonceTemplate is replaced by the nonce of the request in the CSP header.
+const CSPNonceTemplate = "{nonce}"
+
+// Key to use when setting the CSP nonce.
+type ctxCSPNonceKey int
+
+// CSPNonceKey is the key for the CSP nonce in a request context.
+const CSPNonceKey ctxCSPNonceKey = 0
+
+// CSPNonce returns the CSP nonce from the context of r if present,
+// otherwise "". Handlers provide it to templates in the page data for use
+// in the nonce attribute of script elements.
+func CSPNonce(r *http.Request) string {
+	nonce, ok := r.Context().Value(CSPNonceKey).(string)
+	if !ok {
+		return ""
+	}
+	return nonce
+}
+
+// value returns the value of the header or "" if disabled.
+func (h ConfigHeader) value(defaultValue string) string {
+	if h.Disabled {
+		return ""
+	}
+	if h.Value == "" {
+		return defaultValue
+	}
+	return h.Value
+}
+
+// authCookieNames are the cookies that authenticate a request, either fully
+// or as part of a login.
+var authCookieNames = []string{
+	SessionTokenCookieName,
+	RememberCookieName,
+	MFATokenCookieName,
+	PasswordChangeCookieName,
+	MagicCookieName,
+}
+
+// authenticated returns true if r has any of the authCookieNames.
+func authenticated(r *http.Request) bool {
+	for _, name := range authCookieNames {
+		if c, err := r.Cookie(name); err == nil && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// SecurityHeadersHandler is middleware that sets the security headers in cfg
+// on every response. Cache-Control is only set for requests with a cookie
+// that authenticates them, so static files can still be cached.
+func SecurityHeadersHandler(cfg ConfigHeaders, next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+
+		set := func(name string, header ConfigHeader, defaultValue string) {
+			if v := header.value(defaultValue); v != "" {
+				h.Set(name, v)
+			}
+		}
+
+		set("Strict-Transport-Security", cfg.HSTS, DefaultHSTS)
+		set("X-Frame-Options", cfg.FrameOptions, DefaultFrameOptions)
+		set("Referrer-Policy", cfg.ReferrerPolicy, DefaultReferrerPolicy)
+		set("Permissions-Policy", cfg.PermissionsPolicy, DefaultPermissionsPolicy)
+		set("X-Content-Type-Options", cfg.ContentTypeOptions, DefaultContentTypeOptions)
+		if authenticated(r) {
+			set("Cache-Control", cfg.NoStore, DefaultNoStore)
+		}
+
+		if csp := cfg.CSP.value(DefaultCSP); csp != "" {
+			nonce, err := GenerateRandomString(16)
+			if err != nil {
+				slog.Error("failed to GenerateRandomString", "err", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			h.Set("Content-Security-Policy", strings.ReplaceAll(csp, CSPNonceTemplate, nonce))
+			r = r.WithContext(context.WithValue(r.Context(), CSPNonceKey, nonce))
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
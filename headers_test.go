@@ -0,0 +1,163 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestSecurityHeadersHandler(t *testing.T) {
+	var gotNonce string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotNonce = weblogin.CSPNonce(r)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name    string
+		cfg     weblogin.ConfigHeaders
+		cookie  string // name of a cookie to send
+		want    map[string]string
+		wantCSP bool
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{
+				"Strict-Transport-Security": weblogin.DefaultHSTS,
+				"X-Frame-Options":           weblogin.DefaultFrameOptions,
+				"Referrer-Policy":           weblogin.DefaultReferrerPolicy,
+				"Permissions-Policy":        weblogin.DefaultPermissionsPolicy,
+				"X-Content-Type-Options":    weblogin.DefaultContentTypeOptions,
+				"Cache-Control":             "",
+			},
+			wantCSP: true,
+		},
+		{
+			name:   "session",
+			cookie: weblogin.SessionTokenCookieName,
+			want: map[string]string{
+				"Cache-Control": weblogin.DefaultNoStore,
+			},
+			wantCSP: true,
+		},
+		{
+			name:   "remember",
+			cookie: weblogin.RememberCookieName,
+			want: map[string]string{
+				"Cache-Control": weblogin.DefaultNoStore,
+			},
+			wantCSP: true,
+		},
+		{
+			name:   "mfa",
+			cookie: weblogin.MFATokenCookieName,
+			want: map[string]string{
+				"Cache-Control": weblogin.DefaultNoStore,
+			},
+			wantCSP: true,
+		},
+		{
+			name:   "pwchange",
+			cookie: weblogin.PasswordChangeCookieName,
+			want: map[string]string{
+				"Cache-Control": weblogin.DefaultNoStore,
+			},
+			wantCSP: true,
+		},
+		{
+			name:   "magic",
+			cookie: weblogin.MagicCookieName,
+			want: map[string]string{
+				"Cache-Control": weblogin.DefaultNoStore,
+			},
+			wantCSP: true,
+		},
+		{
+			name: "custom and disabled",
+			cfg: weblogin.ConfigHeaders{
+				HSTS:         weblogin.ConfigHeader{Disabled: true},
+				CSP:          weblogin.ConfigHeader{Disabled: true},
+				FrameOptions: weblogin.ConfigHeader{Value: "SAMEORIGIN"},
+			},
+			want: map[string]string{
+				"Strict-Transport-Security": "",
+				"Content-Security-Policy":   "",
+				"X-Frame-Options":           "SAMEORIGIN",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			gotNonce = ""
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: tc.cookie, Value: "token"})
+			}
+
+			weblogin.SecurityHeadersHandler(tc.cfg, next).ServeHTTP(w, r)
+
+			for name, want := range tc.want {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("got %s %q, want %q", name, got, want)
+				}
+			}
+
+			csp := w.Header().Get("Content-Security-Policy")
+			if !tc.wantCSP {
+				if gotNonce != "" {
+					t.Errorf("got nonce %q, want none", gotNonce)
+				}
+				return
+			}
+			if gotNonce == "" {
+				t.Fatalf("got empty nonce")
+			}
+			want := strings.ReplaceAll(weblogin.DefaultCSP, weblogin.CSPNonceTemplate, gotNonce)
+			if csp != want {
+				t.Errorf("got CSP %q, want %q", csp, want)
+			}
+		})
+	}
+}
+
+func TestCSPNonceInLoginPage(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+
+	var nonce string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce = weblogin.CSPNonce(r)
+		app.LoginHandler(w, r)
+	})
+	weblogin.SecurityHeadersHandler(weblogin.ConfigHeaders{}, next).ServeHTTP(w, r)
+
+	want := `nonce="` + nonce + `"`
+	if nonce == "" || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got body %q, want %q in body", w.Body, want)
+	}
+
+	wantType := "text/html; charset=utf-8"
+	if got := w.Header().Get("Content-Type"); got != wantType {
+		t.Errorf("got Content-Type %q, want %q", got, wantType)
+	}
+}
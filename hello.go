@@ -15,16 +15,20 @@ package weblogin
 import (
 	"log/slog"
 	"net/http"
+	"time"
 )
 
 // HelloPageData contains data passed to the HTML template.
 type HelloPageData struct {
-	Title   string
-	Message string
-	User    User
+	Title           string
+	Message         string
+	User            User
+	PasswordExpires time.Time // zero unless the password expires within WarnDays
 }
 
-// HelloHandler prints a simple hello and any user information.
+// HelloHandler prints a simple hello and the user information. It is meant
+// to be wrapped by RequireLogin, and wraps itself if the request has no user
+// from RequireLogin.
 func (app *App) HelloHandler(w http.ResponseWriter, r *http.Request) {
 	logger := slog.With(slog.Group("request",
 		slog.String("id", GetReqID(r.Context())),
@@ -38,16 +42,19 @@ func (app *App) HelloHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserFromRequest(w, r, app.DB)
-	if err != nil {
-		logger.Error("failed to GetUser", "err", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		app.RequireLogin(http.HandlerFunc(app.HelloHandler)).ServeHTTP(w, r)
 		return
 	}
 
 	// display page
-	err = RenderTemplate(app.Tmpls, w, "hello.html",
-		HelloPageData{Message: "", User: user, Title: app.Cfg.Title})
+	err := RenderTemplate(app.Tmpls, w, "hello.html",
+		HelloPageData{
+			Title:           app.Cfg.Title,
+			User:            user,
+			PasswordExpires: app.Cfg.Password.PasswordExpiresSoon(user),
+		})
 	if err != nil {
 		logger.Error("unable to RenderTemplate", "err", err)
 		return
@@ -21,6 +21,12 @@ import (
 	weblogin "github.com/bnixon67/go-weblogin"
 )
 
+// helloHandler returns HelloHandler wrapped by RequireLogin, as registered
+// by the server.
+func helloHandler(app *weblogin.App) http.Handler {
+	return app.RequireLogin(http.HandlerFunc(app.HelloHandler))
+}
+
 func TestHelloHandlerInvalidMethod(t *testing.T) {
 	app := AppForTest(t)
 
@@ -41,16 +47,16 @@ func TestHelloHandlerWithoutCookie(t *testing.T) {
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
 
-	app.HelloHandler(w, r)
+	helloHandler(app).ServeHTTP(w, r)
 
-	expectedStatus := http.StatusOK
+	expectedStatus := http.StatusSeeOther
 	if w.Code != expectedStatus {
 		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
 	}
 
-	expectedInBody := `You must <a href="/login?r=/hello">Login</a>`
-	if !strings.Contains(w.Body.String(), expectedInBody) {
-		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	expectedLocation := "/login?r=%2Fhello"
+	if loc := w.Header().Get("Location"); loc != expectedLocation {
+		t.Errorf("got location %q, expected %q", loc, expectedLocation)
 	}
 }
 
@@ -61,16 +67,16 @@ func TestHelloHandlerWithBadSessionToken(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
 	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: "foo"})
 
-	app.HelloHandler(w, r)
+	helloHandler(app).ServeHTTP(w, r)
 
-	expectedStatus := http.StatusOK
+	expectedStatus := http.StatusSeeOther
 	if w.Code != expectedStatus {
 		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
 	}
 
-	expectedInBody := `You must <a href="/login?r=/hello">Login</a>`
-	if !strings.Contains(w.Body.String(), expectedInBody) {
-		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	expectedLocation := "/login?r=%2Fhello"
+	if loc := w.Header().Get("Location"); loc != expectedLocation {
+		t.Errorf("got location %q, expected %q", loc, expectedLocation)
 	}
 }
 
@@ -87,7 +93,7 @@ func TestHelloHandlerWithGoodSessionToken(t *testing.T) {
 	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
 	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
 
-	app.HelloHandler(w, r)
+	helloHandler(app).ServeHTTP(w, r)
 
 	expectedStatus := http.StatusOK
 	if w.Code != expectedStatus {
@@ -99,3 +105,34 @@ func TestHelloHandlerWithGoodSessionToken(t *testing.T) {
 		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
 	}
 }
+
+func TestHelloHandlerWithoutRequireLogin(t *testing.T) {
+	app := AppForTest(t)
+
+	token, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("could not login user to get session token")
+	}
+
+	// HelloHandler wraps itself if mounted without RequireLogin
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+
+	app.HelloHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/hello", nil)
+
+	app.HelloHandler(w, r)
+
+	expectedLocation := "/login?r=%2Fhello"
+	if loc := w.Header().Get("Location"); w.Code != http.StatusSeeOther || loc != expectedLocation {
+		t.Errorf("got status %d, location %q, expected %d, %q", w.Code, loc, http.StatusSeeOther, expectedLocation)
+	}
+}
@@ -0,0 +1,117 @@
+// webauthn.js registers and uses security keys and passkeys with the
+// /webauthn endpoints. Binary values are exchanged as base64url strings.
+(function () {
+  "use strict";
+
+  function toBase64URL(buf) {
+    let s = "";
+    new Uint8Array(buf).forEach(function (b) { s += String.fromCharCode(b); });
+    return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function fromBase64URL(s) {
+    s = s.replace(/-/g, "+").replace(/_/g, "/");
+    while (s.length % 4) { s += "="; }
+    return Uint8Array.from(atob(s), function (c) { return c.charCodeAt(0); });
+  }
+
+  function csrfToken() {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    return meta ? meta.content : "";
+  }
+
+  async function postJSON(url, data) {
+    const resp = await fetch(url, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: { "Content-Type": "application/json", "X-CSRF-Token": csrfToken() },
+      body: JSON.stringify(data || {}),
+    });
+    const body = await resp.json();
+    if (!resp.ok) { throw new Error(body.error || resp.statusText); }
+    return body;
+  }
+
+  function decodeDescriptors(list) {
+    (list || []).forEach(function (c) { c.id = fromBase64URL(c.id); });
+  }
+
+  async function register(name) {
+    const options = (await postJSON("/webauthn/register/begin")).publicKey;
+    options.challenge = fromBase64URL(options.challenge);
+    options.user.id = fromBase64URL(options.user.id);
+    decodeDescriptors(options.excludeCredentials);
+
+    const cred = await navigator.credentials.create({ publicKey: options });
+    await postJSON("/webauthn/register/finish", {
+      name: name,
+      id: cred.id,
+      rawId: toBase64URL(cred.rawId),
+      type: cred.type,
+      response: {
+        clientDataJSON: toBase64URL(cred.response.clientDataJSON),
+        attestationObject: toBase64URL(cred.response.attestationObject),
+        transports: cred.response.getTransports ? cred.response.getTransports() : [],
+      },
+    });
+    window.location.reload();
+  }
+
+  async function login() {
+    const options = (await postJSON("/webauthn/login/begin")).publicKey;
+    options.challenge = fromBase64URL(options.challenge);
+    decodeDescriptors(options.allowCredentials);
+
+    const cred = await navigator.credentials.get({ publicKey: options });
+
+    // keep r and remember from the mfa page, or remember from the login form
+    const params = new URLSearchParams(window.location.search);
+    const remember = document.getElementById("remember");
+    if (remember && remember.checked) {
+      params.set("remember", "on");
+    }
+
+    const result = await postJSON("/webauthn/login/finish?" + params.toString(), {
+      id: cred.id,
+      rawId: toBase64URL(cred.rawId),
+      type: cred.type,
+      response: {
+        clientDataJSON: toBase64URL(cred.response.clientDataJSON),
+        authenticatorData: toBase64URL(cred.response.authenticatorData),
+        signature: toBase64URL(cred.response.signature),
+        userHandle: cred.response.userHandle ? toBase64URL(cred.response.userHandle) : "",
+      },
+    });
+    window.location.assign(result.redirect);
+  }
+
+  function showError(err) {
+    const el = document.getElementById("webauthn-error");
+    if (el) {
+      el.textContent = err.message;
+      el.hidden = false;
+    }
+  }
+
+  document.addEventListener("DOMContentLoaded", function () {
+    const supported = window.PublicKeyCredential !== undefined;
+
+    const regForm = document.getElementById("webauthn-register");
+    if (regForm) {
+      regForm.hidden = !supported;
+      regForm.addEventListener("submit", function (e) {
+        e.preventDefault();
+        register(document.getElementById("webauthn-name").value).catch(showError);
+      });
+    }
+
+    const loginButton = document.getElementById("webauthn-login");
+    if (loginButton) {
+      loginButton.hidden = !supported;
+      loginButton.addEventListener("click", function (e) {
+        e.preventDefault();
+        login().catch(showError);
+      });
+    }
+  });
+})();
@@ -61,6 +61,8 @@ const MsgTemplateError = "Sorry, the server was unable to display this page. Ple
 // If an error occurs, writer is updated to indicate a Internal Server Error.
 // The caller must ensure no further writes are done for a non-nil error.
 func RenderTemplate(t *template.Template, w http.ResponseWriter, name string, data interface{}) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
 	err := t.ExecuteTemplate(w, name, data)
 	if err != nil {
 		http.Error(w, MsgTemplateError, http.StatusInternalServerError)
@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Default lockout values if MaxFailures is set.
+const (
+	LockoutDefaultWindow      = 15 * time.Minute
+	LockoutDefaultDuration    = 15 * time.Minute
+	LockoutDefaultMaxDuration = 24 * time.Hour
+)
+
+// ErrLoginLocked is returned by LoginUser if the account is locked.
+var ErrLoginLocked = errors.New("account locked")
+
+// lockoutDuration returns the duration of the count consecutive lock.
+func (c ConfigLockout) lockoutDuration(count int) time.Duration {
+	d := time.Duration(c.DurationMinutes) * time.Minute
+	if d == 0 {
+		d = LockoutDefaultDuration
+	}
+
+	if !c.Backoff {
+		return d
+	}
+
+	maxDuration := time.Duration(c.MaxDurationMinutes) * time.Minute
+	if maxDuration == 0 {
+		maxDuration = LockoutDefaultMaxDuration
+	}
+
+	// double for each consecutive lock, stopping at maxDuration
+	for i := 1; i < count && d < maxDuration; i++ {
+		d *= 2
+	}
+
+	return min(d, maxDuration)
+}
+
+// checkLockout returns ErrLoginLocked if userName is locked.
+func (app *App) checkLockout(userName string) error {
+	if app.Cfg.Lockout.MaxFailures == 0 {
+		return nil
+	}
+
+	until, _, err := app.Store.GetLockout(userName)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if until.After(time.Now()) {
+		return ErrLoginLocked
+	}
+
+	return nil
+}
+
+// recordLoginFailure locks userName if the number of failed logins within
+// the window, since any previous lock or successful login, reaches
+// MaxFailures. Logins refused by EventLoginDeny are not counted.
+func (app *App) recordLoginFailure(userName string) {
+	cfg := app.Cfg.Lockout
+	if cfg.MaxFailures == 0 {
+		return
+	}
+
+	logger := slog.With("userName", userName)
+
+	until, count, err := app.Store.GetLockout(userName)
+	if err != nil {
+		if !errors.Is(err, ErrUserNotFound) {
+			logger.Error("failed to GetLockout", "err", err)
+		}
+		return
+	}
+
+	window := time.Duration(cfg.WindowMinutes) * time.Minute
+	if window == 0 {
+		window = LockoutDefaultWindow
+	}
+
+	// failures before a previous lock expired or was cleared, or before a
+	// successful login, are not counted
+	now := time.Now()
+	since := now.Add(-window)
+	if until.After(since) {
+		since = until
+	}
+
+	failures, err := app.Store.CountEvents(EventLogin, false, userName, since)
+	if err != nil {
+		logger.Error("failed to CountEvents", "err", err)
+		return
+	}
+	if failures < cfg.MaxFailures {
+		return
+	}
+
+	count++
+	d := cfg.lockoutDuration(count)
+	err = app.Store.SetLockout(userName, now.Add(d), count)
+	if err != nil {
+		logger.Error("failed to SetLockout", "err", err)
+		return
+	}
+
+	logger.Warn("account locked", "failures", failures, "duration", d)
+	WriteEvent(app.Store, EventLock, true, userName, fmt.Sprintf("%d failures, locked for %v", failures, d))
+}
+
+// resetLockout clears the consecutive lock count after a successful login
+// and starts a new window, so failures before the login are not counted.
+func (app *App) resetLockout(userName string) {
+	if app.Cfg.Lockout.MaxFailures == 0 {
+		return
+	}
+
+	// the login was not locked, so the lock expired before now
+	err := app.Store.SetLockout(userName, time.Now(), 0)
+	if err != nil {
+		slog.Error("failed to SetLockout", "err", err, "userName", userName)
+	}
+}
+
+// UnlockUser clears the lock for userName. The admin is recorded in the event.
+func (app *App) UnlockUser(userName, admin string) error {
+	err := app.Store.SetLockout(userName, time.Now(), 0)
+	if err != nil {
+		WriteEvent(app.Store, EventUnlock, false, userName, err.Error())
+		return err
+	}
+
+	WriteEvent(app.Store, EventUnlock, true, userName, "by "+admin)
+
+	return nil
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// lockoutAppForTest returns an App with a new Store and lockout enabled.
+func lockoutAppForTest(t *testing.T, cfg weblogin.ConfigLockout) *weblogin.App {
+	a := *AppForTest(t)
+	a.Store = weblogin.NewMemStore()
+	a.Cfg.Lockout = cfg
+
+	err := seedStore(a.Store)
+	if err != nil {
+		t.Fatalf("cannot seed Store, %v", err)
+	}
+
+	return &a
+}
+
+// failLogins attempts n logins for userName with the wrong password.
+func failLogins(t *testing.T, app *weblogin.App, userName string, n int) {
+	for i := 0; i < n; i++ {
+		_, err := app.LoginUser(userName, "wrong")
+		if err == nil {
+			t.Fatalf("LoginUser succeeded with wrong password")
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	app := lockoutAppForTest(t, weblogin.ConfigLockout{MaxFailures: 3, DurationMinutes: 10})
+
+	failLogins(t, app, "test", 2)
+	_, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("LoginUser before lock got err %v", err)
+	}
+
+	// success starts a new window, so three more failures are needed
+	failLogins(t, app, "test", 2)
+	_, err = app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("LoginUser after success got err %v", err)
+	}
+	failLogins(t, app, "test", 3)
+	_, err = app.LoginUser("test", "password")
+	if !errors.Is(err, weblogin.ErrLoginLocked) {
+		t.Errorf("LoginUser after lock got err %v, want %v", err, weblogin.ErrLoginLocked)
+	}
+
+	user, err := app.Store.GetUserForName("test")
+	if err != nil || !user.IsLocked() {
+		t.Errorf("user should be locked, got %+v, %v", user, err)
+	}
+	if d := time.Until(user.LockedUntil); d < 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("got lock duration %v, want 10m", d)
+	}
+
+	count, err := app.Store.CountEvents(weblogin.EventLock, true, "test", time.Time{})
+	if err != nil || count != 1 {
+		t.Errorf("got %d lock events, %v, want 1", count, err)
+	}
+
+	err = app.UnlockUser("test", "admin")
+	if err != nil {
+		t.Fatalf("UnlockUser failed: %v", err)
+	}
+
+	// failures before the unlock are not counted
+	failLogins(t, app, "test", 1)
+	_, err = app.LoginUser("test", "password")
+	if err != nil {
+		t.Errorf("LoginUser after unlock got err %v", err)
+	}
+
+	count, err = app.Store.CountEvents(weblogin.EventUnlock, true, "test", time.Time{})
+	if err != nil || count != 1 {
+		t.Errorf("got %d unlock events, %v, want 1", count, err)
+	}
+}
+
+func TestLockoutDenyNotCounted(t *testing.T) {
+	app := lockoutAppForTest(t, weblogin.ConfigLockout{MaxFailures: 2})
+	app.Cfg.VerifyEmail.Required = true
+
+	err := app.Store.CreateUser(weblogin.User{UserName: "new", Email: "new@email"}, TestPasswordHash)
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	// refused for the unverified email, but the password was correct
+	for i := 0; i < 3; i++ {
+		_, err = app.LoginUser("new", "password")
+		if !errors.Is(err, weblogin.ErrLoginUnverified) {
+			t.Fatalf("LoginUser got err %v, want %v", err, weblogin.ErrLoginUnverified)
+		}
+	}
+
+	user, err := app.Store.GetUserForName("new")
+	if err != nil || user.IsLocked() {
+		t.Errorf("user should not be locked, got %+v, %v", user, err)
+	}
+
+	denied, err := app.Store.CountEvents(weblogin.EventLoginDeny, false, "new", time.Time{})
+	if err != nil || denied != 3 {
+		t.Errorf("got %d deny events, %v, want 3", denied, err)
+	}
+	failed, err := app.Store.CountEvents(weblogin.EventLogin, false, "new", time.Time{})
+	if err != nil || failed != 0 {
+		t.Errorf("got %d failed login events, %v, want 0", failed, err)
+	}
+
+	// attempts while locked are denied, not failed
+	failLogins(t, app, "test", 2)
+	_, err = app.LoginUser("test", "password")
+	if !errors.Is(err, weblogin.ErrLoginLocked) {
+		t.Fatalf("LoginUser got err %v, want %v", err, weblogin.ErrLoginLocked)
+	}
+	denied, err = app.Store.CountEvents(weblogin.EventLoginDeny, false, "test", time.Time{})
+	if err != nil || denied != 1 {
+		t.Errorf("got %d deny events, %v, want 1", denied, err)
+	}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	app := lockoutAppForTest(t, weblogin.ConfigLockout{
+		MaxFailures: 2, DurationMinutes: 10, Backoff: true, MaxDurationMinutes: 30,
+	})
+
+	wants := []time.Duration{10 * time.Minute, 20 * time.Minute, 30 * time.Minute}
+	for _, want := range wants {
+		failLogins(t, app, "test", 2)
+
+		until, count, err := app.Store.GetLockout("test")
+		if err != nil {
+			t.Fatalf("GetLockout failed: %v", err)
+		}
+		if d := time.Until(until); d < want-time.Minute || d > want {
+			t.Errorf("got lock duration %v, want %v", d, want)
+		}
+
+		// expire the lock without clearing the count
+		err = app.Store.SetLockout("test", time.Now(), count)
+		if err != nil {
+			t.Fatalf("SetLockout failed: %v", err)
+		}
+	}
+}
+
+func TestLockoutDisabled(t *testing.T) {
+	app := lockoutAppForTest(t, weblogin.ConfigLockout{})
+
+	failLogins(t, app, "test", 10)
+	_, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Errorf("LoginUser got err %v", err)
+	}
+}
+
+func TestLockoutLoginMessage(t *testing.T) {
+	app := lockoutAppForTest(t, weblogin.ConfigLockout{MaxFailures: 1})
+
+	failLogins(t, app, "test", 1)
+
+	d := url.Values{"username": {"test"}, "password": {"password"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(d.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.LoginHandler(w, r)
+
+	if !strings.Contains(w.Body.String(), weblogin.MsgLoginLocked) {
+		t.Errorf("got body %q, want %q in body", w.Body, weblogin.MsgLoginLocked)
+	}
+}
+
+func TestUsersHandlerUnlock(t *testing.T) {
+	app := lockoutAppForTest(t, weblogin.ConfigLockout{MaxFailures: 1})
+
+	failLogins(t, app, "test", 1)
+
+	tests := []struct {
+		name     string
+		userName string
+		want     int
+		locked   bool
+	}{
+		{name: "not admin", userName: "test", want: http.StatusForbidden, locked: true},
+		{name: "admin", userName: "admin", want: http.StatusOK, locked: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := weblogin.SaveNewToken(app.Store, "session", tc.userName, 32, 1)
+			if err != nil {
+				t.Fatalf("SaveNewToken failed: %v", err)
+			}
+
+			d := url.Values{"action": {"unlock"}, "username": {"test"}}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(d.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+
+			app.UsersHandler(w, r)
+
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+
+			user, _ := app.Store.GetUserForName("test")
+			if user.IsLocked() != tc.locked {
+				t.Errorf("got locked %v, want %v", user.IsLocked(), tc.locked)
+			}
+		})
+	}
+}
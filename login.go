@@ -13,16 +13,35 @@ specific language governing permissions and limitations under the License.
 package weblogin
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 // LoginPageData contains data passed to the HTML template.
 type LoginPageData struct {
-	Title   string
-	Message string
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+	CSPNonce  string // see SecurityHeadersHandler
+	Remember  bool   // show the remember me checkbox
+	MagicLink bool   // show the link to login with a magic link
+}
+
+// loginPageData returns the page data for the login page with msg.
+func (app *App) loginPageData(r *http.Request, msg string) LoginPageData {
+	return LoginPageData{
+		Title:     app.Cfg.Title,
+		Message:   msg,
+		CSRFToken: CSRFToken(r),
+		CSPNonce:  CSPNonce(r),
+		Remember:  app.Cfg.RememberDays > 0,
+		MagicLink: app.Cfg.MagicLink.Enabled,
+	}
 }
 
 // LoginHandler handles /login requests.
@@ -42,7 +61,7 @@ func (app *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		err := RenderTemplate(app.Tmpls, w, "login.html",
-			LoginPageData{Title: app.Cfg.Title})
+			app.loginPageData(r, ""))
 		if err != nil {
 			logger.Error("unable to RenderTemplate", "err", err)
 			return
@@ -59,6 +78,7 @@ const (
 	MsgMissingUserName            = "Missing username"
 	MsgMissingPassword            = "Missing password"
 	MsgLoginFailed                = "Login Failed"
+	MsgLoginLocked                = "Login Failed. Please try again later."
 )
 
 // loginPost is called for the POST method of the LoginHandler.
@@ -93,7 +113,7 @@ func (app *App) loginPost(w http.ResponseWriter, r *http.Request) {
 	if msg != "" {
 		logger.Info("error", "display", msg)
 		err := RenderTemplate(app.Tmpls, w, "login.html",
-			LoginPageData{Title: app.Cfg.Title, Message: msg})
+			app.loginPageData(r, msg))
 		if err != nil {
 			logger.Error("unable to RenderTemplate", "err", err)
 			return
@@ -103,13 +123,41 @@ func (app *App) loginPost(w http.ResponseWriter, r *http.Request) {
 
 	// attempt to login the given userName with the given password
 	token, err := app.LoginUser(userName, password)
+	if errors.Is(err, ErrLoginMFARequired) {
+		// password is correct, but a second factor is required
+		setMFACookie(w, token)
+
+		mfaURL := "/mfa?r=" + url.QueryEscape(r.URL.Query().Get("r"))
+		if r.PostFormValue("remember") != "" {
+			mfaURL += "&remember=on"
+		}
+		http.Redirect(w, r, mfaURL, http.StatusSeeOther)
+
+		logger.Info("login requires second factor")
+		return
+	}
+	if errors.Is(err, ErrLoginPasswordExpired) {
+		// password is correct, but must be changed to continue
+		setPasswordChangeCookie(w, token)
+
+		http.Redirect(w, r, "/expired?r="+url.QueryEscape(r.URL.Query().Get("r")), http.StatusSeeOther)
+
+		logger.Info("login requires password change")
+		return
+	}
 	if err != nil {
 		logger.Error("failed to LoginUser", "err", err)
-		err := RenderTemplate(app.Tmpls, w, "login.html",
-			LoginPageData{
-				Title:   app.Cfg.Title,
-				Message: MsgLoginFailed,
-			})
+
+		// avoid saying the account is locked, which confirms it exists
+		msg := MsgLoginFailed
+		switch {
+		case errors.Is(err, ErrLoginLocked) && !app.Cfg.PrivacyMode:
+			msg = MsgLoginLocked
+		case errors.Is(err, ErrLoginUnverified):
+			msg = MsgLoginUnverified
+		}
+
+		err := RenderTemplate(app.Tmpls, w, "login.html", app.loginPageData(r, msg))
 		if err != nil {
 			logger.Error("unable to RenderTemplate", "err", err)
 			return
@@ -118,14 +166,8 @@ func (app *App) loginPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// login successful, so create a cookie for the session Token
-	http.SetCookie(w, &http.Cookie{
-		Name:     SessionTokenCookieName,
-		Value:    token.Value,
-		Expires:  token.Expires,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-	})
+	SetSessionCookie(w, token)
+	app.rememberUser(w, r, userName, token)
 
 	redirect := r.URL.Query().Get("r")
 	if redirect == "" {
@@ -138,24 +180,141 @@ func (app *App) loginPost(w http.ResponseWriter, r *http.Request) {
 	logger.Info("login successful")
 }
 
+// SetSessionCookie sets the session cookie to the session token.
+func SetSessionCookie(w http.ResponseWriter, token Token) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionTokenCookieName,
+		Value:    token.Value,
+		Path:     "/",
+		Expires:  token.Expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ErrLoginMFARequired is returned by LoginUser if the password is correct but
+// the user must also provide a second factor to complete the login.
+var ErrLoginMFARequired = errors.New("second factor required")
+
 // LoginUser returns a session Token if userName and password is correct.
+//
+// If the user is enrolled in two-factor authentication, LoginUser instead
+// returns a short lived "mfa" Token and ErrLoginMFARequired. The "mfa" Token
+// must be passed to VerifyMFA along with the second factor to obtain a
+// session Token.
+//
+// If account lockout is configured, LoginUser returns ErrLoginLocked for a
+// locked account and locks the account after repeated failures.
+//
+// If email verification is required, LoginUser returns ErrLoginUnverified
+// for a correct password until the email address is verified.
+//
+// If PrivacyMode is configured, a password is compared for an account that
+// does not exist or is locked, so the time does not reveal the account.
+//
+// If the password has expired or must be changed, LoginUser returns a short
+// lived "pwchange" Token and ErrLoginPasswordExpired. The login continues
+// after the password is changed with ChangeExpiredPassword.
 func (app *App) LoginUser(userName, password string) (Token, error) {
-	err := CompareUserPassword(app.DB, userName, password)
+	// refuse a locked account without checking the password
+	err := app.checkLockout(userName)
 	if err != nil {
-		WriteEvent(app.DB, EventLogin, false, userName, err.Error())
+		if app.Cfg.PrivacyMode {
+			compareDummyPassword(password)
+		}
+		WriteEvent(app.Store, EventLoginDeny, false, userName, err.Error())
+		return Token{}, err
+	}
+
+	err = CompareUserPassword(app.Store, userName, password)
+	if err != nil {
+		if app.Cfg.PrivacyMode && errors.Is(err, ErrUserNotFound) {
+			compareDummyPassword(password)
+		}
+		WriteEvent(app.Store, EventLogin, false, userName, err.Error())
+		app.recordLoginFailure(userName)
+
+		return Token{}, err
+	}
+	app.resetLockout(userName)
 
+	token, err := app.checkLogin(userName)
+	if err != nil {
+		return token, err
+	}
+
+	return app.completeLogin(userName)
+}
+
+// checkLogin applies the checks of a login once userName is authenticated.
+// ErrLoginUnverified is returned if the email address must be verified, and
+// a "pwchange" Token and ErrLoginPasswordExpired if the password must be
+// changed.
+func (app *App) checkLogin(userName string) (Token, error) {
+	err := app.checkVerified(userName)
+	if err != nil {
+		WriteEvent(app.Store, EventLoginDeny, false, userName, err.Error())
 		return Token{}, err
 	}
 
-	// create and save a new session token
-	token, err := SaveNewToken(app.DB, "session", userName, 32, app.Cfg.SessionExpiresHours)
+	// require a new password before completing the login
+	expired, err := app.passwordExpired(userName)
+	if err != nil {
+		WriteEvent(app.Store, EventLogin, false, userName, err.Error())
+		return Token{}, err
+	}
+	if expired {
+		token, err := SaveNewTokenWithDuration(app.Store, PasswordChangeTokenType, userName, 32, PasswordChangeExpires)
+		if err != nil {
+			WriteEvent(app.Store, EventSaveToken, false, userName, err.Error())
+			slog.Error("unable to SaveNewToken", "err", err, "userName", userName)
+			return Token{}, fmt.Errorf("unable to save token: %w", err)
+		}
+
+		WriteEvent(app.Store, EventPassExp, true, userName, "change required at login")
+		return token, ErrLoginPasswordExpired
+	}
+
+	return Token{}, nil
+}
+
+// completeLogin returns a session Token for userName, whose password has been
+// verified, or an "mfa" Token and ErrLoginMFARequired if a second factor is
+// required.
+func (app *App) completeLogin(userName string) (Token, error) {
+	// check if a second factor is required
+	mfaEnabled, err := app.MFAEnabled(userName)
+	if err != nil {
+		WriteEvent(app.Store, EventLogin, false, userName, err.Error())
+		return Token{}, err
+	}
+	if mfaEnabled {
+		token, err := SaveNewTokenWithDuration(app.Store, MFATokenType, userName, 32, MFAExpires)
+		if err != nil {
+			WriteEvent(app.Store, EventSaveToken, false, userName, err.Error())
+			slog.Error("unable to SaveNewToken", "err", err, "userName", userName)
+			return Token{}, fmt.Errorf("unable to save token: %w", err)
+		}
+
+		return token, ErrLoginMFARequired
+	}
+
+	return app.createSession(userName)
+}
+
+// createSession creates and saves a new session token for userName and
+// records the successful login.
+func (app *App) createSession(userName string) (Token, error) {
+	now := time.Now()
+	token, err := SaveNewTokenWithDuration(app.Store, "session", userName, 32, app.sessionExpires(now, now).Sub(now))
 	if err != nil {
-		WriteEvent(app.DB, EventSaveToken, false, userName, err.Error())
+		WriteEvent(app.Store, EventSaveToken, false, userName, err.Error())
 		slog.Error("unable to SaveNewToken", "err", err, "userName", userName)
 		return Token{}, fmt.Errorf("unable to save token: %w", err)
 	}
 
-	WriteEvent(app.DB, EventLogin, true, userName, "success")
+	WriteEvent(app.Store, EventLogin, true, userName, "success")
 
 	return token, nil
 }
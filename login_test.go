@@ -170,6 +170,11 @@ func TestLoginHandlerPostValidUserNameAndPassword(t *testing.T) {
 	if w.Body.String() != expected {
 		t.Errorf("got body %q, expected %q", w.Body, expected)
 	}
+
+	// the cookie is sent to every path, not just the path of the login
+	if c := cookieFor(w, weblogin.SessionTokenCookieName); c == nil || c.Path != "/" {
+		t.Errorf("got session cookie %v, expected Path /", c)
+	}
 }
 
 func TestLoginHandlerPostValidUserNameAndInvalidPassword(t *testing.T) {
@@ -37,7 +37,17 @@ func (app *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := GetUserFromRequest(w, r, app.DB)
+	// forget the remember me login first, so it cannot start a new session
+	rememberValue, err := GetCookieValue(r, RememberCookieName)
+	if err == nil && rememberValue != "" {
+		err = app.Forget(rememberValue)
+	}
+	if err != nil {
+		logger.Error("failed to Forget", "err", err)
+	}
+	clearRememberCookie(w)
+
+	user, err := app.GetUserFromRequest(w, r)
 	if err != nil {
 		logger.Error("failed to GetUser", "err", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -47,7 +57,7 @@ func (app *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	// create an empty sessionToken cookie with negative MaxAge to delete
 	http.SetCookie(w,
 		&http.Cookie{
-			Name: SessionTokenCookieName, Value: "", MaxAge: -1,
+			Name: SessionTokenCookieName, Value: "", Path: "/", MaxAge: -1,
 		})
 
 	// get sessionToken to remove
@@ -61,7 +71,7 @@ func (app *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	// remove session from database
 	// TODO: consider removing all sessions for user
 	if sessionTokenValue != "" {
-		err := RemoveToken(app.DB, "session", sessionTokenValue)
+		err := app.Store.RemoveToken("session", sessionTokenValue)
 		if err != nil {
 			logger.Error("filed to RemoveToken",
 				"sessionTokenValue", sessionTokenValue,
@@ -81,5 +91,5 @@ func (app *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	logger.Info("logged out", "user", user)
-	WriteEvent(app.DB, EventLogout, true, user.UserName, "success")
+	WriteEvent(app.Store, EventLogout, true, user.UserName, "success")
 }
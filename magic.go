@@ -0,0 +1,330 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	MagicTokenType                 = "magic"
+	MagicCookieName                = "magic"
+	MagicLinkDefaultExpiresMinutes = 15
+)
+
+var (
+	ErrMagicLinkDisabled = errors.New("magic link login disabled")
+	ErrMagicLinkInvalid  = errors.New("invalid magic link")
+)
+
+const (
+	MsgMagicLinkSent    = "If the Email Address is registered, a login link has been sent to it."
+	MsgMagicLinkInvalid = "The login link is invalid or expired. Please request a new one."
+)
+
+// MagicPageData contains data passed to the HTML template.
+type MagicPageData struct {
+	Title      string
+	Message    string
+	CSRFToken  string // see CSRFHandler
+	MagicToken string // token from the link to confirm the login
+	Sent       bool   // link was sent
+}
+
+// magicLinkExpires returns how long a magic link is valid.
+func (app *App) magicLinkExpires() time.Duration {
+	minutes := app.Cfg.MagicLink.ExpiresMinutes
+	if minutes == 0 {
+		minutes = MagicLinkDefaultExpiresMinutes
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
+// SendMagicLink emails a single use login link to the user with email.
+//
+// The account is looked up, and the email sent, in the background with
+// errors only logged, so the response and its timing do not reveal whether
+// there is a user with email. If BindBrowser is configured, the token is
+// split between the link and the returned nonce, which must be stored in a
+// cookie of the requesting browser, so the link cannot be used elsewhere.
+func (app *App) SendMagicLink(email string) (string, error) {
+	fn := "SendMagicLink"
+
+	cfg := app.Cfg.MagicLink
+	if !cfg.Enabled {
+		return "", ErrMagicLinkDisabled
+	}
+
+	value, err := GenerateRandomString(32)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	link, nonce := value, ""
+	if cfg.BindBrowser {
+		link, nonce = value[:len(value)/2], value[len(value)/2:]
+	}
+
+	// always in the background, unlike deliver, since the response would
+	// otherwise reveal the account even if PrivacyMode is false
+	deliverBackground(func() error {
+		return app.sendMagicLink(email, value, link)
+	})
+
+	return nonce, nil
+}
+
+// sendMagicLink saves the token value for the user with email, if there is
+// one, and emails link to them.
+func (app *App) sendMagicLink(email, value, link string) error {
+	fn := "sendMagicLink"
+
+	userName, err := app.Store.GetUserNameForEmail(email)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	token := Token{
+		Type:    MagicTokenType,
+		Value:   value,
+		Expires: time.Now().Add(app.magicLinkExpires()),
+	}
+	err = app.Store.SaveToken(userName, token)
+	if err != nil {
+		WriteEvent(app.Store, EventSaveToken, false, userName, err.Error())
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	subj := app.Cfg.Title + " login link"
+	emailText := fmt.Sprintf("Please visit %s/magic?mtoken=%s within %d minutes to login to %s. If you did not request this link, you can ignore this email.",
+		app.Cfg.BaseURL, url.QueryEscape(link), int(app.magicLinkExpires().Minutes()), app.Cfg.Title)
+
+	err = app.sendEmail(email, subj, emailText)
+	if err != nil {
+		WriteEvent(app.Store, EventMagicSend, false, userName, err.Error())
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	WriteEvent(app.Store, EventMagicSend, true, userName, email)
+
+	return nil
+}
+
+// LoginWithMagicLink uses the token from a magic link, along with the nonce
+// from the browser if BindBrowser is configured, and returns a session Token.
+// The token can only be used once.
+//
+// As with LoginUser, an "mfa" Token and ErrLoginMFARequired are returned if
+// the user must also provide a second factor, and a "pwchange" Token and
+// ErrLoginPasswordExpired if the password must be changed. Since the link was
+// sent to the email address, the email address is marked verified.
+func (app *App) LoginWithMagicLink(link, nonce string) (Token, error) {
+	cfg := app.Cfg.MagicLink
+	if !cfg.Enabled {
+		return Token{}, ErrMagicLinkDisabled
+	}
+
+	tokenValue := link
+	if cfg.BindBrowser {
+		tokenValue = link + nonce
+	}
+
+	userName, err := app.Store.GetUserNameForToken(MagicTokenType, tokenValue)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired) {
+			WriteEvent(app.Store, EventMagicLogin, false, userName, err.Error())
+			return Token{}, ErrMagicLinkInvalid
+		}
+		return Token{}, err
+	}
+
+	ok, err := app.Store.ConsumeToken(MagicTokenType, userName, tokenValue)
+	if err != nil {
+		return Token{}, err
+	}
+	if !ok {
+		WriteEvent(app.Store, EventMagicLogin, false, userName, "token used")
+		return Token{}, ErrMagicLinkInvalid
+	}
+
+	err = app.checkLockout(userName)
+	if err != nil {
+		WriteEvent(app.Store, EventMagicLogin, false, userName, err.Error())
+		return Token{}, err
+	}
+
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		return Token{}, err
+	}
+	if !user.EmailVerified {
+		err = app.Store.SetEmailVerified(userName, true)
+		if err != nil {
+			return Token{}, err
+		}
+		WriteEvent(app.Store, EventVerify, true, userName, "magic link")
+	}
+
+	token, err := app.checkLogin(userName)
+	if err != nil {
+		WriteEvent(app.Store, EventMagicLogin, false, userName, err.Error())
+		return token, err
+	}
+
+	WriteEvent(app.Store, EventMagicLogin, true, userName, "success")
+
+	return app.completeLogin(userName)
+}
+
+// setMagicCookie sets the cookie that binds a magic link to the browser.
+func setMagicCookie(w http.ResponseWriter, nonce string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     MagicCookieName,
+		Value:    nonce,
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+		// Lax since the link is opened from an email
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// MagicHandler handles /magic requests, a passwordless login with a link
+// sent by email.
+//
+// A GET shows a form to request a link. The link is a GET with mtoken, which
+// shows a button to POST the token and login, so a link opened by an email
+// scanner does not use the token.
+func (app *App) MagicHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !app.Cfg.MagicLink.Enabled {
+		logger.Warn("magic link disabled")
+		http.NotFound(w, r)
+		return
+	}
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	pageData := MagicPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r)}
+
+	switch r.Method {
+	case http.MethodGet:
+		pageData.MagicToken = r.URL.Query().Get("mtoken")
+
+	case http.MethodPost:
+		if mtoken := strings.TrimSpace(r.PostFormValue("mtoken")); mtoken != "" {
+			app.magicLoginPost(w, r, mtoken)
+			return
+		}
+
+		email := strings.TrimSpace(r.PostFormValue("email"))
+		if email == "" {
+			pageData.Message = MsgMissingEmail
+			break
+		}
+
+		nonce, err := app.SendMagicLink(email)
+		if err != nil {
+			logger.Error("failed to SendMagicLink", "email", email, "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if nonce != "" {
+			setMagicCookie(w, nonce, time.Now().Add(app.magicLinkExpires()))
+		}
+		logger.Info("magic link requested", "email", email)
+
+		// the same message is shown for every email to avoid revealing accounts
+		pageData.Message = MsgMagicLinkSent
+		pageData.Sent = true
+	}
+
+	err := RenderTemplate(app.Tmpls, w, "magic.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+}
+
+// magicLoginPost is called for the POST method of the MagicHandler with the
+// token from a magic link.
+func (app *App) magicLoginPost(w http.ResponseWriter, r *http.Request, mtoken string) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	nonce, err := GetCookieValue(r, MagicCookieName)
+	if err != nil {
+		logger.Error("failed to GetCookieValue", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := app.LoginWithMagicLink(mtoken, nonce)
+	if !errors.Is(err, ErrMagicLinkInvalid) {
+		// the token was used, so the nonce is no longer needed
+		http.SetCookie(w, &http.Cookie{Name: MagicCookieName, Value: "", MaxAge: -1})
+	}
+	if errors.Is(err, ErrLoginMFARequired) {
+		setMFACookie(w, token)
+		http.Redirect(w, r, "/mfa", http.StatusSeeOther)
+		logger.Info("magic link login requires second factor")
+		return
+	}
+	if errors.Is(err, ErrLoginPasswordExpired) {
+		setPasswordChangeCookie(w, token)
+		http.Redirect(w, r, "/expired", http.StatusSeeOther)
+		logger.Info("magic link login requires password change")
+		return
+	}
+	if err != nil {
+		logger.Warn("failed to LoginWithMagicLink", "err", err)
+		err := RenderTemplate(app.Tmpls, w, "magic.html",
+			MagicPageData{
+				Title:     app.Cfg.Title,
+				CSRFToken: CSRFToken(r),
+				Message:   MsgMagicLinkInvalid,
+			})
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+		}
+		return
+	}
+
+	SetSessionCookie(w, token)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	logger.Info("magic link login successful")
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// magicAppForTest returns an App with a new Store and magic links enabled.
+func magicAppForTest(t *testing.T, bind bool) *weblogin.App {
+	app := profileAppForTest(t)
+	app.Cfg.MagicLink = weblogin.ConfigMagicLink{Enabled: true, BindBrowser: bind}
+	return app
+}
+
+func TestLoginWithMagicLink(t *testing.T) {
+	app := magicAppForTest(t, false)
+
+	token, err := weblogin.SaveNewTokenWithDuration(app.Store, weblogin.MagicTokenType, "test", 32, time.Minute)
+	if err != nil {
+		t.Fatalf("SaveNewTokenWithDuration failed: %v", err)
+	}
+
+	session, err := app.LoginWithMagicLink(token.Value, "")
+	if err != nil {
+		t.Fatalf("LoginWithMagicLink failed: %v", err)
+	}
+	user, _, err := app.GetUserForSessionToken(session.Value)
+	if err != nil || user.UserName != "test" {
+		t.Errorf("GetUserForSessionToken got %q, %v, want test", user.UserName, err)
+	}
+
+	// a link can only be used once
+	_, err = app.LoginWithMagicLink(token.Value, "")
+	if !errors.Is(err, weblogin.ErrMagicLinkInvalid) {
+		t.Errorf("LoginWithMagicLink used got err %v, want %v", err, weblogin.ErrMagicLinkInvalid)
+	}
+
+	expired, err := weblogin.SaveNewTokenWithDuration(app.Store, weblogin.MagicTokenType, "test", 32, -time.Minute)
+	if err != nil {
+		t.Fatalf("SaveNewTokenWithDuration failed: %v", err)
+	}
+	_, err = app.LoginWithMagicLink(expired.Value, "")
+	if !errors.Is(err, weblogin.ErrMagicLinkInvalid) {
+		t.Errorf("LoginWithMagicLink expired got err %v, want %v", err, weblogin.ErrMagicLinkInvalid)
+	}
+
+	app.Cfg.MagicLink.Enabled = false
+	_, err = app.LoginWithMagicLink(token.Value, "")
+	if !errors.Is(err, weblogin.ErrMagicLinkDisabled) {
+		t.Errorf("LoginWithMagicLink disabled got err %v, want %v", err, weblogin.ErrMagicLinkDisabled)
+	}
+}
+
+func TestLoginWithMagicLinkBindBrowser(t *testing.T) {
+	app := magicAppForTest(t, true)
+	app.Cfg.VerifyEmail.Required = true
+
+	token, err := weblogin.SaveNewTokenWithDuration(app.Store, weblogin.MagicTokenType, "test", 32, time.Minute)
+	if err != nil {
+		t.Fatalf("SaveNewTokenWithDuration failed: %v", err)
+	}
+	link, nonce := token.Value[:len(token.Value)/2], token.Value[len(token.Value)/2:]
+
+	for _, n := range []string{"", "other"} {
+		_, err = app.LoginWithMagicLink(link, n)
+		if !errors.Is(err, weblogin.ErrMagicLinkInvalid) {
+			t.Errorf("LoginWithMagicLink with nonce %q got err %v, want %v", n, err, weblogin.ErrMagicLinkInvalid)
+		}
+	}
+
+	_, err = app.LoginWithMagicLink(link, nonce)
+	if err != nil {
+		t.Fatalf("LoginWithMagicLink failed: %v", err)
+	}
+
+	// the link was sent to the email address
+	user, err := app.Store.GetUserForName("test")
+	if err != nil || !user.EmailVerified {
+		t.Errorf("GetUserForName got EmailVerified %v, %v, want true", user.EmailVerified, err)
+	}
+}
+
+func TestMagicHandler(t *testing.T) {
+	app := magicAppForTest(t, true)
+
+	token, err := weblogin.SaveNewTokenWithDuration(app.Store, weblogin.MagicTokenType, "test", 32, time.Minute)
+	if err != nil {
+		t.Fatalf("SaveNewTokenWithDuration failed: %v", err)
+	}
+	link, nonce := token.Value[:len(token.Value)/2], token.Value[len(token.Value)/2:]
+
+	// opening the link asks for confirmation without using the token
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/magic?mtoken="+url.QueryEscape(link), nil)
+	app.MagicHandler(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="mtoken"`) {
+		t.Errorf("GET got status %d, body %q, want confirm form", w.Code, w.Body)
+	}
+
+	data := url.Values{"mtoken": {link}}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/magic", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: weblogin.MagicCookieName, Value: nonce})
+
+	app.MagicHandler(w, r)
+
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("POST got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if c := cookieFor(w, weblogin.SessionTokenCookieName); c == nil || c.Value == "" {
+		t.Errorf("POST got session cookie %v", c)
+	}
+
+	if c := cookieFor(w, weblogin.MagicCookieName); c == nil || c.MaxAge >= 0 {
+		t.Errorf("POST got magic cookie %v, want cleared", c)
+	}
+
+	// the link cannot be used again
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/magic", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: weblogin.MagicCookieName, Value: nonce})
+
+	app.MagicHandler(w, r)
+
+	if !strings.Contains(w.Body.String(), weblogin.MsgMagicLinkInvalid) {
+		t.Errorf("POST used got body %q, want %q", w.Body, weblogin.MsgMagicLinkInvalid)
+	}
+}
+
+func TestMagicHandlerRequest(t *testing.T) {
+	app := magicAppForTest(t, true)
+	mailer := &testMailer{}
+	app.Mailer = mailer
+
+	// the response is the same whether or not the email is registered
+	for _, email := range []string{"test@email", "unknown@email"} {
+		w := postForm(app.MagicHandler, "/magic", url.Values{"email": {email}})
+
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgMagicLinkSent) {
+			t.Errorf("%s: got status %d, body %q, want %q", email, w.Code, w.Body, weblogin.MsgMagicLinkSent)
+		}
+		if c := cookieFor(w, weblogin.MagicCookieName); c == nil || c.Value == "" {
+			t.Errorf("%s: got cookie %v, want nonce", email, c)
+		}
+	}
+
+	// the link is sent in the background
+	weblogin.WaitForEmails()
+	if got := len(mailer.sent("test@email")); got != 1 {
+		t.Errorf("sent to test@email got %d messages, want 1", got)
+	}
+	if got := len(mailer.sent("unknown@email")); got != 0 {
+		t.Errorf("sent to unknown@email got %d messages, want 0", got)
+	}
+
+	n, err := app.Store.CountTokens(weblogin.MagicTokenType, "test")
+	if err != nil || n != 1 {
+		t.Errorf("CountTokens got %d, %v, want 1", n, err)
+	}
+}
+
+func TestMagicHandlerDisabled(t *testing.T) {
+	app := profileAppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/magic", nil)
+
+	app.MagicHandler(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestMagicHandlerLoginChecks(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(app *weblogin.App) error
+		wantLocation string
+		wantCookie   string
+	}{
+		{
+			name: "mfa",
+			setup: func(app *weblogin.App) error {
+				return app.Store.SaveTOTPSecret("test", "secret", true)
+			},
+			wantLocation: "/mfa",
+			wantCookie:   weblogin.MFATokenCookieName,
+		},
+		{
+			name: "must change password",
+			setup: func(app *weblogin.App) error {
+				return app.Store.SetMustChangePassword("test", true)
+			},
+			wantLocation: "/expired",
+			wantCookie:   weblogin.PasswordChangeCookieName,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := magicAppForTest(t, true)
+			err := tc.setup(app)
+			if err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+
+			token, err := weblogin.SaveNewTokenWithDuration(app.Store, weblogin.MagicTokenType, "test", 32, time.Minute)
+			if err != nil {
+				t.Fatalf("SaveNewTokenWithDuration failed: %v", err)
+			}
+			link, nonce := token.Value[:len(token.Value)/2], token.Value[len(token.Value)/2:]
+
+			data := url.Values{"mtoken": {link}}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/magic", strings.NewReader(data.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.AddCookie(&http.Cookie{Name: weblogin.MagicCookieName, Value: nonce})
+
+			app.MagicHandler(w, r)
+
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != tc.wantLocation {
+				t.Errorf("got status %d, location %q, want %d, %q", w.Code, w.Header().Get("Location"), http.StatusSeeOther, tc.wantLocation)
+			}
+			if c := cookieFor(w, tc.wantCookie); c == nil || c.Value == "" {
+				t.Errorf("got %s cookie %v", tc.wantCookie, c)
+			}
+			if c := cookieFor(w, weblogin.SessionTokenCookieName); c != nil {
+				t.Errorf("got session cookie %v, want none", c)
+			}
+			if c := cookieFor(w, weblogin.MagicCookieName); c == nil || c.MaxAge >= 0 {
+				t.Errorf("got magic cookie %v, want cleared", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,1170 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"bytes"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// memUser is a user with the values not included in User.
+type memUser struct {
+	User
+	hashedPassword string
+	totpSecret     string
+	totpEnabled    bool
+	totpLastStep   int64
+	lockCount      int
+	history        []string // previous hashed passwords, most recent first
+}
+
+// memToken is a stored token.
+type memToken struct {
+	userName  string
+	tType     string
+	expires   time.Time
+	created   time.Time
+	lastSeen  time.Time
+	ip        string
+	userAgent string
+	series    string
+}
+
+// session returns the Session for the token with hashedValue.
+func (t memToken) session(hashedValue string) Session {
+	return Session{
+		ID:        hashedValue,
+		UserName:  t.userName,
+		Created:   t.created,
+		LastSeen:  t.lastSeen,
+		Expires:   t.expires,
+		IP:        t.ip,
+		UserAgent: t.userAgent,
+		Series:    t.series,
+	}
+}
+
+// memEmailChange is a stored email change token.
+type memEmailChange struct {
+	memToken
+	email string
+}
+
+// MemStore is a Store that keeps everything in memory, which is useful for
+// development and tests. All data is lost when the process exits.
+type MemStore struct {
+	mu          sync.Mutex
+	users       map[string]*memUser
+	tokens      map[string]memToken       // key is the hashed value
+	emails      map[string]memEmailChange // key is the hashed value
+	remember    map[string]RememberToken  // key is the selector
+	events      []Event
+	credentials []Credential
+	roles       map[string]*Role   // only Name, Description, and Permissions
+	groups      map[string]*Group  // only Name, Description, and Members
+	userRoles   map[[2]string]bool // key is userName and role
+	groupRoles  map[[2]string]bool // key is group and role
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		users:      make(map[string]*memUser),
+		tokens:     make(map[string]memToken),
+		emails:     make(map[string]memEmailChange),
+		remember:   make(map[string]RememberToken),
+		roles:      make(map[string]*Role),
+		groups:     make(map[string]*Group),
+		userRoles:  make(map[[2]string]bool),
+		groupRoles: make(map[[2]string]bool),
+	}
+}
+
+// Close does nothing.
+func (s *MemStore) Close() error {
+	return nil
+}
+
+// CreateUser creates user with hashedPassword.
+func (s *MemStore) CreateUser(user User, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[user.UserName]; ok {
+		return ErrStoreDuplicate
+	}
+	for _, u := range s.users {
+		if u.Email == user.Email {
+			return ErrStoreDuplicate
+		}
+	}
+
+	if user.Created.IsZero() {
+		user.Created = time.Now()
+	}
+	user.LastLoginTime, user.LastLoginResult = time.Time{}, ""
+	user.LockedUntil = time.Time{}
+	user.PasswordChanged = user.Created
+
+	s.users[user.UserName] = &memUser{User: user, hashedPassword: hashedPassword}
+
+	return nil
+}
+
+// GetUserForName returns a user for the given userName.
+func (s *MemStore) GetUserForName(userName string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userName]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+
+	return u.User, nil
+}
+
+// GetUserNameForEmail returns the userName for a given email.
+func (s *MemStore) GetUserNameForEmail(email string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email {
+			return u.UserName, nil
+		}
+	}
+
+	return "", ErrUserNotFound
+}
+
+// UserExists returns true if the given userName already exists.
+func (s *MemStore) UserExists(userName string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.users[userName]
+	return ok, nil
+}
+
+// EmailExists returns true if the given email already exists.
+func (s *MemStore) EmailExists(email string) (bool, error) {
+	_, err := s.GetUserNameForEmail(email)
+	return err == nil, nil
+}
+
+// GetUsers returns a list of all users.
+func (s *MemStore) GetUsers() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []User
+	for _, u := range s.users {
+		users = append(users, u.User)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserName < users[j].UserName
+	})
+
+	return users, nil
+}
+
+// GetPasswordHash returns the hashed password for userName.
+func (s *MemStore) GetPasswordHash(userName string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userName]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+
+	return u.hashedPassword, nil
+}
+
+// SetPasswordHash sets the hashed password for userName and the time it
+// changed, and clears MustChangePassword.
+func (s *MemStore) SetPasswordHash(userName, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userName]; ok {
+		u.hashedPassword = hashedPassword
+		u.PasswordChanged = time.Now()
+		u.MustChangePassword = false
+	}
+
+	return nil
+}
+
+// ResetPasswordHash sets the hashed password of the user of the reset token
+// tValue, marks the token used, and adds the previous hashed password to the
+// history if keep is positive.
+func (s *MemStore) ResetPasswordHash(tValue, hashedPassword string, keep int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	t, ok := s.tokens[hashedValue]
+	if !ok || t.tType != ResetTokenType {
+		return "", ErrTokenNotFound
+	}
+	if t.expires.Before(time.Now()) {
+		return t.userName, ErrTokenExpired
+	}
+
+	u, ok := s.users[t.userName]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+
+	t.tType = ResetUsedTokenType
+	s.tokens[hashedValue] = t
+	if keep > 0 {
+		u.history = append([]string{u.hashedPassword}, u.history...)
+		u.history = u.history[:min(keep, len(u.history))]
+	}
+	u.hashedPassword = hashedPassword
+	u.PasswordChanged = time.Now()
+	u.MustChangePassword = false
+
+	return t.userName, nil
+}
+
+// SetMustChangePassword sets if userName must change their password at the next login.
+func (s *MemStore) SetMustChangePassword(userName string, mustChange bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userName]; ok {
+		u.MustChangePassword = mustChange
+	}
+
+	return nil
+}
+
+// GetPasswordHistory returns up to n previous hashed passwords for userName, most recent first.
+func (s *MemStore) GetPasswordHistory(userName string, n int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userName]
+	if !ok {
+		return nil, nil
+	}
+
+	return slices.Clone(u.history[:min(n, len(u.history))]), nil
+}
+
+// AddPasswordHistory adds hashedPassword to the previous passwords for userName, keeping only the most recent keep.
+func (s *MemStore) AddPasswordHistory(userName, hashedPassword string, keep int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userName]; ok {
+		u.history = append([]string{hashedPassword}, u.history...)
+		u.history = u.history[:min(keep, len(u.history))]
+	}
+
+	return nil
+}
+
+// GetTOTPSecret returns the encrypted TOTP secret for userName and if TOTP is enabled.
+func (s *MemStore) GetTOTPSecret(userName string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userName]
+	if !ok {
+		return "", false, ErrUserNotFound
+	}
+
+	return u.totpSecret, u.totpEnabled, nil
+}
+
+// SaveTOTPSecret stores the encrypted TOTP secret for userName and if TOTP is enabled.
+func (s *MemStore) SaveTOTPSecret(userName, secret string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userName]; ok {
+		u.totpSecret, u.totpEnabled = secret, enabled
+	}
+
+	return nil
+}
+
+// UseTOTPStep records step as the last TOTP time step used by userName.
+func (s *MemStore) UseTOTPStep(userName string, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userName]
+	if !ok || step <= u.totpLastStep {
+		return false, nil
+	}
+	u.totpLastStep = step
+
+	return true, nil
+}
+
+// GetLockout returns the time userName is locked until and the number of consecutive locks.
+func (s *MemStore) GetLockout(userName string) (time.Time, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userName]
+	if !ok {
+		return time.Time{}, 0, ErrUserNotFound
+	}
+
+	return u.LockedUntil, u.lockCount, nil
+}
+
+// SetLockout sets the time userName is locked until and the number of consecutive locks.
+func (s *MemStore) SetLockout(userName string, until time.Time, count int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userName]; ok {
+		u.LockedUntil, u.lockCount = until, count
+	}
+
+	return nil
+}
+
+// SetEmailVerified sets if the email address of userName has been verified.
+func (s *MemStore) SetEmailVerified(userName string, verified bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userName]; ok {
+		u.EmailVerified = verified
+	}
+
+	return nil
+}
+
+// SetFullName sets the full name of userName.
+func (s *MemStore) SetFullName(userName, fullName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userName]; ok {
+		u.FullName = fullName
+	}
+
+	return nil
+}
+
+// SetEmail sets the email address of userName.
+func (s *MemStore) SetEmail(userName, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email && u.UserName != userName {
+			return ErrStoreDuplicate
+		}
+	}
+
+	if u, ok := s.users[userName]; ok {
+		u.Email = email
+	}
+
+	return nil
+}
+
+// LastLoginForUser returns the time and result of the previous login for userName.
+func (s *MemStore) LastLoginForUser(userName string) (time.Time, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var logins []Event
+	for _, e := range s.events {
+		if e.UserName == userName && e.Name == EventLogin {
+			logins = append(logins, e)
+		}
+	}
+
+	// second most recent, since the most recent is the current login
+	if len(logins) < 2 {
+		return time.Time{}, "", nil
+	}
+	sort.Slice(logins, func(i, j int) bool {
+		return logins[i].Created.After(logins[j].Created)
+	})
+
+	return logins[1].Created, strconv.FormatBool(logins[1].Result), nil
+}
+
+// SaveToken saves the given token for user.
+func (s *MemStore) SaveToken(userName string, token Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(token.Value)
+	if _, ok := s.tokens[hashedValue]; ok {
+		return ErrStoreDuplicate
+	}
+
+	s.tokens[hashedValue] = memToken{
+		userName: userName,
+		tType:    token.Type,
+		expires:  token.Expires,
+		created:  time.Now(),
+	}
+
+	return nil
+}
+
+// GetUserNameForToken returns the userName for the given unexpired token.
+func (s *MemStore) GetUserNameForToken(tType, tValue string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[hash(tValue)]
+	if !ok || t.tType != tType {
+		return "", ErrTokenNotFound
+	}
+
+	if t.expires.Before(time.Now()) {
+		return t.userName, ErrTokenExpired
+	}
+
+	return t.userName, nil
+}
+
+// RemoveToken removes the given token.
+func (s *MemStore) RemoveToken(tType, tValue string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	if t, ok := s.tokens[hashedValue]; ok && t.tType == tType {
+		delete(s.tokens, hashedValue)
+	}
+
+	return nil
+}
+
+// RemoveTokensForUser removes all tokens of tType for user.
+func (s *MemStore) RemoveTokensForUser(tType, userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, t := range s.tokens {
+		if t.tType == tType && t.userName == userName {
+			delete(s.tokens, k)
+		}
+	}
+
+	return nil
+}
+
+// RemoveOtherTokensForUser removes the tokens of tType for userName except tValue.
+func (s *MemStore) RemoveOtherTokensForUser(tType, userName, tValue string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keep := hash(tValue)
+	for k, t := range s.tokens {
+		if t.tType == tType && t.userName == userName && k != keep {
+			delete(s.tokens, k)
+		}
+	}
+
+	return nil
+}
+
+// RemoveExpiredTokens removes the tokens of tType that have expired.
+func (s *MemStore) RemoveExpiredTokens(tType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range s.tokens {
+		if t.tType == tType && !t.expires.After(now) {
+			delete(s.tokens, k)
+		}
+	}
+
+	return nil
+}
+
+// ConsumeToken removes the given token of tType for user and reports if it existed.
+func (s *MemStore) ConsumeToken(tType, userName, tValue string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	t, ok := s.tokens[hashedValue]
+	if !ok || t.tType != tType || t.userName != userName || !t.expires.After(time.Now()) {
+		return false, nil
+	}
+
+	delete(s.tokens, hashedValue)
+
+	return true, nil
+}
+
+// CountTokens returns the number of unexpired tokens of tType for user.
+func (s *MemStore) CountTokens(tType, userName string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, t := range s.tokens {
+		if t.tType == tType && t.userName == userName && t.expires.After(now) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// UpdateSession records the time, IP address, and User-Agent of a request
+// with the session token tValue.
+func (s *MemStore) UpdateSession(tValue, ip, userAgent string, seen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	t, ok := s.tokens[hashedValue]
+	if !ok || t.tType != "session" {
+		return nil
+	}
+	if t.ip == ip && t.userAgent == userAgent && seen.Sub(t.lastSeen) < SessionSeenInterval {
+		return nil
+	}
+
+	t.lastSeen, t.ip, t.userAgent = seen, ip, userAgent
+	s.tokens[hashedValue] = t
+
+	return nil
+}
+
+// GetSession returns the session for the token tValue.
+func (s *MemStore) GetSession(tValue string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	t, ok := s.tokens[hashedValue]
+	if !ok || t.tType != "session" {
+		return Session{}, ErrTokenNotFound
+	}
+	if t.expires.Before(time.Now()) {
+		return Session{}, ErrTokenExpired
+	}
+
+	return t.session(hashedValue), nil
+}
+
+// SetSessionExpires sets when the session token tValue expires.
+func (s *MemStore) SetSessionExpires(tValue string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	if t, ok := s.tokens[hashedValue]; ok && t.tType == "session" {
+		t.expires = expires
+		s.tokens[hashedValue] = t
+	}
+
+	return nil
+}
+
+// SetSessionSeries links the session token tValue to series.
+func (s *MemStore) SetSessionSeries(tValue, series string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	if t, ok := s.tokens[hashedValue]; ok && t.tType == "session" {
+		t.series = series
+		s.tokens[hashedValue] = t
+	}
+
+	return nil
+}
+
+// GetSessions returns the unexpired sessions of userName, most recently seen first.
+func (s *MemStore) GetSessions(userName string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var sessions []Session
+	for k, t := range s.tokens {
+		if t.tType != "session" || t.userName != userName || !t.expires.After(now) {
+			continue
+		}
+		sessions = append(sessions, t.session(k))
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+// RemoveSession removes the session of userName with id.
+func (s *MemStore) RemoveSession(userName, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || t.tType != "session" || t.userName != userName {
+		return ErrTokenNotFound
+	}
+	delete(s.tokens, id)
+
+	return nil
+}
+
+// SaveRememberToken saves t.
+func (s *MemStore) SaveRememberToken(t RememberToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.remember[t.Selector]; ok {
+		return ErrStoreDuplicate
+	}
+	s.remember[t.Selector] = t
+
+	return nil
+}
+
+// GetRememberToken returns the token for selector.
+func (s *MemStore) GetRememberToken(selector string) (RememberToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.remember[selector]
+	if !ok {
+		return RememberToken{}, ErrTokenNotFound
+	}
+
+	return t, nil
+}
+
+// RotateRememberToken marks the token with selector rotated and saves next.
+func (s *MemStore) RotateRememberToken(selector string, next RememberToken) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.remember[selector]
+	if !ok || !t.Rotated.IsZero() {
+		return false, nil
+	}
+	if _, ok := s.remember[next.Selector]; ok {
+		return false, ErrStoreDuplicate
+	}
+
+	t.Rotated = time.Now()
+	s.remember[selector] = t
+	s.remember[next.Selector] = next
+
+	return true, nil
+}
+
+// RemoveRememberSeries removes all tokens of series.
+func (s *MemStore) RemoveRememberSeries(series string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, t := range s.remember {
+		if t.Series == series {
+			delete(s.remember, k)
+		}
+	}
+
+	return nil
+}
+
+// RemoveRememberTokensForUser removes all tokens of userName.
+func (s *MemStore) RemoveRememberTokensForUser(userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, t := range s.remember {
+		if t.UserName == userName {
+			delete(s.remember, k)
+		}
+	}
+
+	return nil
+}
+
+// RemoveOtherRememberTokensForUser removes the tokens of userName except
+// the tokens of series.
+func (s *MemStore) RemoveOtherRememberTokensForUser(userName, series string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, t := range s.remember {
+		if t.UserName == userName && t.Series != series {
+			delete(s.remember, k)
+		}
+	}
+
+	return nil
+}
+
+// SaveEmailChange saves a token to set the email address of userName.
+func (s *MemStore) SaveEmailChange(userName, email string, token Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(token.Value)
+	if _, ok := s.emails[hashedValue]; ok {
+		return ErrStoreDuplicate
+	}
+
+	s.emails[hashedValue] = memEmailChange{
+		memToken: memToken{userName: userName, tType: token.Type, expires: token.Expires},
+		email:    email,
+	}
+
+	return nil
+}
+
+// ConsumeEmailChange removes the given unexpired email change token and
+// returns the userName and email address.
+func (s *MemStore) ConsumeEmailChange(tType, tValue string) (string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashedValue := hash(tValue)
+	c, ok := s.emails[hashedValue]
+	if !ok || c.tType != tType || !c.expires.After(time.Now()) {
+		return "", "", ErrTokenNotFound
+	}
+
+	delete(s.emails, hashedValue)
+
+	return c.userName, c.email, nil
+}
+
+// RemoveEmailChangesForUser removes all email change tokens of tType for user.
+func (s *MemStore) RemoveEmailChangesForUser(tType, userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, c := range s.emails {
+		if c.tType == tType && c.userName == userName {
+			delete(s.emails, k)
+		}
+	}
+
+	return nil
+}
+
+// SaveEvent saves event.
+func (s *MemStore) SaveEvent(event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.Created.IsZero() {
+		event.Created = time.Now()
+	}
+	s.events = append(s.events, event)
+
+	return nil
+}
+
+// CountEvents returns the number of events with name and result for user created after since.
+func (s *MemStore) CountEvents(name string, result bool, userName string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, e := range s.events {
+		if e.Name == name && e.Result == result && e.UserName == userName && e.Created.After(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// SaveCredential saves a new credential.
+func (s *MemStore) SaveCredential(c Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cred := range s.credentials {
+		if bytes.Equal(cred.ID, c.ID) {
+			return ErrStoreDuplicate
+		}
+	}
+
+	c.Created = time.Now()
+	c.LastUsed = time.Time{}
+	s.credentials = append(s.credentials, c)
+
+	return nil
+}
+
+// GetCredential returns the credential for the given ID.
+func (s *MemStore) GetCredential(id []byte) (Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.credentials {
+		if bytes.Equal(c.ID, id) {
+			return c, nil
+		}
+	}
+
+	return Credential{}, ErrCredentialNotFound
+}
+
+// GetCredentialsForUser returns the credentials registered by userName.
+func (s *MemStore) GetCredentialsForUser(userName string) ([]Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var creds []Credential
+	for _, c := range s.credentials {
+		if c.UserName == userName {
+			creds = append(creds, c)
+		}
+	}
+
+	return creds, nil
+}
+
+// UpdateCredentialUse records the use of a credential with the new signature counter.
+func (s *MemStore) UpdateCredentialUse(id []byte, signCount uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.credentials {
+		if bytes.Equal(s.credentials[i].ID, id) {
+			s.credentials[i].SignCount = signCount
+			s.credentials[i].LastUsed = time.Now()
+		}
+	}
+
+	return nil
+}
+
+// RemoveCredential removes the credential with id for userName.
+func (s *MemStore) RemoveCredential(userName string, id []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.credentials {
+		if c.UserName == userName && bytes.Equal(c.ID, id) {
+			s.credentials = append(s.credentials[:i], s.credentials[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrCredentialNotFound
+}
+
+// CreateRole creates role with its permissions.
+func (s *MemStore) CreateRole(role Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roles[role.Name]; ok {
+		return ErrStoreDuplicate
+	}
+
+	s.roles[role.Name] = &Role{
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: sortedUnique(role.Permissions),
+	}
+
+	return nil
+}
+
+// GetRoles returns the roles, with their permissions and assignments, sorted by name.
+func (s *MemStore) GetRoles() ([]Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var roles []Role
+	for _, r := range s.roles {
+		role := *r
+		role.Permissions = slices.Clone(r.Permissions)
+		for k := range s.userRoles {
+			if k[1] == r.Name {
+				role.Users = append(role.Users, k[0])
+			}
+		}
+		for k := range s.groupRoles {
+			if k[1] == r.Name {
+				role.Groups = append(role.Groups, k[0])
+			}
+		}
+		sort.Strings(role.Users)
+		sort.Strings(role.Groups)
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+
+	return roles, nil
+}
+
+// SetRolePermissions replaces the permissions of role.
+func (s *MemStore) SetRolePermissions(role string, permissions []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.roles[role]
+	if !ok {
+		return ErrRoleNotFound
+	}
+	r.Permissions = sortedUnique(permissions)
+
+	return nil
+}
+
+// RemoveRole removes role and its assignments.
+func (s *MemStore) RemoveRole(role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.roles, role)
+	for k := range s.userRoles {
+		if k[1] == role {
+			delete(s.userRoles, k)
+		}
+	}
+	for k := range s.groupRoles {
+		if k[1] == role {
+			delete(s.groupRoles, k)
+		}
+	}
+
+	return nil
+}
+
+// AddUserRole assigns role to userName.
+func (s *MemStore) AddUserRole(userName, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userName]; !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := s.roles[role]; !ok {
+		return ErrRoleNotFound
+	}
+	k := [2]string{userName, role}
+	if s.userRoles[k] {
+		return ErrStoreDuplicate
+	}
+	s.userRoles[k] = true
+
+	return nil
+}
+
+// RemoveUserRole removes the assignment of role to userName.
+func (s *MemStore) RemoveUserRole(userName, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.userRoles, [2]string{userName, role})
+
+	return nil
+}
+
+// rolesForUser returns the roles of userName. The caller must hold s.mu.
+func (s *MemStore) rolesForUser(userName string) []string {
+	var roles []string
+	for k := range s.userRoles {
+		if k[0] == userName {
+			roles = append(roles, k[1])
+		}
+	}
+	for k := range s.groupRoles {
+		g, ok := s.groups[k[0]]
+		if !ok {
+			continue
+		}
+		for _, m := range g.Members {
+			if m.UserName == userName {
+				roles = append(roles, k[1])
+			}
+		}
+	}
+
+	return sortedUnique(roles)
+}
+
+// GetPermissionsForUser returns the permissions of the roles of userName.
+func (s *MemStore) GetPermissionsForUser(userName string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var perms []string
+	for _, role := range s.rolesForUser(userName) {
+		if r, ok := s.roles[role]; ok {
+			perms = append(perms, r.Permissions...)
+		}
+	}
+
+	return sortedUnique(perms), nil
+}
+
+// GetRolesForUser returns the roles of userName.
+func (s *MemStore) GetRolesForUser(userName string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.rolesForUser(userName), nil
+}
+
+// CreateGroup creates group.
+func (s *MemStore) CreateGroup(group Group) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.groups[group.Name]; ok {
+		return ErrStoreDuplicate
+	}
+	s.groups[group.Name] = &Group{Name: group.Name, Description: group.Description}
+
+	return nil
+}
+
+// GetGroups returns the groups, with their members and roles, sorted by name.
+func (s *MemStore) GetGroups() ([]Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var groups []Group
+	for _, g := range s.groups {
+		group := *g
+		group.Members = slices.Clone(g.Members)
+		sort.Slice(group.Members, func(i, j int) bool {
+			return group.Members[i].UserName < group.Members[j].UserName
+		})
+		for k := range s.groupRoles {
+			if k[0] == g.Name {
+				group.Roles = append(group.Roles, k[1])
+			}
+		}
+		sort.Strings(group.Roles)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	return groups, nil
+}
+
+// RemoveGroup removes group, its members, and its roles.
+func (s *MemStore) RemoveGroup(group string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.groups, group)
+	for k := range s.groupRoles {
+		if k[0] == group {
+			delete(s.groupRoles, k)
+		}
+	}
+
+	return nil
+}
+
+// SetGroupMember adds userName to group, or updates if they are a lead.
+func (s *MemStore) SetGroupMember(group, userName string, lead bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g, ok := s.groups[group]
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if _, ok := s.users[userName]; !ok {
+		return ErrUserNotFound
+	}
+
+	for i := range g.Members {
+		if g.Members[i].UserName == userName {
+			g.Members[i].IsLead = lead
+			return nil
+		}
+	}
+	g.Members = append(g.Members, GroupMember{UserName: userName, IsLead: lead})
+
+	return nil
+}
+
+// RemoveGroupMember removes userName from group.
+func (s *MemStore) RemoveGroupMember(group, userName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if g, ok := s.groups[group]; ok {
+		g.Members = slices.DeleteFunc(g.Members, func(m GroupMember) bool {
+			return m.UserName == userName
+		})
+	}
+
+	return nil
+}
+
+// AddGroupRole assigns role to group.
+func (s *MemStore) AddGroupRole(group, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.groups[group]; !ok {
+		return ErrGroupNotFound
+	}
+	if _, ok := s.roles[role]; !ok {
+		return ErrRoleNotFound
+	}
+	k := [2]string{group, role}
+	if s.groupRoles[k] {
+		return ErrStoreDuplicate
+	}
+	s.groupRoles[k] = true
+
+	return nil
+}
+
+// RemoveGroupRole removes the assignment of role to group.
+func (s *MemStore) RemoveGroupRole(group, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.groupRoles, [2]string{group, role})
+
+	return nil
+}
+
+// sortedUnique returns a sorted copy of values without duplicates, or nil if
+// values is empty.
+func sortedUnique(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	values = slices.Clone(values)
+	slices.Sort(values)
+
+	return slices.Compact(values)
+}
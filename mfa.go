@@ -0,0 +1,236 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	MFATokenType       = "mfa"           // token type for a pending second factor
+	MFATokenCookieName = "mfa"           // cookie name for a pending second factor
+	MFAExpires         = 5 * time.Minute // time to provide the second factor
+	MFAMaxAttempts     = 5               // failed attempts allowed within MFAExpires
+)
+
+var (
+	ErrMFAInvalidCode     = errors.New("invalid second factor")
+	ErrMFATooManyAttempts = errors.New("too many second factor attempts")
+)
+
+// MFAPageData contains data passed to the HTML template.
+type MFAPageData struct {
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+	CSPNonce  string // see SecurityHeadersHandler
+	WebAuthn  bool   // user has a security key or passkey
+}
+
+const (
+	MsgMFAInvalidCode     = "Invalid code. Please try again."
+	MsgMFATooManyAttempts = "Too many invalid codes. Please login again."
+)
+
+// MFAHandler handles /mfa requests, which is the second step of a login for
+// users enrolled in two-factor authentication.
+func (app *App) MFAHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	// a pending second factor token is required
+	mfaToken, err := GetCookieValue(r, MFATokenCookieName)
+	if err != nil || mfaToken == "" {
+		logger.Warn("missing mfa token", "err", err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		err := RenderTemplate(app.Tmpls, w, "mfa.html", app.mfaPageData(r, mfaToken, ""))
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+			return
+		}
+		logger.Info("MFAHandler")
+
+	case http.MethodPost:
+		app.mfaPost(w, r, mfaToken)
+	}
+}
+
+// mfaPost is called for the POST method of the MFAHandler.
+func (app *App) mfaPost(w http.ResponseWriter, r *http.Request, mfaToken string) {
+	code := strings.TrimSpace(r.PostFormValue("code"))
+
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	// VerifyMFA consumes the mfa token, so get the user for remember me first
+	userName, _ := app.Store.GetUserNameForToken(MFATokenType, mfaToken)
+
+	token, err := app.VerifyMFA(mfaToken, code)
+	if err != nil {
+		logger.Warn("failed to VerifyMFA", "err", err)
+
+		msg := MsgMFAInvalidCode
+		if !errors.Is(err, ErrMFAInvalidCode) {
+			// pending login is no longer valid
+			msg = MsgMFATooManyAttempts
+			http.SetCookie(w, &http.Cookie{
+				Name: MFATokenCookieName, Value: "", Path: "/", MaxAge: -1,
+			})
+		}
+
+		err := RenderTemplate(app.Tmpls, w, "mfa.html", app.mfaPageData(r, mfaToken, msg))
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+			return
+		}
+		return
+	}
+
+	// second factor successful, so replace the mfa cookie with a session
+	http.SetCookie(w, &http.Cookie{
+		Name: MFATokenCookieName, Value: "", Path: "/", MaxAge: -1,
+	})
+	SetSessionCookie(w, token)
+	app.rememberUser(w, r, userName, token)
+
+	redirect := r.URL.Query().Get("r")
+	if redirect == "" {
+		redirect = "/"
+	}
+
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+
+	logger.Info("mfa successful")
+}
+
+// setMFACookie sets the cookie for a pending second factor to token.
+func setMFACookie(w http.ResponseWriter, token Token) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     MFATokenCookieName,
+		Value:    token.Value,
+		Path:     "/",
+		Expires:  token.Expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// mfaPageData returns the page data for the user of mfaToken.
+func (app *App) mfaPageData(r *http.Request, mfaToken, msg string) MFAPageData {
+	pageData := MFAPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), CSPNonce: CSPNonce(r), Message: msg}
+
+	userName, err := app.Store.GetUserNameForToken(MFATokenType, mfaToken)
+	if err == nil {
+		creds, err := app.Store.GetCredentialsForUser(userName)
+		pageData.WebAuthn = err == nil && len(creds) > 0
+	}
+
+	return pageData
+}
+
+// VerifyMFA returns a session Token if code is a valid second factor for the
+// user of mfaToken, which was returned by LoginUser.
+func (app *App) VerifyMFA(mfaToken, code string) (Token, error) {
+	userName, err := app.Store.GetUserNameForToken(MFATokenType, mfaToken)
+	if err != nil {
+		return Token{}, err
+	}
+
+	// limit guesses to prevent brute force of the code
+	since := time.Now().Add(-MFAExpires)
+	failures, err := app.Store.CountEvents(EventMFAVerify, false, userName, since)
+	if err != nil {
+		return Token{}, err
+	}
+	if failures >= MFAMaxAttempts {
+		err := app.Store.RemoveToken(MFATokenType, mfaToken)
+		if err != nil {
+			slog.Error("unable to RemoveToken", "err", err, "userName", userName)
+		}
+		WriteEvent(app.Store, EventMFAVerify, false, userName, ErrMFATooManyAttempts.Error())
+		return Token{}, ErrMFATooManyAttempts
+	}
+
+	secret, enabled, err := app.getTOTPSecret(userName)
+	if err != nil {
+		return Token{}, err
+	}
+
+	// accept either a code from the authenticator app, which is rejected if
+	// already used, or a recovery code
+	valid := false
+	if enabled {
+		valid, err = app.useTOTPCode(userName, secret, code)
+		if err != nil {
+			return Token{}, err
+		}
+	}
+
+	method := "totp"
+	if !valid {
+		used, err := app.UseRecoveryCode(userName, code)
+		if err != nil {
+			return Token{}, err
+		}
+		if !used {
+			WriteEvent(app.Store, EventMFAVerify, false, userName, ErrMFAInvalidCode.Error())
+			return Token{}, ErrMFAInvalidCode
+		}
+		method = "recovery"
+	}
+
+	// pending token is single use
+	err = app.Store.RemoveToken(MFATokenType, mfaToken)
+	if err != nil {
+		return Token{}, err
+	}
+
+	WriteEvent(app.Store, EventMFAVerify, true, userName, method)
+
+	return app.createSession(userName)
+}
+
+// MFAEnabled reports if userName must provide a second factor to login,
+// which is either an authenticator app or a security key.
+func (app *App) MFAEnabled(userName string) (bool, error) {
+	_, enabled, err := app.Store.GetTOTPSecret(userName)
+	if err != nil || enabled {
+		return enabled, err
+	}
+
+	creds, err := app.Store.GetCredentialsForUser(userName)
+	return len(creds) > 0, err
+}
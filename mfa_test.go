@@ -0,0 +1,172 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestMFAHandlerInvalidMethod(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPatch, "/mfa", nil)
+
+	app.MFAHandler(w, r)
+
+	expectedStatus := http.StatusMethodNotAllowed
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+}
+
+func TestMFAHandlerWithoutCookie(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/mfa", nil)
+
+	app.MFAHandler(w, r)
+
+	expectedStatus := http.StatusSeeOther
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	expectedLocation := "/login"
+	if w.Header().Get("Location") != expectedLocation {
+		t.Errorf("got location %q, expected %q", w.Header().Get("Location"), expectedLocation)
+	}
+}
+
+func TestMFAHandlerPostInvalidToken(t *testing.T) {
+	data := url.Values{
+		"code": {"123456"},
+	}
+
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/mfa", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: weblogin.MFATokenCookieName, Value: "foo"})
+
+	app.MFAHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	expectedInBody := weblogin.MsgMFATooManyAttempts
+	if !strings.Contains(w.Body.String(), expectedInBody) {
+		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	}
+}
+
+func TestTOTPHandlerWithoutCookie(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/totp", nil)
+
+	app.TOTPHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	expectedInBody := `You must <a href="/login?r=/totp">Login</a>`
+	if !strings.Contains(w.Body.String(), expectedInBody) {
+		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	}
+}
+
+// totpSecretRE matches the secret to enroll on the TOTP page.
+var totpSecretRE = regexp.MustCompile(`<code>([A-Z2-7]+)</code>`)
+
+// enrollTOTP enables TOTP for userName with the /totp page and returns the
+// secret and the code used to enable it.
+func enrollTOTP(t *testing.T, app *weblogin.App, userName string) (string, string) {
+	// the same secret is shown until it is enabled
+	var secret string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		app.TOTPHandler(w, requestAs(t, app, http.MethodGet, "/totp", nil, userName))
+
+		m := totpSecretRE.FindStringSubmatch(w.Body.String())
+		if m == nil {
+			t.Fatalf("GET got body %q, want secret", w.Body)
+		}
+		if secret != "" && m[1] != secret {
+			t.Fatalf("GET got secret %q, want %q", m[1], secret)
+		}
+		secret = m[1]
+	}
+
+	code, err := weblogin.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Fatalf("TOTPCode failed: %v", err)
+	}
+	w := httptest.NewRecorder()
+	app.TOTPHandler(w, requestAs(t, app, http.MethodPost, "/totp",
+		url.Values{"action": {"enable"}, "code": {code}}, userName))
+	if !strings.Contains(w.Body.String(), weblogin.MsgTOTPEnabled) {
+		t.Fatalf("POST got body %q, want %q", w.Body, weblogin.MsgTOTPEnabled)
+	}
+
+	return secret, code
+}
+
+func TestVerifyMFAReplay(t *testing.T) {
+	app := profileAppForTest(t)
+	app.Cfg.TOTP.Key = base64.StdEncoding.EncodeToString(make([]byte, weblogin.EncryptionKeySize))
+
+	secret, code := enrollTOTP(t, app, "test")
+
+	mfaToken := func() string {
+		token, err := weblogin.SaveNewToken(app.Store, weblogin.MFATokenType, "test", 32, 1)
+		if err != nil {
+			t.Fatalf("SaveNewToken failed: %v", err)
+		}
+		return token.Value
+	}
+
+	// the code used to enable TOTP cannot be used again
+	_, err := app.VerifyMFA(mfaToken(), code)
+	if !errors.Is(err, weblogin.ErrMFAInvalidCode) {
+		t.Errorf("VerifyMFA enroll code got err %v, want %v", err, weblogin.ErrMFAInvalidCode)
+	}
+
+	// the next code is accepted once
+	next, _ := weblogin.TOTPCode(secret, time.Now().Add(weblogin.TOTPPeriod*time.Second))
+	_, err = app.VerifyMFA(mfaToken(), next)
+	if err != nil {
+		t.Errorf("VerifyMFA next code got err %v", err)
+	}
+	_, err = app.VerifyMFA(mfaToken(), next)
+	if !errors.Is(err, weblogin.ErrMFAInvalidCode) {
+		t.Errorf("VerifyMFA replayed code got err %v, want %v", err, weblogin.ErrMFAInvalidCode)
+	}
+}
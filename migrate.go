@@ -0,0 +1,258 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFS contains the migrations for each dialect in
+// migrations/<dialect>/<version>_<name>.<up|down>.sql.
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+var (
+	ErrMigrationName    = errors.New("invalid migration name")
+	ErrMigrationMissing = errors.New("missing migration")
+	ErrMigrationVersion = errors.New("invalid version")
+	ErrSchemaTooNew     = errors.New("schema is newer than supported")
+	ErrSchemaPending    = errors.New("schema migrations pending")
+	ErrMigrationFailed  = errors.New("migration failed")
+	ErrMigrationDialect = errors.New("no migrations for dialect")
+)
+
+// Migration is a numbered change to the schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string // SQL to apply the migration
+	Down    string // SQL to revert the migration
+}
+
+// Migrations returns the migrations for dialect ordered by version.
+func Migrations(dialect string) ([]Migration, error) {
+	fn := "Migrations"
+
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %q", fn, ErrMigrationDialect, dialect)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		// name is of the form 0001_initial.up.sql
+		base, direction, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), ".")
+		vstr, name, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(vstr)
+		if !ok || !found || err != nil || version < 1 || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("%s: %w: %q", fn, ErrMigrationName, entry.Name())
+		}
+
+		b, err := migrationFS.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	// versions must be sequential with both directions
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%s: %w: version %d", fn, ErrMigrationMissing, i+1)
+		}
+	}
+
+	return migrations, nil
+}
+
+// statements splits sql into individual statements, since not every driver
+// allows multiple statements in a single Exec.
+func statements(sql string) []string {
+	var stmts []string
+
+	for _, stmt := range strings.Split(sql, ";") {
+		stmt = strings.TrimSpace(stmt)
+		if stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+
+	return stmts
+}
+
+// SchemaVersion returns the current version of the schema, which is zero
+// if no migrations have been applied. The schema_migrations table is created
+// if it does not exist.
+func (s *SQLStore) SchemaVersion() (int, error) {
+	var version int
+
+	qry := `CREATE TABLE IF NOT EXISTS schema_migrations (version integer NOT NULL PRIMARY KEY, applied timestamp NOT NULL)`
+	_, err := s.exec(qry)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.queryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+
+	return version, err
+}
+
+// LatestSchemaVersion returns the version of the newest known migration.
+func (s *SQLStore) LatestSchemaVersion() (int, error) {
+	migrations, err := Migrations(s.Dialect)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(migrations), nil
+}
+
+// CheckSchema returns the current and latest versions of the schema, with
+// ErrSchemaTooNew if the schema is newer than the newest known migration.
+func (s *SQLStore) CheckSchema() (current, latest int, err error) {
+	fn := "CheckSchema"
+
+	latest, err = s.LatestSchemaVersion()
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	current, err = s.SchemaVersion()
+	if err != nil {
+		return 0, latest, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	if current > latest {
+		return current, latest, fmt.Errorf("%s: %w: version %d, latest %d", fn, ErrSchemaTooNew, current, latest)
+	}
+
+	return current, latest, nil
+}
+
+// Migrate applies up migrations or reverts down migrations until the schema
+// is at target. Each migration is applied in a transaction. If dryRun is
+// true, the SQL of the pending migrations is written to w without being
+// applied, otherwise each migration applied is written to w.
+//
+// MySQL commits each DDL statement, such as ALTER TABLE, as it runs, so the
+// transaction does not cover them. If a migration with several statements
+// fails part way on MySQL, the statements before the failure stay applied
+// but the migration is not recorded, and the schema must be repaired by hand
+// before the migration is retried.
+func (s *SQLStore) Migrate(target int, dryRun bool, w io.Writer) error {
+	fn := "Migrate"
+
+	current, latest, err := s.CheckSchema()
+	if err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	if target < 0 || target > latest {
+		return fmt.Errorf("%s: %w: %d", fn, ErrMigrationVersion, target)
+	}
+
+	migrations, err := Migrations(s.Dialect)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	// up from current+1 to target, or down from current to target+1
+	for current != target {
+		var (
+			m         Migration
+			direction string
+			sql       string
+			next      int
+		)
+		if current < target {
+			m, direction, next = migrations[current], "up", current+1
+			sql = m.Up
+		} else {
+			m, direction, next = migrations[current-1], "down", current-1
+			sql = m.Down
+		}
+
+		if dryRun {
+			fmt.Fprintf(w, "-- %04d_%s.%s.sql\n%s\n", m.Version, m.Name, direction, strings.TrimSpace(sql))
+		} else {
+			err = s.applyMigration(m.Version, direction == "up", sql)
+			if err != nil {
+				return fmt.Errorf("%s: %w: %04d_%s.%s: %v", fn, ErrMigrationFailed, m.Version, m.Name, direction, err)
+			}
+			fmt.Fprintf(w, "%s %04d_%s\n", direction, m.Version, m.Name)
+		}
+
+		current = next
+	}
+
+	return nil
+}
+
+// applyMigration executes sql and records the version in a transaction,
+// which does not undo DDL statements on MySQL, see Migrate.
+func (s *SQLStore) applyMigration(version int, up bool, sql string) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, stmt := range statements(sql) {
+		_, err = tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if up {
+		qry := `INSERT INTO schema_migrations(version, applied) VALUES(?, ?)`
+		_, err = tx.Exec(s.rebind(qry), s.args([]any{version, time.Now()})...)
+	} else {
+		qry := `DELETE FROM schema_migrations WHERE version = ?`
+		_, err = tx.Exec(s.rebind(qry), version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
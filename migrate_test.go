@@ -0,0 +1,144 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestMigrations(t *testing.T) {
+	var latest int
+
+	for _, dialect := range []string{weblogin.DialectMySQL, weblogin.DialectPostgres, weblogin.DialectSQLite} {
+		migrations, err := weblogin.Migrations(dialect)
+		if err != nil {
+			t.Fatalf("Migrations(%q) failed: %v", dialect, err)
+		}
+
+		// each dialect must have the same versions
+		if latest != 0 && len(migrations) != latest {
+			t.Errorf("Migrations(%q) got %d migrations, want %d", dialect, len(migrations), latest)
+		}
+		latest = len(migrations)
+	}
+
+	_, err := weblogin.Migrations("invalid")
+	if !errors.Is(err, weblogin.ErrMigrationDialect) {
+		t.Errorf("got err %v, want %v", err, weblogin.ErrMigrationDialect)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	store, err := weblogin.NewStore("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	defer store.Close()
+	s := store.(*weblogin.SQLStore)
+
+	latest, err := s.LatestSchemaVersion()
+	if err != nil {
+		t.Fatalf("LatestSchemaVersion failed: %v", err)
+	}
+
+	// dry run prints pending SQL without applying it
+	var out strings.Builder
+	err = s.Migrate(latest, true, &out)
+	if err != nil || !strings.Contains(out.String(), "0001_initial.up.sql") {
+		t.Errorf("dry run got %q, %v", out.String(), err)
+	}
+	current, err := s.SchemaVersion()
+	if err != nil || current != 0 {
+		t.Errorf("after dry run got version %d, %v, want 0", current, err)
+	}
+
+	err = s.Migrate(latest, false, io.Discard)
+	if err != nil {
+		t.Fatalf("Migrate up failed: %v", err)
+	}
+	current, err = s.SchemaVersion()
+	if err != nil || current != latest {
+		t.Errorf("after up got version %d, %v, want %d", current, err, latest)
+	}
+
+	err = s.Migrate(latest+1, false, io.Discard)
+	if !errors.Is(err, weblogin.ErrMigrationVersion) {
+		t.Errorf("got err %v, want %v", err, weblogin.ErrMigrationVersion)
+	}
+
+	err = s.Migrate(0, false, io.Discard)
+	if err != nil {
+		t.Fatalf("Migrate down failed: %v", err)
+	}
+	_, err = s.UserExists("test")
+	if err == nil {
+		t.Errorf("users table exists after down migration")
+	}
+
+	// a schema newer than known must be refused
+	_, err = s.DB.Exec(`INSERT INTO schema_migrations(version, applied) VALUES(?, ?)`, latest+1, "2023-01-01 00:00:00")
+	if err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+	_, _, err = s.CheckSchema()
+	if !errors.Is(err, weblogin.ErrSchemaTooNew) {
+		t.Errorf("got err %v, want %v", err, weblogin.ErrSchemaTooNew)
+	}
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	store, err := weblogin.NewStore("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	defer store.Close()
+	s := store.(*weblogin.SQLStore)
+
+	// a database created before migrations, without the later columns
+	for _, qry := range []string{
+		`CREATE TABLE users (userName varchar(30) NOT NULL PRIMARY KEY, fullName varchar(70) NOT NULL, email varchar(256) NOT NULL UNIQUE, hashedPassword varchar(60) NOT NULL, admin boolean NOT NULL DEFAULT false, created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+		`CREATE TABLE tokens (hashedValue char(64) NOT NULL PRIMARY KEY, expires datetime NOT NULL, type varchar(7) NOT NULL, userName varchar(30) NOT NULL, created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+		`CREATE TABLE events (name varchar(10) NOT NULL, result boolean NOT NULL, userName varchar(30) NOT NULL, message varchar(255) NOT NULL DEFAULT '', created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (created, name, userName))`,
+		`INSERT INTO users(userName, fullName, email, hashedPassword) VALUES('test', 'Test User', 'test@email', 'hash')`,
+	} {
+		_, err = s.DB.Exec(qry)
+		if err != nil {
+			t.Fatalf("Exec(%q) failed: %v", qry, err)
+		}
+	}
+
+	latest, err := s.LatestSchemaVersion()
+	if err != nil {
+		t.Fatalf("LatestSchemaVersion failed: %v", err)
+	}
+	err = s.Migrate(latest, false, io.Discard)
+	if err != nil {
+		t.Fatalf("Migrate up failed: %v", err)
+	}
+
+	// the columns added after the baseline exist for the existing user
+	_, enabled, err := s.GetTOTPSecret("test")
+	if err != nil || enabled {
+		t.Errorf("GetTOTPSecret got %v, %v, want false, nil", enabled, err)
+	}
+	_, err = s.GetCredentialsForUser("test")
+	if err != nil {
+		t.Errorf("GetCredentialsForUser failed: %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+CREATE TABLE IF NOT EXISTS `users` (
+  `userName` varchar(30) NOT NULL,
+  `fullName` varchar(70) NOT NULL,
+  `email` varchar(256) NOT NULL,
+  `hashedPassword` binary(60) NOT NULL,
+  `admin` boolean NOT NULL DEFAULT false,
+  `created` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`userName`),
+  UNIQUE KEY `email` (`email`)
+);
+
+CREATE TABLE IF NOT EXISTS `tokens` (
+  `hashedValue` binary(64) NOT NULL,
+  `expires` datetime NOT NULL,
+  `type` varchar(7) NOT NULL,
+  `userName` varchar(30) NOT NULL,
+  `created` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`hashedValue`)
+);
+
+CREATE TABLE IF NOT EXISTS `events` (
+  `name` varchar(10) NOT NULL,
+  `result` boolean NOT NULL,
+  `userName` varchar(30) NOT NULL,
+  `message` varchar(255) NOT NULL DEFAULT '',
+  `created` timestamp(6) NOT NULL DEFAULT current_timestamp,
+  PRIMARY KEY (`created`,`name`,`userName`)
+);
@@ -0,0 +1,4 @@
+DELETE FROM tokens WHERE char_length(type) > 7;
+ALTER TABLE tokens MODIFY COLUMN type varchar(7) NOT NULL;
+ALTER TABLE users DROP COLUMN totpEnabled;
+ALTER TABLE users DROP COLUMN totpSecret;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN totpSecret varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totpEnabled boolean NOT NULL DEFAULT false;
+-- token types such as recovery, webauthn, and reset_used are longer than 7
+ALTER TABLE tokens MODIFY COLUMN type varchar(10) NOT NULL;
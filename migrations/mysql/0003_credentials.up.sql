@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `credentials` (
+  `id` varbinary(1023) NOT NULL,
+  `userName` varchar(30) NOT NULL,
+  `name` varchar(64) NOT NULL DEFAULT '',
+  `publicKey` blob NOT NULL,
+  `signCount` int unsigned NOT NULL DEFAULT 0,
+  `transports` varchar(255) NOT NULL DEFAULT '',
+  `created` timestamp NOT NULL DEFAULT current_timestamp(),
+  `lastUsed` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `userName` (`userName`)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN lockedUntil timestamp NULL DEFAULT NULL;
+ALTER TABLE users ADD COLUMN lockCount integer NOT NULL DEFAULT 0;
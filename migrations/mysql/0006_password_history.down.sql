@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS password_history;
+ALTER TABLE users DROP COLUMN passwordChanged;
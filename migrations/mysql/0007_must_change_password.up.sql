@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN mustChangePassword boolean NOT NULL DEFAULT false;
@@ -1,8 +1,9 @@
-CREATE TABLE `tokens` (
+CREATE TABLE IF NOT EXISTS `email_changes` (
   `hashedValue` binary(64) NOT NULL,
   `expires` datetime NOT NULL,
-  `type` varchar(7) NOT NULL,
+  `type` varchar(10) NOT NULL,
   `userName` varchar(30) NOT NULL,
+  `email` varchar(256) NOT NULL,
   `created` timestamp NOT NULL DEFAULT current_timestamp(),
   PRIMARY KEY (`hashedValue`)
 );
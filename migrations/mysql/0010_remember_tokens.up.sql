@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `remember_tokens` (
+  `selector` char(16) NOT NULL,
+  `hashedValidator` binary(64) NOT NULL,
+  `series` char(16) NOT NULL,
+  `userName` varchar(30) NOT NULL,
+  `expires` datetime NOT NULL,
+  `rotated` timestamp NULL DEFAULT NULL,
+  `created` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`selector`),
+  KEY `series` (`series`)
+);
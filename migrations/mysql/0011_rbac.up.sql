@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS `roles` (
+  `name` varchar(30) NOT NULL,
+  `description` varchar(100) NOT NULL DEFAULT '',
+  `created` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`name`)
+);
+
+CREATE TABLE IF NOT EXISTS `role_permissions` (
+  `role` varchar(30) NOT NULL,
+  `permission` varchar(50) NOT NULL,
+  PRIMARY KEY (`role`, `permission`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_groups` (
+  `name` varchar(30) NOT NULL,
+  `description` varchar(100) NOT NULL DEFAULT '',
+  `created` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`name`)
+);
+
+CREATE TABLE IF NOT EXISTS `group_members` (
+  `groupName` varchar(30) NOT NULL,
+  `userName` varchar(30) NOT NULL,
+  `isLead` boolean NOT NULL DEFAULT false,
+  PRIMARY KEY (`groupName`, `userName`),
+  KEY `userName` (`userName`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_roles` (
+  `userName` varchar(30) NOT NULL,
+  `role` varchar(30) NOT NULL,
+  PRIMARY KEY (`userName`, `role`)
+);
+
+CREATE TABLE IF NOT EXISTS `group_roles` (
+  `groupName` varchar(30) NOT NULL,
+  `role` varchar(30) NOT NULL,
+  PRIMARY KEY (`groupName`, `role`)
+);
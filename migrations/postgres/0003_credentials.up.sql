@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS credentials (
+  id bytea NOT NULL PRIMARY KEY,
+  userName varchar(30) NOT NULL,
+  name varchar(64) NOT NULL DEFAULT '',
+  publicKey bytea NOT NULL,
+  signCount bigint NOT NULL DEFAULT 0,
+  transports varchar(255) NOT NULL DEFAULT '',
+  created timestamp NOT NULL DEFAULT current_timestamp,
+  lastUsed timestamp NULL DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS credentials_userName ON credentials (userName);
@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN emailVerified boolean NOT NULL DEFAULT false;
+-- accounts that existed before verification are trusted
+UPDATE users SET emailVerified = true;
@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN passwordChanged timestamp NULL DEFAULT NULL;
+UPDATE users SET passwordChanged = created;
+
+CREATE TABLE IF NOT EXISTS password_history (
+  userName varchar(30) NOT NULL,
+  hashedPassword varchar(60) NOT NULL,
+  created timestamp(6) NOT NULL DEFAULT current_timestamp,
+  PRIMARY KEY (userName, created)
+);
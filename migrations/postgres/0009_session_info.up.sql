@@ -0,0 +1,3 @@
+ALTER TABLE tokens ADD COLUMN lastSeen timestamp NULL DEFAULT NULL;
+ALTER TABLE tokens ADD COLUMN ip varchar(45) NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN userAgent varchar(255) NOT NULL DEFAULT '';
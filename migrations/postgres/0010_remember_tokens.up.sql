@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS remember_tokens (
+  selector char(16) NOT NULL PRIMARY KEY,
+  hashedValidator char(64) NOT NULL,
+  series char(16) NOT NULL,
+  userName varchar(30) NOT NULL,
+  expires timestamp NOT NULL,
+  rotated timestamp NULL DEFAULT NULL,
+  created timestamp NOT NULL DEFAULT current_timestamp
+);
+
+CREATE INDEX IF NOT EXISTS remember_tokens_series ON remember_tokens (series);
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN totpLastStep bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS events;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS users;
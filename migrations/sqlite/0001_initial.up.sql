@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS users (
+  userName varchar(30) NOT NULL PRIMARY KEY,
+  fullName varchar(70) NOT NULL,
+  email varchar(256) NOT NULL UNIQUE,
+  hashedPassword varchar(60) NOT NULL,
+  admin boolean NOT NULL DEFAULT false,
+  created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+  hashedValue char(64) NOT NULL PRIMARY KEY,
+  expires datetime NOT NULL,
+  type varchar(7) NOT NULL,
+  userName varchar(30) NOT NULL,
+  created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS events (
+  name varchar(10) NOT NULL,
+  result boolean NOT NULL,
+  userName varchar(30) NOT NULL,
+  message varchar(255) NOT NULL DEFAULT '',
+  created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (created, name, userName)
+);
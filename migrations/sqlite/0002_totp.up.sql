@@ -0,0 +1,3 @@
+-- SQLite does not enforce the length of tokens.type, so it is not widened
+ALTER TABLE users ADD COLUMN totpSecret varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totpEnabled boolean NOT NULL DEFAULT false;
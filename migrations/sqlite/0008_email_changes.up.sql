@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS email_changes (
+  hashedValue char(64) NOT NULL PRIMARY KEY,
+  expires datetime NOT NULL,
+  type varchar(10) NOT NULL,
+  userName varchar(30) NOT NULL,
+  email varchar(256) NOT NULL,
+  created timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
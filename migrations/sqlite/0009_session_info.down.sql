@@ -0,0 +1,3 @@
+ALTER TABLE tokens DROP COLUMN userAgent;
+ALTER TABLE tokens DROP COLUMN ip;
+ALTER TABLE tokens DROP COLUMN lastSeen;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS group_roles;
+DROP TABLE IF EXISTS user_roles;
+DROP TABLE IF EXISTS group_members;
+DROP TABLE IF EXISTS user_groups;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
@@ -0,0 +1 @@
+ALTER TABLE tokens ADD COLUMN series char(16) NOT NULL DEFAULT '';
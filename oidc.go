@@ -0,0 +1,411 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the parts of an OpenID Connect provider that do not
+// depend on HTTP: signing keys, JSON Web Tokens, and authorization codes.
+
+const (
+	OIDCCodeExpires     = time.Minute // lifetime of an authorization code
+	OIDCDefaultExpires  = time.Hour   // default lifetime of ID and access tokens
+	OIDCAccessTokenType = "at+jwt"    // JWT typ of access tokens
+)
+
+var (
+	ErrOIDCKey          = errors.New("invalid signing key")
+	ErrOIDCClient       = errors.New("invalid client")
+	ErrOIDCJWT          = errors.New("invalid JWT")
+	ErrOIDCJWTExpired   = errors.New("expired JWT")
+	ErrOIDCCodeNotFound = errors.New("authorization code not found")
+)
+
+// oidcKey is a signing key identified by its JWK thumbprint.
+type oidcKey struct {
+	ID  string
+	Alg string // RS256 or ES256
+	Key crypto.Signer
+}
+
+// oidcCode is the data associated with an authorization code.
+type oidcCode struct {
+	ClientID      string
+	RedirectURI   string
+	UserName      string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	Expires       time.Time
+}
+
+// OIDCProvider is an OpenID Connect provider for the configured clients.
+//
+// Authorization codes are kept in memory, so a code must be redeemed by the
+// same process that issued it.
+type OIDCProvider struct {
+	Issuer  string
+	Expires time.Duration // lifetime of ID and access tokens
+
+	clients map[string]ConfigOIDCClient
+	keys    []oidcKey // the first key is used to sign
+
+	mu    sync.Mutex
+	codes map[string]oidcCode
+}
+
+// NewOIDCProvider returns a new OIDCProvider for cfg. The issuer defaults to
+// baseURL. If no key files are configured, an ephemeral key is generated,
+// which means that tokens cannot be verified after a restart.
+func NewOIDCProvider(cfg ConfigOIDC, baseURL string) (*OIDCProvider, error) {
+	fn := "NewOIDCProvider"
+
+	p := &OIDCProvider{
+		Issuer:  strings.TrimRight(cfg.Issuer, "/"),
+		Expires: time.Duration(cfg.TokenExpiresMinutes) * time.Minute,
+		clients: make(map[string]ConfigOIDCClient, len(cfg.Clients)),
+		codes:   make(map[string]oidcCode),
+	}
+
+	if p.Issuer == "" {
+		p.Issuer = strings.TrimRight(baseURL, "/")
+	}
+
+	if p.Expires == 0 {
+		p.Expires = OIDCDefaultExpires
+	}
+
+	for _, c := range cfg.Clients {
+		if c.ID == "" || len(c.RedirectURIs) == 0 {
+			return nil, fmt.Errorf("%s: %w: %q requires ID and RedirectURIs", fn, ErrOIDCClient, c.ID)
+		}
+		for _, uri := range c.RedirectURIs {
+			u, err := url.Parse(uri)
+			if err != nil || !u.IsAbs() || u.Fragment != "" {
+				return nil, fmt.Errorf("%s: %w: %q has invalid redirect URI %q", fn, ErrOIDCClient, c.ID, uri)
+			}
+		}
+		if _, ok := p.clients[c.ID]; ok {
+			return nil, fmt.Errorf("%s: %w: duplicate %q", fn, ErrOIDCClient, c.ID)
+		}
+		p.clients[c.ID] = c
+	}
+
+	for _, file := range cfg.KeyFiles {
+		key, err := readOIDCKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", fn, ErrOIDCKey, err)
+		}
+		p.keys = append(p.keys, key)
+	}
+
+	if len(p.keys) == 0 {
+		slog.Warn("no OIDC.KeyFiles, generating ephemeral signing key")
+
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", fn, ErrOIDCKey, err)
+		}
+		key, err := newOIDCKey(ecKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w: %v", fn, ErrOIDCKey, err)
+		}
+		p.keys = append(p.keys, key)
+	}
+
+	return p, nil
+}
+
+// readOIDCKey reads a PEM encoded RSA or P-256 private key from file.
+func readOIDCKey(file string) (oidcKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return oidcKey{}, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return oidcKey{}, fmt.Errorf("%s: no PEM data", file)
+	}
+
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return oidcKey{}, fmt.Errorf("%s: %v", file, err)
+	}
+
+	return newOIDCKey(key)
+}
+
+// newOIDCKey returns an oidcKey for a private key.
+func newOIDCKey(key any) (oidcKey, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return oidcKey{}, errors.New("RSA key must be at least 2048 bits")
+		}
+		return oidcKey{ID: jwkThumbprint(k.Public()), Alg: "RS256", Key: k}, nil
+
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return oidcKey{}, errors.New("EC key must use P-256")
+		}
+		return oidcKey{ID: jwkThumbprint(k.Public()), Alg: "ES256", Key: k}, nil
+	}
+
+	return oidcKey{}, fmt.Errorf("unsupported key type %T", key)
+}
+
+// jwk returns the JSON Web Key members of a public key.
+func jwk(pub crypto.PublicKey) map[string]string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA",
+			"n":   base64URL(k.N.Bytes()),
+			"e":   base64URL(big.NewInt(int64(k.E)).Bytes()),
+		}
+
+	case *ecdsa.PublicKey:
+		return map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64URL(k.X.FillBytes(make([]byte, 32))),
+			"y":   base64URL(k.Y.FillBytes(make([]byte, 32))),
+		}
+	}
+
+	return nil
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of a public key, which is
+// used as the key ID.
+func jwkThumbprint(pub crypto.PublicKey) string {
+	// json.Marshal sorts map keys, which gives the required member order
+	b, _ := json.Marshal(jwk(pub))
+	sum := sha256.Sum256(b)
+	return base64URL(sum[:])
+}
+
+// JWKS returns the JSON Web Key Set of all the signing keys, which allows
+// tokens signed by an older key to be verified after a new key is added.
+func (p *OIDCProvider) JWKS() map[string]any {
+	keys := make([]map[string]string, 0, len(p.keys))
+
+	for _, k := range p.keys {
+		key := jwk(k.Key.Public())
+		key["kid"] = k.ID
+		key["alg"] = k.Alg
+		key["use"] = "sig"
+		keys = append(keys, key)
+	}
+
+	return map[string]any{"keys": keys}
+}
+
+// Algorithms returns the signing algorithms of the keys.
+func (p *OIDCProvider) Algorithms() []string {
+	var algs []string
+
+	for _, k := range p.keys {
+		if !StringContains(algs, k.Alg) {
+			algs = append(algs, k.Alg)
+		}
+	}
+
+	return algs
+}
+
+// Client returns the client with id.
+func (p *OIDCProvider) Client(id string) (ConfigOIDCClient, bool) {
+	c, ok := p.clients[id]
+	return c, ok
+}
+
+// SignJWT returns a JWT for claims with typ signed by the current key.
+func (p *OIDCProvider) SignJWT(typ string, claims map[string]any) (string, error) {
+	key := p.keys[0]
+
+	header, err := json.Marshal(map[string]string{
+		"alg": key.Alg, "typ": typ, "kid": key.ID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64URL(header) + "." + base64URL(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+	switch k := key.Key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		// JWS uses the fixed size R || S encoding
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64URL(sig), nil
+}
+
+// VerifyJWT verifies the signature, typ, issuer, and expiration of token
+// and returns the claims.
+func (p *OIDCProvider) VerifyJWT(typ, token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrOIDCJWT
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+		Kid string `json:"kid"`
+	}
+	b, err := decodeBase64URL(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, ErrOIDCJWT
+	}
+	if header.Typ != typ {
+		return nil, ErrOIDCJWT
+	}
+
+	var key *oidcKey
+	for i := range p.keys {
+		if p.keys[i].ID == header.Kid && p.keys[i].Alg == header.Alg {
+			key = &p.keys[i]
+		}
+	}
+	if key == nil {
+		return nil, ErrOIDCJWT
+	}
+
+	sig, err := decodeBase64URL(parts[2])
+	if err != nil {
+		return nil, ErrOIDCJWT
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch k := key.Key.Public().(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return nil, ErrOIDCJWT
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			err = ErrOIDCJWT
+		}
+	}
+	if err != nil {
+		return nil, ErrOIDCJWT
+	}
+
+	var claims map[string]any
+	b, err = decodeBase64URL(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, ErrOIDCJWT
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return nil, ErrOIDCJWT
+	}
+
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Unix() >= int64(exp) {
+		return nil, ErrOIDCJWTExpired
+	}
+
+	return claims, nil
+}
+
+// newCode saves c and returns a new authorization code for it.
+func (p *OIDCProvider) newCode(c oidcCode) (string, error) {
+	code, err := GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	c.Expires = time.Now().Add(OIDCCodeExpires)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// remove expired codes that were never redeemed
+	now := time.Now()
+	for k, v := range p.codes {
+		if v.Expires.Before(now) {
+			delete(p.codes, k)
+		}
+	}
+
+	p.codes[hash(code)] = c
+
+	return code, nil
+}
+
+// redeemCode returns the data for code, which can only be redeemed once.
+func (p *OIDCProvider) redeemCode(code string) (oidcCode, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.codes[hash(code)]
+	if !ok {
+		return oidcCode{}, ErrOIDCCodeNotFound
+	}
+	delete(p.codes, hash(code))
+
+	if c.Expires.Before(time.Now()) {
+		return oidcCode{}, ErrOIDCCodeNotFound
+	}
+
+	return c, nil
+}
@@ -0,0 +1,616 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OIDCScopes are the supported scopes.
+var OIDCScopes = []string{"openid", "profile", "email"}
+
+var ErrOIDCRedirectURI = errors.New("invalid redirect_uri")
+
+// OIDCError is an OAuth 2.0 error returned to the client.
+type OIDCError struct {
+	Code        string
+	Description string
+}
+
+func (e *OIDCError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// oidcAuthRequest is a validated authorization request.
+type oidcAuthRequest struct {
+	Client        ConfigOIDCClient
+	RedirectURI   string
+	State         string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	Prompt        string
+}
+
+// parseAuthRequest validates the authorization request parameters in q.
+// An *OIDCError is returned if the error can be sent to the redirect URI.
+func (p *OIDCProvider) parseAuthRequest(q url.Values) (oidcAuthRequest, error) {
+	var areq oidcAuthRequest
+
+	client, ok := p.Client(q.Get("client_id"))
+	if !ok {
+		return areq, ErrOIDCClient
+	}
+	areq.Client = client
+
+	areq.RedirectURI = q.Get("redirect_uri")
+	if !StringContains(client.RedirectURIs, areq.RedirectURI) {
+		return areq, ErrOIDCRedirectURI
+	}
+
+	areq.State = q.Get("state")
+	areq.Nonce = q.Get("nonce")
+	areq.Prompt = q.Get("prompt")
+
+	if q.Get("response_type") != "code" {
+		return areq, &OIDCError{"unsupported_response_type", "only code is supported"}
+	}
+
+	// only grant supported scopes
+	var scopes []string
+	for _, s := range strings.Fields(q.Get("scope")) {
+		if StringContains(OIDCScopes, s) && !StringContains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if !StringContains(scopes, "openid") {
+		return areq, &OIDCError{"invalid_scope", "openid scope is required"}
+	}
+	areq.Scope = strings.Join(scopes, " ")
+
+	areq.CodeChallenge = q.Get("code_challenge")
+	if areq.CodeChallenge == "" {
+		// public clients cannot keep a secret, so must use PKCE
+		if client.Secret == "" {
+			return areq, &OIDCError{"invalid_request", "code_challenge is required"}
+		}
+	} else {
+		if q.Get("code_challenge_method") != "S256" {
+			return areq, &OIDCError{"invalid_request", "code_challenge_method must be S256"}
+		}
+		if len(areq.CodeChallenge) != 43 {
+			return areq, &OIDCError{"invalid_request", "invalid code_challenge"}
+		}
+	}
+
+	switch areq.Prompt {
+	case "", "none", "consent", "login":
+	default:
+		return areq, &OIDCError{"invalid_request", "unsupported prompt"}
+	}
+
+	return areq, nil
+}
+
+// endSession logs out the user of r by removing the session and remember me
+// login of the request and their cookies.
+func (app *App) endSession(w http.ResponseWriter, r *http.Request) error {
+	rememberValue, err := GetCookieValue(r, RememberCookieName)
+	if err == nil && rememberValue != "" {
+		err = app.Forget(rememberValue)
+	}
+	if err != nil {
+		return err
+	}
+	clearRememberCookie(w)
+
+	sessionTokenValue, err := GetCookieValue(r, SessionTokenCookieName)
+	if err != nil {
+		return err
+	}
+	if sessionTokenValue != "" {
+		err = app.Store.RemoveToken("session", sessionTokenValue)
+		if err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: SessionTokenCookieName, Value: "", Path: "/", MaxAge: -1})
+
+	return nil
+}
+
+// oidcRedirect redirects to redirectURI with params added to the query.
+func oidcRedirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	// redirectURI was validated by NewOIDCProvider
+	u, _ := url.Parse(redirectURI)
+
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// oidcRedirectError redirects to the client with err.
+func oidcRedirectError(w http.ResponseWriter, r *http.Request, areq oidcAuthRequest, err *OIDCError) {
+	params := url.Values{
+		"error":             {err.Code},
+		"error_description": {err.Description},
+	}
+	if areq.State != "" {
+		params.Set("state", areq.State)
+	}
+
+	oidcRedirect(w, r, areq.RedirectURI, params)
+}
+
+// ConsentPageData contains data passed to the HTML template.
+type ConsentPageData struct {
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+	User      User
+	Client    string   // name of the client requesting access
+	Scopes    []string // scopes requested
+	Continue  bool     // reload the page to send the session cookie
+}
+
+const (
+	MsgOIDCInvalidClient      = "The application is not registered."
+	MsgOIDCInvalidRedirectURI = "The application redirect is not registered."
+)
+
+// OIDCAuthorizeHandler handles /authorize requests, which is the
+// authorization endpoint of the OpenID Connect authorization code flow.
+func (app *App) OIDCAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	pageData := ConsentPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r)}
+
+	areq, err := app.OIDC.parseAuthRequest(r.URL.Query())
+	if err != nil {
+		logger.Warn("invalid authorization request", "err", err)
+
+		var oerr *OIDCError
+		if errors.As(err, &oerr) {
+			oidcRedirectError(w, r, areq, oerr)
+			return
+		}
+
+		// the client cannot be trusted, so display the error instead of redirecting
+		pageData.Message = MsgOIDCInvalidClient
+		if errors.Is(err, ErrOIDCRedirectURI) {
+			pageData.Message = MsgOIDCInvalidRedirectURI
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		err = RenderTemplate(app.Tmpls, w, "consent.html", pageData)
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+		}
+		return
+	}
+
+	// prompt=login requires the user to login again, so end any session and
+	// return to the request without prompt after the login
+	loginURI := r.URL.RequestURI()
+	if areq.Prompt == "login" {
+		q := r.URL.Query()
+		q.Del("prompt")
+		loginURI = r.URL.Path + "?" + q.Encode()
+	}
+
+	var user User
+	if areq.Prompt == "login" && r.Method == http.MethodGet {
+		err = app.endSession(w, r)
+		if err != nil {
+			logger.Error("failed to endSession", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		user, err = app.GetUserFromRequest(w, r)
+		if err != nil {
+			logger.Error("failed to GetUser", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if user.UserName == "" {
+		if areq.Prompt == "none" {
+			oidcRedirectError(w, r, areq, &OIDCError{"login_required", "user is not logged in"})
+			return
+		}
+
+		// the SameSite=Strict session cookie is not sent on a cross-site
+		// navigation, so reload from this site before asking for a login
+		if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+			pageData.Continue = true
+			err = RenderTemplate(app.Tmpls, w, "consent.html", pageData)
+			if err != nil {
+				logger.Error("unable to RenderTemplate", "err", err)
+			}
+			return
+		}
+
+		http.Redirect(w, r, "/login?r="+url.QueryEscape(loginURI), http.StatusSeeOther)
+		return
+	}
+
+	switch {
+	case areq.Client.SkipConsent && areq.Prompt != "consent":
+		// trusted client, so consent is not required
+
+	case r.Method == http.MethodPost:
+		if r.PostFormValue("action") != "allow" {
+			logger.Info("consent denied", "user", user, "client", areq.Client.ID)
+			WriteEvent(app.Store, EventOIDCAuth, false, user.UserName, areq.Client.ID+" denied")
+			oidcRedirectError(w, r, areq, &OIDCError{"access_denied", "user denied consent"})
+			return
+		}
+
+	case areq.Prompt == "none":
+		oidcRedirectError(w, r, areq, &OIDCError{"consent_required", "user consent is required"})
+		return
+
+	default:
+		pageData.User = user
+		pageData.Client = areq.Client.Name
+		if pageData.Client == "" {
+			pageData.Client = areq.Client.ID
+		}
+		pageData.Scopes = strings.Fields(areq.Scope)
+
+		err = RenderTemplate(app.Tmpls, w, "consent.html", pageData)
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+		}
+		return
+	}
+
+	code, err := app.OIDC.newCode(oidcCode{
+		ClientID:      areq.Client.ID,
+		RedirectURI:   areq.RedirectURI,
+		UserName:      user.UserName,
+		Scope:         areq.Scope,
+		Nonce:         areq.Nonce,
+		CodeChallenge: areq.CodeChallenge,
+	})
+	if err != nil {
+		logger.Error("failed to create code", "err", err)
+		oidcRedirectError(w, r, areq, &OIDCError{"server_error", "failed to create code"})
+		return
+	}
+
+	WriteEvent(app.Store, EventOIDCAuth, true, user.UserName, areq.Client.ID)
+
+	params := url.Values{"code": {code}}
+	if areq.State != "" {
+		params.Set("state", areq.State)
+	}
+	oidcRedirect(w, r, areq.RedirectURI, params)
+
+	logger.Info("issued authorization code", "user", user, "client", areq.Client.ID)
+}
+
+// writeOIDCError writes an OAuth 2.0 error response.
+func writeOIDCError(w http.ResponseWriter, code int, err *OIDCError) {
+	writeJSON(w, code, map[string]string{
+		"error":             err.Code,
+		"error_description": err.Description,
+	})
+}
+
+// authenticateClient returns the client identified by HTTP Basic
+// authentication or the client_id and client_secret form values.
+func (p *OIDCProvider) authenticateClient(r *http.Request) (ConfigOIDCClient, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+
+	client, ok := p.Client(id)
+	if !ok {
+		return client, ErrOIDCClient
+	}
+
+	// public clients do not have a secret
+	if client.Secret == "" {
+		return client, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1 {
+		return client, ErrOIDCClient
+	}
+
+	return client, nil
+}
+
+// verifyPKCE reports if verifier matches the S256 challenge.
+func verifyPKCE(challenge, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+
+	return subtle.ConstantTimeCompare([]byte(base64URL(sum[:])), []byte(challenge)) == 1
+}
+
+// oidcUserClaims returns the claims about user allowed by scope.
+func oidcUserClaims(user User, scope string) map[string]any {
+	claims := map[string]any{"sub": user.UserName}
+
+	scopes := strings.Fields(scope)
+	if StringContains(scopes, "profile") {
+		claims["name"] = user.FullName
+		claims["preferred_username"] = user.UserName
+	}
+	if StringContains(scopes, "email") {
+		claims["email"] = user.Email
+	}
+
+	return claims
+}
+
+// OIDCTokenHandler handles /token requests, which exchange an authorization
+// code for an ID token and an access token.
+func (app *App) OIDCTokenHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !ValidMethod(w, r, []string{http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	client, err := app.OIDC.authenticateClient(r)
+	if err != nil {
+		logger.Warn("failed to authenticate client", "err", err)
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeOIDCError(w, http.StatusUnauthorized, &OIDCError{"invalid_client", "client authentication failed"})
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		writeOIDCError(w, http.StatusBadRequest, &OIDCError{"unsupported_grant_type", "only authorization_code is supported"})
+		return
+	}
+
+	code, err := app.OIDC.redeemCode(r.PostFormValue("code"))
+	if err == nil && (code.ClientID != client.ID || code.RedirectURI != r.PostFormValue("redirect_uri")) {
+		err = ErrOIDCCodeNotFound
+	}
+	if err == nil && code.CodeChallenge != "" && !verifyPKCE(code.CodeChallenge, r.PostFormValue("code_verifier")) {
+		err = ErrOIDCCodeNotFound
+	}
+	if err != nil {
+		logger.Warn("invalid code", "err", err, "client", client.ID)
+		writeOIDCError(w, http.StatusBadRequest, &OIDCError{"invalid_grant", "invalid code"})
+		return
+	}
+
+	user, err := app.Store.GetUserForName(code.UserName)
+	if err != nil {
+		logger.Error("failed to GetUserForName", "err", err)
+		if errors.Is(err, ErrUserNotFound) {
+			writeOIDCError(w, http.StatusBadRequest, &OIDCError{"invalid_grant", "invalid code"})
+			return
+		}
+		writeOIDCError(w, http.StatusInternalServerError, &OIDCError{"server_error", "failed to get user"})
+		return
+	}
+
+	now := time.Now()
+	exp := now.Add(app.OIDC.Expires)
+
+	idClaims := oidcUserClaims(user, code.Scope)
+	idClaims["iss"] = app.OIDC.Issuer
+	idClaims["aud"] = client.ID
+	idClaims["azp"] = client.ID
+	idClaims["iat"] = now.Unix()
+	idClaims["exp"] = exp.Unix()
+	if code.Nonce != "" {
+		idClaims["nonce"] = code.Nonce
+	}
+
+	idToken, err := app.OIDC.SignJWT("JWT", idClaims)
+	if err != nil {
+		logger.Error("failed to sign ID token", "err", err)
+		writeOIDCError(w, http.StatusInternalServerError, &OIDCError{"server_error", "failed to sign token"})
+		return
+	}
+
+	jti, err := GenerateRandomString(16)
+	if err != nil {
+		logger.Error("failed to GenerateRandomString", "err", err)
+		writeOIDCError(w, http.StatusInternalServerError, &OIDCError{"server_error", "failed to sign token"})
+		return
+	}
+
+	accessToken, err := app.OIDC.SignJWT(OIDCAccessTokenType, map[string]any{
+		"iss":       app.OIDC.Issuer,
+		"sub":       user.UserName,
+		"aud":       app.OIDC.Issuer + "/userinfo",
+		"client_id": client.ID,
+		"scope":     code.Scope,
+		"iat":       now.Unix(),
+		"exp":       exp.Unix(),
+		"jti":       jti,
+	})
+	if err != nil {
+		logger.Error("failed to sign access token", "err", err)
+		writeOIDCError(w, http.StatusInternalServerError, &OIDCError{"server_error", "failed to sign token"})
+		return
+	}
+
+	WriteEvent(app.Store, EventOIDCToken, true, user.UserName, client.ID)
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(app.OIDC.Expires.Seconds()),
+		"id_token":     idToken,
+		"scope":        code.Scope,
+	})
+
+	logger.Info("issued tokens", "user", user, "client", client.ID)
+}
+
+// OIDCUserInfoHandler handles /userinfo requests, which return the claims
+// about the user of the access token.
+func (app *App) OIDCUserInfoHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		writeOIDCError(w, http.StatusUnauthorized, &OIDCError{"invalid_request", "missing bearer token"})
+		return
+	}
+
+	claims, err := app.OIDC.VerifyJWT(OIDCAccessTokenType, token)
+	if err != nil {
+		logger.Warn("invalid access token", "err", err)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOIDCError(w, http.StatusUnauthorized, &OIDCError{"invalid_token", err.Error()})
+		return
+	}
+
+	userName, _ := claims["sub"].(string)
+	scope, _ := claims["scope"].(string)
+
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		logger.Error("failed to GetUserForName", "err", err)
+		if errors.Is(err, ErrUserNotFound) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeOIDCError(w, http.StatusUnauthorized, &OIDCError{"invalid_token", err.Error()})
+			return
+		}
+		writeOIDCError(w, http.StatusInternalServerError, &OIDCError{"server_error", "failed to get user"})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, oidcUserClaims(user, scope))
+
+	logger.Info("OIDCUserInfoHandler", "user", user)
+}
+
+// OIDCDiscoveryHandler handles /.well-known/openid-configuration requests,
+// which return the provider metadata.
+func (app *App) OIDCDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !ValidMethod(w, r, []string{http.MethodGet}) {
+		slog.Error("invalid HTTP method", "method", r.Method)
+		return
+	}
+
+	iss := app.OIDC.Issuer
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/authorize",
+		"token_endpoint":                        iss + "/token",
+		"userinfo_endpoint":                     iss + "/userinfo",
+		"jwks_uri":                              iss + "/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": app.OIDC.Algorithms(),
+		"scopes_supported":                      OIDCScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "name", "preferred_username", "email"},
+	})
+}
+
+// OIDCJWKSHandler handles /jwks.json requests, which return the public keys
+// used to verify tokens.
+func (app *App) OIDCJWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !ValidMethod(w, r, []string{http.MethodGet}) {
+		slog.Error("invalid HTTP method", "method", r.Method)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, app.OIDC.JWKS())
+}
@@ -0,0 +1,373 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// oidcAppForTest returns an App with an OIDC provider that does not need a
+// database for requests without a session.
+func oidcAppForTest(t *testing.T) *weblogin.App {
+	p, err := weblogin.NewOIDCProvider(weblogin.ConfigOIDC{Clients: testOIDCClients}, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpls, err := weblogin.InitTemplates("html/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &weblogin.App{
+		Cfg:   weblogin.Config{Title: "Test", BaseURL: "https://example.com"},
+		Tmpls: tmpls,
+		OIDC:  p,
+	}
+}
+
+const testCodeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+func TestOIDCDisabled(t *testing.T) {
+	app := &weblogin.App{}
+
+	handlers := []http.HandlerFunc{
+		app.OIDCAuthorizeHandler,
+		app.OIDCTokenHandler,
+		app.OIDCUserInfoHandler,
+		app.OIDCDiscoveryHandler,
+		app.OIDCJWKSHandler,
+	}
+
+	for _, handler := range handlers {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		handler(w, r)
+
+		expectedStatus := http.StatusNotFound
+		if w.Code != expectedStatus {
+			t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+		}
+	}
+}
+
+func TestOIDCDiscoveryHandler(t *testing.T) {
+	app := oidcAppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil)
+
+	app.OIDCDiscoveryHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	for _, expectedInBody := range []string{
+		`"issuer":"https://example.com"`,
+		`"jwks_uri":"https://example.com/jwks.json"`,
+		`"code_challenge_methods_supported":["S256"]`,
+	} {
+		if !strings.Contains(w.Body.String(), expectedInBody) {
+			t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+		}
+	}
+}
+
+func TestOIDCJWKSHandler(t *testing.T) {
+	app := oidcAppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/jwks.json", nil)
+
+	app.OIDCJWKSHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	expectedInBody := `"kty":"EC"`
+	if !strings.Contains(w.Body.String(), expectedInBody) {
+		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	}
+}
+
+func TestOIDCAuthorizeHandler(t *testing.T) {
+	app := oidcAppForTest(t)
+
+	testCases := []struct {
+		name          string
+		query         url.Values
+		header        map[string]string
+		wantStatus    int
+		wantLocation  string // prefix of Location header
+		wantInBody    string
+		wantInRawBody string
+	}{
+		{
+			name:       "invalidClient",
+			query:      url.Values{"client_id": {"unknown"}},
+			wantStatus: http.StatusBadRequest,
+			wantInBody: weblogin.MsgOIDCInvalidClient,
+		},
+		{
+			name:       "invalidRedirectURI",
+			query:      url.Values{"client_id": {"app"}, "redirect_uri": {"https://evil.example.com/cb"}},
+			wantStatus: http.StatusBadRequest,
+			wantInBody: weblogin.MsgOIDCInvalidRedirectURI,
+		},
+		{
+			name: "unsupportedResponseType",
+			query: url.Values{
+				"client_id": {"app"}, "redirect_uri": {"https://app.example.com/cb"},
+				"response_type": {"token"}, "scope": {"openid"}, "state": {"xyz"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://app.example.com/cb?error=unsupported_response_type",
+		},
+		{
+			name: "missingOpenID",
+			query: url.Values{
+				"client_id": {"app"}, "redirect_uri": {"https://app.example.com/cb"},
+				"response_type": {"code"}, "scope": {"email"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://app.example.com/cb?error=invalid_scope",
+		},
+		{
+			name: "publicClientWithoutPKCE",
+			query: url.Values{
+				"client_id": {"spa"}, "redirect_uri": {"https://spa.example.com/cb"},
+				"response_type": {"code"}, "scope": {"openid"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://spa.example.com/cb?error=invalid_request",
+		},
+		{
+			name: "plainPKCE",
+			query: url.Values{
+				"client_id": {"spa"}, "redirect_uri": {"https://spa.example.com/cb"},
+				"response_type": {"code"}, "scope": {"openid"},
+				"code_challenge": {testCodeChallenge}, "code_challenge_method": {"plain"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://spa.example.com/cb?error=invalid_request",
+		},
+		{
+			name: "notLoggedIn",
+			query: url.Values{
+				"client_id": {"spa"}, "redirect_uri": {"https://spa.example.com/cb"},
+				"response_type": {"code"}, "scope": {"openid"},
+				"code_challenge": {testCodeChallenge}, "code_challenge_method": {"S256"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "/login?r=%2Fauthorize%3F",
+		},
+		{
+			name: "notLoggedInPromptNone",
+			query: url.Values{
+				"client_id": {"app"}, "redirect_uri": {"https://app.example.com/cb"},
+				"response_type": {"code"}, "scope": {"openid"}, "prompt": {"none"}, "state": {"xyz"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "https://app.example.com/cb?error=login_required",
+		},
+		{
+			name: "notLoggedInPromptLogin",
+			query: url.Values{
+				"client_id": {"app"}, "redirect_uri": {"https://app.example.com/cb"},
+				"response_type": {"code"}, "scope": {"openid"}, "prompt": {"login"},
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "/login?r=%2Fauthorize%3Fclient_id%3Dapp%26redirect_uri",
+		},
+		{
+			name: "notLoggedInCrossSite",
+			query: url.Values{
+				"client_id": {"app"}, "redirect_uri": {"https://app.example.com/cb"},
+				"response_type": {"code"}, "scope": {"openid"},
+			},
+			header:        map[string]string{"Sec-Fetch-Site": "cross-site"},
+			wantStatus:    http.StatusOK,
+			wantInRawBody: `<meta http-equiv="refresh" content="0">`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/authorize?"+tc.query.Encode(), nil)
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+
+			app.OIDCAuthorizeHandler(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), tc.wantStatus, http.StatusText(tc.wantStatus))
+			}
+
+			location := w.Header().Get("Location")
+			if !strings.HasPrefix(location, tc.wantLocation) {
+				t.Errorf("got location %q, expected prefix %q", location, tc.wantLocation)
+			}
+			if strings.Contains(location, "error=") && tc.query.Get("state") != "" && !strings.Contains(location, "state=xyz") {
+				t.Errorf("got location %q, expected state", location)
+			}
+
+			if !strings.Contains(w.Body.String(), tc.wantInBody) {
+				t.Errorf("got body %q, expected %q in body", w.Body, tc.wantInBody)
+			}
+			if !strings.Contains(w.Body.String(), tc.wantInRawBody) {
+				t.Errorf("got body %q, expected %q in body", w.Body, tc.wantInRawBody)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthorizeHandlerPromptLogin(t *testing.T) {
+	app := profileAppForTest(t)
+	app.OIDC = oidcAppForTest(t).OIDC
+
+	q := url.Values{
+		"client_id": {"app"}, "redirect_uri": {"https://app.example.com/cb"},
+		"response_type": {"code"}, "scope": {"openid"}, "prompt": {"login"},
+	}
+	r := requestAs(t, app, http.MethodGet, "/authorize?"+q.Encode(), nil, "test")
+	w := httptest.NewRecorder()
+
+	app.OIDCAuthorizeHandler(w, r)
+
+	// the logged in user must login again, without prompt after the login
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	q.Del("prompt")
+	want := "/login?r=" + url.QueryEscape("/authorize?"+q.Encode())
+	if loc := w.Header().Get("Location"); loc != want {
+		t.Errorf("got Location %q, want %q", loc, want)
+	}
+
+	// the session was ended
+	cookie, err := r.Cookie(weblogin.SessionTokenCookieName)
+	if err != nil {
+		t.Fatalf("missing session cookie: %v", err)
+	}
+	user, _, err := app.GetUserForSessionToken(cookie.Value)
+	if err == nil || user.UserName != "" {
+		t.Errorf("got user %q, %v for ended session", user.UserName, err)
+	}
+}
+
+func TestOIDCTokenHandler(t *testing.T) {
+	app := oidcAppForTest(t)
+
+	testCases := []struct {
+		name       string
+		form       url.Values
+		basicAuth  []string
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "unknownClient",
+			form:       url.Values{"client_id": {"unknown"}, "grant_type": {"authorization_code"}},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid_client",
+		},
+		{
+			name:       "wrongSecret",
+			form:       url.Values{"grant_type": {"authorization_code"}},
+			basicAuth:  []string{"app", "wrong"},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid_client",
+		},
+		{
+			name:       "unsupportedGrantType",
+			form:       url.Values{"client_id": {"app"}, "client_secret": {"secret"}, "grant_type": {"password"}},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "unsupported_grant_type",
+		},
+		{
+			name:       "invalidCode",
+			form:       url.Values{"grant_type": {"authorization_code"}, "code": {"invalid"}},
+			basicAuth:  []string{"app", "secret"},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "publicClientInvalidCode",
+			form:       url.Values{"client_id": {"spa"}, "grant_type": {"authorization_code"}, "code": {"invalid"}},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_grant",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(tc.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tc.basicAuth != nil {
+				r.SetBasicAuth(tc.basicAuth[0], tc.basicAuth[1])
+			}
+
+			app.OIDCTokenHandler(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), tc.wantStatus, http.StatusText(tc.wantStatus))
+			}
+
+			expectedInBody := `"error":"` + tc.wantError + `"`
+			if !strings.Contains(w.Body.String(), expectedInBody) {
+				t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+			}
+
+			if w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("got Cache-Control %q, expected no-store", w.Header().Get("Cache-Control"))
+			}
+		})
+	}
+}
+
+func TestOIDCUserInfoHandlerInvalidToken(t *testing.T) {
+	app := oidcAppForTest(t)
+
+	for _, auth := range []string{"", "Bearer invalid", "Basic dGVzdDp0ZXN0"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/userinfo", nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+
+		app.OIDCUserInfoHandler(w, r)
+
+		expectedStatus := http.StatusUnauthorized
+		if w.Code != expectedStatus {
+			t.Errorf("%q: got status %d %q, expected %d %q", auth, w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+		}
+
+		if !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%q: got WWW-Authenticate %q, expected Bearer", auth, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// writeKeyFile writes key as a PKCS #8 PEM file and returns the file name.
+func writeKeyFile(t *testing.T, key any) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "key.pem")
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func newTestKeyFiles(t *testing.T) (string, string) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writeKeyFile(t, rsaKey), writeKeyFile(t, ecKey)
+}
+
+var testOIDCClients = []weblogin.ConfigOIDCClient{
+	{ID: "app", Secret: "secret", RedirectURIs: []string{"https://app.example.com/cb"}},
+	{ID: "spa", RedirectURIs: []string{"https://spa.example.com/cb"}},
+}
+
+func TestNewOIDCProvider(t *testing.T) {
+	rsaFile, ecFile := newTestKeyFiles(t)
+
+	testCases := []struct {
+		name    string
+		cfg     weblogin.ConfigOIDC
+		wantErr error
+		algs    []string
+	}{
+		{
+			name: "ephemeral",
+			cfg:  weblogin.ConfigOIDC{Clients: testOIDCClients},
+			algs: []string{"ES256"},
+		},
+		{
+			name: "keyFiles",
+			cfg:  weblogin.ConfigOIDC{KeyFiles: []string{rsaFile, ecFile}, Clients: testOIDCClients},
+			algs: []string{"RS256", "ES256"},
+		},
+		{
+			name:    "missingKeyFile",
+			cfg:     weblogin.ConfigOIDC{KeyFiles: []string{"testdata/missing.pem"}},
+			wantErr: weblogin.ErrOIDCKey,
+		},
+		{
+			name: "missingRedirectURIs",
+			cfg: weblogin.ConfigOIDC{
+				Clients: []weblogin.ConfigOIDCClient{{ID: "app"}},
+			},
+			wantErr: weblogin.ErrOIDCClient,
+		},
+		{
+			name: "relativeRedirectURI",
+			cfg: weblogin.ConfigOIDC{
+				Clients: []weblogin.ConfigOIDCClient{{ID: "app", RedirectURIs: []string{"/cb"}}},
+			},
+			wantErr: weblogin.ErrOIDCClient,
+		},
+		{
+			name: "duplicateClient",
+			cfg: weblogin.ConfigOIDC{
+				Clients: append(testOIDCClients, testOIDCClients[0]),
+			},
+			wantErr: weblogin.ErrOIDCClient,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := weblogin.NewOIDCProvider(tc.cfg, "https://example.com/")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if p.Issuer != "https://example.com" {
+				t.Errorf("got Issuer %q, want %q", p.Issuer, "https://example.com")
+			}
+
+			got := strings.Join(p.Algorithms(), ",")
+			want := strings.Join(tc.algs, ",")
+			if got != want {
+				t.Errorf("got Algorithms %q, want %q", got, want)
+			}
+
+			keys := p.JWKS()["keys"].([]map[string]string)
+			if len(keys) != len(tc.cfg.KeyFiles) && len(tc.cfg.KeyFiles) != 0 {
+				t.Errorf("got %d keys, want %d", len(keys), len(tc.cfg.KeyFiles))
+			}
+			for _, k := range keys {
+				if len(k["kid"]) != 43 {
+					t.Errorf("got kid %q, want 43 character thumbprint", k["kid"])
+				}
+			}
+		})
+	}
+}
+
+func TestOIDCProviderJWT(t *testing.T) {
+	rsaFile, ecFile := newTestKeyFiles(t)
+
+	old, err := weblogin.NewOIDCProvider(weblogin.ConfigOIDC{KeyFiles: []string{rsaFile}}, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated provider signs with the new key and still publishes the old key
+	rotated, err := weblogin.NewOIDCProvider(weblogin.ConfigOIDC{KeyFiles: []string{ecFile, rsaFile}}, "https://example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]any{
+		"iss": "https://example.com",
+		"sub": "test",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+
+	for name, p := range map[string]*weblogin.OIDCProvider{"old": old, "rotated": rotated} {
+		token, err := p.SignJWT("JWT", claims)
+		if err != nil {
+			t.Fatalf("%s: SignJWT got err %v", name, err)
+		}
+
+		got, err := rotated.VerifyJWT("JWT", token)
+		if err != nil {
+			t.Fatalf("%s: VerifyJWT got err %v", name, err)
+		}
+		if got["sub"] != "test" {
+			t.Errorf("%s: got sub %v, want %q", name, got["sub"], "test")
+		}
+
+		_, err = rotated.VerifyJWT(weblogin.OIDCAccessTokenType, token)
+		if !errors.Is(err, weblogin.ErrOIDCJWT) {
+			t.Errorf("%s: wrong typ got err %v, want %v", name, err, weblogin.ErrOIDCJWT)
+		}
+
+		parts := strings.Split(token, ".")
+		tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+		_, err = rotated.VerifyJWT("JWT", tampered)
+		if !errors.Is(err, weblogin.ErrOIDCJWT) {
+			t.Errorf("%s: tampered got err %v, want %v", name, err, weblogin.ErrOIDCJWT)
+		}
+	}
+
+	// token signed by the new key cannot be verified without it
+	token, _ := rotated.SignJWT("JWT", claims)
+	_, err = old.VerifyJWT("JWT", token)
+	if !errors.Is(err, weblogin.ErrOIDCJWT) {
+		t.Errorf("unknown key got err %v, want %v", err, weblogin.ErrOIDCJWT)
+	}
+
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	token, _ = rotated.SignJWT("JWT", claims)
+	_, err = rotated.VerifyJWT("JWT", token)
+	if !errors.Is(err, weblogin.ErrOIDCJWTExpired) {
+		t.Errorf("expired got err %v, want %v", err, weblogin.ErrOIDCJWTExpired)
+	}
+
+	claims["exp"] = time.Now().Add(time.Minute).Unix()
+	claims["iss"] = "https://other.example.com"
+	token, _ = rotated.SignJWT("JWT", claims)
+	_, err = rotated.VerifyJWT("JWT", token)
+	if !errors.Is(err, weblogin.ErrOIDCJWT) {
+		t.Errorf("wrong issuer got err %v, want %v", err, weblogin.ErrOIDCJWT)
+	}
+}
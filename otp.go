@@ -0,0 +1,153 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // RFC 6238 default and what authenticator apps expect
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Values used for TOTP codes, which are the defaults from RFC 6238 and
+// the values supported by most authenticator apps.
+const (
+	TOTPDigits     = 6  // number of digits in a code
+	TOTPPeriod     = 30 // seconds each code is valid
+	TOTPSkew       = 1  // number of periods before or after now to accept
+	TOTPSecretSize = 20 // number of random bytes in a secret
+)
+
+var ErrTOTPInvalidSecret = errors.New("invalid TOTP secret")
+
+// totpEncoding is base32 without padding, as used in otpauth URIs.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random base32 encoded TOTP secret.
+func GenerateTOTPSecret() (string, error) {
+	b := make([]byte, TOTPSecretSize)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// hotp returns the RFC 4226 HOTP value for key and counter.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod)
+}
+
+// decodeTOTPSecret decodes a base32 secret, ignoring case and spaces.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	secret = strings.TrimRight(secret, "=")
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrTOTPInvalidSecret
+	}
+
+	return key, nil
+}
+
+// TOTPCode returns the TOTP code for the base32 encoded secret at time t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, uint64(t.Unix()/TOTPPeriod)), nil
+}
+
+// ValidTOTP reports if code is valid for the base32 encoded secret at time t,
+// allowing for TOTPSkew periods of clock drift.
+func ValidTOTP(secret, code string, t time.Time) bool {
+	_, valid := TOTPStep(secret, code, t)
+	return valid
+}
+
+// TOTPStep returns the time step of code for the base32 encoded secret at
+// time t and true if code is valid, allowing for TOTPSkew periods of clock
+// drift. The step is used to reject a code that was already used, as
+// recommended by RFC 6238 section 5.2.
+func TOTPStep(secret, code string, t time.Time) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	counter := t.Unix() / TOTPPeriod
+
+	var step int64
+	valid := false
+	for i := int64(-TOTPSkew); i <= TOTPSkew; i++ {
+		want := hotp(key, uint64(counter+i))
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			step, valid = counter+i, true
+		}
+	}
+
+	return step, valid
+}
+
+// TOTPURI returns the otpauth URI used by authenticator apps to enroll the
+// secret for the account at issuer.
+func TOTPURI(issuer, account, secret string) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + issuer + ":" + account,
+	}
+
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(TOTPDigits))
+	q.Set("period", fmt.Sprint(TOTPPeriod))
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// rfc6238Secret is the base32 encoding of the SHA1 secret used in RFC 6238.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B test vectors truncated to six digits
+	testCases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tc := range testCases {
+		got, err := weblogin.TOTPCode(rfc6238Secret, time.Unix(tc.unix, 0))
+		if err != nil {
+			t.Errorf("TOTPCode(%q, %d) got err %v", rfc6238Secret, tc.unix, err)
+		}
+		if got != tc.want {
+			t.Errorf("TOTPCode(%q, %d) = %q, want %q", rfc6238Secret, tc.unix, got, tc.want)
+		}
+	}
+}
+
+func TestTOTPCodeInvalidSecret(t *testing.T) {
+	_, err := weblogin.TOTPCode("not base32!", time.Now())
+	if err == nil {
+		t.Errorf("TOTPCode with invalid secret got nil err")
+	}
+}
+
+func TestValidTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	period := weblogin.TOTPPeriod * time.Second
+
+	code := func(t time.Time) string {
+		c, _ := weblogin.TOTPCode(rfc6238Secret, t)
+		return c
+	}
+
+	testCases := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"current", code(now), true},
+		{"previous", code(now.Add(-period)), true},
+		{"next", code(now.Add(period)), true},
+		{"tooOld", code(now.Add(-2 * period)), false},
+		{"tooNew", code(now.Add(2 * period)), false},
+		{"empty", "", false},
+		{"short", "12345", false},
+		{"withSpace", code(now)[:3] + " " + code(now)[3:], true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := weblogin.ValidTOTP(rfc6238Secret, tc.code, now)
+			if got != tc.want {
+				t.Errorf("ValidTOTP(%q, %q) = %v, want %v", rfc6238Secret, tc.code, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := weblogin.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret() got err %v", err)
+	}
+
+	_, err = weblogin.TOTPCode(secret, time.Now())
+	if err != nil {
+		t.Errorf("TOTPCode(%q) got err %v", secret, err)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := weblogin.TOTPURI("Go Weblogin", "test", rfc6238Secret)
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("url.Parse(%q) got err %v", uri, err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Go Weblogin:test" {
+		t.Errorf("got %q, want otpauth://totp/Go Weblogin:test", uri)
+	}
+
+	q := u.Query()
+	if q.Get("secret") != rfc6238Secret || q.Get("issuer") != "Go Weblogin" {
+		t.Errorf("got query %v, want secret %q and issuer %q", q, rfc6238Secret, "Go Weblogin")
+	}
+}
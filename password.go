@@ -0,0 +1,330 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordDefaultMinLength = 8
+	PasswordMaxBytes         = 72 // bcrypt ignores bytes after 72
+)
+
+// userInfoMinLength is the minimum length of a username or email to reject
+// in a password, so short values do not reject most passwords.
+const userInfoMinLength = 3
+
+// breachedListMinHexChars is the shortest hash prefix in a BreachedList.
+const breachedListMinHexChars = 5
+
+const (
+	MsgPasswordTooShort    = "Password must be at least %d characters."
+	MsgPasswordTooLong     = "Password must be at most %d bytes."
+	MsgPasswordNeedsUpper  = "Password must contain an uppercase letter."
+	MsgPasswordNeedsLower  = "Password must contain a lowercase letter."
+	MsgPasswordNeedsDigit  = "Password must contain a digit."
+	MsgPasswordNeedsSymbol = "Password must contain a symbol."
+	MsgPasswordHasUserInfo = "Password must not contain your User Name or Email."
+	MsgPasswordBreached    = "Password has appeared in a data breach. Please choose another."
+	MsgPasswordReused      = "Password must differ from your last %d passwords."
+	MsgPasswordTooRecent   = "Password was changed too recently. Please try again later."
+)
+
+var (
+	ErrPasswordReused      = errors.New("password used recently")
+	ErrPasswordTooRecent   = errors.New("password changed too recently")
+	ErrPasswordHashFailed  = errors.New("failed to hash password")
+	ErrBreachedListRead    = errors.New("failed to read breached password list")
+	ErrBreachedListInvalid = errors.New("invalid breached password list")
+)
+
+// BreachedList is a sorted list of hex encoded SHA-1 hashes, or prefixes of
+// the hashes, of passwords known to be breached.
+type BreachedList struct {
+	hashes    []string
+	prefixLen int
+}
+
+// LoadBreachedList reads a BreachedList from filename, which has one hex
+// encoded SHA-1 hash or hash prefix per line in ascending order. Every line
+// must have the same length. Anything after a colon, such as a count, is
+// ignored, as are blank lines.
+//
+// Shorter prefixes make the file smaller, but reject more passwords that
+// were not breached.
+func LoadBreachedList(filename string) (*BreachedList, error) {
+	fn := "LoadBreachedList"
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", fn, ErrBreachedListRead, err)
+	}
+	defer f.Close()
+
+	var list BreachedList
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if hash == "" {
+			continue
+		}
+		hash = strings.ToUpper(hash)
+
+		if list.prefixLen == 0 {
+			list.prefixLen = len(hash)
+			if list.prefixLen < breachedListMinHexChars || list.prefixLen > sha1.Size*2 {
+				return nil, fmt.Errorf("%s: %w: line %d: length %d", fn, ErrBreachedListInvalid, line, len(hash))
+			}
+		}
+
+		if len(hash) != list.prefixLen {
+			return nil, fmt.Errorf("%s: %w: line %d: length %d, want %d", fn, ErrBreachedListInvalid, line, len(hash), list.prefixLen)
+		}
+		if strings.Trim(hash, "0123456789ABCDEF") != "" {
+			return nil, fmt.Errorf("%s: %w: line %d: not hex", fn, ErrBreachedListInvalid, line)
+		}
+		if n := len(list.hashes); n > 0 && hash < list.hashes[n-1] {
+			return nil, fmt.Errorf("%s: %w: line %d: not sorted", fn, ErrBreachedListInvalid, line)
+		}
+
+		list.hashes = append(list.hashes, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", fn, ErrBreachedListRead, err)
+	}
+
+	return &list, nil
+}
+
+// Contains returns true if the SHA-1 hash of password is in the list.
+func (l *BreachedList) Contains(password string) bool {
+	if l == nil || len(l.hashes) == 0 {
+		return false
+	}
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))[:l.prefixLen]
+
+	i := sort.SearchStrings(l.hashes, hash)
+	return i < len(l.hashes) && l.hashes[i] == hash
+}
+
+// Len returns the number of hashes in the list.
+func (l *BreachedList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.hashes)
+}
+
+// maxLength returns the maximum length of a password in bytes.
+func (c ConfigPassword) maxLength() int {
+	if c.MaxLength == 0 || c.MaxLength > PasswordMaxBytes {
+		return PasswordMaxBytes
+	}
+	return c.MaxLength
+}
+
+// minLength returns the minimum length of a password in characters.
+func (c ConfigPassword) minLength() int {
+	if c.MinLength == 0 {
+		return PasswordDefaultMinLength
+	}
+	return c.MinLength
+}
+
+// containsUserInfo returns true if password contains userName or the local
+// part of email, ignoring case.
+func containsUserInfo(password, userName, email string) bool {
+	password = strings.ToLower(password)
+
+	local, _, _ := strings.Cut(email, "@")
+	for _, s := range []string{userName, local} {
+		if len(s) >= userInfoMinLength && strings.Contains(password, strings.ToLower(s)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckPassword returns a message for each way password violates the
+// password policy for the user with userName and email, or nil if it is
+// acceptable.
+func (app *App) CheckPassword(password, userName, email string) []string {
+	cfg := app.Cfg.Password
+
+	var msgs []string
+
+	if n := cfg.minLength(); utf8.RuneCountInString(password) < n {
+		msgs = append(msgs, fmt.Sprintf(MsgPasswordTooShort, n))
+	}
+	if n := cfg.maxLength(); len(password) > n {
+		msgs = append(msgs, fmt.Sprintf(MsgPasswordTooLong, n))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if cfg.RequireUpper && !upper {
+		msgs = append(msgs, MsgPasswordNeedsUpper)
+	}
+	if cfg.RequireLower && !lower {
+		msgs = append(msgs, MsgPasswordNeedsLower)
+	}
+	if cfg.RequireDigit && !digit {
+		msgs = append(msgs, MsgPasswordNeedsDigit)
+	}
+	if cfg.RequireSymbol && !symbol {
+		msgs = append(msgs, MsgPasswordNeedsSymbol)
+	}
+
+	if !cfg.AllowUserInfo && containsUserInfo(password, userName, email) {
+		msgs = append(msgs, MsgPasswordHasUserInfo)
+	}
+
+	if app.Breached.Contains(password) {
+		msgs = append(msgs, MsgPasswordBreached)
+	}
+
+	return msgs
+}
+
+// passwordReused returns true if password matches the current password of
+// userName or one of the previous passwords within History.
+func (app *App) passwordReused(userName, password string) (bool, error) {
+	current, err := app.Store.GetPasswordHash(userName)
+	if err != nil {
+		return false, err
+	}
+
+	previous, err := app.Store.GetPasswordHistory(userName, app.Cfg.Password.History-1)
+	if err != nil {
+		return false, err
+	}
+
+	for _, hash := range append([]string{current}, previous...) {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ChangePassword sets the password for userName. It returns
+// ErrPasswordTooRecent if the password changed within MinAgeHours, unless
+// the user must change it, and ErrPasswordReused if password is one of the
+// last History passwords.
+//
+// The caller is responsible for checking the password with CheckPassword.
+func (app *App) ChangePassword(userName, password string) error {
+	return app.changePassword(userName, password, func(hashedPassword string, keep int) error {
+		// keep the current password in the history before replacing it
+		if keep > 0 {
+			current, err := app.Store.GetPasswordHash(userName)
+			if err != nil {
+				return err
+			}
+
+			err = app.Store.AddPasswordHistory(userName, current, keep)
+			if err != nil {
+				return err
+			}
+		}
+
+		return app.Store.SetPasswordHash(userName, hashedPassword)
+	})
+}
+
+// changePassword checks password for userName as described by ChangePassword
+// and calls set with the hashed password to store it, which must also add the
+// current password to the history if keep is positive.
+func (app *App) changePassword(userName, password string, set func(hashedPassword string, keep int) error) error {
+	fn := "ChangePassword"
+
+	cfg := app.Cfg.Password
+
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	// a required change is allowed regardless of the minimum age
+	minAge := time.Duration(cfg.MinAgeHours) * time.Hour
+	if minAge > 0 && !user.MustChangePassword && time.Since(user.PasswordChanged) < minAge {
+		WriteEvent(app.Store, EventPassAge, false, userName, "changed "+user.PasswordChanged.Format(time.RFC3339))
+		return ErrPasswordTooRecent
+	}
+
+	if cfg.History > 0 {
+		reused, err := app.passwordReused(userName, password)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fn, err)
+		}
+		if reused {
+			WriteEvent(app.Store, EventPassReuse, false, userName, fmt.Sprintf("within last %d", cfg.History))
+			return ErrPasswordReused
+		}
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", fn, ErrPasswordHashFailed, err)
+	}
+
+	// the current password is one of the last History passwords
+	err = set(string(hashedPassword), max(cfg.History-1, 0))
+	if err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+
+	return nil
+}
+
+// passwordChangeMessage returns the message to display for an error from
+// ChangePassword, or "" if the error should not be displayed.
+func passwordChangeMessage(err error, cfg ConfigPassword) string {
+	switch {
+	case errors.Is(err, ErrPasswordReused):
+		return fmt.Sprintf(MsgPasswordReused, cfg.History)
+	case errors.Is(err, ErrPasswordTooRecent):
+		return MsgPasswordTooRecent
+	}
+
+	return ""
+}
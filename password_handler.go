@@ -0,0 +1,151 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+const (
+	MsgPasswordChanged       = "Your password has been changed. You have been logged out of other sessions."
+	MsgCurrentPasswordFailed = "Current password is incorrect."
+)
+
+// PasswordPageData contains data passed to the HTML template.
+type PasswordPageData struct {
+	Title     string
+	Message   string
+	Changed   bool   // password was changed
+	CSRFToken string // see CSRFHandler
+	User      User
+}
+
+// PasswordHandler handles /password requests, where a logged in user can
+// change their password by providing the current password.
+func (app *App) PasswordHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil {
+		logger.Error("failed to GetUser", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if user.UserName == "" {
+		http.Redirect(w, r, "/login?r=/password", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		err := RenderTemplate(app.Tmpls, w, "password.html",
+			PasswordPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), User: user})
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+			return
+		}
+		logger.Info("PasswordHandler")
+
+	case http.MethodPost:
+		app.passwordPost(w, r, user)
+	}
+}
+
+// passwordPost is called for the POST method of the PasswordHandler.
+func (app *App) passwordPost(w http.ResponseWriter, r *http.Request, user User) {
+	current := strings.TrimSpace(r.PostFormValue("current"))
+	password1 := strings.TrimSpace(r.PostFormValue("password1"))
+	password2 := strings.TrimSpace(r.PostFormValue("password2"))
+
+	logger := slog.With(
+		slog.Group("request",
+			slog.String("id", GetReqID(r.Context())),
+			slog.String("remoteAddr", GetRealRemoteAddr(r)),
+			slog.String("method", r.Method),
+			slog.String("url", r.RequestURI),
+		),
+		"userName", user.UserName,
+	)
+
+	pageData := PasswordPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), User: user}
+
+	var msgs []string
+	switch {
+	case IsEmpty(current, password1, password2):
+		msgs = []string{MsgMissingRequired}
+	case password1 != password2:
+		msgs = []string{MsgPasswordsDifferent}
+	case CompareUserPassword(app.Store, user.UserName, current) != nil:
+		WriteEvent(app.Store, EventPassChange, false, user.UserName, "current password incorrect")
+		msgs = []string{MsgCurrentPasswordFailed}
+	default:
+		msgs = app.CheckPassword(password1, user.UserName, user.Email)
+	}
+	if msgs == nil {
+		err := app.ChangePassword(user.UserName, password1)
+		if msg := passwordChangeMessage(err, app.Cfg.Password); msg != "" {
+			msgs = []string{msg}
+		} else if err != nil {
+			logger.Error("failed to ChangePassword", "err", err)
+			WriteEvent(app.Store, EventPassChange, false, user.UserName, err.Error())
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if msgs != nil {
+		logger.Warn("password not changed", "msgs", msgs)
+		pageData.Message = strings.Join(msgs, " ")
+		err := RenderTemplate(app.Tmpls, w, "password.html", pageData)
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+		}
+		return
+	}
+
+	// keep only the session of this request
+	sessionToken, err := GetCookieValue(r, SessionTokenCookieName)
+	if err == nil {
+		err = app.Store.RemoveOtherTokensForUser("session", user.UserName, sessionToken)
+	}
+	if err != nil {
+		logger.Error("failed to remove other sessions", "err", err)
+	}
+	err = app.Store.RemoveRememberTokensForUser(user.UserName)
+	if err != nil {
+		logger.Error("failed to RemoveRememberTokensForUser", "err", err)
+	}
+
+	WriteEvent(app.Store, EventPassChange, true, user.UserName, "success")
+	logger.Info("password changed")
+
+	pageData.Message = MsgPasswordChanged
+	pageData.Changed = true
+	err = RenderTemplate(app.Tmpls, w, "password.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+}
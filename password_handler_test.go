@@ -0,0 +1,162 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestPasswordHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		session   bool
+		data      url.Values
+		wantCode  int
+		wantBody  string
+		wantLogin string // password that must work after the request
+	}{
+		{
+			name:     "not logged in",
+			data:     url.Values{},
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:      "missing",
+			session:   true,
+			data:      url.Values{"current": {"password"}},
+			wantCode:  http.StatusOK,
+			wantBody:  weblogin.MsgMissingRequired,
+			wantLogin: "password",
+		},
+		{
+			name:      "different",
+			session:   true,
+			data:      url.Values{"current": {"password"}, "password1": {"new password"}, "password2": {"other password"}},
+			wantCode:  http.StatusOK,
+			wantBody:  weblogin.MsgPasswordsDifferent,
+			wantLogin: "password",
+		},
+		{
+			name:      "wrong current",
+			session:   true,
+			data:      url.Values{"current": {"wrong"}, "password1": {"new password"}, "password2": {"new password"}},
+			wantCode:  http.StatusOK,
+			wantBody:  weblogin.MsgCurrentPasswordFailed,
+			wantLogin: "password",
+		},
+		{
+			name:      "success",
+			session:   true,
+			data:      url.Values{"current": {"password"}, "password1": {"new password"}, "password2": {"new password"}},
+			wantCode:  http.StatusOK,
+			wantBody:  weblogin.MsgPasswordChanged,
+			wantLogin: "new password",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := *AppForTest(t)
+			a.Store = weblogin.NewMemStore()
+			app := &a
+
+			err := seedStore(app.Store)
+			if err != nil {
+				t.Fatalf("cannot seed Store, %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/password", strings.NewReader(tc.data.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			if tc.session {
+				token, err := weblogin.SaveNewToken(app.Store, "session", "test", 32, 1)
+				if err != nil {
+					t.Fatalf("SaveNewToken failed: %v", err)
+				}
+				r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+			}
+
+			app.PasswordHandler(w, r)
+
+			if w.Code != tc.wantCode || !strings.Contains(w.Body.String(), tc.wantBody) {
+				t.Errorf("got status %d, body %q, want status %d, %q in body", w.Code, w.Body, tc.wantCode, tc.wantBody)
+			}
+
+			if tc.wantLogin != "" {
+				err = weblogin.CompareUserPassword(app.Store, "test", tc.wantLogin)
+				if err != nil {
+					t.Errorf("CompareUserPassword(%q) got err %v", tc.wantLogin, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordHandlerRemovesOtherSessions(t *testing.T) {
+	a := *AppForTest(t)
+	a.Store = weblogin.NewMemStore()
+	app := &a
+
+	err := seedStore(app.Store)
+	if err != nil {
+		t.Fatalf("cannot seed Store, %v", err)
+	}
+
+	current, err := weblogin.SaveNewToken(app.Store, "session", "test", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+	other, err := weblogin.SaveNewToken(app.Store, "session", "test", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+	admin, err := weblogin.SaveNewToken(app.Store, "session", "admin", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+
+	data := url.Values{"current": {"password"}, "password1": {"new password"}, "password2": {"new password"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/password", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: current.Value})
+
+	app.PasswordHandler(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgPasswordChanged) {
+		t.Fatalf("got status %d, body %q", w.Code, w.Body)
+	}
+
+	if _, err := app.Store.GetUserNameForToken("session", current.Value); err != nil {
+		t.Errorf("current session got err %v, want nil", err)
+	}
+	if _, err := app.Store.GetUserNameForToken("session", other.Value); err == nil {
+		t.Errorf("other session was not removed")
+	}
+	if _, err := app.Store.GetUserNameForToken("session", admin.Value); err != nil {
+		t.Errorf("session of another user got err %v, want nil", err)
+	}
+
+	count, err := app.Store.CountEvents(weblogin.EventPassChange, true, "test", time.Time{})
+	if err != nil || count != 1 {
+		t.Errorf("got %d events, %v, want 1", count, err)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// writeBreachedList writes lines to a file and returns the filename.
+func writeBreachedList(t *testing.T, lines ...string) string {
+	filename := filepath.Join(t.TempDir(), "breached.txt")
+
+	err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")), 0o600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	return filename
+}
+
+func TestLoadBreachedList(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		wantErr error
+		wantLen int
+	}{
+		// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+		{"full hashes", []string{"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:100", "7C4A8D09CA3762AF61E59520943DC26494F8941B"}, nil, 2},
+		{"prefixes", []string{"5baa6", "", "7c4a8"}, nil, 2},
+		{"mixed length", []string{"5BAA6", "7C4A8D"}, weblogin.ErrBreachedListInvalid, 0},
+		{"too short", []string{"5BAA"}, weblogin.ErrBreachedListInvalid, 0},
+		{"not hex", []string{"ZZZZZ"}, weblogin.ErrBreachedListInvalid, 0},
+		{"not sorted", []string{"7C4A8", "5BAA6"}, weblogin.ErrBreachedListInvalid, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			list, err := weblogin.LoadBreachedList(writeBreachedList(t, tc.lines...))
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got err %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if list.Len() != tc.wantLen {
+				t.Errorf("got len %d, want %d", list.Len(), tc.wantLen)
+			}
+			if !list.Contains("password") || list.Contains("not breached") {
+				t.Errorf("Contains returned unexpected result")
+			}
+		})
+	}
+
+	_, err := weblogin.LoadBreachedList(filepath.Join(t.TempDir(), "missing"))
+	if !errors.Is(err, weblogin.ErrBreachedListRead) {
+		t.Errorf("missing file got err %v, want %v", err, weblogin.ErrBreachedListRead)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	list, err := weblogin.LoadBreachedList(writeBreachedList(t, "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"))
+	if err != nil {
+		t.Fatalf("LoadBreachedList failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		cfg      weblogin.ConfigPassword
+		password string
+		want     []string
+	}{
+		{"default ok", weblogin.ConfigPassword{}, "correct horse", nil},
+		{"default short", weblogin.ConfigPassword{}, "a", []string{fmt.Sprintf(weblogin.MsgPasswordTooShort, weblogin.PasswordDefaultMinLength)}},
+		{"min length", weblogin.ConfigPassword{MinLength: 20}, "correct horse", []string{fmt.Sprintf(weblogin.MsgPasswordTooShort, 20)}},
+		{"multibyte length", weblogin.ConfigPassword{MinLength: 4}, "ééé", []string{fmt.Sprintf(weblogin.MsgPasswordTooShort, 4)}},
+		{"bcrypt max", weblogin.ConfigPassword{}, strings.Repeat("x", 73), []string{fmt.Sprintf(weblogin.MsgPasswordTooLong, weblogin.PasswordMaxBytes)}},
+		{"max length", weblogin.ConfigPassword{MaxLength: 10}, "correct horse", []string{fmt.Sprintf(weblogin.MsgPasswordTooLong, 10)}},
+		{
+			"classes",
+			weblogin.ConfigPassword{RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true},
+			"correcthorse",
+			[]string{weblogin.MsgPasswordNeedsUpper, weblogin.MsgPasswordNeedsDigit, weblogin.MsgPasswordNeedsSymbol},
+		},
+		{
+			"classes ok",
+			weblogin.ConfigPassword{RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true},
+			"Correct horse 1",
+			nil,
+		},
+		{"username", weblogin.ConfigPassword{}, "my JSmith pass", []string{weblogin.MsgPasswordHasUserInfo}},
+		{"email", weblogin.ConfigPassword{}, "john.smith!", []string{weblogin.MsgPasswordHasUserInfo}},
+		{"user info allowed", weblogin.ConfigPassword{AllowUserInfo: true}, "my jsmith pass", nil},
+		{"breached", weblogin.ConfigPassword{}, "password", []string{weblogin.MsgPasswordBreached}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := *AppForTest(t)
+			app.Cfg.Password = tc.cfg
+			app.Breached = list
+
+			got := app.CheckPassword(tc.password, "jsmith", "john.smith@email")
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegisterHandlerPasswordPolicy(t *testing.T) {
+	app := AppForTest(t)
+
+	data := url.Values{
+		"userName":  {"policy"},
+		"fullName":  {"full name"},
+		"email":     {"policy@email"},
+		"password1": {"short"},
+		"password2": {"short"},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.RegisterHandler(w, r)
+
+	want := fmt.Sprintf(weblogin.MsgPasswordTooShort, weblogin.PasswordDefaultMinLength)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got status %d, body %q, want %q in body", w.Code, w.Body, want)
+	}
+
+	exists, err := app.Store.UserExists("policy")
+	if err != nil || exists {
+		t.Errorf("UserExists got %v, %v, want false", exists, err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	a := *AppForTest(t)
+	a.Store = weblogin.NewMemStore()
+	a.Cfg.Password = weblogin.ConfigPassword{History: 3}
+	app := &a
+
+	err := seedStore(app.Store)
+	if err != nil {
+		t.Fatalf("cannot seed Store, %v", err)
+	}
+
+	steps := []struct {
+		password string
+		want     error
+	}{
+		{"password", weblogin.ErrPasswordReused}, // current password
+		{"password one", nil},
+		{"password two", nil},
+		{"password", weblogin.ErrPasswordReused},
+		{"password one", weblogin.ErrPasswordReused},
+		{"password three", nil},
+		{"password", nil}, // no longer in the last 3
+	}
+
+	for _, step := range steps {
+		err := app.ChangePassword("test", step.password)
+		if !errors.Is(err, step.want) {
+			t.Errorf("ChangePassword(%q) got err %v, want %v", step.password, err, step.want)
+		}
+	}
+
+	err = weblogin.CompareUserPassword(app.Store, "test", "password")
+	if err != nil {
+		t.Errorf("CompareUserPassword got err %v", err)
+	}
+
+	count, err := app.Store.CountEvents(weblogin.EventPassReuse, false, "test", time.Time{})
+	if err != nil || count != 3 {
+		t.Errorf("got %d reuse events, %v, want 3", count, err)
+	}
+
+	app.Cfg.Password = weblogin.ConfigPassword{MinAgeHours: 24}
+	err = app.ChangePassword("test", "password four")
+	if !errors.Is(err, weblogin.ErrPasswordTooRecent) {
+		t.Errorf("ChangePassword within MinAgeHours got err %v, want %v", err, weblogin.ErrPasswordTooRecent)
+	}
+}
+
+func TestResetHandlerPasswordReused(t *testing.T) {
+	a := *AppForTest(t)
+	a.Store = weblogin.NewMemStore()
+	a.Cfg.Password = weblogin.ConfigPassword{History: 12}
+	app := &a
+
+	err := seedStore(app.Store)
+	if err != nil {
+		t.Fatalf("cannot seed Store, %v", err)
+	}
+
+	token, err := weblogin.SaveNewToken(app.Store, "reset", "test", 12, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+
+	data := url.Values{
+		"rtoken":    {token.Value},
+		"password1": {"password"},
+		"password2": {"password"},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/reset", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.ResetHandler(w, r)
+
+	want := fmt.Sprintf(weblogin.MsgPasswordReused, 12)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got status %d, body %q, want %q in body", w.Code, w.Body, want)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"log/slog"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// If Config.PrivacyMode is true, the login, register, and forgot pages
+// respond the same way, and in about the same time, whether or not an
+// account exists. Anything specific to an account is sent by email, which
+// only the owner of the email address can read.
+
+// dummyHash returns a bcrypt hash with the default cost that is compared
+// when there is no password hash, so the comparison takes the same time.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// compareDummyPassword takes the time of checking password for an account
+// that does not exist or is not checked.
+func compareDummyPassword(password string) {
+	_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+}
+
+// hashDummyPassword takes the time of hashing password for an account that
+// is not created.
+func hashDummyPassword(password string) {
+	_, _ = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// MaxBackgroundEmails is the most emails sent in the background at once.
+// Another email waits until one of them is sent, so a flood of requests
+// cannot start an unbounded number of sends.
+const MaxBackgroundEmails = 16
+
+// background limits and tracks the emails sent in the background.
+var background = struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}{slots: make(chan struct{}, MaxBackgroundEmails)}
+
+// deliver calls send to send an email. In privacy mode, send is called in
+// the background by deliverBackground, so the response does not depend on
+// the account or the mail server.
+func (app *App) deliver(send func() error) error {
+	if !app.Cfg.PrivacyMode {
+		return send()
+	}
+
+	deliverBackground(send)
+
+	return nil
+}
+
+// deliverBackground calls send in the background and only logs an error,
+// waiting first if MaxBackgroundEmails are being sent.
+func deliverBackground(send func() error) {
+	background.slots <- struct{}{}
+	background.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-background.slots
+			background.wg.Done()
+		}()
+
+		err := send()
+		if err != nil {
+			slog.Error("failed to send email", "err", err)
+		}
+	}()
+}
+
+// WaitForEmails waits until the emails being sent in the background are
+// sent, such as before the program exits.
+func WaitForEmails() {
+	background.wg.Wait()
+}
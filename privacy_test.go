@@ -0,0 +1,160 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// privacyAppForTest returns an App with a new Store in privacy mode.
+func privacyAppForTest(t *testing.T) *weblogin.App {
+	app := profileAppForTest(t)
+	app.Cfg.PrivacyMode = true
+	return app
+}
+
+// postForm calls handler with a POST of data and returns the response.
+func postForm(handler http.HandlerFunc, target string, data url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	handler(w, r)
+
+	return w
+}
+
+func TestRegisterPrivacyMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		userName string
+		email    string
+		required bool // VerifyEmail.Required
+	}{
+		{"new user", "newuser", "new@email", false},
+		{"new user verify", "newuser", "new@email", true},
+		{"existing user", "test", "new@email", false},
+		{"existing email", "newuser", "test@email", false},
+		{"existing user and email", "test", "test@email", true},
+	}
+
+	var want string
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := privacyAppForTest(t)
+			app.Cfg.VerifyEmail.Required = tc.required
+
+			w := postForm(app.RegisterHandler, "/register", url.Values{
+				"userName":  {tc.userName},
+				"fullName":  {"full name"},
+				"email":     {tc.email},
+				"password1": {"password one"},
+				"password2": {"password one"},
+			})
+
+			body := w.Body.String()
+			if w.Code != http.StatusOK || !strings.Contains(body, weblogin.MsgRegisterSent) {
+				t.Fatalf("got status %d, body %q, want %q in body", w.Code, body, weblogin.MsgRegisterSent)
+			}
+			if want == "" {
+				want = body
+			}
+			if body != want {
+				t.Errorf("got body %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestForgotPrivacyMode(t *testing.T) {
+	app := privacyAppForTest(t)
+
+	// the email is sent in the background, so a failure to send is hidden
+	var want string
+	for _, email := range []string{"test@email", "unknown@email"} {
+		w := postForm(app.ForgotHandler, "/forgot", url.Values{
+			"email":  {email},
+			"action": {"password"},
+		})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", email, w.Code, http.StatusOK)
+		}
+		if want == "" {
+			want = w.Body.String()
+		}
+		if w.Body.String() != want {
+			t.Errorf("%s: got body %q, want %q", email, w.Body, want)
+		}
+	}
+}
+
+func TestVerifyPrivacyMode(t *testing.T) {
+	app := verifyAppForTest(t)
+	app.Cfg.PrivacyMode = true
+	mailer := &testMailer{}
+	app.Mailer = mailer
+
+	// the lookup and email are in the background, so the response is the same
+	var want string
+	for _, email := range []string{"new@email", "test@email", "unknown@email"} {
+		w := postForm(app.VerifyHandler, "/verify", url.Values{"email": {email}})
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d, want %d", email, w.Code, http.StatusOK)
+		}
+		if want == "" {
+			want = w.Body.String()
+		}
+		if w.Body.String() != want {
+			t.Errorf("%s: got body %q, want %q", email, w.Body, want)
+		}
+	}
+
+	weblogin.WaitForEmails()
+
+	for email, n := range map[string]int{"new@email": 1, "test@email": 0, "unknown@email": 0} {
+		if got := len(mailer.sent(email)); got != n {
+			t.Errorf("%s: got %d emails, want %d", email, got, n)
+		}
+	}
+}
+
+func TestLoginPrivacyMode(t *testing.T) {
+	app := privacyAppForTest(t)
+	app.Cfg.Lockout = weblogin.ConfigLockout{MaxFailures: 1, WindowMinutes: 10, DurationMinutes: 10}
+
+	// lock the test account
+	_, err := app.LoginUser("test", "wrong")
+	if err == nil {
+		t.Fatalf("LoginUser with wrong password succeeded")
+	}
+
+	for _, userName := range []string{"test", "unknown"} {
+		w := postForm(app.LoginHandler, "/login", url.Values{
+			"username": {userName},
+			"password": {"password"},
+		})
+
+		if !strings.Contains(w.Body.String(), weblogin.MsgLoginFailed) ||
+			strings.Contains(w.Body.String(), weblogin.MsgLoginLocked) {
+			t.Errorf("%s: got body %q, want %q", userName, w.Body, weblogin.MsgLoginFailed)
+		}
+	}
+}
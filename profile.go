@@ -0,0 +1,389 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Email change token types and how long they are valid. The revert link is
+// sent to the old address once the new address is confirmed.
+const (
+	EmailChangeTokenType = "email"
+	EmailRevertTokenType = "email_rev"
+	EmailChangeExpires   = 24 * time.Hour
+	EmailRevertExpires   = 7 * 24 * time.Hour
+)
+
+var (
+	ErrEmailChangeTokenBad   = errors.New("invalid email change token")
+	ErrEmailChangeSaveFailed = errors.New("failed to save email change")
+	ErrEmailChangeSendFailed = errors.New("failed to send email change")
+)
+
+const (
+	MsgFullNameChanged  = "Your Full Name has been changed."
+	MsgEmailChangeSent  = "A confirmation link has been sent to the new Email Address."
+	MsgEmailChangeSame  = "The new Email Address is the same as the current one."
+	MsgEmailChanged     = "Your Email Address has been changed."
+	MsgEmailReverted    = "Your Email Address has been restored and all sessions have been logged out. Please login and change your password."
+	MsgProfileFailed    = "Your profile could not be changed. Please try again later."
+	MsgEmailLinkInvalid = "The email link is invalid or expired."
+)
+
+// ProfilePageData contains data passed to the HTML template.
+type ProfilePageData struct {
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+	User      User
+	Action    string // confirm or revert for an email change link
+	LinkToken string // token of an email change link to POST
+}
+
+// RequestEmailChange sends a link to email that changes the email address of
+// userName when visited. Links sent previously are no longer valid.
+// ErrStoreDuplicate is returned if email is already registered.
+func (app *App) RequestEmailChange(userName, email string) error {
+	fn := "RequestEmailChange"
+
+	exists, err := app.Store.EmailExists(email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+	if exists {
+		WriteEvent(app.Store, EventEmailReq, false, userName, "email already exists")
+		return ErrStoreDuplicate
+	}
+
+	err = app.Store.RemoveEmailChangesForUser(EmailChangeTokenType, userName)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", fn, ErrEmailChangeSaveFailed, err)
+	}
+
+	token, err := app.saveEmailChange(EmailChangeTokenType, userName, email, EmailChangeExpires)
+	if err != nil {
+		WriteEvent(app.Store, EventEmailReq, false, userName, err.Error())
+		return fmt.Errorf("%s: %w: %v", fn, ErrEmailChangeSaveFailed, err)
+	}
+
+	subj := app.Cfg.Title + " confirm email change"
+	emailText := fmt.Sprintf("Please visit %s/email?confirm=%s within %d hours to use this email address for %s",
+		app.Cfg.BaseURL, url.QueryEscape(token.Value), int(EmailChangeExpires.Hours()), app.Cfg.Title)
+
+	err = app.sendEmail(email, subj, emailText)
+	if err != nil {
+		WriteEvent(app.Store, EventEmailReq, false, userName, err.Error())
+		return fmt.Errorf("%s: %w: %v", fn, ErrEmailChangeSendFailed, err)
+	}
+
+	WriteEvent(app.Store, EventEmailReq, true, userName, email)
+
+	return nil
+}
+
+// saveEmailChange creates and saves a token of tType that sets the email
+// address of userName to email.
+func (app *App) saveEmailChange(tType, userName, email string, d time.Duration) (Token, error) {
+	var err error
+
+	token := Token{Type: tType, Expires: time.Now().Add(d)}
+	token.Value, err = GenerateRandomString(32)
+	if err != nil {
+		return Token{}, err
+	}
+
+	return token, app.Store.SaveEmailChange(userName, email, token)
+}
+
+// ConfirmEmailChange sets the email address for the user of an email change
+// token and returns the userName. A link to revert the change is sent to the
+// old address. ErrStoreDuplicate is returned if the address was registered
+// since the change was requested.
+func (app *App) ConfirmEmailChange(tokenValue string) (string, error) {
+	userName, email, err := app.Store.ConsumeEmailChange(EmailChangeTokenType, tokenValue)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return "", ErrEmailChangeTokenBad
+		}
+		return "", err
+	}
+
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.setEmail(userName, email, EventEmailChange)
+	if err != nil {
+		return "", err
+	}
+
+	// notify the old address, which may revert the change
+	token, err := app.saveEmailChange(EmailRevertTokenType, userName, user.Email, EmailRevertExpires)
+	if err != nil {
+		slog.Error("failed to save email revert", "err", err, "userName", userName)
+		return userName, nil
+	}
+
+	subj := app.Cfg.Title + " email address changed"
+	emailText := fmt.Sprintf("The email address for %s was changed to %s. If you did not make this change, please visit %s/email?revert=%s within %d days to restore this email address.",
+		app.Cfg.Title, email, app.Cfg.BaseURL, url.QueryEscape(token.Value), int(EmailRevertExpires.Hours()/24))
+
+	err = app.sendEmail(user.Email, subj, emailText)
+	if err != nil {
+		slog.Error("failed to send email change notice", "err", err, "userName", userName)
+	}
+
+	return userName, nil
+}
+
+// RevertEmailChange restores the old email address for the user of an email
+// revert token and returns the userName. Since the change may not have been
+// made by the user, all sessions and pending email changes are removed.
+func (app *App) RevertEmailChange(tokenValue string) (string, error) {
+	userName, email, err := app.Store.ConsumeEmailChange(EmailRevertTokenType, tokenValue)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return "", ErrEmailChangeTokenBad
+		}
+		return "", err
+	}
+
+	err = app.setEmail(userName, email, EventEmailRevert)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.Store.RemoveEmailChangesForUser(EmailChangeTokenType, userName)
+	if err != nil {
+		slog.Error("failed to RemoveEmailChangesForUser", "err", err, "userName", userName)
+	}
+
+	err = app.Store.RemoveTokensForUser("session", userName)
+	if err != nil {
+		slog.Error("failed to RemoveTokensForUser", "err", err, "userName", userName)
+	}
+	err = app.Store.RemoveRememberTokensForUser(userName)
+	if err != nil {
+		slog.Error("failed to RemoveRememberTokensForUser", "err", err, "userName", userName)
+	}
+
+	return userName, nil
+}
+
+// setEmail sets the verified email address of userName and writes event.
+func (app *App) setEmail(userName, email, event string) error {
+	err := app.Store.SetEmail(userName, email)
+	if err == nil {
+		// the address was verified by using the link
+		err = app.Store.SetEmailVerified(userName, true)
+	}
+	if err != nil {
+		WriteEvent(app.Store, event, false, userName, err.Error())
+		return err
+	}
+
+	WriteEvent(app.Store, event, true, userName, email)
+
+	return nil
+}
+
+// ProfileHandler handles /profile requests, where a logged in user can
+// change their full name, or request an email change with their current
+// password. It is meant to be wrapped by RequireLogin, and wraps itself if
+// the request has no user from RequireLogin.
+func (app *App) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		app.RequireLogin(http.HandlerFunc(app.ProfileHandler)).ServeHTTP(w, r)
+		return
+	}
+
+	pageData := ProfilePageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), User: user}
+
+	if r.Method == http.MethodPost {
+		pageData.Message = app.profilePost(r, user, logger)
+
+		// show the updated values
+		var err error
+		pageData.User, err = app.Store.GetUserForName(user.UserName)
+		if err != nil {
+			logger.Error("failed to GetUserForName", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err := RenderTemplate(app.Tmpls, w, "profile.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+}
+
+// EmailLinkHandler handles /email requests for the confirm and revert links
+// of an email change, which do not require a login. The GET of a link shows
+// a form to POST the token, so following the link, such as by an email
+// scanner, does not change the email address.
+func (app *App) EmailLinkHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	pageData := ProfilePageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r)}
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		for _, action := range []string{"confirm", "revert"} {
+			if q.Get(action) != "" {
+				pageData.Action, pageData.LinkToken = action, q.Get(action)
+				break
+			}
+		}
+		if pageData.LinkToken == "" {
+			pageData.Message = MsgEmailLinkInvalid
+		}
+
+	case http.MethodPost:
+		pageData.Message = app.emailLinkPost(r, logger)
+	}
+
+	err := RenderTemplate(app.Tmpls, w, "profile.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+}
+
+// emailLinkPost uses the confirm or revert token of an email change link
+// and returns the message to display.
+func (app *App) emailLinkPost(r *http.Request, logger *slog.Logger) string {
+	var (
+		userName string
+		err      error
+		msg      string
+	)
+
+	tokenValue := r.PostFormValue("token")
+	switch r.PostFormValue("action") {
+	case "confirm":
+		userName, err = app.ConfirmEmailChange(tokenValue)
+		msg = MsgEmailChanged
+	case "revert":
+		userName, err = app.RevertEmailChange(tokenValue)
+		msg = MsgEmailReverted
+	default:
+		return MsgEmailLinkInvalid
+	}
+
+	switch {
+	case errors.Is(err, ErrEmailChangeTokenBad):
+		logger.Warn("invalid email link", "err", err)
+		msg = MsgEmailLinkInvalid
+	case errors.Is(err, ErrStoreDuplicate):
+		logger.Warn("email already exists", "userName", userName)
+		msg = MsgEmailExists
+	case err != nil:
+		logger.Error("failed to change email", "err", err)
+		msg = MsgProfileFailed
+	default:
+		logger.Info("email changed", "userName", userName, "msg", msg)
+	}
+
+	return msg
+}
+
+// profilePost handles the POST method of the ProfileHandler for user and
+// returns the message to display.
+func (app *App) profilePost(r *http.Request, user User, logger *slog.Logger) string {
+	logger = logger.With("userName", user.UserName)
+
+	switch r.PostFormValue("action") {
+	case "name":
+		fullName := strings.TrimSpace(r.PostFormValue("fullName"))
+		if fullName == "" {
+			return MsgMissingRequired
+		}
+
+		err := app.Store.SetFullName(user.UserName, fullName)
+		if err != nil {
+			logger.Error("failed to SetFullName", "err", err)
+			WriteEvent(app.Store, EventProfile, false, user.UserName, err.Error())
+			return MsgProfileFailed
+		}
+
+		WriteEvent(app.Store, EventProfile, true, user.UserName, "full name")
+		logger.Info("full name changed")
+		return MsgFullNameChanged
+
+	case "email":
+		email := strings.TrimSpace(r.PostFormValue("email"))
+		password := r.PostFormValue("password")
+		switch {
+		case email == "":
+			return MsgMissingEmail
+		case password == "":
+			return MsgMissingPassword
+		case strings.EqualFold(email, user.Email):
+			return MsgEmailChangeSame
+		case CompareUserPassword(app.Store, user.UserName, password) != nil:
+			WriteEvent(app.Store, EventEmailReq, false, user.UserName, "current password incorrect")
+			logger.Warn("current password incorrect")
+			return MsgCurrentPasswordFailed
+		}
+
+		err := app.RequestEmailChange(user.UserName, email)
+		switch {
+		case errors.Is(err, ErrStoreDuplicate):
+			logger.Warn("email already exists", "email", email)
+			return MsgEmailExists
+		case err != nil:
+			logger.Error("failed to RequestEmailChange", "err", err)
+			return MsgProfileFailed
+		}
+
+		logger.Info("email change requested", "email", email)
+		return MsgEmailChangeSent
+
+	default:
+		return MsgInvalidAction
+	}
+}
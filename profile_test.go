@@ -0,0 +1,255 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// profileAppForTest returns an App with a new Store.
+func profileAppForTest(t *testing.T) *weblogin.App {
+	a := *AppForTest(t)
+	a.Store = weblogin.NewMemStore()
+
+	err := seedStore(a.Store)
+	if err != nil {
+		t.Fatalf("cannot seed Store, %v", err)
+	}
+
+	return &a
+}
+
+func TestProfileHandlerPost(t *testing.T) {
+	tests := []struct {
+		name         string
+		session      bool
+		data         url.Values
+		wantCode     int
+		wantBody     string
+		wantFullName string
+	}{
+		{
+			name:     "not logged in",
+			data:     url.Values{"action": {"name"}, "fullName": {"New Name"}},
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:         "full name",
+			session:      true,
+			data:         url.Values{"action": {"name"}, "fullName": {" New Name "}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgFullNameChanged,
+			wantFullName: "New Name",
+		},
+		{
+			name:         "missing full name",
+			session:      true,
+			data:         url.Values{"action": {"name"}, "fullName": {""}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgMissingRequired,
+			wantFullName: "Test User",
+		},
+		{
+			name:         "same email",
+			session:      true,
+			data:         url.Values{"action": {"email"}, "email": {"test@email"}, "password": {"password"}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgEmailChangeSame,
+			wantFullName: "Test User",
+		},
+		{
+			name:         "email missing password",
+			session:      true,
+			data:         url.Values{"action": {"email"}, "email": {"new@email"}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgMissingPassword,
+			wantFullName: "Test User",
+		},
+		{
+			name:         "email wrong password",
+			session:      true,
+			data:         url.Values{"action": {"email"}, "email": {"new@email"}, "password": {"wrong"}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgCurrentPasswordFailed,
+			wantFullName: "Test User",
+		},
+		{
+			name:         "email change",
+			session:      true,
+			data:         url.Values{"action": {"email"}, "email": {"new@email"}, "password": {"password"}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgEmailChangeSent,
+			wantFullName: "Test User",
+		},
+		{
+			name:         "duplicate email",
+			session:      true,
+			data:         url.Values{"action": {"email"}, "email": {"admin@email"}, "password": {"password"}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgEmailExists,
+			wantFullName: "Test User",
+		},
+		{
+			name:         "invalid action",
+			session:      true,
+			data:         url.Values{"action": {"invalid"}},
+			wantCode:     http.StatusOK,
+			wantBody:     weblogin.MsgInvalidAction,
+			wantFullName: "Test User",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := profileAppForTest(t)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/profile", strings.NewReader(tc.data.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			if tc.session {
+				token, err := weblogin.SaveNewToken(app.Store, "session", "test", 32, 1)
+				if err != nil {
+					t.Fatalf("SaveNewToken failed: %v", err)
+				}
+				r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+			}
+
+			app.ProfileHandler(w, r)
+
+			if w.Code != tc.wantCode || !strings.Contains(w.Body.String(), tc.wantBody) {
+				t.Errorf("got status %d, body %q, want status %d, %q in body", w.Code, w.Body, tc.wantCode, tc.wantBody)
+			}
+
+			user, err := app.Store.GetUserForName("test")
+			if err != nil || user.Email != "test@email" {
+				t.Errorf("GetUserForName got %+v, %v", user, err)
+			}
+			if tc.wantFullName != "" && user.FullName != tc.wantFullName {
+				t.Errorf("got FullName %q, want %q", user.FullName, tc.wantFullName)
+			}
+		})
+	}
+}
+
+// getEmailLink requests /email with the query and returns the response.
+func getEmailLink(app *weblogin.App, query url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/email?"+query.Encode(), nil)
+
+	app.EmailLinkHandler(w, r)
+
+	return w
+}
+
+// postEmailLink posts the token of an email change link for action to
+// /email and returns the response.
+func postEmailLink(app *weblogin.App, action, token string) *httptest.ResponseRecorder {
+	data := url.Values{"action": {action}, "token": {token}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/email", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.EmailLinkHandler(w, r)
+
+	return w
+}
+
+func TestEmailLinkHandler(t *testing.T) {
+	app := profileAppForTest(t)
+
+	expires := time.Now().Add(time.Hour)
+	confirm := weblogin.Token{Value: "confirm", Type: weblogin.EmailChangeTokenType, Expires: expires}
+	err := app.Store.SaveEmailChange("test", "new@email", confirm)
+	if err != nil {
+		t.Fatalf("SaveEmailChange failed: %v", err)
+	}
+
+	// following the link only shows a form to post the token
+	w := getEmailLink(app, url.Values{"confirm": {confirm.Value}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/email"`) ||
+		!strings.Contains(w.Body.String(), `name="token" value="confirm"`) {
+		t.Errorf("confirm GET got status %d, body %q", w.Code, w.Body)
+	}
+	user, err := app.Store.GetUserForName("test")
+	if err != nil || user.Email != "test@email" {
+		t.Errorf("after confirm GET got %+v, %v", user, err)
+	}
+
+	w = postEmailLink(app, "confirm", confirm.Value)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgEmailChanged) {
+		t.Errorf("confirm got status %d, body %q", w.Code, w.Body)
+	}
+	user, err = app.Store.GetUserForName("test")
+	if err != nil || user.Email != "new@email" || !user.EmailVerified {
+		t.Errorf("after confirm got %+v, %v", user, err)
+	}
+
+	w = postEmailLink(app, "confirm", confirm.Value)
+	if !strings.Contains(w.Body.String(), weblogin.MsgEmailLinkInvalid) {
+		t.Errorf("confirm again got body %q, want %q", w.Body, weblogin.MsgEmailLinkInvalid)
+	}
+
+	session, err := weblogin.SaveNewToken(app.Store, "session", "test", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+	revert := weblogin.Token{Value: "revert", Type: weblogin.EmailRevertTokenType, Expires: expires}
+	err = app.Store.SaveEmailChange("test", "test@email", revert)
+	if err != nil {
+		t.Fatalf("SaveEmailChange failed: %v", err)
+	}
+
+	w = getEmailLink(app, url.Values{"revert": {revert.Value}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="action" value="revert"`) {
+		t.Errorf("revert GET got status %d, body %q", w.Code, w.Body)
+	}
+
+	w = postEmailLink(app, "revert", revert.Value)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgEmailReverted) {
+		t.Errorf("revert got status %d, body %q", w.Code, w.Body)
+	}
+	user, err = app.Store.GetUserForName("test")
+	if err != nil || user.Email != "test@email" {
+		t.Errorf("after revert got %+v, %v", user, err)
+	}
+	_, err = app.Store.GetUserNameForToken("session", session.Value)
+	if err == nil {
+		t.Errorf("session was not removed by revert")
+	}
+
+	// another user registered the address after the change was requested
+	duplicate := weblogin.Token{Value: "duplicate", Type: weblogin.EmailChangeTokenType, Expires: expires}
+	err = app.Store.SaveEmailChange("test", "admin@email", duplicate)
+	if err != nil {
+		t.Fatalf("SaveEmailChange failed: %v", err)
+	}
+
+	w = postEmailLink(app, "confirm", duplicate.Value)
+	if !strings.Contains(w.Body.String(), weblogin.MsgEmailExists) {
+		t.Errorf("confirm duplicate got body %q, want %q", w.Body, weblogin.MsgEmailExists)
+	}
+
+	w = getEmailLink(app, url.Values{})
+	if !strings.Contains(w.Body.String(), weblogin.MsgEmailLinkInvalid) {
+		t.Errorf("no token got body %q, want %q", w.Body, weblogin.MsgEmailLinkInvalid)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a rate limiter shared by all requests.
+//
+// MemLimiter is used by default, but a Limiter backed by a shared store can
+// be assigned to App.Limiter so limits apply across multiple instances.
+type Limiter interface {
+	// Allow reports if an event for key is allowed by limit and, if not,
+	// the time to wait until the next event is allowed.
+	Allow(key string, limit ConfigLimit) (bool, time.Duration)
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  ConfigLimit // limit of the route for the key
+}
+
+// memLimiterMaxBuckets is the maximum number of buckets kept in memory.
+const memLimiterMaxBuckets = 10000
+
+// MemLimiter is a Limiter using a token bucket per key in memory.
+type MemLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// NewMemLimiter returns an empty MemLimiter.
+func NewMemLimiter() *MemLimiter {
+	return &MemLimiter{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// refill adds the tokens for the time since the last event to b.
+func (b *bucket) refill(now time.Time) {
+	perSecond := b.limit.PerMinute / 60
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+}
+
+// Allow reports if an event for key is allowed by limit and, if not, the
+// time to wait until the next event is allowed.
+func (l *MemLimiter) Allow(key string, limit ConfigLimit) (bool, time.Duration) {
+	if !limit.Enabled() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= memLimiterMaxBuckets {
+			l.evict(now)
+		}
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / (limit.PerMinute / 60) * float64(time.Second))
+	return false, wait
+}
+
+// evict removes buckets that have refilled with their own limit, which
+// behave the same as a new bucket, to limit memory use. If none have
+// refilled, the least recently used bucket is removed.
+func (l *MemLimiter) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+
+	for key, b := range l.buckets {
+		if oldestKey == "" || b.last.Before(oldest) {
+			oldestKey, oldest = key, b.last
+		}
+
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+
+	if len(l.buckets) >= memLimiterMaxBuckets {
+		delete(l.buckets, oldestKey)
+	}
+}
+
+// remoteIP returns the IP address of the client without the port.
+func remoteIP(r *http.Request) string {
+	addr := GetRealRemoteAddr(r)
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// accountKey returns the submitted username or email, if any.
+func accountKey(r *http.Request) string {
+	for _, name := range []string{"username", "userName", "email"} {
+		value := strings.TrimSpace(r.PostFormValue(name))
+		if value != "" {
+			return strings.ToLower(value)
+		}
+	}
+
+	return ""
+}
+
+// RateLimitHandler is middleware that limits POST requests to route using
+// the limits configured for route, keyed by the client IP address and by
+// the submitted username or email. A limited request receives a 429 response
+// with Retry-After set.
+func (app *App) RateLimitHandler(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits, ok := app.Cfg.RateLimit[route]
+		if !ok || r.Method != http.MethodPost || app.Limiter == nil {
+			next(w, r)
+			return
+		}
+
+		logger := slog.With(slog.Group("request",
+			slog.String("id", GetReqID(r.Context())),
+			slog.String("remoteAddr", GetRealRemoteAddr(r)),
+			slog.String("method", r.Method),
+			slog.String("url", r.RequestURI),
+		))
+
+		allowed, wait := app.Limiter.Allow(route+" ip "+remoteIP(r), limits.PerIP)
+		if allowed {
+			if account := accountKey(r); account != "" {
+				allowed, wait = app.Limiter.Allow(route+" account "+account, limits.PerAccount)
+			}
+		}
+
+		if !allowed {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			logger.Warn("rate limited", "route", route, "retryAfter", seconds)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestMemLimiter(t *testing.T) {
+	l := weblogin.NewMemLimiter()
+	limit := weblogin.ConfigLimit{PerMinute: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		allowed, _ := l.Allow("key", limit)
+		if !allowed {
+			t.Fatalf("event %d not allowed", i)
+		}
+	}
+
+	allowed, wait := l.Allow("key", limit)
+	if allowed || wait <= 0 || wait.Seconds() > 60 {
+		t.Errorf("got %v, %v, want false with wait up to 60s", allowed, wait)
+	}
+
+	allowed, _ = l.Allow("other", limit)
+	if !allowed {
+		t.Errorf("other key should be allowed")
+	}
+
+	allowed, _ = l.Allow("key", weblogin.ConfigLimit{})
+	if !allowed {
+		t.Errorf("disabled limit should be allowed")
+	}
+}
+
+func TestMemLimiterEvict(t *testing.T) {
+	l := weblogin.NewMemLimiter()
+	slow := weblogin.ConfigLimit{PerMinute: 0.001, Burst: 1}
+	fast := weblogin.ConfigLimit{PerMinute: 6000000, Burst: 1}
+
+	l.Allow("slow", slow)
+
+	// enough keys of another route to require removing buckets
+	for i := 0; i < 10001; i++ {
+		l.Allow("fast "+strconv.Itoa(i), fast)
+	}
+
+	// the slow bucket has not refilled with its own limit, so it is kept
+	allowed, _ := l.Allow("slow", slow)
+	if allowed {
+		t.Errorf("slow key should still be limited")
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	a := *AppForTest(t)
+	a.Limiter = weblogin.NewMemLimiter()
+	a.Cfg.RateLimit = map[string]weblogin.ConfigRouteLimit{
+		"/test": {
+			PerIP:      weblogin.ConfigLimit{PerMinute: 1, Burst: 3},
+			PerAccount: weblogin.ConfigLimit{PerMinute: 1, Burst: 2},
+		},
+	}
+
+	next := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	handler := a.RateLimitHandler("/test", next)
+
+	tests := []struct {
+		name       string
+		method     string
+		remoteAddr string
+		userName   string
+		want       int
+	}{
+		{"get not limited", http.MethodGet, "192.0.2.1:1", "", http.StatusOK},
+		{"get not limited", http.MethodGet, "192.0.2.1:1", "", http.StatusOK},
+		{"get not limited", http.MethodGet, "192.0.2.1:1", "", http.StatusOK},
+		{"get not limited", http.MethodGet, "192.0.2.1:1", "", http.StatusOK},
+		{"account 1", http.MethodPost, "192.0.2.2:1", "user", http.StatusOK},
+		{"account 2", http.MethodPost, "192.0.2.3:1", "User", http.StatusOK},
+		{"account limited", http.MethodPost, "192.0.2.4:1", "user", http.StatusTooManyRequests},
+		{"ip 1", http.MethodPost, "192.0.2.5:1", "a", http.StatusOK},
+		{"ip 2", http.MethodPost, "192.0.2.5:2", "b", http.StatusOK},
+		{"ip 3", http.MethodPost, "192.0.2.5:3", "c", http.StatusOK},
+		{"ip limited", http.MethodPost, "192.0.2.5:4", "d", http.StatusTooManyRequests},
+	}
+
+	for _, tc := range tests {
+		d := url.Values{"username": {tc.userName}}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(tc.method, "/test", strings.NewReader(d.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = tc.remoteAddr
+
+		handler(w, r)
+
+		if w.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.want)
+		}
+
+		if w.Code == http.StatusTooManyRequests {
+			retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			if err != nil || retry < 1 || retry > 60 {
+				t.Errorf("%s: got Retry-After %q", tc.name, w.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"slices"
+)
+
+// Permissions used by weblogin. Roles may also have other permissions that
+// are used by applications.
+const (
+	PermUsersRead      = "users.read"      // view the users page
+	PermUsersWrite     = "users.write"     // unlock, verify, or expire users
+	PermSessionsManage = "sessions.manage" // view and revoke sessions of other users
+	PermRolesManage    = "roles.manage"    // manage roles, groups, and assignments
+)
+
+// Permissions lists the permissions used by weblogin.
+var Permissions = []string{PermUsersRead, PermUsersWrite, PermSessionsManage, PermRolesManage}
+
+var (
+	ErrRoleNotFound  = errors.New("role not found")
+	ErrGroupNotFound = errors.New("group not found")
+)
+
+// Role is a named set of permissions that is assigned to users directly or
+// through groups.
+type Role struct {
+	Name        string
+	Description string
+	Permissions []string // sorted
+	Users       []string // users assigned the role directly, sorted
+	Groups      []string // groups assigned the role, sorted
+}
+
+// GroupMember is a member of a Group. A lead can manage the members of the
+// group without PermRolesManage.
+type GroupMember struct {
+	UserName string
+	IsLead   bool
+}
+
+// Group is a named set of users that have the roles of the group.
+type Group struct {
+	Name        string
+	Description string
+	Members     []GroupMember // sorted by UserName
+	Roles       []string      // sorted
+}
+
+// Lead returns true if userName is a lead of the group.
+func (g Group) Lead(userName string) bool {
+	for _, m := range g.Members {
+		if m.UserName == userName {
+			return m.IsLead
+		}
+	}
+
+	return false
+}
+
+// HasPermission returns true if user has perm through a role assigned to the
+// user or one of their groups. An admin has every permission.
+func (app *App) HasPermission(user User, perm string) (bool, error) {
+	if user.UserName == "" {
+		return false, nil
+	}
+	if user.IsAdmin {
+		return true, nil
+	}
+
+	perms, err := app.Store.GetPermissionsForUser(user.UserName)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(perms, perm), nil
+}
+
+// HasRole returns true if user is assigned role directly or through one of
+// their groups. An admin has every role.
+func (app *App) HasRole(user User, role string) (bool, error) {
+	if user.UserName == "" {
+		return false, nil
+	}
+	if user.IsAdmin {
+		return true, nil
+	}
+
+	roles, err := app.Store.GetRolesForUser(user.UserName)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(roles, role), nil
+}
+
+// InGroup returns true if user is a member of group. An admin is in every
+// group.
+func (app *App) InGroup(user User, group string) (bool, error) {
+	if user.UserName == "" {
+		return false, nil
+	}
+	if user.IsAdmin {
+		return true, nil
+	}
+
+	groups, err := app.Store.GetGroups()
+	if err != nil {
+		return false, err
+	}
+
+	i := findGroup(groups, group)
+	if i < 0 {
+		return false, nil
+	}
+
+	return slices.ContainsFunc(groups[i].Members,
+		func(m GroupMember) bool { return m.UserName == user.UserName }), nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// rbacAppForTest returns an App with a new Store, where the "member" user is
+// in the "team" group, which has the "viewer" role with PermUsersRead, and
+// "test" is the lead of the group.
+func rbacAppForTest(t *testing.T) *weblogin.App {
+	app := profileAppForTest(t)
+
+	err := app.Store.CreateUser(weblogin.User{UserName: "member", Email: "member@email"}, "hash")
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	err = app.Store.CreateRole(weblogin.Role{Name: "viewer", Permissions: []string{weblogin.PermUsersRead}})
+	if err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	err = app.Store.CreateGroup(weblogin.Group{Name: "team"})
+	if err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+	for _, m := range []weblogin.GroupMember{{UserName: "test", IsLead: true}, {UserName: "member"}} {
+		err = app.Store.SetGroupMember("team", m.UserName, m.IsLead)
+		if err != nil {
+			t.Fatalf("SetGroupMember failed: %v", err)
+		}
+	}
+	err = app.Store.AddGroupRole("team", "viewer")
+	if err != nil {
+		t.Fatalf("AddGroupRole failed: %v", err)
+	}
+
+	return app
+}
+
+// requestAs returns a request with a session cookie for userName, or no
+// cookie if userName is empty.
+func requestAs(t *testing.T, app *weblogin.App, method, target string, data url.Values, userName string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if userName != "" {
+		token, err := weblogin.SaveNewToken(app.Store, "session", userName, 32, 1)
+		if err != nil {
+			t.Fatalf("SaveNewToken failed: %v", err)
+		}
+		r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+	}
+
+	return r
+}
+
+func TestHasPermission(t *testing.T) {
+	app := rbacAppForTest(t)
+
+	err := app.Store.CreateRole(weblogin.Role{Name: "writer", Permissions: []string{weblogin.PermUsersWrite}})
+	if err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	err = app.Store.AddUserRole("member", "writer")
+	if err != nil {
+		t.Fatalf("AddUserRole failed: %v", err)
+	}
+
+	tests := []struct {
+		userName string
+		isAdmin  bool
+		perm     string
+		want     bool
+	}{
+		{"member", false, weblogin.PermUsersRead, true},    // through group
+		{"member", false, weblogin.PermUsersWrite, true},   // direct
+		{"member", false, weblogin.PermRolesManage, false}, // not assigned
+		{"other", false, weblogin.PermUsersRead, false},
+		{"admin", true, weblogin.PermRolesManage, true},
+		{"", false, weblogin.PermUsersRead, false},
+	}
+
+	for _, tc := range tests {
+		user := weblogin.User{UserName: tc.userName, IsAdmin: tc.isAdmin}
+		got, err := app.HasPermission(user, tc.perm)
+		if err != nil || got != tc.want {
+			t.Errorf("HasPermission(%q, %q) got %v, %v, want %v", tc.userName, tc.perm, got, err, tc.want)
+		}
+	}
+}
+
+func TestUsersHandlerPermission(t *testing.T) {
+	app := rbacAppForTest(t)
+	handler := app.RequirePermission(weblogin.PermUsersRead, http.HandlerFunc(app.UsersHandler))
+
+	// member can read, but not change, the users
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, requestAs(t, app, http.MethodGet, "/users", nil, "member"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "admin@email") ||
+		strings.Contains(w.Body.String(), `name="action"`) {
+		t.Errorf("GET got status %d, body %q", w.Code, w.Body)
+	}
+
+	d := url.Values{"action": {"verify"}, "username": {"test"}}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, requestAs(t, app, http.MethodPost, "/users", d, "member"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("POST got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestRolesHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		userName string
+		data     url.Values
+		want     int
+		wantMsg  string
+	}{
+		{"not lead", "member", nil, http.StatusForbidden, ""},
+		{"lead get", "test", nil, http.StatusOK, ""},
+		{"lead remove member", "test",
+			url.Values{"action": {"member_remove"}, "group": {"team"}, "username": {"member"}},
+			http.StatusOK, weblogin.MsgAccessUpdated},
+		{"lead add member", "test",
+			url.Values{"action": {"member_add"}, "group": {"team"}, "username": {"admin"}},
+			http.StatusOK, weblogin.MsgAccessUpdated},
+		{"lead add missing user", "test",
+			url.Values{"action": {"member_add"}, "group": {"team"}, "username": {"missing"}},
+			http.StatusOK, weblogin.MsgAccessNotFound},
+		{"lead add lead", "test",
+			url.Values{"action": {"member_add"}, "group": {"team"}, "username": {"member"}, "lead": {"on"}},
+			http.StatusForbidden, ""},
+		{"lead demote self", "test",
+			url.Values{"action": {"member_add"}, "group": {"team"}, "username": {"test"}},
+			http.StatusForbidden, ""},
+		{"lead create role", "test",
+			url.Values{"action": {"role_create"}, "name": {"new"}},
+			http.StatusForbidden, ""},
+		{"admin create role", "admin",
+			url.Values{"action": {"role_create"}, "name": {"new"}, "permissions": {"a, b"}},
+			http.StatusOK, weblogin.MsgAccessUpdated},
+		{"admin duplicate role", "admin",
+			url.Values{"action": {"role_create"}, "name": {"viewer"}},
+			http.StatusOK, weblogin.MsgAccessDuplicate},
+		{"admin missing name", "admin",
+			url.Values{"action": {"group_create"}},
+			http.StatusOK, weblogin.MsgAccessMissing},
+		{"admin add lead", "admin",
+			url.Values{"action": {"member_add"}, "group": {"team"}, "username": {"member"}, "lead": {"on"}},
+			http.StatusOK, weblogin.MsgAccessUpdated},
+		{"invalid action", "admin",
+			url.Values{"action": {"invalid"}},
+			http.StatusBadRequest, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := rbacAppForTest(t)
+
+			method := http.MethodGet
+			if tc.data != nil {
+				method = http.MethodPost
+			}
+
+			w := httptest.NewRecorder()
+			app.RolesHandler(w, requestAs(t, app, method, "/roles", tc.data, tc.userName))
+
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+			if !strings.Contains(w.Body.String(), tc.wantMsg) {
+				t.Errorf("got body %q, want %q", w.Body, tc.wantMsg)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	RecoveryTokenType   = "recovery"                // token type for recovery codes
+	RecoveryCodeCount   = 10                        // number of codes generated
+	RecoveryCodeExpires = 10 * 365 * 24 * time.Hour // recovery codes do not expire in practice
+	recoveryCodeLen     = 10                        // characters in a code, excluding separator
+)
+
+// GenerateRecoveryCodes returns n new random recovery codes of the form xxxxx-xxxxx.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		// 7 bytes is enough for the 50 bits in a 10 character base32 code
+		b := make([]byte, 7)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:recoveryCodeLen]
+		codes = append(codes, code[:recoveryCodeLen/2]+"-"+code[recoveryCodeLen/2:])
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode returns code without separators or spaces in lower case,
+// which is the value stored for a recovery code.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// SaveRecoveryCodes replaces any existing recovery codes for userName with
+// new codes, which are returned. Only the hashes of the codes are stored.
+func (app *App) SaveRecoveryCodes(userName string) ([]string, error) {
+	codes, err := GenerateRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.Store.RemoveTokensForUser(RecoveryTokenType, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(RecoveryCodeExpires)
+	for _, code := range codes {
+		token := Token{
+			Value:   normalizeRecoveryCode(code),
+			Expires: expires,
+			Type:    RecoveryTokenType,
+		}
+		err = app.Store.SaveToken(userName, token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode reports if code is a valid recovery code for userName.
+// A valid code is removed so that it cannot be used again.
+func (app *App) UseRecoveryCode(userName, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLen {
+		return false, nil
+	}
+
+	used, err := app.Store.ConsumeToken(RecoveryTokenType, userName, code)
+	if err != nil {
+		return false, err
+	}
+
+	if used {
+		WriteEvent(app.Store, EventRecovUse, true, userName, "success")
+	}
+
+	return used, nil
+}
+
+// RecoveryPageData contains data passed to the HTML template.
+type RecoveryPageData struct {
+	Title      string
+	Message    string
+	CSRFToken  string // see CSRFHandler
+	User       User
+	MFAEnabled bool     // user has a second factor enabled
+	Remaining  int      // number of unused recovery codes
+	Codes      []string // newly generated codes to display
+}
+
+const MsgRecoveryRequiresMFA = "Recovery codes are available once two-factor authentication is enabled."
+
+// RecoveryHandler handles /recovery requests to display and generate recovery codes.
+func (app *App) RecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil {
+		logger.Error("failed to GetUser", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	pageData := RecoveryPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), User: user}
+
+	if user.UserName != "" {
+		pageData.MFAEnabled, err = app.MFAEnabled(user.UserName)
+		if err != nil {
+			logger.Error("failed to get MFAEnabled", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !pageData.MFAEnabled {
+			pageData.Message = MsgRecoveryRequiresMFA
+		}
+	}
+
+	// generate new codes
+	if r.Method == http.MethodPost && pageData.MFAEnabled {
+		action := strings.TrimSpace(r.PostFormValue("action"))
+		if action != "show" && action != "download" {
+			pageData.Message = MsgInvalidAction
+		} else {
+			pageData.Codes, err = app.SaveRecoveryCodes(user.UserName)
+			if err != nil {
+				WriteEvent(app.Store, EventRecovGen, false, user.UserName, err.Error())
+				logger.Error("failed to SaveRecoveryCodes", "err", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			WriteEvent(app.Store, EventRecovGen, true, user.UserName, "success")
+		}
+
+		if action == "download" {
+			writeRecoveryCodes(w, app.Cfg.Title, pageData.Codes)
+			logger.Info("downloaded recovery codes", "user", user)
+			return
+		}
+	}
+
+	if pageData.MFAEnabled {
+		pageData.Remaining, err = app.Store.CountTokens(RecoveryTokenType, user.UserName)
+		if err != nil {
+			logger.Error("failed to CountTokens", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = RenderTemplate(app.Tmpls, w, "recovery.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+
+	logger.Info("RecoveryHandler", "user", user)
+}
+
+// writeRecoveryCodes writes codes as a text file attachment.
+func writeRecoveryCodes(w http.ResponseWriter, title string, codes []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="recovery-codes.txt"`)
+
+	fmt.Fprintf(w, "%s recovery codes\n\n", title)
+	fmt.Fprintln(w, "Each code can be used once in place of your authenticator app.")
+	fmt.Fprintln(w)
+	for _, code := range codes {
+		fmt.Fprintln(w, code)
+	}
+}
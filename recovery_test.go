@@ -0,0 +1,105 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := weblogin.GenerateRecoveryCodes(weblogin.RecoveryCodeCount)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes() got err %v", err)
+	}
+
+	if len(codes) != weblogin.RecoveryCodeCount {
+		t.Errorf("got %d codes, want %d", len(codes), weblogin.RecoveryCodeCount)
+	}
+
+	format := regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q does not match %v", code, format)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestRecoveryHandlerInvalidMethod(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPatch, "/recovery", nil)
+
+	app.RecoveryHandler(w, r)
+
+	expectedStatus := http.StatusMethodNotAllowed
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+}
+
+func TestRecoveryHandlerWithoutCookie(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/recovery", nil)
+
+	app.RecoveryHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	expectedInBody := `You must <a href="/login?r=/recovery">Login</a>`
+	if !strings.Contains(w.Body.String(), expectedInBody) {
+		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	}
+}
+
+func TestRecoveryHandlerWithoutMFA(t *testing.T) {
+	app := AppForTest(t)
+
+	token, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("could not login user to get session token")
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/recovery", strings.NewReader("action=show"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+
+	app.RecoveryHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	expectedInBody := weblogin.MsgRecoveryRequiresMFA
+	if !strings.Contains(w.Body.String(), expectedInBody) {
+		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	}
+}
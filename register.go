@@ -13,6 +13,7 @@ specific language governing permissions and limitations under the License.
 package weblogin
 
 import (
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -23,12 +24,14 @@ const (
 	MsgUserNameExists     = "User Name already exists."
 	MsgEmailExists        = "Email Address already registered."
 	MsgPasswordsDifferent = "Password values do not match."
+	MsgRegisterSent       = "Please check your email to complete the registration."
 )
 
 // RegisterPageData contains data passed to the HTML template.
 type RegisterPageData struct {
-	Title   string
-	Message string
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
 }
 
 // RegisterHandler handles /register requests.
@@ -48,7 +51,7 @@ func (app *App) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		err := RenderTemplate(app.Tmpls, w, "register.html",
-			RegisterPageData{Title: app.Cfg.Title})
+			RegisterPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r)})
 		if err != nil {
 			logger.Error("unable to parse template", "err", err)
 			return
@@ -92,6 +95,7 @@ func (app *App) registerPost(w http.ResponseWriter, r *http.Request) {
 		err := RenderTemplate(app.Tmpls, w, "register.html",
 			RegisterPageData{
 				Title: app.Cfg.Title, Message: msg,
+				CSRFToken: CSRFToken(r),
 			})
 		if err != nil {
 			logger.Error("unable to execute template", "err", err)
@@ -107,6 +111,23 @@ func (app *App) registerPost(w http.ResponseWriter, r *http.Request) {
 		err := RenderTemplate(app.Tmpls, w, "register.html",
 			RegisterPageData{
 				Title: app.Cfg.Title, Message: msg,
+				CSRFToken: CSRFToken(r),
+			})
+		if err != nil {
+			logger.Error("unable to execute template", "err", err)
+			return
+		}
+		return
+	}
+
+	// check that password meets the password policy
+	if msgs := app.CheckPassword(password1, userName, email); msgs != nil {
+		logger.Warn("password violates policy", "violations", len(msgs))
+		err := RenderTemplate(app.Tmpls, w, "register.html",
+			RegisterPageData{
+				Title:     app.Cfg.Title,
+				CSRFToken: CSRFToken(r),
+				Message:   strings.Join(msgs, " "),
 			})
 		if err != nil {
 			logger.Error("unable to execute template", "err", err)
@@ -116,19 +137,34 @@ func (app *App) registerPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check that userName doesn't already exist
-	userExists, err := UserExists(app.DB, userName)
+	userExists, err := app.Store.UserExists(userName)
 	if err != nil {
 		logger.Error("UserExists failed", "err", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+
+	// check that email doesn't already exist
+	emailExists, err := app.Store.EmailExists(email)
+	if err != nil {
+		logger.Error("EmailExists failed")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if app.Cfg.PrivacyMode && (userExists || emailExists) {
+		app.registerExisting(w, r, userName, email, password1, emailExists)
+		return
+	}
+
 	if userExists {
 		logger.Warn("user already exists")
-		WriteEvent(app.DB, EventRegister, false, userName, "user already exists")
+		WriteEvent(app.Store, EventRegister, false, userName, "user already exists")
 		err := RenderTemplate(app.Tmpls, w, "register.html",
 			RegisterPageData{
-				Title:   app.Cfg.Title,
-				Message: MsgUserNameExists,
+				Title:     app.Cfg.Title,
+				CSRFToken: CSRFToken(r),
+				Message:   MsgUserNameExists,
 			})
 		if err != nil {
 			logger.Error("unable to execute template", "err", err)
@@ -137,20 +173,14 @@ func (app *App) registerPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check that email doesn't already exist
-	emailExists, err := EmailExists(app.DB, email)
-	if err != nil {
-		logger.Error("EmailExists failed")
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
-	}
 	if emailExists {
 		logger.Warn("email already exists")
-		WriteEvent(app.DB, EventRegister, false, userName, "email already exists")
+		WriteEvent(app.Store, EventRegister, false, userName, "email already exists")
 		err := RenderTemplate(app.Tmpls, w, "register.html",
 			RegisterPageData{
-				Title:   app.Cfg.Title,
-				Message: MsgEmailExists,
+				Title:     app.Cfg.Title,
+				CSRFToken: CSRFToken(r),
+				Message:   MsgEmailExists,
 			})
 		if err != nil {
 			logger.Error("unable to execute template", "err", err)
@@ -160,14 +190,15 @@ func (app *App) registerPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Register User
-	err = RegisterUser(app.DB, userName, fullName, email, password1)
+	err = RegisterUser(app.Store, userName, fullName, email, password1)
 	if err != nil {
 		logger.Error("RegisterUser failed", "err", err)
-		WriteEvent(app.DB, EventRegister, false, userName, err.Error())
+		WriteEvent(app.Store, EventRegister, false, userName, err.Error())
 		err := RenderTemplate(app.Tmpls, w, "register.html",
 			RegisterPageData{
-				Title:   app.Cfg.Title,
-				Message: "Unable to Register User",
+				Title:     app.Cfg.Title,
+				CSRFToken: CSRFToken(r),
+				Message:   "Unable to Register User",
 			})
 		if err != nil {
 			logger.Error("unable to execute template", "err", err)
@@ -178,6 +209,105 @@ func (app *App) registerPost(w http.ResponseWriter, r *http.Request) {
 
 	// registration successful
 	logger.Info("registered user")
-	WriteEvent(app.DB, EventRegister, true, userName, "success")
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	WriteEvent(app.Store, EventRegister, true, userName, "success")
+
+	if !app.Cfg.VerifyEmail.Required {
+		err = app.Store.SetEmailVerified(userName, true)
+		if err != nil {
+			logger.Error("failed to SetEmailVerified", "err", err)
+		}
+		if !app.Cfg.PrivacyMode {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		// respond the same as for an existing account
+		subj := app.Cfg.Title + " registration"
+		emailText := fmt.Sprintf("Your User Name %s is registered for %s. Please visit %s/login to login.",
+			userName, app.Cfg.Title, app.Cfg.BaseURL)
+		err = app.deliver(func() error {
+			return app.sendEmail(email, subj, emailText)
+		})
+		if err != nil {
+			logger.Error("failed to send registration email", "err", err)
+		}
+		app.renderRegisterSent(w, r)
+		return
+	}
+
+	// the user can resend the link if sending fails
+	err = app.deliver(func() error { return app.SendVerifyEmail(userName, email) })
+	if err != nil {
+		logger.Error("failed to SendVerifyEmail", "err", err)
+	}
+
+	if app.Cfg.PrivacyMode {
+		app.renderRegisterSent(w, r)
+		return
+	}
+
+	err = RenderTemplate(app.Tmpls, w, "verify.html",
+		VerifyPageData{
+			Title:     app.Cfg.Title,
+			CSRFToken: CSRFToken(r),
+			Message:   MsgVerifySent,
+		})
+	if err != nil {
+		logger.Error("unable to execute template", "err", err)
+		return
+	}
+}
+
+// registerExisting is called by registerPost in privacy mode if userName or
+// email is already registered. The response is the same as a successful
+// registration and the owner of email is told about the attempt.
+func (app *App) registerExisting(w http.ResponseWriter, r *http.Request, userName, email, password string, emailExists bool) {
+	logger := slog.With(
+		slog.Group("request",
+			slog.String("id", GetReqID(r.Context())),
+			slog.String("remoteAddr", GetRealRemoteAddr(r)),
+			slog.String("method", r.Method),
+			slog.String("url", r.RequestURI),
+		),
+		"userName", userName,
+	)
+
+	// take the time of hashing the password for a new user
+	hashDummyPassword(password)
+
+	subj := app.Cfg.Title + " registration"
+	var emailText string
+	if emailExists {
+		logger.Warn("email already exists")
+		WriteEvent(app.Store, EventRegister, false, userName, "email already exists")
+		emailText = fmt.Sprintf("Someone tried to register for %s with this email address, which is already registered. If this was you, please visit %s/login to login or %s/forgot if you forgot your User Name or password. Otherwise, you can ignore this email.",
+			app.Cfg.Title, app.Cfg.BaseURL, app.Cfg.BaseURL)
+	} else {
+		logger.Warn("user already exists")
+		WriteEvent(app.Store, EventRegister, false, userName, "user already exists")
+		emailText = fmt.Sprintf("Someone tried to register for %s with this email address, but the User Name %s is not available. If this was you, please visit %s/register to register with a different User Name. Otherwise, you can ignore this email.",
+			app.Cfg.Title, userName, app.Cfg.BaseURL)
+	}
+
+	err := app.deliver(func() error {
+		return app.sendEmail(email, subj, emailText)
+	})
+	if err != nil {
+		logger.Error("failed to send registration email", "err", err)
+	}
+
+	app.renderRegisterSent(w, r)
+}
+
+// renderRegisterSent renders the response to a registration in privacy mode.
+func (app *App) renderRegisterSent(w http.ResponseWriter, r *http.Request) {
+	err := RenderTemplate(app.Tmpls, w, "verify.html",
+		VerifyPageData{
+			Title:     app.Cfg.Title,
+			CSRFToken: CSRFToken(r),
+			Message:   MsgRegisterSent,
+		})
+	if err != nil {
+		slog.Error("unable to execute template", "err", err)
+	}
 }
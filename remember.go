@@ -0,0 +1,293 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	RememberCookieName = "remember"
+	RememberReuseGrace = 30 * time.Second // concurrent requests may present a token just rotated
+)
+
+var (
+	ErrRememberDisabled = errors.New("remember me disabled")
+	ErrRememberInvalid  = errors.New("invalid remember me token")
+	ErrRememberReused   = errors.New("rotated remember me token reused")
+	ErrRememberRotated  = errors.New("remember me token rotated by another request")
+)
+
+// RememberToken is a persistent login token using the selector/validator
+// pattern. The selector finds the token and only a hash of the validator is
+// stored, so the validator is compared without a timing leak.
+//
+// Each use rotates the token to a new one in the same series. Since the
+// owner always has the latest token, the use of a rotated token means it
+// was stolen and the series is revoked.
+type RememberToken struct {
+	Selector        string
+	HashedValidator string
+	Series          string
+	UserName        string
+	Expires         time.Time // the same for every token in a series
+	Rotated         time.Time // zero if this is the latest token
+}
+
+// newRememberToken returns a RememberToken for userName in series and the
+// cookie value for it.
+func newRememberToken(userName, series string, expires time.Time) (RememberToken, string, error) {
+	selector, err := GenerateRandomString(12)
+	if err != nil {
+		return RememberToken{}, "", err
+	}
+
+	validator, err := GenerateRandomString(32)
+	if err != nil {
+		return RememberToken{}, "", err
+	}
+
+	t := RememberToken{
+		Selector:        selector,
+		HashedValidator: hash(validator),
+		Series:          series,
+		UserName:        userName,
+		Expires:         expires,
+	}
+
+	return t, selector + ":" + validator, nil
+}
+
+// Remember starts a new remember me series for userName and returns the
+// cookie value.
+func (app *App) Remember(userName string) (RememberToken, string, error) {
+	fn := "Remember"
+
+	if app.Cfg.RememberDays == 0 {
+		return RememberToken{}, "", ErrRememberDisabled
+	}
+
+	series, err := GenerateRandomString(12)
+	if err != nil {
+		return RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	t, value, err := newRememberToken(userName, series, time.Now().AddDate(0, 0, app.Cfg.RememberDays))
+	if err != nil {
+		return RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	err = app.Store.SaveRememberToken(t)
+	if err != nil {
+		WriteEvent(app.Store, EventRemember, false, userName, err.Error())
+		return RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	WriteEvent(app.Store, EventRemember, true, userName, "new series")
+
+	return t, value, nil
+}
+
+// LoginWithRemember validates the remember me cookie value, rotates it, and
+// creates a new session. It returns the session Token and the rotated
+// RememberToken and cookie value.
+//
+// If a rotated token is used after RememberReuseGrace, the series is revoked
+// and ErrRememberReused is returned. ErrRememberRotated is returned within
+// RememberReuseGrace, since the other request has the new cookie.
+//
+// As with LoginUser, ErrLoginUnverified, or a "pwchange" Token and
+// ErrLoginPasswordExpired, are returned if the user must act before the
+// login completes. The cookie is not rotated, so it can be used once they do.
+func (app *App) LoginWithRemember(value string) (Token, RememberToken, string, error) {
+	fn := "LoginWithRemember"
+
+	if app.Cfg.RememberDays == 0 {
+		return Token{}, RememberToken{}, "", ErrRememberDisabled
+	}
+
+	selector, validator, ok := strings.Cut(value, ":")
+	if !ok {
+		return Token{}, RememberToken{}, "", ErrRememberInvalid
+	}
+
+	t, err := app.Store.GetRememberToken(selector)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return Token{}, RememberToken{}, "", ErrRememberInvalid
+		}
+		return Token{}, RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash(validator)), []byte(t.HashedValidator)) != 1 ||
+		t.Expires.Before(time.Now()) {
+		return Token{}, RememberToken{}, "", ErrRememberInvalid
+	}
+
+	if !t.Rotated.IsZero() {
+		if time.Since(t.Rotated) < RememberReuseGrace {
+			return Token{}, RememberToken{}, "", ErrRememberRotated
+		}
+
+		err = app.Store.RemoveRememberSeries(t.Series)
+		if err != nil {
+			slog.Error("failed to RemoveRememberSeries", "err", err, "userName", t.UserName)
+		}
+		WriteEvent(app.Store, EventRememberReuse, false, t.UserName, "series revoked")
+		slog.Warn("remember me token reused, possible theft", "userName", t.UserName)
+
+		return Token{}, RememberToken{}, "", ErrRememberReused
+	}
+
+	user, err := app.Store.GetUserForName(t.UserName)
+	if err != nil {
+		return Token{}, RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+	if user.IsLocked() {
+		WriteEvent(app.Store, EventRemember, false, t.UserName, "locked")
+		return Token{}, RememberToken{}, "", ErrRememberInvalid
+	}
+
+	token, err := app.checkLogin(t.UserName)
+	if err != nil {
+		return token, RememberToken{}, "", err
+	}
+
+	next, nextValue, err := newRememberToken(t.UserName, t.Series, t.Expires)
+	if err != nil {
+		return Token{}, RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	ok, err = app.Store.RotateRememberToken(selector, next)
+	if err != nil {
+		return Token{}, RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+	if !ok {
+		return Token{}, RememberToken{}, "", ErrRememberRotated
+	}
+
+	token, err = app.createSession(t.UserName)
+	if err != nil {
+		return Token{}, RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	err = app.Store.SetSessionSeries(token.Value, t.Series)
+	if err != nil {
+		return Token{}, RememberToken{}, "", fmt.Errorf("%s: %w", fn, err)
+	}
+
+	WriteEvent(app.Store, EventRemember, true, t.UserName, "rotated")
+
+	return token, next, nextValue, nil
+}
+
+// Forget removes the remember me series of the cookie value, if any.
+func (app *App) Forget(value string) error {
+	selector, _, _ := strings.Cut(value, ":")
+
+	t, err := app.Store.GetRememberToken(selector)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	return app.Store.RemoveRememberSeries(t.Series)
+}
+
+// setRememberCookie sets the remember me cookie to value until t expires.
+func setRememberCookie(w http.ResponseWriter, t RememberToken, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     RememberCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  t.Expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearRememberCookie removes the remember me cookie.
+func clearRememberCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: RememberCookieName, Value: "", Path: "/", MaxAge: -1})
+}
+
+// rememberUser starts a remember me series for userName if requested by the
+// form of the login request r, which is linked to the session token.
+func (app *App) rememberUser(w http.ResponseWriter, r *http.Request, userName string, session Token) {
+	if app.Cfg.RememberDays == 0 || r.FormValue("remember") == "" {
+		return
+	}
+
+	t, value, err := app.Remember(userName)
+	if err != nil {
+		slog.Error("failed to Remember", "err", err, "userName", userName)
+		return
+	}
+
+	// revoking the session also revokes the series
+	err = app.Store.SetSessionSeries(session.Value, t.Series)
+	if err != nil {
+		slog.Error("failed to SetSessionSeries", "err", err, "userName", userName)
+	}
+
+	setRememberCookie(w, t, value)
+}
+
+// loginFromRemember uses the remember me cookie of the request, if any, to
+// start a new session and returns the user. An empty user is returned if
+// there is no valid remember me cookie. If the password must be changed, the
+// "pwchange" cookie is set and ErrLoginPasswordExpired is returned, and
+// ErrLoginUnverified is returned if the email address must be verified.
+func (app *App) loginFromRemember(w http.ResponseWriter, r *http.Request) (User, error) {
+	if app.Cfg.RememberDays == 0 {
+		return User{}, nil
+	}
+
+	value, err := GetCookieValue(r, RememberCookieName)
+	if err != nil || value == "" {
+		return User{}, err
+	}
+
+	token, t, nextValue, err := app.LoginWithRemember(value)
+	if err != nil {
+		slog.Warn("failed to LoginWithRemember", "err", err)
+		switch {
+		case errors.Is(err, ErrRememberRotated):
+			// keep the cookie, which the other request replaces
+			return User{}, nil
+		case errors.Is(err, ErrRememberInvalid) || errors.Is(err, ErrRememberReused):
+			clearRememberCookie(w)
+			return User{}, nil
+		case errors.Is(err, ErrLoginPasswordExpired):
+			setPasswordChangeCookie(w, token)
+		}
+		return User{}, err
+	}
+
+	setRememberCookie(w, t, nextValue)
+	SetSessionCookie(w, token)
+	updateSession(app.Store, r, token.Value)
+
+	user, _, err := app.GetUserForSessionToken(token.Value)
+
+	return user, err
+}
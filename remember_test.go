@@ -0,0 +1,317 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// agedRememberStore makes rotated remember me tokens appear older by age.
+type agedRememberStore struct {
+	weblogin.Store
+	age time.Duration
+}
+
+func (s *agedRememberStore) GetRememberToken(selector string) (weblogin.RememberToken, error) {
+	t, err := s.Store.GetRememberToken(selector)
+	if !t.Rotated.IsZero() {
+		t.Rotated = t.Rotated.Add(-s.age)
+	}
+	return t, err
+}
+
+func TestLoginWithRemember(t *testing.T) {
+	app := profileAppForTest(t)
+	app.Cfg.RememberDays = 30
+	store := &agedRememberStore{Store: app.Store}
+	app.Store = store
+
+	_, value, err := app.Remember("test")
+	if err != nil {
+		t.Fatalf("Remember failed: %v", err)
+	}
+
+	token, _, nextValue, err := app.LoginWithRemember(value)
+	if err != nil {
+		t.Fatalf("LoginWithRemember failed: %v", err)
+	}
+	if nextValue == value {
+		t.Errorf("LoginWithRemember did not rotate the token")
+	}
+	user, _, err := app.GetUserForSessionToken(token.Value)
+	if err != nil || user.UserName != "test" {
+		t.Errorf("GetUserForSessionToken got %q, %v, want test", user.UserName, err)
+	}
+
+	// a concurrent request with the previous token
+	_, _, _, err = app.LoginWithRemember(value)
+	if !errors.Is(err, weblogin.ErrRememberRotated) {
+		t.Errorf("LoginWithRemember within grace got err %v, want %v", err, weblogin.ErrRememberRotated)
+	}
+
+	selector, _, _ := strings.Cut(nextValue, ":")
+	_, _, _, err = app.LoginWithRemember(selector + ":wrong")
+	if !errors.Is(err, weblogin.ErrRememberInvalid) {
+		t.Errorf("LoginWithRemember wrong validator got err %v, want %v", err, weblogin.ErrRememberInvalid)
+	}
+
+	// the previous token used later means it was stolen
+	since := time.Now().Add(-time.Minute)
+	store.age = 2 * weblogin.RememberReuseGrace
+	_, _, _, err = app.LoginWithRemember(value)
+	if !errors.Is(err, weblogin.ErrRememberReused) {
+		t.Errorf("LoginWithRemember reused got err %v, want %v", err, weblogin.ErrRememberReused)
+	}
+	_, _, _, err = app.LoginWithRemember(nextValue)
+	if !errors.Is(err, weblogin.ErrRememberInvalid) {
+		t.Errorf("LoginWithRemember revoked series got err %v, want %v", err, weblogin.ErrRememberInvalid)
+	}
+	n, err := app.Store.CountEvents(weblogin.EventRememberReuse, false, "test", since)
+	if err != nil || n != 1 {
+		t.Errorf("CountEvents got %d, %v, want 1", n, err)
+	}
+
+	app.Cfg.RememberDays = 0
+	_, _, err = app.Remember("test")
+	if !errors.Is(err, weblogin.ErrRememberDisabled) {
+		t.Errorf("Remember disabled got err %v, want %v", err, weblogin.ErrRememberDisabled)
+	}
+}
+
+// cookieFor returns the cookie with name set by w or nil.
+func cookieFor(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestRememberLogin(t *testing.T) {
+	app := profileAppForTest(t)
+	app.Cfg.RememberDays = 30
+
+	data := url.Values{"username": {"test"}, "password": {"password"}, "remember": {"on"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.LoginHandler(w, r)
+
+	remember := cookieFor(w, weblogin.RememberCookieName)
+	if remember == nil || remember.Value == "" {
+		t.Fatalf("LoginHandler got remember cookie %v", remember)
+	}
+	want := time.Now().AddDate(0, 0, 30)
+	if remember.Expires.Sub(want).Abs() > 5*time.Second {
+		t.Errorf("got remember cookie expires %v, want near %v", remember.Expires, want)
+	}
+
+	// the session cookie is gone, so a new session is started
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/hello", nil)
+	r.AddCookie(&http.Cookie{Name: weblogin.RememberCookieName, Value: remember.Value})
+
+	helloHandler(app).ServeHTTP(w, r)
+
+	if !strings.Contains(w.Body.String(), "test@email") {
+		t.Errorf("HelloHandler did not login from remember cookie")
+	}
+	session := cookieFor(w, weblogin.SessionTokenCookieName)
+	if session == nil || session.Value == "" {
+		t.Fatalf("HelloHandler got session cookie %v", session)
+	}
+	rotated := cookieFor(w, weblogin.RememberCookieName)
+	if rotated == nil || rotated.Value == "" || rotated.Value == remember.Value {
+		t.Fatalf("HelloHandler got remember cookie %v, want rotated", rotated)
+	}
+
+	// logout forgets the series
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/logout", nil)
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: session.Value})
+	r.AddCookie(&http.Cookie{Name: weblogin.RememberCookieName, Value: rotated.Value})
+
+	app.LogoutHandler(w, r)
+
+	_, _, _, err := app.LoginWithRemember(rotated.Value)
+	if !errors.Is(err, weblogin.ErrRememberInvalid) {
+		t.Errorf("LoginWithRemember after logout got err %v, want %v", err, weblogin.ErrRememberInvalid)
+	}
+}
+
+func TestRememberLoginNotRequested(t *testing.T) {
+	app := profileAppForTest(t)
+	app.Cfg.RememberDays = 30
+
+	data := url.Values{"username": {"test"}, "password": {"password"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.LoginHandler(w, r)
+
+	if c := cookieFor(w, weblogin.RememberCookieName); c != nil {
+		t.Errorf("got remember cookie %v, want none", c)
+	}
+}
+
+// rememberLogin logs in test with remember me and returns the session and
+// remember me cookie values.
+func rememberLogin(t *testing.T, app *weblogin.App) (string, string) {
+	data := url.Values{"username": {"test"}, "password": {"password"}, "remember": {"on"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(data.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	app.LoginHandler(w, r)
+
+	session := cookieFor(w, weblogin.SessionTokenCookieName)
+	remember := cookieFor(w, weblogin.RememberCookieName)
+	if session == nil || remember == nil {
+		t.Fatalf("LoginHandler got session cookie %v, remember cookie %v", session, remember)
+	}
+
+	return session.Value, remember.Value
+}
+
+func TestRevokeRememberSession(t *testing.T) {
+	app := profileAppForTest(t)
+	app.Cfg.RememberDays = 30
+
+	device, deviceRemember := rememberLogin(t, app)
+	current, currentRemember := rememberLogin(t, app)
+
+	currentSession, err := app.Store.GetSession(current)
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	sessions, err := app.Store.GetSessions("test")
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("GetSessions got %v, %v", sessions, err)
+	}
+	var id string
+	for _, s := range sessions {
+		if s.Series == "" {
+			t.Errorf("session %+v not linked to a series", s)
+		}
+		if s.ID != currentSession.ID {
+			id = s.ID
+		}
+	}
+
+	w := sessionsRequest(app, http.MethodPost, current, url.Values{"action": {"revoke"}, "id": {id}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgSessionRevoked) {
+		t.Fatalf("revoke got status %d, body %q", w.Code, w.Body)
+	}
+
+	// the revoked device stays logged out
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: device})
+	r.AddCookie(&http.Cookie{Name: weblogin.RememberCookieName, Value: deviceRemember})
+
+	helloHandler(app).ServeHTTP(w, r)
+
+	if strings.Contains(w.Body.String(), "test@email") {
+		t.Errorf("revoked device is still logged in")
+	}
+	_, _, _, err = app.LoginWithRemember(deviceRemember)
+	if !errors.Is(err, weblogin.ErrRememberInvalid) {
+		t.Errorf("LoginWithRemember after revoke got err %v, want %v", err, weblogin.ErrRememberInvalid)
+	}
+
+	// revoking the others keeps the series of the current session
+	_, otherRemember := rememberLogin(t, app)
+
+	w = sessionsRequest(app, http.MethodPost, current, url.Values{"action": {"others"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgSessionsRevoked) {
+		t.Fatalf("others got status %d, body %q", w.Code, w.Body)
+	}
+
+	_, _, _, err = app.LoginWithRemember(otherRemember)
+	if !errors.Is(err, weblogin.ErrRememberInvalid) {
+		t.Errorf("LoginWithRemember after others got err %v, want %v", err, weblogin.ErrRememberInvalid)
+	}
+	_, _, _, err = app.LoginWithRemember(currentRemember)
+	if err != nil {
+		t.Errorf("LoginWithRemember for current got err %v", err)
+	}
+}
+
+func TestRememberLoginChecks(t *testing.T) {
+	tests := []struct {
+		name         string
+		setup        func(app *weblogin.App) error
+		wantLocation string
+		wantCookie   string
+	}{
+		{
+			name: "must change password",
+			setup: func(app *weblogin.App) error {
+				return app.Store.SetMustChangePassword("test", true)
+			},
+			wantLocation: "/expired?r=%2Fhello",
+			wantCookie:   weblogin.PasswordChangeCookieName,
+		},
+		{
+			name: "unverified",
+			setup: func(app *weblogin.App) error {
+				app.Cfg.VerifyEmail.Required = true
+				return app.Store.SetEmailVerified("test", false)
+			},
+			wantLocation: "/verify",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := profileAppForTest(t)
+			app.Cfg.RememberDays = 30
+
+			_, remember := rememberLogin(t, app)
+			err := tc.setup(app)
+			if err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+
+			// the session cookie is gone, so the remember cookie is used
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+			r.AddCookie(&http.Cookie{Name: weblogin.RememberCookieName, Value: remember})
+
+			helloHandler(app).ServeHTTP(w, r)
+
+			if w.Code != http.StatusSeeOther || w.Header().Get("Location") != tc.wantLocation {
+				t.Errorf("got status %d, location %q, want %d, %q", w.Code, w.Header().Get("Location"), http.StatusSeeOther, tc.wantLocation)
+			}
+			if c := cookieFor(w, weblogin.SessionTokenCookieName); c != nil && c.Value != "" {
+				t.Errorf("got session cookie %v, want none", c)
+			}
+			if tc.wantCookie != "" {
+				if c := cookieFor(w, tc.wantCookie); c == nil || c.Value == "" {
+					t.Errorf("got %s cookie %v", tc.wantCookie, c)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// Key to use when setting the user.
+type ctxUserKey int
+
+// UserKey is the key for the logged in User in a request context.
+const UserKey ctxUserKey = 0
+
+// UserFromContext returns the logged in User from ctx and true if it was
+// set by RequireLogin, RequireRole, or RequirePermission.
+func UserFromContext(ctx context.Context) (User, bool) {
+	if ctx == nil {
+		return User{}, false
+	}
+	user, ok := ctx.Value(UserKey).(User)
+	return user, ok
+}
+
+// RequireLogin is middleware that only calls next if the request has a logged
+// in user, which is stored in the request context for UserFromContext and
+// GetUserFromRequest. A user that is not logged in is redirected to the login
+// page, which returns to the request.
+func (app *App) RequireLogin(next http.Handler) http.Handler {
+	return app.requireUser("login", nil, next)
+}
+
+// RequireRole is like RequireLogin, but the user must also have role, either
+// directly or through a group. A user without role gets a 403.
+func (app *App) RequireRole(role string, next http.Handler) http.Handler {
+	return app.requireUser("role "+role,
+		func(user User) (bool, error) { return app.HasRole(user, role) },
+		next)
+}
+
+// RequirePermission is like RequireLogin, but the user must also have perm.
+// A user without perm gets a 403.
+func (app *App) RequirePermission(perm string, next http.Handler) http.Handler {
+	return app.requireUser("permission "+perm,
+		func(user User) (bool, error) { return app.HasPermission(user, perm) },
+		next)
+}
+
+// requireUser returns middleware that resolves the user of the request and
+// calls next if the user is logged in and allowed is nil or returns true.
+// required describes what allowed checks for the log.
+func (app *App) requireUser(required string, allowed func(User) (bool, error), next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.With(slog.Group("request",
+			slog.String("id", GetReqID(r.Context())),
+			slog.String("remoteAddr", GetRealRemoteAddr(r)),
+			slog.String("method", r.Method),
+			slog.String("url", r.RequestURI),
+		))
+
+		// userFromRequest uses the user from an outer middleware
+		user, err := app.userFromRequest(w, r)
+		switch {
+		case errors.Is(err, ErrLoginPasswordExpired):
+			// a remember me login must change the password to continue
+			http.Redirect(w, r, "/expired?r="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		case errors.Is(err, ErrLoginUnverified):
+			http.Redirect(w, r, "/verify", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			logger.Error("failed to GetUser", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if user.UserName == "" {
+			http.Redirect(w, r, "/login?r="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+
+		if allowed != nil {
+			ok, err := allowed(user)
+			if err != nil {
+				logger.Error("failed to check access", "required", required, "err", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				logger.Warn("access denied", "user", user.UserName, "required", required)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), UserKey, user)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// userRecorder returns a handler that records the user from the request
+// context in got.
+func userRecorder(got *weblogin.User) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := weblogin.UserFromContext(r.Context())
+		if !ok {
+			http.Error(w, "no user", http.StatusInternalServerError)
+			return
+		}
+		*got = user
+	})
+}
+
+func TestUserFromContext(t *testing.T) {
+	_, ok := weblogin.UserFromContext(context.Background())
+	if ok {
+		t.Errorf("UserFromContext got ok for empty context")
+	}
+
+	want := weblogin.User{UserName: "test"}
+	ctx := context.WithValue(context.Background(), weblogin.UserKey, want)
+	got, ok := weblogin.UserFromContext(ctx)
+	if !ok || got.UserName != want.UserName {
+		t.Errorf("UserFromContext got %q, %v, want %q", got.UserName, ok, want.UserName)
+	}
+}
+
+func TestRequireLogin(t *testing.T) {
+	app := rbacAppForTest(t)
+
+	var got weblogin.User
+	handler := app.RequireLogin(userRecorder(&got))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, requestAs(t, app, http.MethodGet, "/private/page?a=b", nil, ""))
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("anonymous got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if loc, want := w.Header().Get("Location"), "/login?r=%2Fprivate%2Fpage%3Fa%3Db"; loc != want {
+		t.Errorf("anonymous got Location %q, want %q", loc, want)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, requestAs(t, app, http.MethodGet, "/private/page", nil, "member"))
+	if w.Code != http.StatusOK || got.UserName != "member" {
+		t.Errorf("logged in got status %d, user %q, want member", w.Code, got.UserName)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	app := rbacAppForTest(t)
+
+	tests := []struct {
+		userName string
+		want     int
+	}{
+		{"", http.StatusSeeOther},
+		{"member", http.StatusOK}, // through the team group
+		{"admin", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		var got weblogin.User
+		handler := app.RequireRole("viewer", userRecorder(&got))
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, requestAs(t, app, http.MethodGet, "/viewer", nil, tc.userName))
+
+		if w.Code != tc.want {
+			t.Errorf("%q: got status %d, want %d", tc.userName, w.Code, tc.want)
+		}
+		if got.UserName != tc.userName {
+			t.Errorf("%q: got user %q", tc.userName, got.UserName)
+		}
+	}
+
+	// removed from the group, so no longer has the role
+	err := app.Store.RemoveGroupMember("team", "member")
+	if err != nil {
+		t.Fatalf("RemoveGroupMember failed: %v", err)
+	}
+
+	var got weblogin.User
+	w := httptest.NewRecorder()
+	app.RequireRole("viewer", userRecorder(&got)).ServeHTTP(w,
+		requestAs(t, app, http.MethodGet, "/viewer", nil, "member"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("removed member got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	app := rbacAppForTest(t)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := app.RequirePermission(weblogin.PermUsersWrite, next)
+
+	err := app.Store.CreateRole(weblogin.Role{Name: "writer", Permissions: []string{weblogin.PermUsersWrite}})
+	if err != nil {
+		t.Fatalf("CreateRole failed: %v", err)
+	}
+	err = app.Store.AddUserRole("member", "writer")
+	if err != nil {
+		t.Fatalf("AddUserRole failed: %v", err)
+	}
+
+	tests := []struct {
+		userName string
+		want     int
+	}{
+		{"", http.StatusSeeOther},
+		{"test", http.StatusForbidden},
+		{"member", http.StatusTeapot},
+		{"admin", http.StatusTeapot},
+	}
+
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, requestAs(t, app, http.MethodGet, "/users?x=1", nil, tc.userName))
+
+		if w.Code != tc.want {
+			t.Errorf("%q: got status %d, want %d", tc.userName, w.Code, tc.want)
+		}
+		if tc.userName == "" {
+			if loc, want := w.Header().Get("Location"), "/login?r=%2Fusers%3Fx%3D1"; loc != want {
+				t.Errorf("got Location %q, want %q", loc, want)
+			}
+		}
+	}
+}
+
+func TestRequireLoginResolvesOnce(t *testing.T) {
+	app := rbacAppForTest(t)
+
+	r := requestAs(t, app, http.MethodGet, "/hello", nil, "member")
+
+	// the handler uses the user from the context, even though the session
+	// was removed after the middleware resolved it
+	handler := app.RequireLogin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := app.Store.RemoveTokensForUser("session", "member")
+		if err != nil {
+			t.Fatalf("RemoveTokensForUser failed: %v", err)
+		}
+		app.HelloHandler(w, r)
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "member@email") {
+		t.Errorf("got status %d, body %q, want member", w.Code, w.Body)
+	}
+}
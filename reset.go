@@ -13,17 +13,37 @@ specific language governing permissions and limitations under the License.
 package weblogin
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
+)
+
+// Reset token types. A reset token is changed to ResetUsedTokenType when it is
+// used, so later attempts to use it can be detected.
+const (
+	ResetTokenType     = "reset"
+	ResetUsedTokenType = "reset_used"
+)
+
+var (
+	ErrResetTokenInvalid = errors.New("invalid reset token")
+	ErrResetTokenExpired = errors.New("reset token expired")
+	ErrResetTokenUsed    = errors.New("reset token already used")
+)
 
-	"golang.org/x/crypto/bcrypt"
+const (
+	MsgResetTokenInvalid = "Please provide a valid Reset Token"
+	MsgResetTokenExpired = "The Reset Token has expired. Please request a new one."
+	MsgResetTokenUsed    = "The Reset Token has already been used. Please request a new one."
 )
 
 // ResetPageData contains data passed to the HTML template.
 type ResetPageData struct {
 	Title      string
 	Message    string
+	CSRFToken  string // see CSRFHandler
 	ResetToken string
 }
 
@@ -46,6 +66,7 @@ func (app *App) ResetHandler(w http.ResponseWriter, r *http.Request) {
 		err := RenderTemplate(app.Tmpls, w, "reset.html",
 			ResetPageData{
 				Title:      app.Cfg.Title,
+				CSRFToken:  CSRFToken(r),
 				ResetToken: r.URL.Query().Get("rtoken"),
 			})
 		if err != nil {
@@ -89,6 +110,7 @@ func (app *App) resetPost(w http.ResponseWriter, r *http.Request, tmplFileName s
 		err := RenderTemplate(app.Tmpls, w, tmplFileName,
 			ResetPageData{
 				Title:      app.Cfg.Title,
+				CSRFToken:  CSRFToken(r),
 				Message:    msg,
 				ResetToken: r.URL.Query().Get("rtoken"),
 			})
@@ -107,6 +129,7 @@ func (app *App) resetPost(w http.ResponseWriter, r *http.Request, tmplFileName s
 		err := RenderTemplate(app.Tmpls, w, tmplFileName,
 			ResetPageData{
 				Title:      app.Cfg.Title,
+				CSRFToken:  CSRFToken(r),
 				Message:    msg,
 				ResetToken: r.URL.Query().Get("rtoken"),
 			})
@@ -117,15 +140,18 @@ func (app *App) resetPost(w http.ResponseWriter, r *http.Request, tmplFileName s
 		return
 	}
 
-	userName, err := GetUserNameForResetToken(app.DB, resetToken)
+	userName, err := app.ResetTokenUser(resetToken)
 	if err != nil {
-		logger.Error("failed GetUserNameForResetToken",
-			"resetToken", resetToken,
-			"err", err)
-		msg := "Please provide a valid Reset Token"
+		logger.Error("failed ResetTokenUser", "err", err)
+		msg := resetTokenMessage(err)
+		if msg == "" {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
 		err := RenderTemplate(app.Tmpls, w, tmplFileName,
 			ResetPageData{
 				Title:      app.Cfg.Title,
+				CSRFToken:  CSRFToken(r),
 				Message:    msg,
 				ResetToken: r.URL.Query().Get("rtoken"),
 			})
@@ -136,14 +162,23 @@ func (app *App) resetPost(w http.ResponseWriter, r *http.Request, tmplFileName s
 		return
 	}
 
-	// hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password1), bcrypt.DefaultCost)
+	user, err := app.Store.GetUserForName(userName)
 	if err != nil {
-		msg := "Cannot hash password"
-		logger.Error("failed bcrypt.GenerateFromPassword",
-			"userName", userName, "err", err)
+		logger.Error("failed GetUserForName", "userName", userName, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// check that password meets the password policy
+	if msgs := app.CheckPassword(password1, userName, user.Email); msgs != nil {
+		logger.Warn("password violates policy", "userName", userName, "violations", len(msgs))
 		err := RenderTemplate(app.Tmpls, w, tmplFileName,
-			ResetPageData{Title: app.Cfg.Title, Message: msg})
+			ResetPageData{
+				Title:      app.Cfg.Title,
+				CSRFToken:  CSRFToken(r),
+				Message:    strings.Join(msgs, " "),
+				ResetToken: resetToken,
+			})
 		if err != nil {
 			logger.Error("unable to RenderTemplate", "err", err)
 			return
@@ -151,8 +186,27 @@ func (app *App) resetPost(w http.ResponseWriter, r *http.Request, tmplFileName s
 		return
 	}
 
-	// store the user and hashed password
-	_, err = app.DB.Exec("UPDATE users SET hashedPassword = ? WHERE username = ?", string(hashedPassword), userName)
+	// check the password history and minimum age, then store the password
+	err = app.ResetPassword(userName, resetToken, password1)
+	msg := passwordChangeMessage(err, app.Cfg.Password)
+	if msg == "" {
+		msg = resetTokenMessage(err)
+	}
+	if msg != "" {
+		logger.Warn("password change refused", "userName", userName, "err", err)
+		err := RenderTemplate(app.Tmpls, w, tmplFileName,
+			ResetPageData{
+				Title:      app.Cfg.Title,
+				CSRFToken:  CSRFToken(r),
+				Message:    msg,
+				ResetToken: resetToken,
+			})
+		if err != nil {
+			logger.Error("unable to RenderTemplate", "err", err)
+			return
+		}
+		return
+	}
 	if err != nil {
 		logger.Error("update password failed",
 			"userName", userName, "err", err)
@@ -160,10 +214,116 @@ func (app *App) resetPost(w http.ResponseWriter, r *http.Request, tmplFileName s
 		return
 	}
 
-	// TODO: don't allow reuse of the reset token if successful
-
-	// register successful
+	// reset successful
 	logger.Info("successful password reset", "userName", userName)
-	WriteEvent(app.DB, EventReset, true, userName, "success")
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
+
+// resetTokenMessage returns the message to display for a reset token error,
+// or "" if the error should not be displayed.
+func resetTokenMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrResetTokenInvalid):
+		return MsgResetTokenInvalid
+	case errors.Is(err, ErrResetTokenExpired):
+		return MsgResetTokenExpired
+	case errors.Is(err, ErrResetTokenUsed):
+		return MsgResetTokenUsed
+	}
+
+	return ""
+}
+
+// ResetTokenUser returns the userName for the reset token tokenValue. It
+// returns ErrResetTokenExpired or ErrResetTokenUsed, and records an event,
+// for an expired or previously used token, or ErrResetTokenInvalid if the
+// token does not exist.
+func (app *App) ResetTokenUser(tokenValue string) (string, error) {
+	userName, err := app.Store.GetUserNameForToken(ResetTokenType, tokenValue)
+	switch {
+	case err == nil:
+		return userName, nil
+	case errors.Is(err, ErrTokenExpired):
+		WriteEvent(app.Store, EventResetExpired, false, userName, "expired token")
+		return "", ErrResetTokenExpired
+	case !errors.Is(err, ErrTokenNotFound):
+		return "", err
+	}
+
+	// a used token is reported even if it has since expired
+	userName, err = app.Store.GetUserNameForToken(ResetUsedTokenType, tokenValue)
+	switch {
+	case err == nil || errors.Is(err, ErrTokenExpired):
+		WriteEvent(app.Store, EventResetReuse, false, userName, "used token")
+		return "", ErrResetTokenUsed
+	case errors.Is(err, ErrTokenNotFound):
+		return "", ErrResetTokenInvalid
+	}
+
+	return "", err
+}
+
+// ResetPassword sets the password for userName using the reset token
+// tokenValue from ResetTokenUser. The token is used in the same transaction
+// as the password change, so it can only be used once. On success, the
+// other reset tokens, sessions, and remember me logins of the user are
+// removed and the user is notified by email.
+//
+// The password is checked as described by ChangePassword.
+func (app *App) ResetPassword(userName, tokenValue, password string) error {
+	err := app.changePassword(userName, password, func(hashedPassword string, keep int) error {
+		_, err := app.Store.ResetPasswordHash(tokenValue, hashedPassword, keep)
+		switch {
+		case errors.Is(err, ErrTokenExpired):
+			WriteEvent(app.Store, EventResetExpired, false, userName, "expired token")
+			return ErrResetTokenExpired
+		case errors.Is(err, ErrTokenNotFound):
+			// another request used the token first
+			WriteEvent(app.Store, EventResetReuse, false, userName, "used token")
+			return ErrResetTokenUsed
+		}
+		return err
+	})
+	if err != nil {
+		WriteEvent(app.Store, EventReset, false, userName, err.Error())
+		return err
+	}
+
+	WriteEvent(app.Store, EventReset, true, userName, "success")
+
+	err = app.Store.RemoveTokensForUser(ResetTokenType, userName)
+	if err != nil {
+		slog.Error("failed to RemoveTokensForUser", "err", err, "userName", userName)
+	}
+	err = app.Store.RemoveTokensForUser("session", userName)
+	if err != nil {
+		slog.Error("failed to RemoveTokensForUser", "err", err, "userName", userName)
+	}
+	err = app.Store.RemoveRememberTokensForUser(userName)
+	if err != nil {
+		slog.Error("failed to RemoveRememberTokensForUser", "err", err, "userName", userName)
+	}
+
+	app.sendPasswordChangedEmail(userName)
+
+	return nil
+}
+
+// sendPasswordChangedEmail notifies userName that their password was changed.
+// Errors are logged since the password has already been changed.
+func (app *App) sendPasswordChangedEmail(userName string) {
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		slog.Error("failed to GetUserForName", "err", err, "userName", userName)
+		return
+	}
+
+	subj := app.Cfg.Title + " password changed"
+	emailText := fmt.Sprintf("The password for %s on %s was changed. If you did not make this change, please visit %s/forgot to reset your password.",
+		user.UserName, app.Cfg.Title, app.Cfg.BaseURL)
+
+	err = app.sendEmail(user.Email, subj, emailText)
+	if err != nil {
+		slog.Error("failed to send password changed email", "err", err, "userName", userName)
+	}
+}
@@ -13,11 +13,13 @@ specific language governing permissions and limitations under the License.
 package weblogin_test
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	weblogin "github.com/bnixon67/go-weblogin"
 )
@@ -99,3 +101,76 @@ func TestResetHandlerPostMismatchedPassword(t *testing.T) {
 		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
 	}
 }
+
+func TestResetHandlerPostToken(t *testing.T) {
+	app := profileAppForTest(t)
+
+	token, err := weblogin.SaveNewToken(app.Store, weblogin.ResetTokenType, "test", 12, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+	other, err := weblogin.SaveNewToken(app.Store, weblogin.ResetTokenType, "test", 12, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+	expired, err := weblogin.SaveNewTokenWithDuration(app.Store, weblogin.ResetTokenType, "test", 12, -time.Minute)
+	if err != nil {
+		t.Fatalf("SaveNewTokenWithDuration failed: %v", err)
+	}
+	session, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	since := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name      string
+		rtoken    string
+		wantCode  int
+		wantBody  string
+		wantEvent string
+	}{
+		{"invalid", "bad token", http.StatusOK, weblogin.MsgResetTokenInvalid, ""},
+		{"expired", expired.Value, http.StatusOK, weblogin.MsgResetTokenExpired, weblogin.EventResetExpired},
+		{"valid", token.Value, http.StatusSeeOther, "", ""},
+		{"reused", token.Value, http.StatusOK, weblogin.MsgResetTokenUsed, weblogin.EventResetReuse},
+		{"outstanding", other.Value, http.StatusOK, weblogin.MsgResetTokenInvalid, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := url.Values{
+				"rtoken":    {tc.rtoken},
+				"password1": {"new password"},
+				"password2": {"new password"},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/reset", strings.NewReader(data.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			app.ResetHandler(w, r)
+
+			if w.Code != tc.wantCode || !strings.Contains(w.Body.String(), tc.wantBody) {
+				t.Errorf("got status %d, body %q, want %d with %q in body", w.Code, w.Body, tc.wantCode, tc.wantBody)
+			}
+
+			if tc.wantEvent != "" {
+				n, err := app.Store.CountEvents(tc.wantEvent, false, "test", since)
+				if err != nil || n != 1 {
+					t.Errorf("CountEvents %s got %d, %v, want 1", tc.wantEvent, n, err)
+				}
+			}
+		})
+	}
+
+	err = weblogin.CompareUserPassword(app.Store, "test", "new password")
+	if err != nil {
+		t.Errorf("CompareUserPassword failed: %v", err)
+	}
+	_, _, err = app.GetUserForSessionToken(session.Value)
+	if !errors.Is(err, weblogin.ErrUserSessionNotFound) {
+		t.Errorf("GetUserForSessionToken got err %v, want %v", err, weblogin.ErrUserSessionNotFound)
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var ErrAccessDenied = errors.New("access denied")
+
+// errAccessMissing is returned if a value required for an action is missing.
+var errAccessMissing = errors.New("missing value")
+
+const (
+	MsgAccessUpdated   = "Access updated"
+	MsgAccessMissing   = "Please provide the required values."
+	MsgAccessDuplicate = "The name or assignment already exists."
+	MsgAccessNotFound  = "The user, role, or group was not found."
+)
+
+// RolesPageData contains data passed to the HTML template.
+type RolesPageData struct {
+	Title       string
+	Message     string
+	CSRFToken   string // see CSRFHandler
+	User        User
+	CanManage   bool     // user has PermRolesManage
+	Roles       []Role   // empty unless CanManage
+	Groups      []Group  // all groups if CanManage, else groups led by User
+	Permissions []string // permissions used by weblogin
+}
+
+// ledGroups returns the groups that userName is a lead of.
+func ledGroups(groups []Group, userName string) []Group {
+	var led []Group
+	for _, g := range groups {
+		if g.Lead(userName) {
+			led = append(led, g)
+		}
+	}
+
+	return led
+}
+
+// parsePermissions returns the permissions in s, which are separated by
+// commas or spaces.
+func parsePermissions(s string) []string {
+	return strings.Fields(strings.ReplaceAll(s, ",", " "))
+}
+
+// RolesHandler handles /roles requests to manage roles, groups, and their
+// assignments.
+//
+// A user with PermRolesManage can POST any action. A lead of a group, without
+// PermRolesManage, can only add or remove members of the group that are not
+// leads, so team leads can manage their own members without being admins.
+func (app *App) RolesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil {
+		logger.Error("failed to GetUser", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if user.UserName == "" {
+		http.Redirect(w, r, "/login?r=/roles", http.StatusSeeOther)
+		return
+	}
+
+	logger = logger.With("user", user.UserName)
+
+	canManage, err := app.HasPermission(user, PermRolesManage)
+	if err != nil {
+		logger.Error("failed to HasPermission", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	groups, err := app.Store.GetGroups()
+	if err != nil {
+		logger.Error("failed to GetGroups", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !canManage {
+		groups = ledGroups(groups, user.UserName)
+		if len(groups) == 0 {
+			logger.Warn("permission denied", "permission", PermRolesManage)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	var msg string
+	if r.Method == http.MethodPost {
+		msg, err = app.rolesPost(r, user.UserName, canManage, groups)
+		if errors.Is(err, ErrAccessDenied) {
+			logger.Warn("access action denied", "action", r.PostFormValue("action"))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			logger.Error("failed access action", "action", r.PostFormValue("action"), "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if msg == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		logger.Info("access action", "action", r.PostFormValue("action"), "msg", msg)
+
+		// show the result of the action
+		groups, err = app.Store.GetGroups()
+		if err != nil {
+			logger.Error("failed to GetGroups", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !canManage {
+			groups = ledGroups(groups, user.UserName)
+		}
+	}
+
+	var roles []Role
+	if canManage {
+		roles, err = app.Store.GetRoles()
+		if err != nil {
+			logger.Error("failed to GetRoles", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = RenderTemplate(app.Tmpls, w, "roles.html",
+		RolesPageData{
+			Title:       app.Cfg.Title,
+			Message:     msg,
+			CSRFToken:   CSRFToken(r),
+			User:        user,
+			CanManage:   canManage,
+			Roles:       roles,
+			Groups:      groups,
+			Permissions: Permissions,
+		})
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+}
+
+// rolesPost performs the action of the request by user, returning the
+// message to display or an empty message if the action is invalid.
+// ErrAccessDenied is returned if user is not allowed to perform the action.
+// groups are the groups visible to user.
+func (app *App) rolesPost(r *http.Request, user string, canManage bool, groups []Group) (string, error) {
+	action := r.PostFormValue("action")
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	group := strings.TrimSpace(r.PostFormValue("group"))
+	role := strings.TrimSpace(r.PostFormValue("role"))
+	userName := strings.TrimSpace(r.PostFormValue("username"))
+
+	var (
+		detail string
+		err    error
+	)
+
+	switch action {
+	case "member_add", "member_remove":
+		if group == "" || userName == "" {
+			err = errAccessMissing
+			break
+		}
+		lead := r.PostFormValue("lead") != ""
+		if !canManage {
+			// a lead can only manage the members of their group that are not leads
+			i := findGroup(groups, group)
+			if i < 0 || lead || groups[i].Lead(userName) {
+				return "", ErrAccessDenied
+			}
+		}
+		if action == "member_add" {
+			err = app.Store.SetGroupMember(group, userName, lead)
+			detail = fmt.Sprintf("%s %s %s lead=%v", action, group, userName, lead)
+		} else {
+			err = app.Store.RemoveGroupMember(group, userName)
+			detail = fmt.Sprintf("%s %s %s", action, group, userName)
+		}
+
+	case "role_create", "role_update", "role_delete",
+		"group_create", "group_delete",
+		"user_role_add", "user_role_remove",
+		"group_role_add", "group_role_remove":
+		if !canManage {
+			return "", ErrAccessDenied
+		}
+		detail, err = app.manageAccess(r, action, name, group, role, userName)
+
+	default:
+		return "", nil
+	}
+
+	switch {
+	case errors.Is(err, errAccessMissing):
+		return MsgAccessMissing, nil
+	case errors.Is(err, ErrStoreDuplicate):
+		return MsgAccessDuplicate, nil
+	case errors.Is(err, ErrUserNotFound), errors.Is(err, ErrRoleNotFound), errors.Is(err, ErrGroupNotFound):
+		return MsgAccessNotFound, nil
+	case err != nil:
+		WriteEvent(app.Store, EventAccess, false, user, err.Error())
+		return "", err
+	}
+
+	WriteEvent(app.Store, EventAccess, true, user, detail)
+
+	return MsgAccessUpdated, nil
+}
+
+// manageAccess performs an action that requires PermRolesManage, returning a
+// description of the action for the event.
+func (app *App) manageAccess(r *http.Request, action, name, group, role, userName string) (string, error) {
+	description := strings.TrimSpace(r.PostFormValue("description"))
+	permissions := parsePermissions(r.PostFormValue("permissions"))
+
+	switch action {
+	case "role_create":
+		if name == "" {
+			return "", errAccessMissing
+		}
+		err := app.Store.CreateRole(Role{Name: name, Description: description, Permissions: permissions})
+		return fmt.Sprintf("%s %s %v", action, name, permissions), err
+	case "role_update":
+		if name == "" {
+			return "", errAccessMissing
+		}
+		err := app.Store.SetRolePermissions(name, permissions)
+		return fmt.Sprintf("%s %s %v", action, name, permissions), err
+	case "role_delete":
+		if name == "" {
+			return "", errAccessMissing
+		}
+		return action + " " + name, app.Store.RemoveRole(name)
+	case "group_create":
+		if name == "" {
+			return "", errAccessMissing
+		}
+		err := app.Store.CreateGroup(Group{Name: name, Description: description})
+		return action + " " + name, err
+	case "group_delete":
+		if name == "" {
+			return "", errAccessMissing
+		}
+		return action + " " + name, app.Store.RemoveGroup(name)
+	case "user_role_add", "user_role_remove":
+		if userName == "" || role == "" {
+			return "", errAccessMissing
+		}
+		detail := fmt.Sprintf("%s %s %s", action, userName, role)
+		if action == "user_role_add" {
+			return detail, app.Store.AddUserRole(userName, role)
+		}
+		return detail, app.Store.RemoveUserRole(userName, role)
+	case "group_role_add", "group_role_remove":
+		if group == "" || role == "" {
+			return "", errAccessMissing
+		}
+		detail := fmt.Sprintf("%s %s %s", action, group, role)
+		if action == "group_role_add" {
+			return detail, app.Store.AddGroupRole(group, role)
+		}
+		return detail, app.Store.RemoveGroupRole(group, role)
+	}
+
+	return "", nil
+}
+
+// findGroup returns the index of the group with name in groups, or -1.
+func findGroup(groups []Group, name string) int {
+	for i, g := range groups {
+		if g.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,338 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// SessionSeenInterval is how often the last seen time of a session is
+// updated if the client does not change.
+const SessionSeenInterval = time.Minute
+
+// SessionRefreshInterval is the minimum time a session with an idle timeout
+// must be extended by before the new expiration is saved, which avoids a
+// write for every request.
+const SessionRefreshInterval = time.Minute
+
+const (
+	MsgSessionRevoked   = "Session signed out."
+	MsgSessionsRevoked  = "All other sessions signed out."
+	MsgSessionNotFound  = "Session not found."
+	MsgSessionIsCurrent = "Use Logout to sign out of this session."
+)
+
+// Session is a session token and the client that last used it.
+type Session struct {
+	ID        string // hashed token value, which is safe to display
+	UserName  string
+	Created   time.Time
+	LastSeen  time.Time // zero if not used since login
+	Expires   time.Time
+	IP        string
+	UserAgent string
+	Series    string // remember me series that started the session, if any
+	Current   bool   // session of the request, set by SessionsHandler
+}
+
+// sortSessions sorts sessions by the most recently seen, or created if not seen.
+func sortSessions(sessions []Session) {
+	seen := func(s Session) time.Time {
+		if s.LastSeen.IsZero() {
+			return s.Created
+		}
+		return s.LastSeen
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return seen(sessions[i]).After(seen(sessions[j]))
+	})
+}
+
+// sessionExpires returns when a session created at created expires if it is
+// used at now. Without an idle timeout, this is SessionExpiresHours after
+// created. Otherwise, it is SessionIdleMinutes after now but no later than
+// SessionMaxHours after created.
+func (app *App) sessionExpires(created, now time.Time) time.Time {
+	cfg := app.Cfg
+
+	if cfg.SessionIdleMinutes == 0 {
+		return created.Add(time.Duration(cfg.SessionExpiresHours) * time.Hour)
+	}
+
+	maxHours := cfg.SessionMaxHours
+	if maxHours == 0 {
+		maxHours = cfg.SessionExpiresHours
+	}
+
+	expires := now.Add(time.Duration(cfg.SessionIdleMinutes) * time.Minute)
+	if limit := created.Add(time.Duration(maxHours) * time.Hour); expires.After(limit) {
+		expires = limit
+	}
+
+	return expires
+}
+
+// refreshSession extends the session with the token tValue if sessions have
+// an idle timeout, returning the token with the new expiration or a zero Token
+// if the session was not extended.
+func (app *App) refreshSession(tValue string, session Session) Token {
+	if app.Cfg.SessionIdleMinutes == 0 {
+		return Token{}
+	}
+
+	expires := app.sessionExpires(session.Created, time.Now())
+	if expires.Sub(session.Expires) < SessionRefreshInterval {
+		return Token{}
+	}
+
+	err := app.Store.SetSessionExpires(tValue, expires)
+	if err != nil {
+		slog.Error("failed to SetSessionExpires", "err", err, "userName", session.UserName)
+		return Token{}
+	}
+
+	return Token{Value: tValue, Expires: expires, Type: "session"}
+}
+
+// Maximum lengths, in characters, of the client of a session, which are
+// the widths of the ip and userAgent columns.
+const (
+	SessionIPMaxLength        = 45
+	SessionUserAgentMaxLength = 255
+)
+
+// updateSession records the client of the request for the session token.
+// The values are truncated to fit the columns, since the User-Agent can be
+// any length.
+func updateSession(s Store, r *http.Request, sessionToken string) {
+	ip := truncate(GetRealRemoteAddr(r), SessionIPMaxLength)
+	userAgent := truncate(r.UserAgent(), SessionUserAgentMaxLength)
+
+	err := s.UpdateSession(sessionToken, ip, userAgent, time.Now())
+	if err != nil {
+		slog.Error("failed to UpdateSession", "err", err)
+	}
+}
+
+// truncate returns the first n characters of s.
+func truncate(s string, n int) string {
+	var count int
+	for i := range s {
+		if count == n {
+			return s[:i]
+		}
+		count++
+	}
+
+	return s
+}
+
+// SessionsPageData contains data passed to the HTML template.
+type SessionsPageData struct {
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+	User      User
+	UserName  string // owner of the sessions
+	Sessions  []Session
+	ShowUsers bool // user has PermUsersRead
+}
+
+// SessionsHandler handles /sessions requests, which lists the active
+// sessions of the logged in user.
+//
+// A POST with action=revoke and an id signs out that session, and
+// action=others signs out every session except the current one. A user with
+// PermSessionsManage can use the user parameter to list and sign out the
+// sessions of any user.
+func (app *App) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil {
+		logger.Error("failed to GetUser", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if user.UserName == "" {
+		http.Redirect(w, r, "/login?r=/sessions", http.StatusSeeOther)
+		return
+	}
+
+	userName := r.FormValue("user")
+	if userName == "" {
+		userName = user.UserName
+	}
+	if userName != user.UserName {
+		ok, err := app.HasPermission(user, PermSessionsManage)
+		if err != nil {
+			logger.Error("failed to HasPermission", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			logger.Warn("user without permission attempted to access sessions", "user", user.UserName, "userName", userName)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	logger = logger.With("userName", userName, "user", user.UserName)
+
+	// the current session is only part of the sessions of the user
+	sessionToken, _ := GetCookieValue(r, SessionTokenCookieName)
+	current := hash(sessionToken)
+
+	var msg string
+	if r.Method == http.MethodPost {
+		msg, err = app.sessionsPost(r, userName, user.UserName, sessionToken, current)
+		if err != nil {
+			logger.Error("failed to revoke sessions", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if msg == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		logger.Info("sessions action", "action", r.PostFormValue("action"), "msg", msg)
+	}
+
+	sessions, err := app.Store.GetSessions(userName)
+	if err != nil {
+		logger.Error("failed to GetSessions", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+
+	showUsers, err := app.HasPermission(user, PermUsersRead)
+	if err != nil {
+		logger.Error("failed to HasPermission", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = RenderTemplate(app.Tmpls, w, "sessions.html",
+		SessionsPageData{
+			Title:     app.Cfg.Title,
+			Message:   msg,
+			CSRFToken: CSRFToken(r),
+			User:      user,
+			UserName:  userName,
+			Sessions:  sessions,
+			ShowUsers: showUsers,
+		})
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+}
+
+// sessionsPost revokes the sessions of userName for the action of the
+// request by user, returning the message to display or an empty message if
+// the action is invalid. The remember me series of a revoked session is also
+// removed, so it cannot start a new session.
+func (app *App) sessionsPost(r *http.Request, userName, user, sessionToken, current string) (string, error) {
+	by := "by " + user
+
+	switch r.PostFormValue("action") {
+	case "revoke":
+		id := r.PostFormValue("id")
+		if id == "" {
+			return "", nil
+		}
+		if id == current {
+			return MsgSessionIsCurrent, nil
+		}
+
+		series, err := app.sessionSeries(userName, id)
+		if err != nil {
+			return "", err
+		}
+
+		err = app.Store.RemoveSession(userName, id)
+		if errors.Is(err, ErrTokenNotFound) {
+			return MsgSessionNotFound, nil
+		}
+		if err == nil && series != "" {
+			err = app.Store.RemoveRememberSeries(series)
+		}
+		if err != nil {
+			WriteEvent(app.Store, EventSessRevoke, false, userName, err.Error())
+			return "", err
+		}
+		WriteEvent(app.Store, EventSessRevoke, true, userName, by)
+		return MsgSessionRevoked, nil
+
+	case "others":
+		// keep the series of the current session, unless it belongs to
+		// another user
+		var series string
+		if userName == user {
+			session, err := app.Store.GetSession(sessionToken)
+			if err != nil && !errors.Is(err, ErrTokenNotFound) && !errors.Is(err, ErrTokenExpired) {
+				return "", err
+			}
+			series = session.Series
+		}
+
+		// the current session belongs to user, so this also works for others
+		err := app.Store.RemoveOtherTokensForUser("session", userName, sessionToken)
+		if err == nil {
+			err = app.Store.RemoveOtherRememberTokensForUser(userName, series)
+		}
+		if err != nil {
+			WriteEvent(app.Store, EventSessRevoke, false, userName, err.Error())
+			return "", err
+		}
+		WriteEvent(app.Store, EventSessRevoke, true, userName, "others "+by)
+		return MsgSessionsRevoked, nil
+	}
+
+	return "", nil
+}
+
+// sessionSeries returns the remember me series of the session of userName
+// with id, or "" if there is none.
+func (app *App) sessionSeries(userName, id string) (string, error) {
+	sessions, err := app.Store.GetSessions(userName)
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range sessions {
+		if s.ID == id {
+			return s.Series, nil
+		}
+	}
+
+	return "", nil
+}
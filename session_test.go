@@ -0,0 +1,232 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// sessionsRequest sends a request to /sessions with the session cookie.
+func sessionsRequest(app *weblogin.App, method, session string, data url.Values) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+
+	var r *http.Request
+	if method == http.MethodPost {
+		r = httptest.NewRequest(method, "/sessions", strings.NewReader(data.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, "/sessions?"+data.Encode(), nil)
+	}
+	r.Header.Set("User-Agent", "test agent")
+	if session != "" {
+		r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: session})
+	}
+
+	app.SessionsHandler(w, r)
+
+	return w
+}
+
+func TestSessionsHandler(t *testing.T) {
+	app := profileAppForTest(t)
+
+	var tokens []weblogin.Token
+	for _, userName := range []string{"test", "test", "test", "admin"} {
+		token, err := weblogin.SaveNewToken(app.Store, "session", userName, 32, 1)
+		if err != nil {
+			t.Fatalf("SaveNewToken failed: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	current, admin := tokens[0].Value, tokens[3].Value
+
+	w := sessionsRequest(app, http.MethodGet, "", url.Values{})
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("not logged in got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+
+	w = sessionsRequest(app, http.MethodGet, current, url.Values{"user": {"admin"}})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("non-admin other user got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = sessionsRequest(app, http.MethodGet, current, url.Values{})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "test agent") || !strings.Contains(w.Body.String(), "(this session)") {
+		t.Errorf("list got status %d, body %q", w.Code, w.Body)
+	}
+
+	sessions, err := app.Store.GetSessions("test")
+	if err != nil || len(sessions) != 3 {
+		t.Fatalf("GetSessions got %v, %v", sessions, err)
+	}
+
+	// the current session is the one most recently seen
+	w = sessionsRequest(app, http.MethodPost, current, url.Values{"action": {"revoke"}, "id": {sessions[0].ID}})
+	if !strings.Contains(w.Body.String(), weblogin.MsgSessionIsCurrent) {
+		t.Errorf("revoke current got body %q, want %q", w.Body, weblogin.MsgSessionIsCurrent)
+	}
+
+	w = sessionsRequest(app, http.MethodPost, current, url.Values{"action": {"revoke"}, "id": {sessions[1].ID}})
+	if !strings.Contains(w.Body.String(), weblogin.MsgSessionRevoked) {
+		t.Errorf("revoke got body %q, want %q", w.Body, weblogin.MsgSessionRevoked)
+	}
+
+	w = sessionsRequest(app, http.MethodPost, current, url.Values{"action": {"others"}})
+	if !strings.Contains(w.Body.String(), weblogin.MsgSessionsRevoked) {
+		t.Errorf("others got body %q, want %q", w.Body, weblogin.MsgSessionsRevoked)
+	}
+
+	count, err := app.Store.CountTokens("session", "test")
+	if err != nil || count != 1 {
+		t.Errorf("CountTokens got %d, %v, want 1", count, err)
+	}
+	if _, err := app.Store.GetUserNameForToken("session", current); err != nil {
+		t.Errorf("current session got err %v", err)
+	}
+
+	// an admin can sign out every session of another user
+	w = sessionsRequest(app, http.MethodPost, admin, url.Values{"action": {"others"}, "user": {"test"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgSessionsRevoked) {
+		t.Errorf("admin others got status %d, body %q", w.Code, w.Body)
+	}
+	count, err = app.Store.CountTokens("session", "test")
+	if err != nil || count != 0 {
+		t.Errorf("CountTokens after admin got %d, %v, want 0", count, err)
+	}
+	if _, err := app.Store.GetUserNameForToken("session", admin); err != nil {
+		t.Errorf("admin session got err %v", err)
+	}
+
+	events, err := app.Store.CountEvents(weblogin.EventSessRevoke, true, "test", time.Time{})
+	if err != nil || events != 3 {
+		t.Errorf("CountEvents got %d, %v, want 3", events, err)
+	}
+
+	w = sessionsRequest(app, http.MethodPost, admin, url.Values{"action": {"invalid"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid action got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		idle        int // SessionIdleMinutes
+		max         int // SessionMaxHours
+		remaining   time.Duration
+		wantUser    bool
+		wantExpires time.Duration // from now, zero if the cookie is not re-issued
+	}{
+		{"idle", 30, 2, -time.Minute, false, 0},
+		{"recently extended", 30, 2, 30*time.Minute - 10*time.Second, true, 0},
+		{"extended", 30, 2, 5 * time.Minute, true, 30 * time.Minute},
+		{"max lifetime", 120, 1, 5 * time.Minute, true, time.Hour},
+		{"no idle timeout", 0, 0, 5 * time.Minute, true, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := profileAppForTest(t)
+			app.Cfg.SessionIdleMinutes = tc.idle
+			app.Cfg.SessionMaxHours = tc.max
+
+			token, err := weblogin.SaveNewTokenWithDuration(app.Store, "session", "test", 32, tc.remaining)
+			if err != nil {
+				t.Fatalf("SaveNewTokenWithDuration failed: %v", err)
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+			r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+
+			helloHandler(app).ServeHTTP(w, r)
+
+			if got := strings.Contains(w.Body.String(), "test@email"); got != tc.wantUser {
+				t.Errorf("got user %v, want %v", got, tc.wantUser)
+			}
+
+			var cookie *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == weblogin.SessionTokenCookieName && c.Value != "" {
+					cookie = c
+				}
+			}
+
+			if tc.wantExpires == 0 {
+				if cookie != nil {
+					t.Errorf("got cookie %v, want none", cookie)
+				}
+				return
+			}
+
+			want := time.Now().Add(tc.wantExpires)
+			if cookie == nil || cookie.Expires.Sub(want).Abs() > 5*time.Second {
+				t.Fatalf("got cookie %v, want expires near %v", cookie, want)
+			}
+			session, err := app.Store.GetSession(token.Value)
+			if err != nil || session.Expires.Sub(want).Abs() > 5*time.Second {
+				t.Errorf("GetSession got %v, %v, want expires near %v", session.Expires, err, want)
+			}
+		})
+	}
+}
+
+func TestLoginSessionIdleTimeout(t *testing.T) {
+	app := profileAppForTest(t)
+	app.Cfg.SessionIdleMinutes = 30
+
+	token, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	want := time.Now().Add(30 * time.Minute)
+	if token.Expires.Sub(want).Abs() > 5*time.Second {
+		t.Errorf("got expires %v, want near %v", token.Expires, want)
+	}
+}
+
+func TestUpdateSessionTruncates(t *testing.T) {
+	app := profileAppForTest(t)
+
+	token, err := app.LoginUser("test", "password")
+	if err != nil {
+		t.Fatalf("LoginUser failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+	r.Header.Set("User-Agent", strings.Repeat("é", weblogin.SessionUserAgentMaxLength+10))
+	r.Header.Set("X-Real-IP", strings.Repeat("1", weblogin.SessionIPMaxLength+10))
+
+	helloHandler(app).ServeHTTP(w, r)
+
+	session, err := app.Store.GetSession(token.Value)
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if got := []rune(session.UserAgent); len(got) != weblogin.SessionUserAgentMaxLength {
+		t.Errorf("got UserAgent of %d characters, want %d", len(got), weblogin.SessionUserAgentMaxLength)
+	}
+	if got := len(session.IP); got != weblogin.SessionIPMaxLength {
+		t.Errorf("got IP of %d characters, want %d", got, weblogin.SessionIPMaxLength)
+	}
+}
@@ -0,0 +1,1233 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLStore is a Store using a SQL database.
+//
+// Queries are written with ? placeholders and without database specific
+// functions, so they can be used with each dialect. Times are always
+// provided by the application in UTC rather than using database defaults.
+type SQLStore struct {
+	DB      *sql.DB
+	Dialect string // DialectMySQL, DialectPostgres, or DialectSQLite
+}
+
+// NewSQLStore returns a SQLStore for db using dialect.
+func NewSQLStore(db *sql.DB, dialect string) *SQLStore {
+	return &SQLStore{DB: db, Dialect: dialect}
+}
+
+// sqliteTimeFormat is a fixed width format, so SQLite can compare times as text.
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000"
+
+// rebind converts ? placeholders in qry to the format of the dialect.
+func (s *SQLStore) rebind(qry string) string {
+	if s.Dialect != DialectPostgres {
+		return qry
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range qry {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// args converts times in args to UTC values for the dialect.
+func (s *SQLStore) args(args []any) []any {
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			if s.Dialect == DialectSQLite {
+				args[i] = t.UTC().Format(sqliteTimeFormat)
+			} else {
+				args[i] = t.UTC()
+			}
+		}
+	}
+
+	return args
+}
+
+// sqlRunner runs queries, which is implemented by *sql.DB and *sql.Tx.
+type sqlRunner interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func (s *SQLStore) exec(qry string, args ...any) (sql.Result, error) {
+	return s.DB.Exec(s.rebind(qry), s.args(args)...)
+}
+
+func (s *SQLStore) queryRow(qry string, args ...any) *sql.Row {
+	return s.DB.QueryRow(s.rebind(qry), s.args(args)...)
+}
+
+func (s *SQLStore) query(qry string, args ...any) (*sql.Rows, error) {
+	return s.DB.Query(s.rebind(qry), s.args(args)...)
+}
+
+// rowExists return true if the given query returns at least one row.
+// qry should be of the form "SELECT 1 ..."
+func (s *SQLStore) rowExists(qry string, args ...any) (bool, error) {
+	var num int
+
+	err := s.queryRow(qry, args...).Scan(&num)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, err
+}
+
+// isDuplicate reports if err is a unique constraint violation.
+func isDuplicate(err error) bool {
+	msg := err.Error()
+
+	return strings.Contains(msg, "Duplicate entry") || // MySQL
+		strings.Contains(msg, "duplicate key value") || // PostgreSQL
+		strings.Contains(msg, "UNIQUE constraint failed") // SQLite
+}
+
+// Close closes the database.
+func (s *SQLStore) Close() error {
+	return s.DB.Close()
+}
+
+// CreateUser creates user with hashedPassword.
+func (s *SQLStore) CreateUser(user User, hashedPassword string) error {
+	created := user.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	qry := `INSERT INTO users(userName, hashedPassword, fullName, email, admin, created, emailVerified, passwordChanged) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.exec(qry, user.UserName, hashedPassword, user.FullName, user.Email, user.IsAdmin, created, user.EmailVerified, created)
+	if err != nil && isDuplicate(err) {
+		return ErrStoreDuplicate
+	}
+
+	return err
+}
+
+const userColumns = `userName, fullName, email, admin, created, lockedUntil, emailVerified, passwordChanged, mustChangePassword`
+
+// scanUser scans a row of userColumns.
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var (
+		user            User
+		lockedUntil     sql.NullTime
+		passwordChanged sql.NullTime
+	)
+
+	err := row.Scan(&user.UserName, &user.FullName, &user.Email, &user.IsAdmin, &user.Created, &lockedUntil, &user.EmailVerified, &passwordChanged, &user.MustChangePassword)
+	user.LockedUntil = lockedUntil.Time
+	user.PasswordChanged = passwordChanged.Time
+
+	return user, err
+}
+
+// GetUserForName returns a user for the given userName.
+func (s *SQLStore) GetUserForName(userName string) (User, error) {
+	qry := `SELECT ` + userColumns + ` FROM users WHERE userName=? LIMIT 1`
+	user, err := scanUser(s.queryRow(qry, userName))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, ErrUserNotFound
+		}
+		return User{}, err
+	}
+
+	return user, err
+}
+
+// GetUserNameForEmail returns the userName for a given email.
+func (s *SQLStore) GetUserNameForEmail(email string) (string, error) {
+	var userName string
+
+	err := s.queryRow(`SELECT userName FROM users WHERE email=?`, email).Scan(&userName)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrUserNotFound
+		}
+		return "", err
+	}
+
+	return userName, err
+}
+
+// UserExists returns true if the given userName already exists.
+func (s *SQLStore) UserExists(userName string) (bool, error) {
+	return s.rowExists(`SELECT 1 FROM users WHERE userName=? LIMIT 1`, userName)
+}
+
+// EmailExists returns true if the given email already exists.
+func (s *SQLStore) EmailExists(email string) (bool, error) {
+	return s.rowExists(`SELECT 1 FROM users WHERE email=? LIMIT 1`, email)
+}
+
+// GetUsers returns a list of all users.
+func (s *SQLStore) GetUsers() ([]User, error) {
+	var users []User
+
+	qry := `SELECT ` + userColumns + ` FROM users ORDER BY userName`
+	rows, err := s.query(qry)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetPasswordHash returns the hashed password for userName.
+func (s *SQLStore) GetPasswordHash(userName string) (string, error) {
+	var hashedPassword string
+
+	qry := `SELECT hashedPassword FROM users WHERE userName=? LIMIT 1`
+	err := s.queryRow(qry, userName).Scan(&hashedPassword)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrUserNotFound
+		}
+		return "", err
+	}
+
+	return hashedPassword, nil
+}
+
+// SetPasswordHash sets the hashed password for userName and the time it
+// changed, and clears mustChangePassword.
+func (s *SQLStore) SetPasswordHash(userName, hashedPassword string) error {
+	qry := `UPDATE users SET hashedPassword=?, passwordChanged=?, mustChangePassword=? WHERE userName=?`
+	_, err := s.exec(qry, hashedPassword, time.Now(), false, userName)
+	return err
+}
+
+// ResetPasswordHash sets the hashed password of the user of the reset token
+// tValue, marks the token used, and adds the previous hashed password to the
+// history if keep is positive, in a single transaction.
+func (s *SQLStore) ResetPasswordHash(tValue, hashedPassword string, keep int) (string, error) {
+	var (
+		userName string
+		expires  time.Time
+	)
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	qry := `SELECT userName, expires FROM tokens WHERE type = ? AND hashedValue = ?`
+	err = tx.QueryRow(s.rebind(qry), s.args([]any{ResetTokenType, hash(tValue)})...).Scan(&userName, &expires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrTokenNotFound
+		}
+		return "", err
+	}
+	if expires.Before(time.Now()) {
+		return userName, ErrTokenExpired
+	}
+
+	// only the request that marks the token used may set the password
+	qry = `UPDATE tokens SET type = ? WHERE type = ? AND hashedValue = ?`
+	result, err := tx.Exec(s.rebind(qry), s.args([]any{ResetUsedTokenType, ResetTokenType, hash(tValue)})...)
+	if err != nil {
+		return "", err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if n != 1 {
+		return "", ErrTokenNotFound
+	}
+
+	if keep > 0 {
+		var current string
+		qry = `SELECT hashedPassword FROM users WHERE userName=?`
+		err = tx.QueryRow(s.rebind(qry), userName).Scan(&current)
+		if err != nil {
+			return "", err
+		}
+
+		err = s.addPasswordHistory(tx, userName, current, keep)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	qry = `UPDATE users SET hashedPassword=?, passwordChanged=?, mustChangePassword=? WHERE userName=?`
+	_, err = tx.Exec(s.rebind(qry), s.args([]any{hashedPassword, time.Now(), false, userName})...)
+	if err != nil {
+		return "", err
+	}
+
+	return userName, tx.Commit()
+}
+
+// SetMustChangePassword sets if userName must change their password at the next login.
+func (s *SQLStore) SetMustChangePassword(userName string, mustChange bool) error {
+	_, err := s.exec(`UPDATE users SET mustChangePassword=? WHERE userName=?`, mustChange, userName)
+	return err
+}
+
+// GetPasswordHistory returns up to n previous hashed passwords for userName, most recent first.
+func (s *SQLStore) GetPasswordHistory(userName string, n int) ([]string, error) {
+	var hashes []string
+
+	qry := `SELECT hashedPassword FROM password_history WHERE userName=? ORDER BY created DESC LIMIT ?`
+	rows, err := s.query(qry, userName, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// AddPasswordHistory adds hashedPassword to the previous passwords for userName, keeping only the most recent keep.
+func (s *SQLStore) AddPasswordHistory(userName, hashedPassword string, keep int) error {
+	return s.addPasswordHistory(s.DB, userName, hashedPassword, keep)
+}
+
+// addPasswordHistory is AddPasswordHistory using db, which may be a
+// transaction.
+func (s *SQLStore) addPasswordHistory(db sqlRunner, userName, hashedPassword string, keep int) error {
+	qry := `INSERT INTO password_history(userName, hashedPassword, created) VALUES (?, ?, ?)`
+	_, err := db.Exec(s.rebind(qry), s.args([]any{userName, hashedPassword, time.Now()})...)
+	if err != nil {
+		return err
+	}
+
+	// find the most recent entry to remove, if any
+	var oldest time.Time
+	qry = `SELECT created FROM password_history WHERE userName=? ORDER BY created DESC LIMIT 1 OFFSET ?`
+	err = db.QueryRow(s.rebind(qry), userName, keep).Scan(&oldest)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	qry = `DELETE FROM password_history WHERE userName=? AND created <= ?`
+	_, err = db.Exec(s.rebind(qry), s.args([]any{userName, oldest})...)
+	return err
+}
+
+// GetTOTPSecret returns the encrypted TOTP secret for userName and if TOTP is enabled.
+func (s *SQLStore) GetTOTPSecret(userName string) (string, bool, error) {
+	var (
+		secret  string
+		enabled bool
+	)
+
+	qry := `SELECT totpSecret, totpEnabled FROM users WHERE userName=? LIMIT 1`
+	err := s.queryRow(qry, userName).Scan(&secret, &enabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", false, ErrUserNotFound
+		}
+		return "", false, err
+	}
+
+	return secret, enabled, nil
+}
+
+// SaveTOTPSecret stores the encrypted TOTP secret for userName and if TOTP is enabled.
+func (s *SQLStore) SaveTOTPSecret(userName, secret string, enabled bool) error {
+	qry := `UPDATE users SET totpSecret=?, totpEnabled=? WHERE userName=?`
+	_, err := s.exec(qry, secret, enabled, userName)
+	return err
+}
+
+// UseTOTPStep records step as the last TOTP time step used by userName.
+func (s *SQLStore) UseTOTPStep(userName string, step int64) (bool, error) {
+	qry := `UPDATE users SET totpLastStep=? WHERE userName=? AND totpLastStep<?`
+	result, err := s.exec(qry, step, userName, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// GetLockout returns the time userName is locked until and the number of consecutive locks.
+func (s *SQLStore) GetLockout(userName string) (time.Time, int, error) {
+	var (
+		until sql.NullTime
+		count int
+	)
+
+	qry := `SELECT lockedUntil, lockCount FROM users WHERE userName=? LIMIT 1`
+	err := s.queryRow(qry, userName).Scan(&until, &count)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, 0, ErrUserNotFound
+		}
+		return time.Time{}, 0, err
+	}
+
+	return until.Time, count, nil
+}
+
+// SetLockout sets the time userName is locked until and the number of consecutive locks.
+func (s *SQLStore) SetLockout(userName string, until time.Time, count int) error {
+	_, err := s.exec(`UPDATE users SET lockedUntil=?, lockCount=? WHERE userName=?`, until, count, userName)
+	return err
+}
+
+// SetEmailVerified sets if the email address of userName has been verified.
+func (s *SQLStore) SetEmailVerified(userName string, verified bool) error {
+	_, err := s.exec(`UPDATE users SET emailVerified=? WHERE userName=?`, verified, userName)
+	return err
+}
+
+// SetFullName sets the full name of userName.
+func (s *SQLStore) SetFullName(userName, fullName string) error {
+	_, err := s.exec(`UPDATE users SET fullName=? WHERE userName=?`, fullName, userName)
+	return err
+}
+
+// SetEmail sets the email address of userName.
+func (s *SQLStore) SetEmail(userName, email string) error {
+	_, err := s.exec(`UPDATE users SET email=? WHERE userName=?`, email, userName)
+	if err != nil && isDuplicate(err) {
+		return ErrStoreDuplicate
+	}
+
+	return err
+}
+
+// LastLoginForUser returns the time and result of the previous login for userName.
+func (s *SQLStore) LastLoginForUser(userName string) (time.Time, string, error) {
+	var (
+		lastLogin time.Time
+		result    bool
+	)
+
+	// get the second row, if it exists, since first row is current login
+	qry := `SELECT created, result FROM events WHERE userName = ? AND name = ? ORDER BY created DESC LIMIT 1 OFFSET 1`
+	err := s.queryRow(qry, userName, EventLogin).Scan(&lastLogin, &result)
+	if err != nil {
+		// ignore ErrNoRows since there may not be a last login
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, "", nil
+		}
+		return time.Time{}, "", err
+	}
+
+	return lastLogin, strconv.FormatBool(result), nil
+}
+
+// SaveToken saves the given token for user.
+func (s *SQLStore) SaveToken(userName string, token Token) error {
+	// hash the token to avoid reuse if database is compromised
+	qry := `INSERT INTO tokens(hashedValue, expires, type, userName, created) VALUES(?, ?, ?, ?, ?)`
+	_, err := s.exec(qry, hash(token.Value), token.Expires, token.Type, userName, time.Now())
+	if err != nil && isDuplicate(err) {
+		return ErrStoreDuplicate
+	}
+
+	return err
+}
+
+// GetUserNameForToken returns the userName for the given unexpired token.
+func (s *SQLStore) GetUserNameForToken(tType, tValue string) (string, error) {
+	var (
+		userName string
+		expires  time.Time
+	)
+
+	qry := `SELECT userName, expires FROM tokens WHERE type = ? AND hashedValue = ?`
+	err := s.queryRow(qry, tType, hash(tValue)).Scan(&userName, &expires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrTokenNotFound
+		}
+		return "", err
+	}
+
+	if expires.Before(time.Now()) {
+		return userName, ErrTokenExpired
+	}
+
+	return userName, nil
+}
+
+// RemoveToken removes the given token.
+func (s *SQLStore) RemoveToken(tType, tValue string) error {
+	_, err := s.exec(`DELETE FROM tokens WHERE type = ? AND hashedValue = ?`, tType, hash(tValue))
+	return err
+}
+
+// RemoveTokensForUser removes all tokens of tType for user.
+func (s *SQLStore) RemoveTokensForUser(tType, userName string) error {
+	_, err := s.exec(`DELETE FROM tokens WHERE type = ? AND userName = ?`, tType, userName)
+	return err
+}
+
+// RemoveOtherTokensForUser removes the tokens of tType for userName except tValue.
+func (s *SQLStore) RemoveOtherTokensForUser(tType, userName, tValue string) error {
+	qry := `DELETE FROM tokens WHERE type = ? AND userName = ? AND hashedValue <> ?`
+	_, err := s.exec(qry, tType, userName, hash(tValue))
+	return err
+}
+
+// RemoveExpiredTokens removes the tokens of tType that have expired.
+func (s *SQLStore) RemoveExpiredTokens(tType string) error {
+	_, err := s.exec(`DELETE FROM tokens WHERE type = ? AND expires <= ?`, tType, time.Now())
+	return err
+}
+
+// ConsumeToken removes the given token of tType for user and reports if it existed.
+func (s *SQLStore) ConsumeToken(tType, userName, tValue string) (bool, error) {
+	qry := `DELETE FROM tokens WHERE type = ? AND userName = ? AND hashedValue = ? AND expires > ?`
+	result, err := s.exec(qry, tType, userName, hash(tValue), time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// CountTokens returns the number of unexpired tokens of tType for user.
+func (s *SQLStore) CountTokens(tType, userName string) (int, error) {
+	var count int
+
+	qry := `SELECT COUNT(*) FROM tokens WHERE type = ? AND userName = ? AND expires > ?`
+	err := s.queryRow(qry, tType, userName, time.Now()).Scan(&count)
+
+	return count, err
+}
+
+// UpdateSession records the time, IP address, and User-Agent of a request
+// with the session token tValue.
+func (s *SQLStore) UpdateSession(tValue, ip, userAgent string, seen time.Time) error {
+	// skip the write if nothing changed recently
+	qry := `UPDATE tokens SET lastSeen = ?, ip = ?, userAgent = ? WHERE type = ? AND hashedValue = ? AND (lastSeen IS NULL OR lastSeen < ? OR ip <> ? OR userAgent <> ?)`
+	_, err := s.exec(qry, seen, ip, userAgent, "session", hash(tValue), seen.Add(-SessionSeenInterval), ip, userAgent)
+	return err
+}
+
+const sessionColumns = `hashedValue, userName, created, lastSeen, expires, ip, userAgent, series`
+
+// scanSession scans sessionColumns into a Session.
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var (
+		session  Session
+		lastSeen sql.NullTime
+	)
+
+	err := row.Scan(&session.ID, &session.UserName, &session.Created, &lastSeen, &session.Expires, &session.IP, &session.UserAgent, &session.Series)
+	session.LastSeen = lastSeen.Time
+
+	return session, err
+}
+
+// GetSession returns the session for the token tValue.
+func (s *SQLStore) GetSession(tValue string) (Session, error) {
+	qry := `SELECT ` + sessionColumns + ` FROM tokens WHERE type = ? AND hashedValue = ?`
+	session, err := scanSession(s.queryRow(qry, "session", hash(tValue)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Session{}, ErrTokenNotFound
+		}
+		return Session{}, err
+	}
+
+	if session.Expires.Before(time.Now()) {
+		return Session{}, ErrTokenExpired
+	}
+
+	return session, nil
+}
+
+// SetSessionExpires sets when the session token tValue expires.
+func (s *SQLStore) SetSessionExpires(tValue string, expires time.Time) error {
+	_, err := s.exec(`UPDATE tokens SET expires = ? WHERE type = ? AND hashedValue = ?`, expires, "session", hash(tValue))
+	return err
+}
+
+// SetSessionSeries links the session token tValue to series.
+func (s *SQLStore) SetSessionSeries(tValue, series string) error {
+	_, err := s.exec(`UPDATE tokens SET series = ? WHERE type = ? AND hashedValue = ?`, series, "session", hash(tValue))
+	return err
+}
+
+// GetSessions returns the unexpired sessions of userName, most recently seen first.
+func (s *SQLStore) GetSessions(userName string) ([]Session, error) {
+	qry := `SELECT ` + sessionColumns + ` FROM tokens WHERE type = ? AND userName = ? AND expires > ?`
+	rows, err := s.query(qry, "session", userName, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+// RemoveSession removes the session of userName with id.
+func (s *SQLStore) RemoveSession(userName, id string) error {
+	qry := `DELETE FROM tokens WHERE type = ? AND userName = ? AND hashedValue = ?`
+	result, err := s.exec(qry, "session", userName, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// SaveRememberToken saves t.
+func (s *SQLStore) SaveRememberToken(t RememberToken) error {
+	qry := `INSERT INTO remember_tokens(selector, hashedValidator, series, userName, expires, created) VALUES(?, ?, ?, ?, ?, ?)`
+	_, err := s.exec(qry, t.Selector, t.HashedValidator, t.Series, t.UserName, t.Expires, time.Now())
+	if err != nil && isDuplicate(err) {
+		return ErrStoreDuplicate
+	}
+
+	return err
+}
+
+// GetRememberToken returns the token for selector.
+func (s *SQLStore) GetRememberToken(selector string) (RememberToken, error) {
+	var (
+		t       RememberToken
+		rotated sql.NullTime
+	)
+
+	qry := `SELECT selector, hashedValidator, series, userName, expires, rotated FROM remember_tokens WHERE selector = ?`
+	err := s.queryRow(qry, selector).Scan(&t.Selector, &t.HashedValidator, &t.Series, &t.UserName, &t.Expires, &rotated)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RememberToken{}, ErrTokenNotFound
+		}
+		return RememberToken{}, err
+	}
+	t.Rotated = rotated.Time
+
+	return t, nil
+}
+
+// RotateRememberToken marks the token with selector rotated and saves next.
+func (s *SQLStore) RotateRememberToken(selector string, next RememberToken) (bool, error) {
+	// only the request that marks the token rotated may save next
+	result, err := s.exec(`UPDATE remember_tokens SET rotated = ? WHERE selector = ? AND rotated IS NULL`, time.Now(), selector)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n != 1 {
+		return false, err
+	}
+
+	return true, s.SaveRememberToken(next)
+}
+
+// RemoveRememberSeries removes all tokens of series.
+func (s *SQLStore) RemoveRememberSeries(series string) error {
+	_, err := s.exec(`DELETE FROM remember_tokens WHERE series = ?`, series)
+	return err
+}
+
+// RemoveRememberTokensForUser removes all tokens of userName.
+func (s *SQLStore) RemoveRememberTokensForUser(userName string) error {
+	_, err := s.exec(`DELETE FROM remember_tokens WHERE userName = ?`, userName)
+	return err
+}
+
+// RemoveOtherRememberTokensForUser removes the tokens of userName except
+// the tokens of series.
+func (s *SQLStore) RemoveOtherRememberTokensForUser(userName, series string) error {
+	_, err := s.exec(`DELETE FROM remember_tokens WHERE userName = ? AND series <> ?`, userName, series)
+	return err
+}
+
+// SaveEmailChange saves a token to set the email address of userName.
+func (s *SQLStore) SaveEmailChange(userName, email string, token Token) error {
+	qry := `INSERT INTO email_changes(hashedValue, expires, type, userName, email, created) VALUES(?, ?, ?, ?, ?, ?)`
+	_, err := s.exec(qry, hash(token.Value), token.Expires, token.Type, userName, email, time.Now())
+	if err != nil && isDuplicate(err) {
+		return ErrStoreDuplicate
+	}
+
+	return err
+}
+
+// ConsumeEmailChange removes the given unexpired email change token and
+// returns the userName and email address.
+func (s *SQLStore) ConsumeEmailChange(tType, tValue string) (string, string, error) {
+	var userName, email string
+
+	qry := `SELECT userName, email FROM email_changes WHERE type = ? AND hashedValue = ? AND expires > ?`
+	err := s.queryRow(qry, tType, hash(tValue), time.Now()).Scan(&userName, &email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", ErrTokenNotFound
+		}
+		return "", "", err
+	}
+
+	// only the request that deletes the row may use it
+	result, err := s.exec(`DELETE FROM email_changes WHERE type = ? AND hashedValue = ?`, tType, hash(tValue))
+	if err != nil {
+		return "", "", err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return "", "", err
+	}
+	if n != 1 {
+		return "", "", ErrTokenNotFound
+	}
+
+	return userName, email, nil
+}
+
+// RemoveEmailChangesForUser removes all email change tokens of tType for user.
+func (s *SQLStore) RemoveEmailChangesForUser(tType, userName string) error {
+	_, err := s.exec(`DELETE FROM email_changes WHERE type = ? AND userName = ?`, tType, userName)
+	return err
+}
+
+// SaveEvent saves event.
+func (s *SQLStore) SaveEvent(event Event) error {
+	if event.Created.IsZero() {
+		event.Created = time.Now()
+	}
+
+	qry := `INSERT INTO events(name, result, userName, message, created) VALUES(?, ?, ?, ?, ?)`
+	_, err := s.exec(qry, event.Name, event.Result, event.UserName, event.Message, event.Created)
+	return err
+}
+
+// CountEvents returns the number of events with name and result for user created after since.
+func (s *SQLStore) CountEvents(name string, result bool, userName string, since time.Time) (int, error) {
+	var count int
+
+	qry := `SELECT COUNT(*) FROM events WHERE name = ? AND result = ? AND userName = ? AND created > ?`
+	err := s.queryRow(qry, name, result, userName, since).Scan(&count)
+
+	return count, err
+}
+
+const credentialColumns = `id, userName, name, publicKey, signCount, transports, created, lastUsed`
+
+// scanCredential scans a row of credentialColumns.
+func scanCredential(row interface{ Scan(...any) error }) (Credential, error) {
+	var (
+		c          Credential
+		transports string
+		lastUsed   sql.NullTime
+	)
+
+	err := row.Scan(&c.ID, &c.UserName, &c.Name, &c.PublicKey, &c.SignCount, &transports, &c.Created, &lastUsed)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	if transports != "" {
+		c.Transports = strings.Split(transports, ",")
+	}
+	c.LastUsed = lastUsed.Time
+
+	return c, nil
+}
+
+// SaveCredential saves a new credential.
+func (s *SQLStore) SaveCredential(c Credential) error {
+	qry := `INSERT INTO credentials(id, userName, name, publicKey, signCount, transports, created) VALUES(?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.exec(qry, c.ID, c.UserName, c.Name, c.PublicKey, c.SignCount, strings.Join(c.Transports, ","), time.Now())
+	if err != nil && isDuplicate(err) {
+		return ErrStoreDuplicate
+	}
+
+	return err
+}
+
+// GetCredential returns the credential for the given ID.
+func (s *SQLStore) GetCredential(id []byte) (Credential, error) {
+	qry := `SELECT ` + credentialColumns + ` FROM credentials WHERE id = ?`
+	c, err := scanCredential(s.queryRow(qry, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Credential{}, ErrCredentialNotFound
+	}
+
+	return c, err
+}
+
+// GetCredentialsForUser returns the credentials registered by userName.
+func (s *SQLStore) GetCredentialsForUser(userName string) ([]Credential, error) {
+	var creds []Credential
+
+	qry := `SELECT ` + credentialColumns + ` FROM credentials WHERE userName = ? ORDER BY created`
+	rows, err := s.query(qry, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c, err := scanCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, c)
+	}
+
+	return creds, rows.Err()
+}
+
+// UpdateCredentialUse records the use of a credential with the new signature counter.
+func (s *SQLStore) UpdateCredentialUse(id []byte, signCount uint32) error {
+	qry := `UPDATE credentials SET signCount = ?, lastUsed = ? WHERE id = ?`
+	_, err := s.exec(qry, signCount, time.Now(), id)
+	return err
+}
+
+// RemoveCredential removes the credential with id for userName.
+func (s *SQLStore) RemoveCredential(userName string, id []byte) error {
+	result, err := s.exec(`DELETE FROM credentials WHERE userName = ? AND id = ?`, userName, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrCredentialNotFound
+	}
+
+	return err
+}
+
+// queryPairs returns the rows of qry, which selects two string columns.
+func (s *SQLStore) queryPairs(qry string, args ...any) ([][2]string, error) {
+	var pairs [][2]string
+
+	rows, err := s.query(qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p [2]string
+		if err := rows.Scan(&p[0], &p[1]); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, p)
+	}
+
+	return pairs, rows.Err()
+}
+
+// checkExists returns notFound if qry, of the form "SELECT 1 ...", returns no rows.
+func (s *SQLStore) checkExists(notFound error, qry string, args ...any) error {
+	exists, err := s.rowExists(qry, args...)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return notFound
+	}
+
+	return nil
+}
+
+// insertAssignment inserts args with qry, returning ErrStoreDuplicate if
+// the row exists.
+func (s *SQLStore) insertAssignment(qry string, args ...any) error {
+	_, err := s.exec(qry, args...)
+	if err != nil && isDuplicate(err) {
+		return ErrStoreDuplicate
+	}
+
+	return err
+}
+
+// CreateRole creates role with its permissions.
+func (s *SQLStore) CreateRole(role Role) error {
+	err := s.insertAssignment(`INSERT INTO roles(name, description, created) VALUES(?, ?, ?)`, role.Name, role.Description, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return s.SetRolePermissions(role.Name, role.Permissions)
+}
+
+// GetRoles returns the roles, with their permissions and assignments, sorted by name.
+func (s *SQLStore) GetRoles() ([]Role, error) {
+	roles, err := s.queryPairs(`SELECT name, description FROM roles ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(roles) == 0 {
+		return nil, nil
+	}
+
+	result := make([]Role, len(roles))
+	index := make(map[string]*Role, len(roles))
+	for i, r := range roles {
+		result[i] = Role{Name: r[0], Description: r[1]}
+		index[r[0]] = &result[i]
+	}
+
+	perms, err := s.queryPairs(`SELECT role, permission FROM role_permissions ORDER BY permission`)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range perms {
+		if r, ok := index[p[0]]; ok {
+			r.Permissions = append(r.Permissions, p[1])
+		}
+	}
+
+	users, err := s.queryPairs(`SELECT role, userName FROM user_roles ORDER BY userName`)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if r, ok := index[u[0]]; ok {
+			r.Users = append(r.Users, u[1])
+		}
+	}
+
+	groups, err := s.queryPairs(`SELECT role, groupName FROM group_roles ORDER BY groupName`)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if r, ok := index[g[0]]; ok {
+			r.Groups = append(r.Groups, g[1])
+		}
+	}
+
+	return result, nil
+}
+
+// SetRolePermissions replaces the permissions of role.
+func (s *SQLStore) SetRolePermissions(role string, permissions []string) error {
+	err := s.checkExists(ErrRoleNotFound, `SELECT 1 FROM roles WHERE name=? LIMIT 1`, role)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(s.rebind(`DELETE FROM role_permissions WHERE role = ?`), role)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, perm := range permissions {
+		if seen[perm] {
+			continue
+		}
+		seen[perm] = true
+
+		_, err = tx.Exec(s.rebind(`INSERT INTO role_permissions(role, permission) VALUES(?, ?)`), role, perm)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RemoveRole removes role and its assignments.
+func (s *SQLStore) RemoveRole(role string) error {
+	for _, qry := range []string{
+		`DELETE FROM user_roles WHERE role = ?`,
+		`DELETE FROM group_roles WHERE role = ?`,
+		`DELETE FROM role_permissions WHERE role = ?`,
+		`DELETE FROM roles WHERE name = ?`,
+	} {
+		_, err := s.exec(qry, role)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddUserRole assigns role to userName.
+func (s *SQLStore) AddUserRole(userName, role string) error {
+	err := s.checkExists(ErrUserNotFound, `SELECT 1 FROM users WHERE userName=? LIMIT 1`, userName)
+	if err != nil {
+		return err
+	}
+	err = s.checkExists(ErrRoleNotFound, `SELECT 1 FROM roles WHERE name=? LIMIT 1`, role)
+	if err != nil {
+		return err
+	}
+
+	return s.insertAssignment(`INSERT INTO user_roles(userName, role) VALUES(?, ?)`, userName, role)
+}
+
+// RemoveUserRole removes the assignment of role to userName.
+func (s *SQLStore) RemoveUserRole(userName, role string) error {
+	_, err := s.exec(`DELETE FROM user_roles WHERE userName = ? AND role = ?`, userName, role)
+	return err
+}
+
+// GetPermissionsForUser returns the permissions of the roles of userName.
+func (s *SQLStore) GetPermissionsForUser(userName string) ([]string, error) {
+	var perms []string
+
+	qry := `SELECT DISTINCT permission FROM role_permissions WHERE role IN (
+		SELECT role FROM user_roles WHERE userName = ?
+		UNION
+		SELECT r.role FROM group_roles r JOIN group_members m ON m.groupName = r.groupName WHERE m.userName = ?
+	) ORDER BY permission`
+	rows, err := s.query(qry, userName, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var perm string
+		if err := rows.Scan(&perm); err != nil {
+			return nil, err
+		}
+		perms = append(perms, perm)
+	}
+
+	return perms, rows.Err()
+}
+
+// GetRolesForUser returns the roles of userName.
+func (s *SQLStore) GetRolesForUser(userName string) ([]string, error) {
+	var roles []string
+
+	qry := `SELECT role FROM user_roles WHERE userName = ?
+		UNION
+		SELECT r.role FROM group_roles r JOIN group_members m ON m.groupName = r.groupName WHERE m.userName = ?
+		ORDER BY role`
+	rows, err := s.query(qry, userName, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// CreateGroup creates group.
+func (s *SQLStore) CreateGroup(group Group) error {
+	return s.insertAssignment(`INSERT INTO user_groups(name, description, created) VALUES(?, ?, ?)`, group.Name, group.Description, time.Now())
+}
+
+// GetGroups returns the groups, with their members and roles, sorted by name.
+func (s *SQLStore) GetGroups() ([]Group, error) {
+	groups, err := s.queryPairs(`SELECT name, description FROM user_groups ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	result := make([]Group, len(groups))
+	index := make(map[string]*Group, len(groups))
+	for i, g := range groups {
+		result[i] = Group{Name: g[0], Description: g[1]}
+		index[g[0]] = &result[i]
+	}
+
+	rows, err := s.query(`SELECT groupName, userName, isLead FROM group_members ORDER BY userName`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			groupName string
+			m         GroupMember
+		)
+		if err := rows.Scan(&groupName, &m.UserName, &m.IsLead); err != nil {
+			return nil, err
+		}
+		if g, ok := index[groupName]; ok {
+			g.Members = append(g.Members, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	roles, err := s.queryPairs(`SELECT groupName, role FROM group_roles ORDER BY role`)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range roles {
+		if g, ok := index[r[0]]; ok {
+			g.Roles = append(g.Roles, r[1])
+		}
+	}
+
+	return result, nil
+}
+
+// RemoveGroup removes group, its members, and its roles.
+func (s *SQLStore) RemoveGroup(group string) error {
+	for _, qry := range []string{
+		`DELETE FROM group_members WHERE groupName = ?`,
+		`DELETE FROM group_roles WHERE groupName = ?`,
+		`DELETE FROM user_groups WHERE name = ?`,
+	} {
+		_, err := s.exec(qry, group)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetGroupMember adds userName to group, or updates if they are a lead.
+func (s *SQLStore) SetGroupMember(group, userName string, lead bool) error {
+	err := s.checkExists(ErrGroupNotFound, `SELECT 1 FROM user_groups WHERE name=? LIMIT 1`, group)
+	if err != nil {
+		return err
+	}
+	err = s.checkExists(ErrUserNotFound, `SELECT 1 FROM users WHERE userName=? LIMIT 1`, userName)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.exec(`UPDATE group_members SET isLead = ? WHERE groupName = ? AND userName = ?`, lead, group, userName)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 1 {
+		return err
+	}
+
+	// MySQL does not count a row that is unchanged
+	err = s.insertAssignment(`INSERT INTO group_members(groupName, userName, isLead) VALUES(?, ?, ?)`, group, userName, lead)
+	if errors.Is(err, ErrStoreDuplicate) {
+		return nil
+	}
+
+	return err
+}
+
+// RemoveGroupMember removes userName from group.
+func (s *SQLStore) RemoveGroupMember(group, userName string) error {
+	_, err := s.exec(`DELETE FROM group_members WHERE groupName = ? AND userName = ?`, group, userName)
+	return err
+}
+
+// AddGroupRole assigns role to group.
+func (s *SQLStore) AddGroupRole(group, role string) error {
+	err := s.checkExists(ErrGroupNotFound, `SELECT 1 FROM user_groups WHERE name=? LIMIT 1`, group)
+	if err != nil {
+		return err
+	}
+	err = s.checkExists(ErrRoleNotFound, `SELECT 1 FROM roles WHERE name=? LIMIT 1`, role)
+	if err != nil {
+		return err
+	}
+
+	return s.insertAssignment(`INSERT INTO group_roles(groupName, role) VALUES(?, ?)`, group, role)
+}
+
+// RemoveGroupRole removes the assignment of role to group.
+func (s *SQLStore) RemoveGroupRole(group, role string) error {
+	_, err := s.exec(`DELETE FROM group_roles WHERE groupName = ? AND role = ?`, group, role)
+	return err
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store is the storage for users, tokens, events, and credentials.
+//
+// Token values are provided in plain text and only their hashes are stored.
+// Methods that look up a single item return ErrUserNotFound,
+// ErrTokenNotFound, or ErrCredentialNotFound if it does not exist.
+type Store interface {
+	// CreateUser creates user with hashedPassword, returning
+	// ErrStoreDuplicate if the userName or email already exists.
+	CreateUser(user User, hashedPassword string) error
+	GetUserForName(userName string) (User, error)
+	GetUserNameForEmail(email string) (string, error)
+	UserExists(userName string) (bool, error)
+	EmailExists(email string) (bool, error)
+	GetUsers() ([]User, error)
+	GetPasswordHash(userName string) (string, error)
+	// SetPasswordHash sets the hashed password and the time it changed,
+	// and clears MustChangePassword.
+	SetPasswordHash(userName, hashedPassword string) error
+	SetMustChangePassword(userName string, mustChange bool) error
+	// ResetPasswordHash sets the hashed password of the user of the reset
+	// token tValue and marks the token used in a single transaction, so a
+	// token can only be used once. If keep is positive, the previous hashed
+	// password is added to the history in the transaction, as described by
+	// AddPasswordHistory. It returns the userName, or ErrTokenExpired or
+	// ErrTokenNotFound if the token cannot be used.
+	ResetPasswordHash(tValue, hashedPassword string, keep int) (string, error)
+	// GetPasswordHistory returns up to n previous hashed passwords for
+	// userName, most recent first.
+	GetPasswordHistory(userName string, n int) ([]string, error)
+	// AddPasswordHistory adds hashedPassword to the previous passwords for
+	// userName, keeping only the most recent keep.
+	AddPasswordHistory(userName, hashedPassword string, keep int) error
+	GetTOTPSecret(userName string) (secret string, enabled bool, err error)
+	SaveTOTPSecret(userName, secret string, enabled bool) error
+	// UseTOTPStep records step as the last TOTP time step used by userName
+	// and returns false if step is not after the last step used, so a code
+	// cannot be replayed.
+	UseTOTPStep(userName string, step int64) (bool, error)
+	// GetLockout returns the time userName is locked until and the number
+	// of consecutive locks.
+	GetLockout(userName string) (until time.Time, count int, err error)
+	SetLockout(userName string, until time.Time, count int) error
+	SetEmailVerified(userName string, verified bool) error
+	SetFullName(userName, fullName string) error
+	// SetEmail returns ErrStoreDuplicate if another user has email.
+	SetEmail(userName, email string) error
+	// LastLoginForUser returns the time and result of the login before the
+	// most recent login, or zero values if there is none.
+	LastLoginForUser(userName string) (time.Time, string, error)
+
+	SaveToken(userName string, token Token) error
+	// GetUserNameForToken returns ErrTokenExpired, along with the userName,
+	// if the token has expired.
+	GetUserNameForToken(tType, tValue string) (string, error)
+	RemoveToken(tType, tValue string) error
+	RemoveTokensForUser(tType, userName string) error
+	// RemoveOtherTokensForUser removes the tokens of tType for userName
+	// except the token with tValue.
+	RemoveOtherTokensForUser(tType, userName, tValue string) error
+	// RemoveExpiredTokens removes the tokens of tType that have expired.
+	RemoveExpiredTokens(tType string) error
+	// ConsumeToken removes an unexpired token and reports if it existed,
+	// which ensures that a token can only be used once.
+	ConsumeToken(tType, userName, tValue string) (bool, error)
+	CountTokens(tType, userName string) (int, error)
+
+	// UpdateSession records the time, IP address, and User-Agent of a
+	// request with the session token tValue. The write is skipped if the
+	// session was seen within SessionSeenInterval from the same client.
+	UpdateSession(tValue, ip, userAgent string, seen time.Time) error
+	// GetSession returns the session for the token tValue, or
+	// ErrTokenExpired if it has expired.
+	GetSession(tValue string) (Session, error)
+	SetSessionExpires(tValue string, expires time.Time) error
+	// SetSessionSeries links the session token tValue to the remember me
+	// series that started it.
+	SetSessionSeries(tValue, series string) error
+	// GetSessions returns the unexpired sessions of userName, most
+	// recently seen first.
+	GetSessions(userName string) ([]Session, error)
+	// RemoveSession removes the session of userName with id, returning
+	// ErrTokenNotFound if it does not exist.
+	RemoveSession(userName, id string) error
+
+	// SaveRememberToken returns ErrStoreDuplicate if the selector exists.
+	SaveRememberToken(t RememberToken) error
+	// GetRememberToken returns the token for selector, including expired
+	// and rotated tokens.
+	GetRememberToken(selector string) (RememberToken, error)
+	// RotateRememberToken marks the token with selector rotated and saves
+	// next, reporting false if the token was already rotated.
+	RotateRememberToken(selector string, next RememberToken) (bool, error)
+	RemoveRememberSeries(series string) error
+	RemoveRememberTokensForUser(userName string) error
+	// RemoveOtherRememberTokensForUser removes the tokens of userName
+	// except the tokens of series.
+	RemoveOtherRememberTokensForUser(userName, series string) error
+
+	// SaveEmailChange saves a token that sets the email address of
+	// userName to email when used.
+	SaveEmailChange(userName, email string, token Token) error
+	// ConsumeEmailChange removes an unexpired email change token and
+	// returns the userName and email address, or ErrTokenNotFound.
+	ConsumeEmailChange(tType, tValue string) (userName, email string, err error)
+	RemoveEmailChangesForUser(tType, userName string) error
+
+	// SaveEvent saves event, using the current time if Created is zero.
+	SaveEvent(event Event) error
+	CountEvents(name string, result bool, userName string, since time.Time) (int, error)
+
+	SaveCredential(c Credential) error
+	GetCredential(id []byte) (Credential, error)
+	GetCredentialsForUser(userName string) ([]Credential, error)
+	UpdateCredentialUse(id []byte, signCount uint32) error
+	RemoveCredential(userName string, id []byte) error
+
+	// CreateRole returns ErrStoreDuplicate if the role exists.
+	CreateRole(role Role) error
+	// GetRoles returns the roles, with their permissions and assignments,
+	// sorted by name.
+	GetRoles() ([]Role, error)
+	// SetRolePermissions replaces the permissions of role, returning
+	// ErrRoleNotFound if it does not exist.
+	SetRolePermissions(role string, permissions []string) error
+	// RemoveRole removes role and its assignments.
+	RemoveRole(role string) error
+	// AddUserRole returns ErrUserNotFound or ErrRoleNotFound if either
+	// does not exist, or ErrStoreDuplicate if it is already assigned.
+	AddUserRole(userName, role string) error
+	RemoveUserRole(userName, role string) error
+	// GetPermissionsForUser returns the permissions of the roles assigned
+	// to userName directly or through groups, sorted without duplicates.
+	GetPermissionsForUser(userName string) ([]string, error)
+	// GetRolesForUser returns the roles assigned to userName directly or
+	// through groups, sorted without duplicates.
+	GetRolesForUser(userName string) ([]string, error)
+
+	// CreateGroup returns ErrStoreDuplicate if the group exists.
+	CreateGroup(group Group) error
+	// GetGroups returns the groups, with their members and roles, sorted
+	// by name.
+	GetGroups() ([]Group, error)
+	// RemoveGroup removes group, its members, and its roles.
+	RemoveGroup(group string) error
+	// SetGroupMember adds userName to group, or updates if they are a
+	// lead, returning ErrGroupNotFound or ErrUserNotFound.
+	SetGroupMember(group, userName string, lead bool) error
+	RemoveGroupMember(group, userName string) error
+	// AddGroupRole returns ErrGroupNotFound or ErrRoleNotFound if either
+	// does not exist, or ErrStoreDuplicate if it is already assigned.
+	AddGroupRole(group, role string) error
+	RemoveGroupRole(group, role string) error
+
+	Close() error
+}
+
+var (
+	ErrStoreDriver    = errors.New("unsupported driver")
+	ErrStoreDuplicate = errors.New("duplicate")
+)
+
+// Supported SQL dialects.
+const (
+	DialectMySQL    = "mysql"
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// MemoryDriverName is the DriverName of the in-memory store.
+const MemoryDriverName = "memory"
+
+// dialects maps a database/sql driver name to its SQL dialect.
+var dialects = map[string]string{
+	"mysql":    DialectMySQL,
+	"postgres": DialectPostgres,
+	"pgx":      DialectPostgres,
+	"sqlite":   DialectSQLite,
+	"sqlite3":  DialectSQLite,
+}
+
+// NewStore returns the Store for driverName, which is either "memory" or
+// the name of a registered database/sql driver for MySQL, PostgreSQL, or
+// SQLite. The driver must be imported by the main package.
+func NewStore(driverName, dataSourceName string) (Store, error) {
+	fn := "NewStore"
+
+	if driverName == MemoryDriverName {
+		return NewMemStore(), nil
+	}
+
+	dialect, ok := dialects[driverName]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w: %q", fn, ErrStoreDriver, driverName)
+	}
+
+	db, err := InitDB(driverName, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	return NewSQLStore(db, dialect), nil
+}
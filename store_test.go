@@ -0,0 +1,872 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+	_ "modernc.org/sqlite"
+)
+
+// newSQLiteStore returns a Store for a new SQLite database with the schema.
+func newSQLiteStore(t *testing.T) *weblogin.SQLStore {
+	dsn := filepath.Join(t.TempDir(), "test.db")
+
+	store, err := weblogin.NewStore("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	s := store.(*weblogin.SQLStore)
+	latest, err := s.LatestSchemaVersion()
+	if err != nil {
+		t.Fatalf("LatestSchemaVersion failed: %v", err)
+	}
+
+	err = s.Migrate(latest, false, io.Discard)
+	if err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	return s
+}
+
+// stores returns each Store implementation that can be tested locally.
+func stores(t *testing.T) map[string]weblogin.Store {
+	return map[string]weblogin.Store{
+		"memory": weblogin.NewMemStore(),
+		"sqlite": newSQLiteStore(t),
+	}
+}
+
+func TestNewStore(t *testing.T) {
+	_, err := weblogin.NewStore("invalid", "")
+	if !errors.Is(err, weblogin.ErrStoreDriver) {
+		t.Errorf("got err %v, want %v", err, weblogin.ErrStoreDriver)
+	}
+
+	s, err := weblogin.NewStore(weblogin.MemoryDriverName, "")
+	if err != nil || s == nil {
+		t.Errorf("got %v, %v for memory store", s, err)
+	}
+}
+
+func TestStoreUsers(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			user := weblogin.User{UserName: "user", FullName: "Full Name", Email: "user@email", IsAdmin: true}
+
+			err := s.CreateUser(user, "hash")
+			if err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+
+			err = s.CreateUser(user, "hash")
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("CreateUser duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+
+			err = s.CreateUser(weblogin.User{UserName: "other", Email: user.Email}, "hash")
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("CreateUser duplicate email got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+
+			got, err := s.GetUserForName(user.UserName)
+			if err != nil || got.UserName != user.UserName || got.Email != user.Email || !got.IsAdmin || got.Created.IsZero() || got.EmailVerified {
+				t.Errorf("GetUserForName got %+v, %v", got, err)
+			}
+
+			_, err = s.GetUserForName("missing")
+			if !errors.Is(err, weblogin.ErrUserNotFound) {
+				t.Errorf("GetUserForName missing got err %v, want %v", err, weblogin.ErrUserNotFound)
+			}
+
+			userName, err := s.GetUserNameForEmail(user.Email)
+			if err != nil || userName != user.UserName {
+				t.Errorf("GetUserNameForEmail got %q, %v", userName, err)
+			}
+
+			exists, err := s.UserExists(user.UserName)
+			if err != nil || !exists {
+				t.Errorf("UserExists got %v, %v", exists, err)
+			}
+
+			exists, err = s.EmailExists("missing@email")
+			if err != nil || exists {
+				t.Errorf("EmailExists missing got %v, %v", exists, err)
+			}
+
+			err = s.SetPasswordHash(user.UserName, "newhash")
+			if err != nil {
+				t.Errorf("SetPasswordHash failed: %v", err)
+			}
+			hash, err := s.GetPasswordHash(user.UserName)
+			if err != nil || hash != "newhash" {
+				t.Errorf("GetPasswordHash got %q, %v", hash, err)
+			}
+			got, err = s.GetUserForName(user.UserName)
+			if err != nil || time.Since(got.PasswordChanged) > time.Minute {
+				t.Errorf("GetUserForName got PasswordChanged %v, %v", got.PasswordChanged, err)
+			}
+
+			err = s.SetMustChangePassword(user.UserName, true)
+			if err != nil {
+				t.Errorf("SetMustChangePassword failed: %v", err)
+			}
+			got, err = s.GetUserForName(user.UserName)
+			if err != nil || !got.MustChangePassword {
+				t.Errorf("GetUserForName got MustChangePassword %v, %v", got.MustChangePassword, err)
+			}
+			err = s.SetPasswordHash(user.UserName, "newhash")
+			if err != nil {
+				t.Errorf("SetPasswordHash failed: %v", err)
+			}
+			got, err = s.GetUserForName(user.UserName)
+			if err != nil || got.MustChangePassword {
+				t.Errorf("SetPasswordHash did not clear MustChangePassword, %v", err)
+			}
+
+			for _, hash := range []string{"hash1", "hash2", "hash3"} {
+				err = s.AddPasswordHistory(user.UserName, hash, 2)
+				if err != nil {
+					t.Errorf("AddPasswordHistory failed: %v", err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			history, err := s.GetPasswordHistory(user.UserName, 5)
+			if err != nil || !slices.Equal(history, []string{"hash3", "hash2"}) {
+				t.Errorf("GetPasswordHistory got %q, %v", history, err)
+			}
+			history, err = s.GetPasswordHistory(user.UserName, 1)
+			if err != nil || !slices.Equal(history, []string{"hash3"}) {
+				t.Errorf("GetPasswordHistory 1 got %q, %v", history, err)
+			}
+
+			err = s.SaveTOTPSecret(user.UserName, "secret", true)
+			if err != nil {
+				t.Errorf("SaveTOTPSecret failed: %v", err)
+			}
+			secret, enabled, err := s.GetTOTPSecret(user.UserName)
+			if err != nil || secret != "secret" || !enabled {
+				t.Errorf("GetTOTPSecret got %q, %v, %v", secret, enabled, err)
+			}
+
+			for _, tc := range []struct {
+				step int64
+				want bool
+			}{{10, true}, {10, false}, {9, false}, {11, true}} {
+				ok, err := s.UseTOTPStep(user.UserName, tc.step)
+				if err != nil || ok != tc.want {
+					t.Errorf("UseTOTPStep(%d) got %v, %v, want %v", tc.step, ok, err, tc.want)
+				}
+			}
+
+			until := time.Now().Add(time.Hour).Truncate(time.Second)
+			err = s.SetLockout(user.UserName, until, 2)
+			if err != nil {
+				t.Errorf("SetLockout failed: %v", err)
+			}
+			gotUntil, count, err := s.GetLockout(user.UserName)
+			if err != nil || !gotUntil.Equal(until) || count != 2 {
+				t.Errorf("GetLockout got %v, %d, %v", gotUntil, count, err)
+			}
+
+			err = s.SetEmailVerified(user.UserName, true)
+			if err != nil {
+				t.Errorf("SetEmailVerified failed: %v", err)
+			}
+
+			users, err := s.GetUsers()
+			if err != nil || len(users) != 1 || !users[0].IsLocked() || !users[0].EmailVerified {
+				t.Errorf("GetUsers got %v, %v", users, err)
+			}
+		})
+	}
+}
+
+func TestStoreTokens(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			token := weblogin.Token{Value: "value", Type: "test", Expires: time.Now().Add(time.Hour)}
+			expired := weblogin.Token{Value: "expired", Type: "test", Expires: time.Now().Add(-time.Hour)}
+
+			for _, tok := range []weblogin.Token{token, expired} {
+				err := s.SaveToken("user", tok)
+				if err != nil {
+					t.Fatalf("SaveToken failed: %v", err)
+				}
+			}
+
+			userName, err := s.GetUserNameForToken("test", token.Value)
+			if err != nil || userName != "user" {
+				t.Errorf("GetUserNameForToken got %q, %v", userName, err)
+			}
+
+			_, err = s.GetUserNameForToken("other", token.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetUserNameForToken wrong type got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+
+			_, err = s.GetUserNameForToken("test", expired.Value)
+			if !errors.Is(err, weblogin.ErrTokenExpired) {
+				t.Errorf("GetUserNameForToken expired got err %v, want %v", err, weblogin.ErrTokenExpired)
+			}
+
+			count, err := s.CountTokens("test", "user")
+			if err != nil || count != 1 {
+				t.Errorf("CountTokens got %d, %v, want 1", count, err)
+			}
+
+			ok, err := s.ConsumeToken("test", "user", token.Value)
+			if err != nil || !ok {
+				t.Errorf("ConsumeToken got %v, %v, want true", ok, err)
+			}
+			ok, err = s.ConsumeToken("test", "user", token.Value)
+			if err != nil || ok {
+				t.Errorf("ConsumeToken again got %v, %v, want false", ok, err)
+			}
+
+			other := weblogin.Token{Value: "other", Type: "test", Expires: time.Now().Add(time.Hour)}
+			err = s.SaveToken("user", other)
+			if err != nil {
+				t.Fatalf("SaveToken failed: %v", err)
+			}
+			err = s.RemoveExpiredTokens("test")
+			if err != nil {
+				t.Errorf("RemoveExpiredTokens failed: %v", err)
+			}
+			_, err = s.GetUserNameForToken("test", expired.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetUserNameForToken expired removed got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+			_, err = s.GetUserNameForToken("test", other.Value)
+			if err != nil {
+				t.Errorf("GetUserNameForToken unexpired got err %v", err)
+			}
+
+			err = s.RemoveOtherTokensForUser("test", "user", other.Value)
+			if err != nil {
+				t.Errorf("RemoveOtherTokensForUser failed: %v", err)
+			}
+			count, err = s.CountTokens("test", "user")
+			if err != nil || count != 1 {
+				t.Errorf("CountTokens after RemoveOtherTokensForUser got %d, %v, want 1", count, err)
+			}
+			_, err = s.GetUserNameForToken("test", expired.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetUserNameForToken other got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+
+			err = s.RemoveTokensForUser("test", "user")
+			if err != nil {
+				t.Errorf("RemoveTokensForUser failed: %v", err)
+			}
+			_, err = s.GetUserNameForToken("test", expired.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetUserNameForToken removed got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+			_, err = s.GetUserNameForToken("test", other.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetUserNameForToken removed other got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestStoreResetPasswordHash(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := s.CreateUser(weblogin.User{UserName: "user", FullName: "Full Name", Email: "user@email"}, "hash")
+			if err != nil {
+				t.Fatalf("CreateUser failed: %v", err)
+			}
+			for _, tok := range []weblogin.Token{
+				{Value: "valid", Type: weblogin.ResetTokenType, Expires: time.Now().Add(time.Hour)},
+				{Value: "expired", Type: weblogin.ResetTokenType, Expires: time.Now().Add(-time.Hour)},
+				{Value: "other", Type: "test", Expires: time.Now().Add(time.Hour)},
+			} {
+				err := s.SaveToken("user", tok)
+				if err != nil {
+					t.Fatalf("SaveToken failed: %v", err)
+				}
+			}
+
+			userName, err := s.ResetPasswordHash("valid", "newhash", 2)
+			if err != nil || userName != "user" {
+				t.Errorf("ResetPasswordHash got %q, %v, want user", userName, err)
+			}
+			hash, err := s.GetPasswordHash("user")
+			if err != nil || hash != "newhash" {
+				t.Errorf("GetPasswordHash got %q, %v, want newhash", hash, err)
+			}
+			history, err := s.GetPasswordHistory("user", 2)
+			if err != nil || !slices.Equal(history, []string{"hash"}) {
+				t.Errorf("GetPasswordHistory got %v, %v, want [hash]", history, err)
+			}
+
+			// a token can only be used once
+			_, err = s.ResetPasswordHash("valid", "otherhash", 2)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("ResetPasswordHash used got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+			userName, err = s.GetUserNameForToken(weblogin.ResetUsedTokenType, "valid")
+			if err != nil || userName != "user" {
+				t.Errorf("GetUserNameForToken used got %q, %v, want user", userName, err)
+			}
+
+			for tValue, want := range map[string]error{
+				"expired": weblogin.ErrTokenExpired,
+				"other":   weblogin.ErrTokenNotFound,
+				"missing": weblogin.ErrTokenNotFound,
+			} {
+				_, err = s.ResetPasswordHash(tValue, "otherhash", 2)
+				if !errors.Is(err, want) {
+					t.Errorf("ResetPasswordHash %s got err %v, want %v", tValue, err, want)
+				}
+			}
+			hash, err = s.GetPasswordHash("user")
+			if err != nil || hash != "newhash" {
+				t.Errorf("GetPasswordHash got %q, %v, want newhash", hash, err)
+			}
+			history, err = s.GetPasswordHistory("user", 2)
+			if err != nil || len(history) != 1 {
+				t.Errorf("GetPasswordHistory after failed resets got %v, %v, want 1", history, err)
+			}
+		})
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			expires := time.Now().Add(time.Hour)
+			for _, tok := range []weblogin.Token{
+				{Value: "first", Type: "session", Expires: expires},
+				{Value: "second", Type: "session", Expires: expires},
+				{Value: "expired", Type: "session", Expires: time.Now().Add(-time.Hour)},
+				{Value: "other", Type: "test", Expires: expires},
+			} {
+				err := s.SaveToken("user", tok)
+				if err != nil {
+					t.Fatalf("SaveToken failed: %v", err)
+				}
+			}
+
+			seen := time.Now().Add(time.Minute).Truncate(time.Second)
+			err := s.UpdateSession("second", "10.0.0.1", "agent", seen)
+			if err != nil {
+				t.Errorf("UpdateSession failed: %v", err)
+			}
+			// within SessionSeenInterval from the same client is not written
+			err = s.UpdateSession("second", "10.0.0.1", "agent", seen.Add(time.Second))
+			if err != nil {
+				t.Errorf("UpdateSession failed: %v", err)
+			}
+
+			sessions, err := s.GetSessions("user")
+			if err != nil || len(sessions) != 2 {
+				t.Fatalf("GetSessions got %v, %v, want 2 sessions", sessions, err)
+			}
+			got := sessions[0]
+			if got.IP != "10.0.0.1" || got.UserAgent != "agent" || !got.LastSeen.Equal(seen) || got.Created.IsZero() || got.ID == "" {
+				t.Errorf("GetSessions got %+v", got)
+			}
+			if !sessions[1].LastSeen.IsZero() {
+				t.Errorf("GetSessions got LastSeen %v for unused session", sessions[1].LastSeen)
+			}
+
+			session, err := s.GetSession("second")
+			if err != nil || session.ID != got.ID || session.UserName != "user" {
+				t.Errorf("GetSession got %+v, %v", session, err)
+			}
+			_, err = s.GetSession("expired")
+			if !errors.Is(err, weblogin.ErrTokenExpired) {
+				t.Errorf("GetSession expired got err %v, want %v", err, weblogin.ErrTokenExpired)
+			}
+			_, err = s.GetSession("other")
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetSession wrong type got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+
+			later := expires.Add(time.Hour).Truncate(time.Second)
+			err = s.SetSessionExpires("second", later)
+			if err != nil {
+				t.Errorf("SetSessionExpires failed: %v", err)
+			}
+			session, err = s.GetSession("second")
+			if err != nil || !session.Expires.Equal(later) {
+				t.Errorf("GetSession after SetSessionExpires got %v, %v, want %v", session.Expires, err, later)
+			}
+
+			err = s.SetSessionSeries("second", "series")
+			if err != nil {
+				t.Errorf("SetSessionSeries failed: %v", err)
+			}
+			session, err = s.GetSession("second")
+			if err != nil || session.Series != "series" {
+				t.Errorf("GetSession after SetSessionSeries got %q, %v, want series", session.Series, err)
+			}
+
+			err = s.RemoveSession("other", got.ID)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("RemoveSession other user got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+			err = s.RemoveSession("user", got.ID)
+			if err != nil {
+				t.Errorf("RemoveSession failed: %v", err)
+			}
+			_, err = s.GetUserNameForToken("session", "second")
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetUserNameForToken removed got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestStoreRememberTokens(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			expires := time.Now().Add(time.Hour).Truncate(time.Second)
+			first := weblogin.RememberToken{
+				Selector: "selector1", HashedValidator: "hash1",
+				Series: "series", UserName: "user", Expires: expires,
+			}
+			err := s.SaveRememberToken(first)
+			if err != nil {
+				t.Fatalf("SaveRememberToken failed: %v", err)
+			}
+			err = s.SaveRememberToken(first)
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("SaveRememberToken duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+
+			got, err := s.GetRememberToken("selector1")
+			if err != nil || got.HashedValidator != "hash1" || got.Series != "series" ||
+				got.UserName != "user" || !got.Expires.Equal(expires) || !got.Rotated.IsZero() {
+				t.Errorf("GetRememberToken got %+v, %v", got, err)
+			}
+			_, err = s.GetRememberToken("missing")
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetRememberToken missing got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+
+			next := first
+			next.Selector, next.HashedValidator = "selector2", "hash2"
+			ok, err := s.RotateRememberToken("selector1", next)
+			if err != nil || !ok {
+				t.Errorf("RotateRememberToken got %v, %v, want true", ok, err)
+			}
+			// only the first request may rotate a token
+			again := first
+			again.Selector = "selector3"
+			ok, err = s.RotateRememberToken("selector1", again)
+			if err != nil || ok {
+				t.Errorf("RotateRememberToken rotated got %v, %v, want false", ok, err)
+			}
+			got, err = s.GetRememberToken("selector1")
+			if err != nil || got.Rotated.IsZero() {
+				t.Errorf("GetRememberToken rotated got %+v, %v", got, err)
+			}
+			_, err = s.GetRememberToken("selector3")
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetRememberToken not rotated got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+
+			other := weblogin.RememberToken{
+				Selector: "selector4", HashedValidator: "hash4",
+				Series: "other", UserName: "user", Expires: expires,
+			}
+			err = s.SaveRememberToken(other)
+			if err != nil {
+				t.Fatalf("SaveRememberToken failed: %v", err)
+			}
+
+			err = s.RemoveRememberSeries("series")
+			if err != nil {
+				t.Errorf("RemoveRememberSeries failed: %v", err)
+			}
+			for _, selector := range []string{"selector1", "selector2"} {
+				_, err = s.GetRememberToken(selector)
+				if !errors.Is(err, weblogin.ErrTokenNotFound) {
+					t.Errorf("GetRememberToken %s got err %v, want %v", selector, err, weblogin.ErrTokenNotFound)
+				}
+			}
+			_, err = s.GetRememberToken("selector4")
+			if err != nil {
+				t.Errorf("GetRememberToken other series got err %v", err)
+			}
+
+			last := weblogin.RememberToken{
+				Selector: "selector5", HashedValidator: "hash5",
+				Series: "last", UserName: "user", Expires: expires,
+			}
+			err = s.SaveRememberToken(last)
+			if err != nil {
+				t.Fatalf("SaveRememberToken failed: %v", err)
+			}
+			err = s.RemoveOtherRememberTokensForUser("user", "other")
+			if err != nil {
+				t.Errorf("RemoveOtherRememberTokensForUser failed: %v", err)
+			}
+			_, err = s.GetRememberToken("selector5")
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetRememberToken after RemoveOtherRememberTokensForUser got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+			_, err = s.GetRememberToken("selector4")
+			if err != nil {
+				t.Errorf("GetRememberToken kept series got err %v", err)
+			}
+
+			err = s.RemoveRememberTokensForUser("user")
+			if err != nil {
+				t.Errorf("RemoveRememberTokensForUser failed: %v", err)
+			}
+			_, err = s.GetRememberToken("selector4")
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("GetRememberToken after RemoveRememberTokensForUser got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestStoreRoles(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, userName := range []string{"lead", "member"} {
+				err := s.CreateUser(weblogin.User{UserName: userName, Email: userName + "@email"}, "hash")
+				if err != nil {
+					t.Fatalf("CreateUser failed: %v", err)
+				}
+			}
+
+			err := s.CreateRole(weblogin.Role{Name: "viewer", Description: "view", Permissions: []string{"b", "a", "a"}})
+			if err != nil {
+				t.Fatalf("CreateRole failed: %v", err)
+			}
+			err = s.CreateRole(weblogin.Role{Name: "viewer"})
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("CreateRole duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+			err = s.CreateRole(weblogin.Role{Name: "editor", Permissions: []string{"c"}})
+			if err != nil {
+				t.Fatalf("CreateRole failed: %v", err)
+			}
+			err = s.SetRolePermissions("missing", nil)
+			if !errors.Is(err, weblogin.ErrRoleNotFound) {
+				t.Errorf("SetRolePermissions missing got err %v, want %v", err, weblogin.ErrRoleNotFound)
+			}
+
+			err = s.AddUserRole("lead", "viewer")
+			if err != nil {
+				t.Errorf("AddUserRole failed: %v", err)
+			}
+			err = s.AddUserRole("lead", "viewer")
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("AddUserRole duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+			err = s.AddUserRole("missing", "viewer")
+			if !errors.Is(err, weblogin.ErrUserNotFound) {
+				t.Errorf("AddUserRole missing user got err %v, want %v", err, weblogin.ErrUserNotFound)
+			}
+			err = s.AddUserRole("lead", "missing")
+			if !errors.Is(err, weblogin.ErrRoleNotFound) {
+				t.Errorf("AddUserRole missing role got err %v, want %v", err, weblogin.ErrRoleNotFound)
+			}
+
+			err = s.CreateGroup(weblogin.Group{Name: "team", Description: "a team"})
+			if err != nil {
+				t.Fatalf("CreateGroup failed: %v", err)
+			}
+			err = s.CreateGroup(weblogin.Group{Name: "team"})
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("CreateGroup duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+			for _, m := range []weblogin.GroupMember{{"member", true}, {"member", false}, {"lead", true}} {
+				err = s.SetGroupMember("team", m.UserName, m.IsLead)
+				if err != nil {
+					t.Errorf("SetGroupMember %+v failed: %v", m, err)
+				}
+			}
+			err = s.SetGroupMember("missing", "lead", false)
+			if !errors.Is(err, weblogin.ErrGroupNotFound) {
+				t.Errorf("SetGroupMember missing group got err %v, want %v", err, weblogin.ErrGroupNotFound)
+			}
+			err = s.SetGroupMember("team", "missing", false)
+			if !errors.Is(err, weblogin.ErrUserNotFound) {
+				t.Errorf("SetGroupMember missing user got err %v, want %v", err, weblogin.ErrUserNotFound)
+			}
+			err = s.AddGroupRole("team", "editor")
+			if err != nil {
+				t.Errorf("AddGroupRole failed: %v", err)
+			}
+			err = s.AddGroupRole("team", "editor")
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("AddGroupRole duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+
+			roles, err := s.GetRoles()
+			want := []weblogin.Role{
+				{Name: "editor", Permissions: []string{"c"}, Groups: []string{"team"}},
+				{Name: "viewer", Description: "view", Permissions: []string{"a", "b"}, Users: []string{"lead"}},
+			}
+			if err != nil || !reflect.DeepEqual(roles, want) {
+				t.Errorf("GetRoles got %+v, %v, want %+v", roles, err, want)
+			}
+
+			groups, err := s.GetGroups()
+			wantGroups := []weblogin.Group{{
+				Name: "team", Description: "a team", Roles: []string{"editor"},
+				Members: []weblogin.GroupMember{{"lead", true}, {"member", false}},
+			}}
+			if err != nil || !reflect.DeepEqual(groups, wantGroups) {
+				t.Errorf("GetGroups got %+v, %v, want %+v", groups, err, wantGroups)
+			}
+
+			for userName, want := range map[string][]string{
+				"lead":    {"editor", "viewer"},
+				"member":  {"editor"},
+				"missing": nil,
+			} {
+				roles, err := s.GetRolesForUser(userName)
+				if err != nil || !slices.Equal(roles, want) {
+					t.Errorf("GetRolesForUser(%q) got %v, %v, want %v", userName, roles, err, want)
+				}
+			}
+
+			for userName, want := range map[string][]string{
+				"lead":    {"a", "b", "c"},
+				"member":  {"c"},
+				"missing": nil,
+			} {
+				perms, err := s.GetPermissionsForUser(userName)
+				if err != nil || !slices.Equal(perms, want) {
+					t.Errorf("GetPermissionsForUser(%q) got %v, %v, want %v", userName, perms, err, want)
+				}
+			}
+
+			err = s.SetRolePermissions("editor", []string{"d"})
+			if err != nil {
+				t.Errorf("SetRolePermissions failed: %v", err)
+			}
+			err = s.RemoveGroupMember("team", "member")
+			if err != nil {
+				t.Errorf("RemoveGroupMember failed: %v", err)
+			}
+			perms, err := s.GetPermissionsForUser("member")
+			if err != nil || perms != nil {
+				t.Errorf("GetPermissionsForUser removed member got %v, %v, want none", perms, err)
+			}
+			perms, err = s.GetPermissionsForUser("lead")
+			if want := []string{"a", "b", "d"}; err != nil || !slices.Equal(perms, want) {
+				t.Errorf("GetPermissionsForUser got %v, %v, want %v", perms, err, want)
+			}
+
+			for _, err := range []error{
+				s.RemoveGroupRole("team", "editor"),
+				s.RemoveUserRole("lead", "viewer"),
+			} {
+				if err != nil {
+					t.Errorf("Remove failed: %v", err)
+				}
+			}
+			perms, err = s.GetPermissionsForUser("lead")
+			if err != nil || perms != nil {
+				t.Errorf("GetPermissionsForUser unassigned got %v, %v, want none", perms, err)
+			}
+
+			err = s.AddUserRole("lead", "viewer")
+			if err != nil {
+				t.Errorf("AddUserRole failed: %v", err)
+			}
+			for _, err := range []error{s.RemoveRole("viewer"), s.RemoveGroup("team")} {
+				if err != nil {
+					t.Errorf("Remove failed: %v", err)
+				}
+			}
+			roles, err = s.GetRoles()
+			if err != nil || len(roles) != 1 || roles[0].Name != "editor" {
+				t.Errorf("GetRoles after RemoveRole got %+v, %v", roles, err)
+			}
+			groups, err = s.GetGroups()
+			if err != nil || groups != nil {
+				t.Errorf("GetGroups after RemoveGroup got %+v, %v", groups, err)
+			}
+			perms, err = s.GetPermissionsForUser("lead")
+			if err != nil || perms != nil {
+				t.Errorf("GetPermissionsForUser removed role got %v, %v, want none", perms, err)
+			}
+		})
+	}
+}
+
+func TestStoreEmailChanges(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, u := range []weblogin.User{
+				{UserName: "user", FullName: "Full Name", Email: "user@email"},
+				{UserName: "other", FullName: "Other", Email: "other@email"},
+			} {
+				err := s.CreateUser(u, "hash")
+				if err != nil {
+					t.Fatalf("CreateUser failed: %v", err)
+				}
+			}
+
+			err := s.SetFullName("user", "New Name")
+			if err != nil {
+				t.Errorf("SetFullName failed: %v", err)
+			}
+
+			err = s.SetEmail("user", "other@email")
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("SetEmail duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+			err = s.SetEmail("user", "new@email")
+			if err != nil {
+				t.Errorf("SetEmail failed: %v", err)
+			}
+
+			got, err := s.GetUserForName("user")
+			if err != nil || got.FullName != "New Name" || got.Email != "new@email" {
+				t.Errorf("GetUserForName got %+v, %v", got, err)
+			}
+
+			token := weblogin.Token{Value: "value", Type: "email", Expires: time.Now().Add(time.Hour)}
+			expired := weblogin.Token{Value: "expired", Type: "email", Expires: time.Now().Add(-time.Hour)}
+			for _, tok := range []weblogin.Token{token, expired} {
+				err := s.SaveEmailChange("user", "change@email", tok)
+				if err != nil {
+					t.Fatalf("SaveEmailChange failed: %v", err)
+				}
+			}
+
+			_, _, err = s.ConsumeEmailChange("other", token.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("ConsumeEmailChange wrong type got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+			_, _, err = s.ConsumeEmailChange("email", expired.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("ConsumeEmailChange expired got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+
+			userName, email, err := s.ConsumeEmailChange("email", token.Value)
+			if err != nil || userName != "user" || email != "change@email" {
+				t.Errorf("ConsumeEmailChange got %q, %q, %v", userName, email, err)
+			}
+			_, _, err = s.ConsumeEmailChange("email", token.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("ConsumeEmailChange again got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+
+			err = s.SaveEmailChange("user", "change@email", token)
+			if err != nil {
+				t.Fatalf("SaveEmailChange failed: %v", err)
+			}
+			err = s.RemoveEmailChangesForUser("email", "user")
+			if err != nil {
+				t.Errorf("RemoveEmailChangesForUser failed: %v", err)
+			}
+			_, _, err = s.ConsumeEmailChange("email", token.Value)
+			if !errors.Is(err, weblogin.ErrTokenNotFound) {
+				t.Errorf("ConsumeEmailChange removed got err %v, want %v", err, weblogin.ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func TestStoreEvents(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			dt := time.Date(2023, time.January, 15, 1, 0, 0, 0, time.UTC)
+
+			for _, hour := range []int{1, 3, 2} {
+				err := s.SaveEvent(weblogin.Event{
+					Name: weblogin.EventLogin, Result: hour != 2, UserName: "user",
+					Created: dt.Add(time.Duration(hour-1) * time.Hour),
+				})
+				if err != nil {
+					t.Fatalf("SaveEvent failed: %v", err)
+				}
+			}
+
+			got, result, err := s.LastLoginForUser("user")
+			if err != nil || !got.Equal(dt.Add(time.Hour)) || result != "false" {
+				t.Errorf("LastLoginForUser got %v, %q, %v", got, result, err)
+			}
+
+			count, err := s.CountEvents(weblogin.EventLogin, true, "user", dt)
+			if err != nil || count != 1 {
+				t.Errorf("CountEvents got %d, %v, want 1", count, err)
+			}
+		})
+	}
+}
+
+func TestStoreCredentials(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			cred := weblogin.Credential{
+				ID: []byte{1, 2, 3}, UserName: "user", Name: "key",
+				PublicKey: []byte{4, 5, 6}, Transports: []string{"usb", "nfc"},
+			}
+
+			err := s.SaveCredential(cred)
+			if err != nil {
+				t.Fatalf("SaveCredential failed: %v", err)
+			}
+
+			err = s.SaveCredential(cred)
+			if !errors.Is(err, weblogin.ErrStoreDuplicate) {
+				t.Errorf("SaveCredential duplicate got err %v, want %v", err, weblogin.ErrStoreDuplicate)
+			}
+
+			err = s.UpdateCredentialUse(cred.ID, 42)
+			if err != nil {
+				t.Errorf("UpdateCredentialUse failed: %v", err)
+			}
+
+			got, err := s.GetCredential(cred.ID)
+			if err != nil || got.SignCount != 42 || got.LastUsed.IsZero() || len(got.Transports) != 2 {
+				t.Errorf("GetCredential got %+v, %v", got, err)
+			}
+
+			creds, err := s.GetCredentialsForUser("user")
+			if err != nil || len(creds) != 1 {
+				t.Errorf("GetCredentialsForUser got %v, %v", creds, err)
+			}
+
+			err = s.RemoveCredential("other", cred.ID)
+			if !errors.Is(err, weblogin.ErrCredentialNotFound) {
+				t.Errorf("RemoveCredential other got err %v, want %v", err, weblogin.ErrCredentialNotFound)
+			}
+
+			err = s.RemoveCredential("user", cred.ID)
+			if err != nil {
+				t.Errorf("RemoveCredential failed: %v", err)
+			}
+
+			_, err = s.GetCredential(cred.ID)
+			if !errors.Is(err, weblogin.ErrCredentialNotFound) {
+				t.Errorf("GetCredential removed got err %v, want %v", err, weblogin.ErrCredentialNotFound)
+			}
+		})
+	}
+}
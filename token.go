@@ -14,8 +14,8 @@ package weblogin
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
+	"errors"
 	"time"
 )
 
@@ -34,8 +34,18 @@ func hash(s string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+var (
+	ErrTokenNotFound = errors.New("token not found")
+	ErrTokenExpired  = errors.New("token expired")
+)
+
 // SaveNewToken creates and saves a token for user of size that expires in hrs.
-func SaveNewToken(db *sql.DB, tType, userName string, size, hrs int) (Token, error) {
+func SaveNewToken(s Store, tType, userName string, size, hrs int) (Token, error) {
+	return SaveNewTokenWithDuration(s, tType, userName, size, time.Duration(hrs)*time.Hour)
+}
+
+// SaveNewTokenWithDuration creates and saves a token for user of size that expires after d.
+func SaveNewTokenWithDuration(s Store, tType, userName string, size int, d time.Duration) (Token, error) {
 	var err error
 
 	token := Token{Type: tType}
@@ -43,21 +53,8 @@ func SaveNewToken(db *sql.DB, tType, userName string, size, hrs int) (Token, err
 	if err != nil {
 		return Token{}, err
 	}
-	token.Expires = time.Now().Add(time.Duration(hrs) * time.Hour)
+	token.Expires = time.Now().Add(d)
 
-	// hash the token to avoid reuse if database is compromised
-	hashedValue := hash(token.Value)
-
-	qry := `INSERT INTO tokens(hashedValue, expires, type, userName) VALUES(?, ?, ?, ?)`
-	_, err = db.Exec(qry, hashedValue, token.Expires, tType, userName)
+	err = s.SaveToken(userName, token)
 	return token, err
 }
-
-// RemoveToken removes the given sessionToken.
-func RemoveToken(db *sql.DB, tType, tValue string) error {
-	hashedValue := hash(tValue)
-
-	qry := `DELETE FROM tokens WHERE type = ? AND hashedValue = ?`
-	_, err := db.Exec(qry, tType, hashedValue)
-	return err
-}
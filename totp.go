@@ -0,0 +1,249 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrTOTPNotConfigured = errors.New("TOTP key is not configured")
+
+// TOTPPageData contains data passed to the HTML template.
+type TOTPPageData struct {
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+	User      User
+	Enabled   bool         // user has enabled TOTP
+	Secret    string       // secret to enroll, if not enabled
+	URI       template.URL // otpauth URI to enroll, if not enabled
+}
+
+const (
+	MsgTOTPUnavailable = "Two-factor authentication is not available."
+	MsgTOTPEnabled     = "Two-factor authentication is enabled."
+	MsgTOTPDisabled    = "Two-factor authentication is disabled."
+)
+
+// TOTPHandler handles /totp requests to enroll or remove TOTP two-factor
+// authentication for the current user.
+func (app *App) TOTPHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil {
+		logger.Error("failed to GetUser", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	pageData := TOTPPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), User: user}
+
+	switch {
+	case user.UserName == "":
+		// template will ask user to login
+
+	case app.Cfg.TOTP.Key == "":
+		pageData.Message = MsgTOTPUnavailable
+
+	case r.Method == http.MethodPost:
+		pageData, err = app.totpPost(r, pageData)
+
+	default:
+		pageData, err = app.totpPageData(pageData, "")
+	}
+	if err != nil {
+		logger.Error("failed to update TOTP", "user", user, "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	err = RenderTemplate(app.Tmpls, w, "totp.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+
+	logger.Info("TOTPHandler", "user", user, "enabled", pageData.Enabled)
+}
+
+// totpPost enables or disables TOTP for the user based on the form values.
+func (app *App) totpPost(r *http.Request, pageData TOTPPageData) (TOTPPageData, error) {
+	userName := pageData.User.UserName
+
+	action := strings.TrimSpace(r.PostFormValue("action"))
+	code := strings.TrimSpace(r.PostFormValue("code"))
+
+	secret, enabled, err := app.getTOTPSecret(userName)
+	if err != nil {
+		return pageData, err
+	}
+
+	event := EventMFAEnroll
+	if action == "disable" {
+		event = EventMFARemove
+	}
+
+	// a valid code is required to both enable and disable
+	valid, err := app.useTOTPCode(userName, secret, code)
+	if err != nil {
+		return pageData, err
+	}
+	if !valid {
+		WriteEvent(app.Store, event, false, userName, ErrMFAInvalidCode.Error())
+		pageData.Enabled = enabled
+		if !enabled {
+			pageData.Secret = secret
+			pageData.URI = template.URL(TOTPURI(app.Cfg.TOTP.Issuer, userName, secret)) //nolint:gosec // URI is generated
+		}
+		pageData.Message = MsgMFAInvalidCode
+		return pageData, nil
+	}
+
+	switch {
+	case action == "enable" && !enabled:
+		err = app.saveTOTPSecret(userName, secret, true)
+		pageData.Message = MsgTOTPEnabled
+	case action == "disable" && enabled:
+		err = app.Store.SaveTOTPSecret(userName, "", false)
+		if err == nil {
+			// recovery codes are only used with a second factor
+			err = app.Store.RemoveTokensForUser(RecoveryTokenType, userName)
+		}
+		pageData.Message = MsgTOTPDisabled
+	default:
+		return app.totpPageData(pageData, MsgInvalidAction)
+	}
+	if err != nil {
+		WriteEvent(app.Store, event, false, userName, err.Error())
+		return pageData, err
+	}
+
+	WriteEvent(app.Store, event, true, userName, "success")
+
+	return app.totpPageData(pageData, pageData.Message)
+}
+
+// totpPageData returns pageData for the current TOTP state of the user,
+// with the secret to enroll if TOTP is not enabled. The secret is generated
+// once, so every page shows the same secret until it is enabled.
+func (app *App) totpPageData(pageData TOTPPageData, msg string) (TOTPPageData, error) {
+	userName := pageData.User.UserName
+
+	secret, enabled, err := app.getTOTPSecret(userName)
+	if err != nil {
+		return pageData, err
+	}
+
+	pageData.Message = msg
+	pageData.Enabled = enabled
+	pageData.Secret = ""
+	pageData.URI = ""
+
+	if enabled {
+		return pageData, nil
+	}
+
+	// save a new secret, which is enabled once the user provides a valid code
+	if secret == "" {
+		secret, err = GenerateTOTPSecret()
+		if err != nil {
+			return pageData, err
+		}
+
+		err = app.saveTOTPSecret(userName, secret, false)
+		if err != nil {
+			return pageData, err
+		}
+	}
+
+	pageData.Secret = secret
+	pageData.URI = template.URL(TOTPURI(app.Cfg.TOTP.Issuer, userName, secret)) //nolint:gosec // URI is generated
+
+	return pageData, nil
+}
+
+// useTOTPCode returns true if code is valid for secret and its time step was
+// not used before by userName, recording the step so the code cannot be
+// used again.
+func (app *App) useTOTPCode(userName, secret, code string) (bool, error) {
+	if secret == "" {
+		return false, nil
+	}
+
+	step, valid := TOTPStep(secret, code, time.Now())
+	if !valid {
+		return false, nil
+	}
+
+	return app.Store.UseTOTPStep(userName, step)
+}
+
+// getTOTPSecret returns the decrypted TOTP secret for userName and if TOTP is enabled.
+func (app *App) getTOTPSecret(userName string) (string, bool, error) {
+	encrypted, enabled, err := app.Store.GetTOTPSecret(userName)
+	if err != nil || encrypted == "" {
+		return "", enabled, err
+	}
+
+	key, err := app.totpKey()
+	if err != nil {
+		return "", enabled, err
+	}
+
+	secret, err := Decrypt(key, encrypted)
+	if err != nil {
+		return "", enabled, err
+	}
+
+	return secret, enabled, nil
+}
+
+// saveTOTPSecret encrypts and saves the TOTP secret for userName.
+func (app *App) saveTOTPSecret(userName, secret string, enabled bool) error {
+	key, err := app.totpKey()
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := Encrypt(key, secret)
+	if err != nil {
+		return err
+	}
+
+	return app.Store.SaveTOTPSecret(userName, encrypted, enabled)
+}
+
+// totpKey returns the key used to encrypt TOTP secrets.
+func (app *App) totpKey() ([]byte, error) {
+	if app.Cfg.TOTP.Key == "" {
+		return nil, ErrTOTPNotConfigured
+	}
+
+	return DecodeKey(app.Cfg.TOTP.Key)
+}
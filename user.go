@@ -13,7 +13,6 @@ specific language governing permissions and limitations under the License.
 package weblogin
 
 import (
-	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -23,15 +22,24 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-// User represents a user stored in the database.
+// User represents a user stored in the Store.
 type User struct {
-	UserName        string
-	FullName        string
-	Email           string
-	IsAdmin         bool
-	Created         time.Time
-	LastLoginTime   time.Time
-	LastLoginResult string
+	UserName           string
+	FullName           string
+	Email              string
+	IsAdmin            bool
+	Created            time.Time
+	LastLoginTime      time.Time
+	LastLoginResult    string
+	LockedUntil        time.Time // zero if the account has never been locked
+	EmailVerified      bool      // see ConfigVerifyEmail
+	PasswordChanged    time.Time // zero if unknown
+	MustChangePassword bool      // password must be changed at the next login
+}
+
+// IsLocked returns true if the account is currently locked.
+func (u User) IsLocked() bool {
+	return u.LockedUntil.After(time.Now())
 }
 
 // Define command error values.
@@ -43,98 +51,47 @@ var (
 )
 
 // GetUserForSessionToken returns a user for the given sessionToken.
-func GetUserForSessionToken(db *sql.DB, sessionToken string) (User, error) {
-	var (
-		expires time.Time
-		user    User
-	)
-
-	hashedValue := hash(sessionToken)
-
-	qry := `SELECT users.userName, fullName, email, expires, admin, users.created FROM users INNER JOIN tokens ON users.userName=tokens.userName WHERE tokens.type = "session" AND hashedValue=? LIMIT 1`
-	result := db.QueryRow(qry, hashedValue)
-	err := result.Scan(&user.UserName, &user.FullName, &user.Email, &expires, &user.IsAdmin, &user.Created)
+//
+// If sessions have an idle timeout, the session is extended and the returned
+// Token has the new expiration so the cookie can be re-issued. Otherwise, the
+// Token is zero.
+func (app *App) GetUserForSessionToken(sessionToken string) (User, Token, error) {
+	session, err := app.Store.GetSession(sessionToken)
 	if err != nil {
-		// return custom error and empty user if session not found
-		if errors.Is(err, sql.ErrNoRows) {
+		// return custom error and empty user if session not found or expired
+		if errors.Is(err, ErrTokenNotFound) {
 			slog.Warn("unexpected",
 				"err", ErrUserSessionNotFound,
 				"sessionToken", sessionToken)
-			return User{}, ErrUserSessionNotFound
+			return User{}, Token{}, ErrUserSessionNotFound
 		}
-		return User{}, err
-	}
-
-	// return empty user if session is expired
-	if expires.Before(time.Now()) {
-		slog.Warn("unexpected",
-			"err", ErrUserSessionExpired,
-			"expires", expires,
-			"user", user)
-		return User{}, ErrUserSessionExpired
-	}
-
-	user.LastLoginTime, user.LastLoginResult, err = LastLoginForUser(db, user.UserName)
-	if err != nil {
-		return user, fmt.Errorf("%w: %v", ErrUserGetLastLoginFailed, err)
+		if errors.Is(err, ErrTokenExpired) {
+			slog.Warn("unexpected",
+				"err", ErrUserSessionExpired,
+				"userName", session.UserName)
+			return User{}, Token{}, ErrUserSessionExpired
+		}
+		return User{}, Token{}, err
 	}
 
-	return user, err
-}
-
-// GetUserForName returns a user for the given userName.
-func GetUserForName(db *sql.DB, userName string) (User, error) {
-	var user User
-
-	qry := `SELECT userName, fullName, email, admin FROM users WHERE userName=? LIMIT 1`
-	result := db.QueryRow(qry, userName)
-	err := result.Scan(&user.UserName, &user.FullName, &user.Email, &user.IsAdmin)
+	user, err := app.Store.GetUserForName(session.UserName)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return User{}, ErrUserNotFound
-		}
-		return User{}, err
+		return User{}, Token{}, err
 	}
 
-	return user, err
-}
-
-// UserExists returns true if the given userName already exists in db.
-func UserExists(db *sql.DB, userName string) (bool, error) {
-	return RowExists(db, "SELECT 1 FROM users WHERE userName=? LIMIT 1", userName)
-}
-
-// EmailExists returns true if the given email already exists.
-func EmailExists(db *sql.DB, email string) (bool, error) {
-	return RowExists(db, "SELECT 1 FROM users WHERE email=? LIMIT 1", email)
-}
-
-// GetUserNameForEmail returns the userName for a given email.
-func GetUserNameForEmail(db *sql.DB, email string) (string, error) {
-	var userName string
-
-	row := db.QueryRow("SELECT username FROM users WHERE email=?", email)
-	err := row.Scan(&userName)
+	user.LastLoginTime, user.LastLoginResult, err = app.Store.LastLoginForUser(user.UserName)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return "", ErrUserNotFound
-		}
-		return "", err
+		return user, Token{}, fmt.Errorf("%w: %v", ErrUserGetLastLoginFailed, err)
 	}
 
-	return userName, err
+	return user, app.refreshSession(sessionToken, session), nil
 }
 
 // GetUserNameForResetToken returns the userName for a given reset token.
-func GetUserNameForResetToken(db *sql.DB, tokenValue string) (string, error) {
-	var userName string
-	hashedValue := hash(tokenValue)
-
-	qry := `SELECT userName FROM tokens WHERE type="reset" AND hashedValue=?`
-	row := db.QueryRow(qry, hashedValue)
-	err := row.Scan(&userName)
+func GetUserNameForResetToken(s Store, tokenValue string) (string, error) {
+	userName, err := s.GetUserNameForToken(ResetTokenType, tokenValue)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired) {
 			return "", ErrUserNotFound
 		}
 		return "", err
@@ -145,17 +102,10 @@ func GetUserNameForResetToken(db *sql.DB, tokenValue string) (string, error) {
 
 // CompareUserPassword compares the password and hashed password for the user.
 // Returns nil on success or an error on failure.
-func CompareUserPassword(db *sql.DB, userName, password string) error {
+func CompareUserPassword(s Store, userName, password string) error {
 	// get hashed password for the given user
-	qry := `SELECT hashedPassword FROM users WHERE username=? LIMIT 1`
-	result := db.QueryRow(qry, userName)
-
-	var hashedPassword string
-	err := result.Scan(&hashedPassword)
+	hashedPassword, err := s.GetPasswordHash(userName)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return ErrUserNotFound
-		}
 		return err
 	}
 
@@ -168,9 +118,9 @@ func CompareUserPassword(db *sql.DB, userName, password string) error {
 	return nil
 }
 
-// RegisterUser registers a user with the given values.
-// Returns nil on success or an error on failure.
-func RegisterUser(db *sql.DB, userName, fullName, email, password string) error {
+// RegisterUser registers a user with the given values. The email address of
+// the user is not verified. Returns nil on success or an error on failure.
+func RegisterUser(s Store, userName, fullName, email, password string) error {
 	// hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -178,39 +128,36 @@ func RegisterUser(db *sql.DB, userName, fullName, email, password string) error
 	}
 
 	// store the user and hashed password
-	_, err = db.Exec("INSERT INTO users(username, hashedPassword, fullName, email) VALUES (?, ?, ?, ?)",
-		userName, hashedPassword, fullName, email)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	user := User{UserName: userName, FullName: fullName, Email: email}
+	return s.CreateUser(user, string(hashedPassword))
 }
 
-// LastLoginForUser retrieves the last login time and result for a given userName.  It returns zero values in case of no previous login.
-func LastLoginForUser(db *sql.DB, userName string) (time.Time, string, error) {
-	var lastLogin time.Time
-	var result string
+const SessionTokenCookieName = "session"
 
-	// get the second row, if it exists, since first row is current login
-	qry := `SELECT created, result FROM events WHERE userName = ? AND name = ? ORDER BY created DESC LIMIT 1 OFFSET 1`
-	row := db.QueryRow(qry, userName, EventLogin)
-	err := row.Scan(&lastLogin, &result)
-	if err != nil {
-		// ignore ErrNoRows since there may not be a last login
-		if errors.Is(err, sql.ErrNoRows) {
-			return lastLogin, result, nil
-		}
-		return lastLogin, result, err
+// GetUserFromRequest returns the current User or empty User if the session is
+// not found. The session cookie is re-issued if the session was extended.
+//
+// If RequireLogin already resolved the user, the User from the request
+// context is returned without looking up the session again. An empty User is
+// also returned if a remember me login requires the user to change their
+// password or verify their email address, which RequireLogin redirects to.
+func (app *App) GetUserFromRequest(w http.ResponseWriter, r *http.Request) (User, error) {
+	user, err := app.userFromRequest(w, r)
+	if errors.Is(err, ErrLoginPasswordExpired) || errors.Is(err, ErrLoginUnverified) {
+		return User{}, nil
 	}
 
-	return lastLogin, result, nil
+	return user, err
 }
 
-const SessionTokenCookieName = "session"
+// userFromRequest is GetUserFromRequest, except that ErrLoginPasswordExpired
+// or ErrLoginUnverified is returned if a remember me login requires action,
+// as described by loginFromRemember.
+func (app *App) userFromRequest(w http.ResponseWriter, r *http.Request) (User, error) {
+	if user, ok := UserFromContext(r.Context()); ok {
+		return user, nil
+	}
 
-// GetUserFromRequest returns the current User or empty User if the session is not found.
-func GetUserFromRequest(w http.ResponseWriter, r *http.Request, db *sql.DB) (User, error) {
 	var user User
 
 	// get sessionToken from cookie, if it exists
@@ -221,13 +168,15 @@ func GetUserFromRequest(w http.ResponseWriter, r *http.Request, db *sql.DB) (Use
 
 	// get user if there is a sessionToken
 	if sessionToken != "" {
-		user, err = GetUserForSessionToken(db, sessionToken)
+		var token Token
+		user, token, err = app.GetUserForSessionToken(sessionToken)
 		if err != nil {
 			// delete invalid token to prevent session fixation
 			http.SetCookie(w,
 				&http.Cookie{
 					Name:   SessionTokenCookieName,
 					Value:  "",
+					Path:   "/",
 					MaxAge: -1,
 				})
 		}
@@ -235,6 +184,17 @@ func GetUserFromRequest(w http.ResponseWriter, r *http.Request, db *sql.DB) (Use
 		if errors.Is(err, ErrUserSessionNotFound) || errors.Is(err, ErrUserSessionExpired) {
 			err = nil
 		}
+		if user.UserName != "" {
+			updateSession(app.Store, r, sessionToken)
+		}
+		if token.Value != "" {
+			SetSessionCookie(w, token)
+		}
+	}
+
+	// sessions are short, so use a remember me cookie to start a new one
+	if user.UserName == "" && err == nil {
+		user, err = app.loginFromRemember(w, r)
 	}
 
 	return user, err
@@ -4,8 +4,6 @@ import (
 	"errors"
 	"testing"
 	"time"
-
-	weblogin "github.com/bnixon67/go-weblogin"
 )
 
 func TestLastLoginForUser(t *testing.T) {
@@ -28,12 +26,12 @@ func TestLastLoginForUser(t *testing.T) {
 	app := AppForTest(t)
 
 	for _, tc := range cases {
-		got, _, err := weblogin.LastLoginForUser(app.DB, tc.userName)
+		got, _, err := app.Store.LastLoginForUser(tc.userName)
 		if !errors.Is(err, tc.err) {
-			t.Errorf("LastLoginForUser(db, %q)\ngot err '%v' want '%v'", tc.userName, err, tc.err)
+			t.Errorf("LastLoginForUser(%q)\ngot err '%v' want '%v'", tc.userName, err, tc.err)
 		}
 		if got != tc.want {
-			t.Errorf("LastLoginForUser(db, %q)\n got '%v'\nwant '%v'", tc.userName, got, tc.want)
+			t.Errorf("LastLoginForUser(%q)\n got '%v'\nwant '%v'", tc.userName, got, tc.want)
 		}
 	}
 }
@@ -13,82 +13,110 @@ specific language governing permissions and limitations under the License.
 package weblogin
 
 import (
-	"database/sql"
-	"errors"
 	"log/slog"
 	"net/http"
 )
 
 // UsersPageData contains data passed to the HTML template.
 type UsersPageData struct {
-	Title   string
-	Message string
-	User    User
-	Users   []User
+	Title             string
+	Message           string
+	CSRFToken         string // see CSRFHandler
+	User              User
+	Users             []User
+	CanWrite          bool // user has PermUsersWrite
+	CanManageSessions bool // user has PermSessionsManage
 }
 
-// UsersHandler prints a simple hello message.
+const MsgUserUnlocked = "User unlocked"
+
+// UsersHandler shows the users. It should be wrapped by RequirePermission
+// with PermUsersRead, which sets the logged in user.
+//
+// A user with PermUsersWrite can POST action=unlock with a username to clear
+// an account lock, action=verify to mark the email address of the user
+// verified, or action=expire to require a password change at the next login.
 func (app *App) UsersHandler(w http.ResponseWriter, r *http.Request) {
-	if !ValidMethod(w, r, []string{http.MethodGet}) {
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
 		slog.Error("invalid HTTP method", "method", r.Method)
 		return
 	}
 
-	currentUser, err := GetUserFromRequest(w, r, app.DB)
+	currentUser, err := app.GetUserFromRequest(w, r)
 	if err != nil {
 		slog.Error("failed GetUser", "err", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	users, err := GetUsers(app.DB)
+	canWrite, err := app.HasPermission(currentUser, PermUsersWrite)
 	if err != nil {
-		slog.Error("failed GetUsers", "err", err)
+		slog.Error("failed HasPermission", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
-
-	// display page
-	err = RenderTemplate(app.Tmpls, w, "users.html",
-		UsersPageData{Message: "", User: currentUser, Users: users})
+	canManageSessions, err := app.HasPermission(currentUser, PermSessionsManage)
 	if err != nil {
-		slog.Error("failed to RenderTemplate", "err", err)
+		slog.Error("failed HasPermission", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-}
 
-// GetUsers returns a list of all users.
-func GetUsers(db *sql.DB) ([]User, error) {
-	var users []User
-	var err error
-
-	if db == nil {
-		slog.Error("db is nil")
-		return users, errors.New("invdalid db")
-	}
-
-	qry := `SELECT userName, fullName, email, admin, created FROM users`
-
-	rows, err := db.Query(qry)
-	if err != nil {
-		slog.Error("query for users failed", "err", err)
-		return users, err
-
-	}
-	defer rows.Close()
+	var msg string
+	if r.Method == http.MethodPost {
+		if !canWrite {
+			slog.Warn("user without permission attempted action", "user", currentUser.UserName, "permission", PermUsersWrite)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
 
-	for rows.Next() {
-		var user User
+		userName := r.PostFormValue("username")
+		action := r.PostFormValue("action")
+		if userName == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
 
-		err = rows.Scan(&user.UserName, &user.FullName, &user.Email, &user.IsAdmin, &user.Created)
+		switch action {
+		case "unlock":
+			err = app.UnlockUser(userName, currentUser.UserName)
+			msg = MsgUserUnlocked
+		case "verify":
+			err = app.VerifyUser(userName, currentUser.UserName)
+			msg = MsgUserVerified
+		case "expire":
+			err = app.ExpirePassword(userName, currentUser.UserName)
+			msg = MsgUserExpired
+		default:
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			slog.Error("failed rows.Scan", "err", err)
+			slog.Error("failed action", "action", action, "err", err, "userName", userName)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
-
-		users = append(users, user)
+		slog.Info("user action", "action", action, "userName", userName, "admin", currentUser.UserName)
 	}
-	err = rows.Err()
+
+	users, err := app.Store.GetUsers()
 	if err != nil {
-		slog.Error("failed rows.Err", "err", err)
+		slog.Error("failed GetUsers", "err", err)
 	}
 
-	return users, err
+	// display page
+	err = RenderTemplate(app.Tmpls, w, "users.html",
+		UsersPageData{
+			Title:             app.Cfg.Title,
+			Message:           msg,
+			User:              currentUser,
+			Users:             users,
+			CSRFToken:         CSRFToken(r),
+			CanWrite:          canWrite,
+			CanManageSessions: canManageSessions,
+		})
+	if err != nil {
+		slog.Error("failed to RenderTemplate", "err", err)
+		return
+	}
 }
@@ -0,0 +1,270 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// VerifyTokenType is the type of token sent to verify an email address.
+const VerifyTokenType = "verify"
+
+// Default verification values if not set in ConfigVerifyEmail.
+const (
+	VerifyDefaultExpiresHours  = 24
+	VerifyDefaultResendMinutes = 5
+)
+
+var (
+	ErrLoginUnverified   = errors.New("email not verified")
+	ErrVerifyThrottled   = errors.New("verification email sent recently")
+	ErrVerifyTokenBad    = errors.New("invalid verification token")
+	ErrVerifySendFailed  = errors.New("failed to send verification email")
+	ErrVerifySaveFailed  = errors.New("failed to save verification token")
+	ErrVerifyCheckFailed = errors.New("failed to check verification emails")
+)
+
+const (
+	MsgLoginUnverified = "Please verify your Email Address before you login."
+	MsgVerifySent      = "If the Email Address is registered and not verified, a verification link has been sent to it."
+	MsgVerified        = "Your Email Address is verified. Please login."
+	MsgVerifyInvalid   = "The verification link is invalid or expired."
+	MsgUserVerified    = "User verified"
+)
+
+// VerifyPageData contains data passed to the HTML template.
+type VerifyPageData struct {
+	Title     string
+	Message   string
+	CSRFToken string // see CSRFHandler
+	Verified  bool
+}
+
+// SendVerifyEmail sends a link to verify the email address of userName.
+// Links sent previously are no longer valid. ErrVerifyThrottled is returned
+// if a link was sent within ResendMinutes.
+func (app *App) SendVerifyEmail(userName, email string) error {
+	fn := "SendVerifyEmail"
+
+	cfg := app.Cfg.VerifyEmail
+
+	resend := time.Duration(cfg.ResendMinutes) * time.Minute
+	if resend == 0 {
+		resend = VerifyDefaultResendMinutes * time.Minute
+	}
+
+	sent, err := app.Store.CountEvents(EventVerifySend, true, userName, time.Now().Add(-resend))
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", fn, ErrVerifyCheckFailed, err)
+	}
+	if sent > 0 {
+		return ErrVerifyThrottled
+	}
+
+	hours := cfg.ExpiresHours
+	if hours == 0 {
+		hours = VerifyDefaultExpiresHours
+	}
+
+	err = app.Store.RemoveTokensForUser(VerifyTokenType, userName)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", fn, ErrVerifySaveFailed, err)
+	}
+
+	token, err := SaveNewToken(app.Store, VerifyTokenType, userName, 32, hours)
+	if err != nil {
+		WriteEvent(app.Store, EventSaveToken, false, userName, err.Error())
+		return fmt.Errorf("%s: %w: %v", fn, ErrVerifySaveFailed, err)
+	}
+
+	subj := app.Cfg.Title + " verify email"
+	emailText := fmt.Sprintf("Please visit %s/verify?vtoken=%s within %d hours to verify your email address for %s",
+		app.Cfg.BaseURL, url.QueryEscape(token.Value), hours, app.Cfg.Title)
+
+	err = app.sendEmail(email, subj, emailText)
+	if err != nil {
+		WriteEvent(app.Store, EventVerifySend, false, userName, err.Error())
+		return fmt.Errorf("%s: %w: %v", fn, ErrVerifySendFailed, err)
+	}
+
+	WriteEvent(app.Store, EventVerifySend, true, userName, email)
+
+	return nil
+}
+
+// VerifyEmail marks the email address verified for the user of the verify
+// token and returns the userName. The token can only be used once.
+func (app *App) VerifyEmail(tokenValue string) (string, error) {
+	userName, err := app.Store.GetUserNameForToken(VerifyTokenType, tokenValue)
+	if err != nil {
+		if errors.Is(err, ErrTokenNotFound) || errors.Is(err, ErrTokenExpired) {
+			return "", ErrVerifyTokenBad
+		}
+		return "", err
+	}
+
+	ok, err := app.Store.ConsumeToken(VerifyTokenType, userName, tokenValue)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrVerifyTokenBad
+	}
+
+	err = app.Store.SetEmailVerified(userName, true)
+	if err != nil {
+		WriteEvent(app.Store, EventVerify, false, userName, err.Error())
+		return "", err
+	}
+
+	WriteEvent(app.Store, EventVerify, true, userName, "link")
+
+	return userName, nil
+}
+
+// VerifyUser marks the email address of userName verified without a link.
+// The admin is recorded in the event.
+func (app *App) VerifyUser(userName, admin string) error {
+	err := app.Store.SetEmailVerified(userName, true)
+	if err != nil {
+		WriteEvent(app.Store, EventVerify, false, userName, err.Error())
+		return err
+	}
+
+	err = app.Store.RemoveTokensForUser(VerifyTokenType, userName)
+	if err != nil {
+		slog.Error("failed to RemoveTokensForUser", "err", err, "userName", userName)
+	}
+
+	WriteEvent(app.Store, EventVerify, true, userName, "by "+admin)
+
+	return nil
+}
+
+// checkVerified returns ErrLoginUnverified if verification is required and
+// the email address of userName is not verified.
+func (app *App) checkVerified(userName string) error {
+	if !app.Cfg.VerifyEmail.Required {
+		return nil
+	}
+
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		return err
+	}
+
+	if !user.EmailVerified {
+		return ErrLoginUnverified
+	}
+
+	return nil
+}
+
+// VerifyHandler handles /verify requests.
+//
+// A GET with a vtoken verifies the email address. Otherwise, a form is shown
+// to POST an email address to resend the verification link.
+func (app *App) VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	pageData := VerifyPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r)}
+
+	switch r.Method {
+	case http.MethodGet:
+		if tokenValue := r.URL.Query().Get("vtoken"); tokenValue != "" {
+			userName, err := app.VerifyEmail(tokenValue)
+			if err != nil {
+				logger.Warn("failed to VerifyEmail", "err", err)
+				pageData.Message = MsgVerifyInvalid
+			} else {
+				logger.Info("verified email", "userName", userName)
+				pageData.Message = MsgVerified
+				pageData.Verified = true
+			}
+		}
+
+	case http.MethodPost:
+		email := strings.TrimSpace(r.PostFormValue("email"))
+		if email == "" {
+			pageData.Message = MsgMissingEmail
+			break
+		}
+
+		// the same message is shown for every email to avoid revealing accounts
+		pageData.Message = MsgVerifySent
+
+		// in privacy mode, the lookup and email are in the background too,
+		// so the time of the response does not reveal accounts either
+		err := app.deliver(func() error { return app.resendVerifyEmail(email) })
+		if err != nil {
+			logger.Error("failed to resendVerifyEmail", "err", err)
+			break
+		}
+	}
+
+	err := RenderTemplate(app.Tmpls, w, "verify.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+}
+
+// resendVerifyEmail sends a new verification email to the unverified account
+// with email, if any. Unknown, verified, or throttled accounts are only logged,
+// since the response must be the same for every email.
+func (app *App) resendVerifyEmail(email string) error {
+	fn := "resendVerifyEmail"
+
+	userName, err := app.Store.GetUserNameForEmail(email)
+	if err != nil {
+		slog.Warn("failed to GetUserNameForEmail", "email", email, "err", err)
+		return nil
+	}
+
+	user, err := app.Store.GetUserForName(userName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fn, err)
+	}
+	if user.EmailVerified {
+		slog.Info("email already verified", "userName", userName)
+		return nil
+	}
+
+	err = app.SendVerifyEmail(userName, email)
+	if errors.Is(err, ErrVerifyThrottled) {
+		slog.Warn("verify email throttled", "userName", userName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("sent verify email", "userName", userName)
+
+	return nil
+}
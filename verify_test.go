@@ -0,0 +1,178 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+// verifyAppForTest returns an App with a new Store, verification required,
+// and an unverified user "new".
+func verifyAppForTest(t *testing.T) *weblogin.App {
+	a := *AppForTest(t)
+	a.Store = weblogin.NewMemStore()
+	a.Cfg.VerifyEmail = weblogin.ConfigVerifyEmail{Required: true}
+
+	err := seedStore(a.Store)
+	if err != nil {
+		t.Fatalf("cannot seed Store, %v", err)
+	}
+
+	err = a.Store.CreateUser(weblogin.User{UserName: "new", Email: "new@email"}, TestPasswordHash)
+	if err != nil {
+		t.Fatalf("cannot create user, %v", err)
+	}
+
+	return &a
+}
+
+func TestVerifyEmail(t *testing.T) {
+	app := verifyAppForTest(t)
+
+	_, err := app.LoginUser("new", "password")
+	if !errors.Is(err, weblogin.ErrLoginUnverified) {
+		t.Errorf("LoginUser unverified got err %v, want %v", err, weblogin.ErrLoginUnverified)
+	}
+
+	_, err = app.VerifyEmail("invalid")
+	if !errors.Is(err, weblogin.ErrVerifyTokenBad) {
+		t.Errorf("VerifyEmail invalid got err %v, want %v", err, weblogin.ErrVerifyTokenBad)
+	}
+
+	token, err := weblogin.SaveNewToken(app.Store, weblogin.VerifyTokenType, "new", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+
+	userName, err := app.VerifyEmail(token.Value)
+	if err != nil || userName != "new" {
+		t.Errorf("VerifyEmail got %q, %v", userName, err)
+	}
+
+	_, err = app.VerifyEmail(token.Value)
+	if !errors.Is(err, weblogin.ErrVerifyTokenBad) {
+		t.Errorf("VerifyEmail reused got err %v, want %v", err, weblogin.ErrVerifyTokenBad)
+	}
+
+	_, err = app.LoginUser("new", "password")
+	if err != nil {
+		t.Errorf("LoginUser verified got err %v", err)
+	}
+}
+
+func TestVerifyNotRequired(t *testing.T) {
+	app := verifyAppForTest(t)
+	app.Cfg.VerifyEmail.Required = false
+
+	_, err := app.LoginUser("new", "password")
+	if err != nil {
+		t.Errorf("LoginUser got err %v", err)
+	}
+}
+
+func TestSendVerifyEmailThrottled(t *testing.T) {
+	app := verifyAppForTest(t)
+
+	weblogin.WriteEvent(app.Store, weblogin.EventVerifySend, true, "new", "new@email")
+
+	err := app.SendVerifyEmail("new", "new@email")
+	if !errors.Is(err, weblogin.ErrVerifyThrottled) {
+		t.Errorf("SendVerifyEmail got err %v, want %v", err, weblogin.ErrVerifyThrottled)
+	}
+
+	count, err := app.Store.CountTokens(weblogin.VerifyTokenType, "new")
+	if err != nil || count != 0 {
+		t.Errorf("got %d verify tokens, %v, want 0", count, err)
+	}
+}
+
+func TestVerifyHandler(t *testing.T) {
+	app := verifyAppForTest(t)
+
+	token, err := weblogin.SaveNewToken(app.Store, weblogin.VerifyTokenType, "new", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		email  string
+		want   string
+	}{
+		{"form", http.MethodGet, "/verify", "", "Resend Verification"},
+		{"valid", http.MethodGet, "/verify?vtoken=" + url.QueryEscape(token.Value), "", weblogin.MsgVerified},
+		{"reused", http.MethodGet, "/verify?vtoken=" + url.QueryEscape(token.Value), "", weblogin.MsgVerifyInvalid},
+		{"missing email", http.MethodPost, "/verify", "", weblogin.MsgMissingEmail},
+		{"unknown email", http.MethodPost, "/verify", "unknown@email", weblogin.MsgVerifySent},
+		{"verified email", http.MethodPost, "/verify", "new@email", weblogin.MsgVerifySent},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := url.Values{"email": {tc.email}}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(d.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			app.VerifyHandler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if !strings.Contains(w.Body.String(), tc.want) {
+				t.Errorf("got body %q, want %q in body", w.Body, tc.want)
+			}
+		})
+	}
+
+	count, err := app.Store.CountEvents(weblogin.EventVerify, true, "new", time.Time{})
+	if err != nil || count != 1 {
+		t.Errorf("got %d verify events, %v, want 1", count, err)
+	}
+}
+
+func TestUsersHandlerVerify(t *testing.T) {
+	app := verifyAppForTest(t)
+
+	token, err := weblogin.SaveNewToken(app.Store, "session", "admin", 32, 1)
+	if err != nil {
+		t.Fatalf("SaveNewToken failed: %v", err)
+	}
+
+	d := url.Values{"action": {"verify"}, "username": {"new"}}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(d.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(&http.Cookie{Name: weblogin.SessionTokenCookieName, Value: token.Value})
+
+	app.UsersHandler(w, r)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), weblogin.MsgUserVerified) {
+		t.Errorf("got status %d, body %q", w.Code, w.Body)
+	}
+
+	user, err := app.Store.GetUserForName("new")
+	if err != nil || !user.EmailVerified {
+		t.Errorf("user should be verified, got %+v, %v", user, err)
+	}
+}
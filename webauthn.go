@@ -0,0 +1,447 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// This file implements the parts of Web Authentication (WebAuthn) Level 2
+// needed to register credentials and verify assertions. Only the "none" and
+// "packed" attestation formats are supported, and attestation certificates
+// are not validated, which matches requesting "none" attestation.
+
+// COSE algorithm identifiers.
+const (
+	COSEAlgES256 = -7
+	COSEAlgEdDSA = -8
+	COSEAlgRS256 = -257
+)
+
+// Authenticator data flags.
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+)
+
+var (
+	ErrWebAuthnClientData       = errors.New("invalid client data")
+	ErrWebAuthnType             = errors.New("invalid client data type")
+	ErrWebAuthnChallenge        = errors.New("invalid challenge")
+	ErrWebAuthnOrigin           = errors.New("invalid origin")
+	ErrWebAuthnAuthData         = errors.New("invalid authenticator data")
+	ErrWebAuthnRPID             = errors.New("invalid relying party ID")
+	ErrWebAuthnUserPresent      = errors.New("user not present")
+	ErrWebAuthnUserVerified     = errors.New("user not verified")
+	ErrWebAuthnAttestation      = errors.New("invalid attestation")
+	ErrWebAuthnUnsupportedKey   = errors.New("unsupported public key")
+	ErrWebAuthnSignature        = errors.New("invalid signature")
+	ErrWebAuthnSignCount        = errors.New("invalid signature counter")
+	ErrWebAuthnUnsupportedFmt   = errors.New("unsupported attestation format")
+	ErrWebAuthnCredentialLength = errors.New("invalid credential ID length")
+)
+
+// WebAuthnRP identifies the relying party, i.e., this application.
+type WebAuthnRP struct {
+	ID     string // relying party ID, which is the host name
+	Origin string // expected origin, e.g., https://host:port
+}
+
+// clientData is the subset of CollectedClientData used for verification.
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// parseClientData parses clientDataJSON.
+func parseClientData(clientDataJSON []byte) (clientData, error) {
+	var cd clientData
+
+	err := json.Unmarshal(clientDataJSON, &cd)
+	if err != nil {
+		return cd, fmt.Errorf("%w: %v", ErrWebAuthnClientData, err)
+	}
+
+	return cd, nil
+}
+
+// ClientDataChallenge returns the challenge in clientDataJSON, which should
+// be checked to be a challenge issued by the relying party.
+func ClientDataChallenge(clientDataJSON []byte) (string, error) {
+	cd, err := parseClientData(clientDataJSON)
+	return cd.Challenge, err
+}
+
+// verifyClientData checks the type, challenge, and origin of clientDataJSON.
+func (rp WebAuthnRP) verifyClientData(clientDataJSON []byte, wantType, challenge string) error {
+	cd, err := parseClientData(clientDataJSON)
+	if err != nil {
+		return err
+	}
+
+	if cd.Type != wantType {
+		return ErrWebAuthnType
+	}
+
+	if challenge == "" || cd.Challenge != challenge {
+		return ErrWebAuthnChallenge
+	}
+
+	if cd.Origin != rp.Origin {
+		return ErrWebAuthnOrigin
+	}
+
+	return nil
+}
+
+// authData is the parsed authenticator data.
+type authData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte // only if attested credential data is present
+	PublicKey    []byte // COSE encoded, only if attested credential data is present
+}
+
+// parseAuthData parses authenticator data.
+func parseAuthData(b []byte) (authData, error) {
+	var ad authData
+
+	// rpIdHash (32), flags (1), signCount (4)
+	if len(b) < 37 {
+		return ad, ErrWebAuthnAuthData
+	}
+
+	ad.RPIDHash = b[:32]
+	ad.Flags = b[32]
+	ad.SignCount = binary.BigEndian.Uint32(b[33:37])
+	b = b[37:]
+
+	if ad.Flags&authFlagAttested == 0 {
+		return ad, nil
+	}
+
+	// aaguid (16), credentialIdLength (2)
+	if len(b) < 18 {
+		return ad, ErrWebAuthnAuthData
+	}
+	n := int(binary.BigEndian.Uint16(b[16:18]))
+	b = b[18:]
+	if n > 1023 || len(b) < n {
+		return ad, ErrWebAuthnCredentialLength
+	}
+	ad.CredentialID = b[:n]
+	b = b[n:]
+
+	// the public key is followed by optional extensions
+	_, rest, err := cborDecode(b)
+	if err != nil {
+		return ad, fmt.Errorf("%w: %v", ErrWebAuthnAuthData, err)
+	}
+	ad.PublicKey = b[:len(b)-len(rest)]
+
+	return ad, nil
+}
+
+// verifyAuthData checks the RP ID hash and user flags of authenticator data.
+func (rp WebAuthnRP) verifyAuthData(ad authData, requireUV bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return ErrWebAuthnRPID
+	}
+
+	if ad.Flags&authFlagUserPresent == 0 {
+		return ErrWebAuthnUserPresent
+	}
+
+	if requireUV && ad.Flags&authFlagUserVerified == 0 {
+		return ErrWebAuthnUserVerified
+	}
+
+	return nil
+}
+
+// VerifyRegistration verifies the response to a credential creation request
+// with the given challenge and returns the new Credential, which must be
+// assigned a UserName before it is saved.
+func (rp WebAuthnRP) VerifyRegistration(challenge string, clientDataJSON, attestationObject []byte) (Credential, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	v, _, err := cborDecode(attestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("%w: %v", ErrWebAuthnAttestation, err)
+	}
+	att, ok := v.(map[any]any)
+	if !ok {
+		return Credential{}, ErrWebAuthnAttestation
+	}
+	format, _ := att["fmt"].(string)
+	rawAuthData, _ := att["authData"].([]byte)
+	attStmt, _ := att["attStmt"].(map[any]any)
+
+	ad, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	err = rp.verifyAuthData(ad, false)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	if ad.CredentialID == nil {
+		return Credential{}, ErrWebAuthnAuthData
+	}
+
+	pub, alg, err := parseCOSEKey(ad.PublicKey)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+
+	switch format {
+	case "none":
+		if len(attStmt) != 0 {
+			return Credential{}, ErrWebAuthnAttestation
+		}
+	case "packed":
+		err = verifyPackedAttestation(attStmt, signed, pub, alg)
+		if err != nil {
+			return Credential{}, err
+		}
+	default:
+		return Credential{}, fmt.Errorf("%w: %q", ErrWebAuthnUnsupportedFmt, format)
+	}
+
+	return Credential{
+		ID:        append([]byte(nil), ad.CredentialID...),
+		PublicKey: append([]byte(nil), ad.PublicKey...),
+		SignCount: ad.SignCount,
+	}, nil
+}
+
+// verifyPackedAttestation verifies a "packed" attestation statement, which
+// is either signed by the credential (self attestation) or by the x5c
+// certificate. The certificate chain is not validated.
+func verifyPackedAttestation(attStmt map[any]any, signed []byte, credKey crypto.PublicKey, credAlg int64) error {
+	alg, ok := attStmt["alg"].(int64)
+	if !ok {
+		return ErrWebAuthnAttestation
+	}
+	sig, ok := attStmt["sig"].([]byte)
+	if !ok {
+		return ErrWebAuthnAttestation
+	}
+
+	key := credKey
+	if x5c, ok := attStmt["x5c"].([]any); ok {
+		if len(x5c) == 0 {
+			return ErrWebAuthnAttestation
+		}
+		der, ok := x5c[0].([]byte)
+		if !ok {
+			return ErrWebAuthnAttestation
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrWebAuthnAttestation, err)
+		}
+		key = cert.PublicKey
+	} else if alg != credAlg {
+		// self attestation must use the algorithm of the credential
+		return ErrWebAuthnAttestation
+	}
+
+	err := verifySignature(key, alg, signed, sig)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrWebAuthnAttestation, err)
+	}
+
+	return nil
+}
+
+// VerifyAssertion verifies the response to a credential request with the
+// given challenge for the credential and returns the new signature counter.
+// If requireUV is true, the authenticator must have verified the user.
+func (rp WebAuthnRP) VerifyAssertion(challenge string, cred Credential, clientDataJSON, rawAuthData, signature []byte, requireUV bool) (uint32, error) {
+	err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge)
+	if err != nil {
+		return 0, err
+	}
+
+	ad, err := parseAuthData(rawAuthData)
+	if err != nil {
+		return 0, err
+	}
+
+	err = rp.verifyAuthData(ad, requireUV)
+	if err != nil {
+		return 0, err
+	}
+
+	pub, alg, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return 0, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+
+	err = verifySignature(pub, alg, signed, signature)
+	if err != nil {
+		return 0, err
+	}
+
+	// a counter that does not increase may indicate a cloned authenticator,
+	// but authenticators that do not implement a counter always return zero
+	if (ad.SignCount != 0 || cred.SignCount != 0) && ad.SignCount <= cred.SignCount {
+		return 0, ErrWebAuthnSignCount
+	}
+
+	return ad.SignCount, nil
+}
+
+// parseCOSEKey returns the public key and algorithm of a COSE encoded key.
+func parseCOSEKey(b []byte) (crypto.PublicKey, int64, error) {
+	v, _, err := cborDecode(b)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrWebAuthnUnsupportedKey, err)
+	}
+	m, ok := v.(map[any]any)
+	if !ok {
+		return nil, 0, ErrWebAuthnUnsupportedKey
+	}
+
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+
+	switch {
+	case kty == 2 && alg == COSEAlgES256: // EC2
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		y, _ := m[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, ErrWebAuthnUnsupportedKey
+		}
+
+		// ensure the point is on the curve
+		point := append(append([]byte{4}, x...), y...)
+		_, err := ecdh.P256().NewPublicKey(point)
+		if err != nil {
+			return nil, 0, ErrWebAuthnUnsupportedKey
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, alg, nil
+
+	case kty == 3 && alg == COSEAlgRS256: // RSA
+		n, _ := m[int64(-1)].([]byte)
+		e, _ := m[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, ErrWebAuthnUnsupportedKey
+		}
+
+		var exp int
+		for _, d := range e {
+			exp = exp<<8 | int(d)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, alg, nil
+
+	case kty == 1 && alg == COSEAlgEdDSA: // OKP
+		crv, _ := m[int64(-1)].(int64)
+		x, _ := m[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, ErrWebAuthnUnsupportedKey
+		}
+
+		return ed25519.PublicKey(x), alg, nil
+	}
+
+	return nil, 0, ErrWebAuthnUnsupportedKey
+}
+
+// verifySignature verifies sig over data using pub and the COSE algorithm.
+func verifySignature(pub crypto.PublicKey, alg int64, data, sig []byte) error {
+	switch alg {
+	case COSEAlgES256:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrWebAuthnUnsupportedKey
+		}
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(key, digest[:], sig) {
+			return ErrWebAuthnSignature
+		}
+
+	case COSEAlgRS256:
+		key, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return ErrWebAuthnUnsupportedKey
+		}
+		digest := sha256.Sum256(data)
+		err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig)
+		if err != nil {
+			return ErrWebAuthnSignature
+		}
+
+	case COSEAlgEdDSA:
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return ErrWebAuthnUnsupportedKey
+		}
+		if !ed25519.Verify(key, data, sig) {
+			return ErrWebAuthnSignature
+		}
+
+	default:
+		return ErrWebAuthnUnsupportedKey
+	}
+
+	return nil
+}
+
+// base64URL encodes b as unpadded base64url, which is used by WebAuthn.
+func base64URL(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeBase64URL decodes a base64url string with or without padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,642 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	WebAuthnTokenType = "webauthn"      // token type for WebAuthn challenges
+	WebAuthnTimeout   = 5 * time.Minute // time allowed to complete a ceremony
+	webAuthnMaxBody   = 64 << 10        // maximum size of a request body
+)
+
+var (
+	ErrWebAuthnNotLoggedIn      = errors.New("not logged in")
+	ErrWebAuthnCredentialExists = errors.New("credential already registered")
+)
+
+// WebAuthnRP returns the relying party for this application, which is
+// based on the BaseURL.
+func (app *App) WebAuthnRP() (WebAuthnRP, error) {
+	u, err := url.Parse(app.Cfg.BaseURL)
+	if err != nil {
+		return WebAuthnRP{}, err
+	}
+
+	return WebAuthnRP{ID: u.Hostname(), Origin: u.Scheme + "://" + u.Host}, nil
+}
+
+// webAuthnUserID returns the opaque user handle for userName.
+func webAuthnUserID(userName string) string {
+	h := sha256.Sum256([]byte(userName))
+	return base64URL(h[:])
+}
+
+// newWebAuthnChallenge creates and saves a challenge for userName, which is
+// empty if the user is not yet known. Expired challenges are removed, since
+// a challenge that is not used is not otherwise removed.
+func (app *App) newWebAuthnChallenge(userName string) (string, error) {
+	err := app.Store.RemoveExpiredTokens(WebAuthnTokenType)
+	if err != nil {
+		slog.Error("failed to RemoveExpiredTokens", "err", err)
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	token := Token{
+		Value:   base64URL(b),
+		Expires: time.Now().Add(WebAuthnTimeout),
+		Type:    WebAuthnTokenType,
+	}
+
+	return token.Value, app.Store.SaveToken(userName, token)
+}
+
+// consumeWebAuthnChallenge returns the userName for the challenge in
+// clientDataJSON and removes the challenge so it cannot be reused.
+func (app *App) consumeWebAuthnChallenge(clientDataJSON []byte) (string, string, error) {
+	challenge, err := ClientDataChallenge(clientDataJSON)
+	if err != nil {
+		return "", "", err
+	}
+
+	userName, err := app.Store.GetUserNameForToken(WebAuthnTokenType, challenge)
+	if err != nil {
+		return "", "", ErrWebAuthnChallenge
+	}
+
+	ok, err := app.Store.ConsumeToken(WebAuthnTokenType, userName, challenge)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", ErrWebAuthnChallenge
+	}
+
+	return userName, challenge, nil
+}
+
+// credentialDescriptor identifies a credential in WebAuthn options.
+type credentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+// credentialDescriptors returns descriptors for creds.
+func credentialDescriptors(creds []Credential) []credentialDescriptor {
+	descs := make([]credentialDescriptor, 0, len(creds))
+	for _, c := range creds {
+		descs = append(descs, credentialDescriptor{
+			Type: "public-key", ID: c.EncodedID(), Transports: c.Transports,
+		})
+	}
+	return descs
+}
+
+// credentialResponse is the JSON sent by webauthn.js for a credential.
+type credentialResponse struct {
+	Name     string `json:"name"`
+	ID       string `json:"id"`
+	RawID    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+		AuthenticatorData string   `json:"authenticatorData"`
+		Signature         string   `json:"signature"`
+		UserHandle        string   `json:"userHandle"`
+	} `json:"response"`
+}
+
+// decodeCredentialResponse decodes the JSON request body.
+func decodeCredentialResponse(w http.ResponseWriter, r *http.Request) (credentialResponse, error) {
+	var resp credentialResponse
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, webAuthnMaxBody)).Decode(&resp)
+	if err != nil {
+		return resp, err
+	}
+
+	if resp.Type != "public-key" {
+		return resp, ErrWebAuthnType
+	}
+
+	return resp, nil
+}
+
+// writeJSON writes v as a JSON response with status code.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("failed to encode JSON", "err", err)
+	}
+}
+
+// writeJSONError writes a JSON error response with status code.
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// WebAuthnRegisterBeginHandler handles /webauthn/register/begin requests,
+// which return the options to create a credential for the current user.
+func (app *App) WebAuthnRegisterBeginHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil || user.UserName == "" {
+		logger.Warn("failed to GetUser", "err", err)
+		writeJSONError(w, http.StatusUnauthorized, ErrWebAuthnNotLoggedIn.Error())
+		return
+	}
+
+	rp, err := app.WebAuthnRP()
+	if err != nil {
+		logger.Error("failed to get WebAuthnRP", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	creds, err := app.Store.GetCredentialsForUser(user.UserName)
+	if err != nil {
+		logger.Error("failed to GetCredentialsForUser", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	challenge, err := app.newWebAuthnChallenge(user.UserName)
+	if err != nil {
+		logger.Error("failed to save challenge", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	options := map[string]any{
+		"challenge": challenge,
+		"rp":        map[string]string{"id": rp.ID, "name": app.Cfg.Title},
+		"user": map[string]string{
+			"id":          webAuthnUserID(user.UserName),
+			"name":        user.UserName,
+			"displayName": user.FullName,
+		},
+		"pubKeyCredParams": []map[string]any{
+			{"type": "public-key", "alg": COSEAlgES256},
+			{"type": "public-key", "alg": COSEAlgEdDSA},
+			{"type": "public-key", "alg": COSEAlgRS256},
+		},
+		"timeout":            WebAuthnTimeout.Milliseconds(),
+		"attestation":        "none",
+		"excludeCredentials": credentialDescriptors(creds),
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"publicKey": options})
+
+	logger.Info("WebAuthnRegisterBeginHandler", "user", user)
+}
+
+// WebAuthnRegisterFinishHandler handles /webauthn/register/finish requests,
+// which verify and save a new credential for the current user.
+func (app *App) WebAuthnRegisterFinishHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil || user.UserName == "" {
+		logger.Warn("failed to GetUser", "err", err)
+		writeJSONError(w, http.StatusUnauthorized, ErrWebAuthnNotLoggedIn.Error())
+		return
+	}
+
+	cred, err := app.registerCredential(w, r, user.UserName)
+	if err != nil {
+		logger.Warn("failed to register credential", "user", user, "err", err)
+		WriteEvent(app.Store, EventWebAuthnReg, false, user.UserName, err.Error())
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	WriteEvent(app.Store, EventWebAuthnReg, true, user.UserName, cred.Name)
+	writeJSON(w, http.StatusOK, map[string]string{"id": cred.EncodedID()})
+
+	logger.Info("registered credential", "user", user, "name", cred.Name)
+}
+
+// registerCredential verifies the credential in the request and saves it for userName.
+func (app *App) registerCredential(w http.ResponseWriter, r *http.Request, userName string) (Credential, error) {
+	resp, err := decodeCredentialResponse(w, r)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	clientDataJSON, err := decodeBase64URL(resp.Response.ClientDataJSON)
+	if err != nil {
+		return Credential{}, ErrWebAuthnClientData
+	}
+	attestationObject, err := decodeBase64URL(resp.Response.AttestationObject)
+	if err != nil {
+		return Credential{}, ErrWebAuthnAttestation
+	}
+
+	challengeUser, challenge, err := app.consumeWebAuthnChallenge(clientDataJSON)
+	if err != nil {
+		return Credential{}, err
+	}
+	if challengeUser != userName {
+		return Credential{}, ErrWebAuthnChallenge
+	}
+
+	rp, err := app.WebAuthnRP()
+	if err != nil {
+		return Credential{}, err
+	}
+
+	cred, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	_, err = app.Store.GetCredential(cred.ID)
+	if !errors.Is(err, ErrCredentialNotFound) {
+		if err == nil {
+			err = ErrWebAuthnCredentialExists
+		}
+		return Credential{}, err
+	}
+
+	cred.UserName = userName
+	cred.Name = strings.TrimSpace(resp.Name)
+	if len(cred.Name) > 64 {
+		cred.Name = cred.Name[:64]
+	}
+	for _, t := range resp.Response.Transports {
+		if len(t) <= 16 && !strings.Contains(t, ",") {
+			cred.Transports = append(cred.Transports, t)
+		}
+	}
+
+	return cred, app.Store.SaveCredential(cred)
+}
+
+// WebAuthnLoginBeginHandler handles /webauthn/login/begin requests, which
+// return the options to get a credential. If there is a pending second
+// factor, the options are for the credentials of that user, otherwise the
+// options allow any discoverable credential for a passwordless login.
+func (app *App) WebAuthnLoginBeginHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	rp, err := app.WebAuthnRP()
+	if err != nil {
+		logger.Error("failed to get WebAuthnRP", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	userName := app.pendingMFAUser(r)
+
+	options := map[string]any{
+		"rpId":             rp.ID,
+		"timeout":          WebAuthnTimeout.Milliseconds(),
+		"userVerification": "required",
+	}
+
+	if userName != "" {
+		creds, err := app.Store.GetCredentialsForUser(userName)
+		if err != nil {
+			logger.Error("failed to GetCredentialsForUser", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+			return
+		}
+		options["allowCredentials"] = credentialDescriptors(creds)
+		options["userVerification"] = "discouraged"
+	}
+
+	options["challenge"], err = app.newWebAuthnChallenge(userName)
+	if err != nil {
+		logger.Error("failed to save challenge", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"publicKey": options})
+
+	logger.Info("WebAuthnLoginBeginHandler", "userName", userName)
+}
+
+// pendingMFAUser returns the userName for a pending second factor or "".
+func (app *App) pendingMFAUser(r *http.Request) string {
+	mfaToken, err := GetCookieValue(r, MFATokenCookieName)
+	if err != nil || mfaToken == "" {
+		return ""
+	}
+
+	userName, err := app.Store.GetUserNameForToken(MFATokenType, mfaToken)
+	if err != nil {
+		return ""
+	}
+
+	return userName
+}
+
+// WebAuthnLoginFinishHandler handles /webauthn/login/finish requests, which
+// verify the credential and create a session for the user.
+func (app *App) WebAuthnLoginFinishHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	cred, mfa, err := app.verifyCredential(w, r)
+	if err != nil {
+		logger.Warn("failed to verify credential", "err", err)
+		if cred.UserName != "" {
+			WriteEvent(app.Store, EventWebAuthnLogin, false, cred.UserName, err.Error())
+		}
+		writeJSONError(w, http.StatusUnauthorized, MsgLoginFailed)
+		return
+	}
+
+	WriteEvent(app.Store, EventWebAuthnLogin, true, cred.UserName, cred.Name)
+
+	// credential was the second factor for a pending login
+	if mfa {
+		mfaToken, _ := GetCookieValue(r, MFATokenCookieName)
+		err = app.Store.RemoveToken(MFATokenType, mfaToken)
+		if err != nil {
+			logger.Error("failed to RemoveToken", "err", err)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name: MFATokenCookieName, Value: "", Path: "/", MaxAge: -1,
+		})
+		WriteEvent(app.Store, EventMFAVerify, true, cred.UserName, "webauthn")
+	}
+
+	redirect := r.URL.Query().Get("r")
+	if redirect == "" {
+		redirect = "/"
+	}
+
+	// the pending login already passed the checks of LoginUser
+	var token Token
+	if mfa {
+		token, err = app.createSession(cred.UserName)
+	} else {
+		token, err = app.LoginWithPasskey(cred.UserName)
+	}
+	if errors.Is(err, ErrLoginPasswordExpired) {
+		setPasswordChangeCookie(w, token)
+		writeJSON(w, http.StatusOK, map[string]string{"redirect": "/expired?r=" + url.QueryEscape(redirect)})
+		logger.Info("login requires password change", "userName", cred.UserName)
+		return
+	}
+	if err != nil {
+		logger.Warn("failed to login with passkey", "err", err, "userName", cred.UserName)
+
+		// avoid saying the account is locked, which confirms it exists
+		switch {
+		case errors.Is(err, ErrLoginLocked) && !app.Cfg.PrivacyMode:
+			writeJSONError(w, http.StatusForbidden, MsgLoginLocked)
+		case errors.Is(err, ErrLoginLocked):
+			writeJSONError(w, http.StatusUnauthorized, MsgLoginFailed)
+		case errors.Is(err, ErrLoginUnverified):
+			writeJSONError(w, http.StatusForbidden, MsgLoginUnverified)
+		default:
+			writeJSONError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}
+		return
+	}
+	SetSessionCookie(w, token)
+	// remember=on is in the query, from the mfa page or the login form
+	app.rememberUser(w, r, cred.UserName, token)
+
+	writeJSON(w, http.StatusOK, map[string]string{"redirect": redirect})
+
+	logger.Info("login successful", "userName", cred.UserName, "mfa", mfa)
+}
+
+// LoginWithPasskey returns a session Token for userName, who signed in with
+// a passkey instead of a password. The checks of LoginUser apply, so
+// ErrLoginLocked, ErrLoginUnverified, or a "pwchange" Token and
+// ErrLoginPasswordExpired may be returned. A second factor is not required
+// since the passkey is one.
+func (app *App) LoginWithPasskey(userName string) (Token, error) {
+	err := app.checkLockout(userName)
+	if err != nil {
+		WriteEvent(app.Store, EventLoginDeny, false, userName, err.Error())
+		return Token{}, err
+	}
+
+	token, err := app.checkLogin(userName)
+	if err != nil {
+		return token, err
+	}
+
+	return app.createSession(userName)
+}
+
+// verifyCredential verifies the assertion in the request and returns the
+// credential used and if it was for a pending second factor.
+func (app *App) verifyCredential(w http.ResponseWriter, r *http.Request) (Credential, bool, error) {
+	resp, err := decodeCredentialResponse(w, r)
+	if err != nil {
+		return Credential{}, false, err
+	}
+
+	id, err := decodeBase64URL(resp.RawID)
+	if err != nil {
+		return Credential{}, false, ErrCredentialNotFound
+	}
+	clientDataJSON, err := decodeBase64URL(resp.Response.ClientDataJSON)
+	if err != nil {
+		return Credential{}, false, ErrWebAuthnClientData
+	}
+	authData, err := decodeBase64URL(resp.Response.AuthenticatorData)
+	if err != nil {
+		return Credential{}, false, ErrWebAuthnAuthData
+	}
+	signature, err := decodeBase64URL(resp.Response.Signature)
+	if err != nil {
+		return Credential{}, false, ErrWebAuthnSignature
+	}
+
+	cred, err := app.Store.GetCredential(id)
+	if err != nil {
+		return Credential{}, false, err
+	}
+
+	challengeUser, challenge, err := app.consumeWebAuthnChallenge(clientDataJSON)
+	if err != nil {
+		return cred, false, err
+	}
+
+	// a challenge for a second factor must match the pending user
+	mfa := challengeUser != ""
+	if mfa && (challengeUser != cred.UserName || app.pendingMFAUser(r) != cred.UserName) {
+		return cred, false, ErrWebAuthnChallenge
+	}
+
+	rp, err := app.WebAuthnRP()
+	if err != nil {
+		return cred, false, err
+	}
+
+	// a passwordless login requires user verification by the authenticator
+	signCount, err := rp.VerifyAssertion(challenge, cred, clientDataJSON, authData, signature, !mfa)
+	if err != nil {
+		return cred, false, err
+	}
+
+	err = app.Store.UpdateCredentialUse(cred.ID, signCount)
+	if err != nil {
+		return cred, false, err
+	}
+
+	return cred, mfa, nil
+}
+
+// WebAuthnPageData contains data passed to the HTML template.
+type WebAuthnPageData struct {
+	Title       string
+	Message     string
+	CSRFToken   string // see CSRFHandler
+	CSPNonce    string // see SecurityHeadersHandler
+	User        User
+	Credentials []Credential
+}
+
+const MsgCredentialRemoved = "Security key removed."
+
+// WebAuthnHandler handles /webauthn requests to list and revoke the
+// credentials of the current user.
+func (app *App) WebAuthnHandler(w http.ResponseWriter, r *http.Request) {
+	logger := slog.With(slog.Group("request",
+		slog.String("id", GetReqID(r.Context())),
+		slog.String("remoteAddr", GetRealRemoteAddr(r)),
+		slog.String("method", r.Method),
+		slog.String("url", r.RequestURI),
+	))
+
+	if !ValidMethod(w, r, []string{http.MethodGet, http.MethodPost}) {
+		logger.Error("invalid HTTP method")
+		return
+	}
+
+	user, err := app.GetUserFromRequest(w, r)
+	if err != nil {
+		logger.Error("failed to GetUser", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	pageData := WebAuthnPageData{Title: app.Cfg.Title, CSRFToken: CSRFToken(r), CSPNonce: CSPNonce(r), User: user}
+
+	if user.UserName != "" && r.Method == http.MethodPost {
+		pageData.Message = app.revokeCredential(r, user.UserName)
+	}
+
+	if user.UserName != "" {
+		pageData.Credentials, err = app.Store.GetCredentialsForUser(user.UserName)
+		if err != nil {
+			logger.Error("failed to GetCredentialsForUser", "err", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = RenderTemplate(app.Tmpls, w, "webauthn.html", pageData)
+	if err != nil {
+		logger.Error("unable to RenderTemplate", "err", err)
+		return
+	}
+
+	logger.Info("WebAuthnHandler", "user", user)
+}
+
+// revokeCredential removes the credential in the form for userName and
+// returns a message to display.
+func (app *App) revokeCredential(r *http.Request, userName string) string {
+	action := strings.TrimSpace(r.PostFormValue("action"))
+	if action != "revoke" {
+		return MsgInvalidAction
+	}
+
+	id, err := decodeBase64URL(strings.TrimSpace(r.PostFormValue("id")))
+	if err == nil {
+		err = app.Store.RemoveCredential(userName, id)
+	}
+	if err != nil {
+		WriteEvent(app.Store, EventWebAuthnDel, false, userName, err.Error())
+		return err.Error()
+	}
+
+	WriteEvent(app.Store, EventWebAuthnDel, true, userName, base64URL(id))
+
+	return MsgCredentialRemoved
+}
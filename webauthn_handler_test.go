@@ -0,0 +1,139 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	weblogin "github.com/bnixon67/go-weblogin"
+)
+
+func TestWebAuthnHandlersInvalidMethod(t *testing.T) {
+	app := AppForTest(t)
+
+	handlers := map[string]http.HandlerFunc{
+		"/webauthn/register/begin":  app.WebAuthnRegisterBeginHandler,
+		"/webauthn/register/finish": app.WebAuthnRegisterFinishHandler,
+		"/webauthn/login/begin":     app.WebAuthnLoginBeginHandler,
+		"/webauthn/login/finish":    app.WebAuthnLoginFinishHandler,
+	}
+
+	for target, handler := range handlers {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+
+		handler(w, r)
+
+		expectedStatus := http.StatusMethodNotAllowed
+		if w.Code != expectedStatus {
+			t.Errorf("%s: got status %d %q, expected %d %q", target, w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+		}
+	}
+}
+
+func TestWebAuthnRegisterBeginNotLoggedIn(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/webauthn/register/begin", nil)
+
+	app.WebAuthnRegisterBeginHandler(w, r)
+
+	expectedStatus := http.StatusUnauthorized
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+}
+
+func TestWebAuthnLoginBegin(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/webauthn/login/begin", nil)
+
+	app.WebAuthnLoginBeginHandler(w, r)
+
+	expectedStatus := http.StatusOK
+	if w.Code != expectedStatus {
+		t.Errorf("got status %d %q, expected %d %q", w.Code, http.StatusText(w.Code), expectedStatus, http.StatusText(expectedStatus))
+	}
+
+	expectedInBody := `"userVerification":"required"`
+	if !strings.Contains(w.Body.String(), expectedInBody) {
+		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	}
+}
+
+func TestWebAuthnHandlerNotLoggedIn(t *testing.T) {
+	app := AppForTest(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/webauthn", nil)
+
+	app.WebAuthnHandler(w, r)
+
+	expectedInBody := "You must"
+	if !strings.Contains(w.Body.String(), expectedInBody) {
+		t.Errorf("got body %q, expected %q in body", w.Body, expectedInBody)
+	}
+}
+
+func TestLoginWithPasskey(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, app *weblogin.App)
+		wantErr error
+	}{
+		{"success", func(t *testing.T, app *weblogin.App) {}, nil},
+		{"locked", func(t *testing.T, app *weblogin.App) {
+			failLogins(t, app, "test", 1)
+		}, weblogin.ErrLoginLocked},
+		{"unverified", func(t *testing.T, app *weblogin.App) {
+			app.Cfg.VerifyEmail.Required = true
+			err := app.Store.SetEmailVerified("test", false)
+			if err != nil {
+				t.Fatalf("SetEmailVerified failed: %v", err)
+			}
+		}, weblogin.ErrLoginUnverified},
+		{"must change password", func(t *testing.T, app *weblogin.App) {
+			err := app.ExpirePassword("test", "admin")
+			if err != nil {
+				t.Fatalf("ExpirePassword failed: %v", err)
+			}
+		}, weblogin.ErrLoginPasswordExpired},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := lockoutAppForTest(t, weblogin.ConfigLockout{MaxFailures: 1, DurationMinutes: 10})
+			tc.setup(t, app)
+
+			token, err := app.LoginWithPasskey("test")
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("LoginWithPasskey got err %v, want %v", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			user, _, err := app.GetUserForSessionToken(token.Value)
+			if err != nil || user.UserName != "test" {
+				t.Errorf("GetUserForSessionToken got %q, %v, want test", user.UserName, err)
+			}
+		})
+	}
+}
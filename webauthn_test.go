@@ -0,0 +1,265 @@
+/*
+Copyright 2023 Bill Nixon
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License.  You may obtain a copy of the
+License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied.  See the License for the
+specific language governing permissions and limitations under the License.
+*/
+package weblogin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// cborEncode encodes the subset of values used by testAuthenticator.
+// Map keys are not sorted, so the encoding of a map is not deterministic.
+func cborEncode(v any) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 1<<8:
+			return []byte{major<<5 | 24, byte(n)}
+		case n < 1<<16:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(n))
+		}
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(n))
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[any]any:
+		b := head(5, uint64(len(v)))
+		for k, e := range v {
+			b = append(b, cborEncode(k)...)
+			b = append(b, cborEncode(e)...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// testAuthenticator is a software authenticator with a single P-256 credential.
+type testAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	pub       []byte // COSE encoded public key
+	id        []byte
+	rpID      string
+	origin    string
+	flags     byte
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T, rp WebAuthnRP) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+
+	pub := cborEncode(map[any]any{
+		1:  2,
+		3:  COSEAlgES256,
+		-1: 1,
+		-2: key.X.FillBytes(make([]byte, 32)),
+		-3: key.Y.FillBytes(make([]byte, 32)),
+	})
+
+	return &testAuthenticator{
+		key:    key,
+		pub:    pub,
+		id:     id,
+		rpID:   rp.ID,
+		origin: rp.Origin,
+		flags:  authFlagUserPresent | authFlagUserVerified,
+	}
+}
+
+func (a *testAuthenticator) clientData(typ, challenge string) []byte {
+	b, _ := json.Marshal(map[string]string{
+		"type": typ, "challenge": challenge, "origin": a.origin,
+	})
+	return b
+}
+
+func (a *testAuthenticator) authData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	b := append([]byte(nil), rpIDHash[:]...)
+
+	flags := a.flags
+	if attested {
+		flags |= authFlagAttested
+	}
+	b = append(b, flags)
+	b = binary.BigEndian.AppendUint32(b, a.signCount)
+
+	if attested {
+		b = append(b, make([]byte, 16)...) // aaguid
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, a.pub...)
+	}
+
+	return b
+}
+
+func (a *testAuthenticator) sign(authData, clientDataJSON []byte) []byte {
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+
+	return sig
+}
+
+// create returns the clientDataJSON and attestationObject for registration.
+func (a *testAuthenticator) create(challenge, format string) ([]byte, []byte) {
+	clientDataJSON := a.clientData("webauthn.create", challenge)
+	authData := a.authData(true)
+
+	attStmt := map[any]any{}
+	if format == "packed" {
+		attStmt["alg"] = COSEAlgES256
+		attStmt["sig"] = a.sign(authData, clientDataJSON)
+	}
+
+	return clientDataJSON, cborEncode(map[any]any{
+		"fmt": format, "authData": authData, "attStmt": attStmt,
+	})
+}
+
+// get returns the clientDataJSON, authenticatorData, and signature for login.
+func (a *testAuthenticator) get(challenge string) ([]byte, []byte, []byte) {
+	a.signCount++
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	authData := a.authData(false)
+	return clientDataJSON, authData, a.sign(authData, clientDataJSON)
+}
+
+var testRP = WebAuthnRP{ID: "example.com", Origin: "https://example.com"}
+
+func TestVerifyRegistration(t *testing.T) {
+	for _, format := range []string{"none", "packed"} {
+		a := newTestAuthenticator(t, testRP)
+		clientDataJSON, att := a.create("challenge", format)
+
+		cred, err := testRP.VerifyRegistration("challenge", clientDataJSON, att)
+		if err != nil {
+			t.Fatalf("VerifyRegistration(%s) got err %v", format, err)
+		}
+		if string(cred.ID) != string(a.id) {
+			t.Errorf("VerifyRegistration(%s) got ID %x, want %x", format, cred.ID, a.id)
+		}
+		if string(cred.PublicKey) != string(a.pub) {
+			t.Errorf("VerifyRegistration(%s) got PublicKey %x, want %x", format, cred.PublicKey, a.pub)
+		}
+	}
+}
+
+func TestVerifyRegistrationInvalid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(a *testAuthenticator)
+		format string
+		want   error
+	}{
+		{"origin", func(a *testAuthenticator) { a.origin = "https://evil.com" }, "none", ErrWebAuthnOrigin},
+		{"rpID", func(a *testAuthenticator) { a.rpID = "evil.com" }, "none", ErrWebAuthnRPID},
+		{"userPresent", func(a *testAuthenticator) { a.flags = 0 }, "none", ErrWebAuthnUserPresent},
+		{"format", func(a *testAuthenticator) {}, "tpm", ErrWebAuthnUnsupportedFmt},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newTestAuthenticator(t, testRP)
+			tc.modify(a)
+			clientDataJSON, att := a.create("challenge", tc.format)
+
+			_, err := testRP.VerifyRegistration("challenge", clientDataJSON, att)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("got err %v, want %v", err, tc.want)
+			}
+		})
+	}
+
+	a := newTestAuthenticator(t, testRP)
+	clientDataJSON, att := a.create("challenge", "none")
+	_, err := testRP.VerifyRegistration("other", clientDataJSON, att)
+	if !errors.Is(err, ErrWebAuthnChallenge) {
+		t.Errorf("wrong challenge got err %v, want %v", err, ErrWebAuthnChallenge)
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	a := newTestAuthenticator(t, testRP)
+	clientDataJSON, att := a.create("register", "none")
+	cred, err := testRP.VerifyRegistration("register", clientDataJSON, att)
+	if err != nil {
+		t.Fatalf("VerifyRegistration got err %v", err)
+	}
+
+	clientDataJSON, authData, sig := a.get("login")
+	signCount, err := testRP.VerifyAssertion("login", cred, clientDataJSON, authData, sig, true)
+	if err != nil {
+		t.Fatalf("VerifyAssertion got err %v", err)
+	}
+	if signCount != a.signCount {
+		t.Errorf("VerifyAssertion got signCount %d, want %d", signCount, a.signCount)
+	}
+	cred.SignCount = signCount
+
+	// replaying the same counter indicates a cloned authenticator
+	_, err = testRP.VerifyAssertion("login", cred, clientDataJSON, authData, sig, true)
+	if !errors.Is(err, ErrWebAuthnSignCount) {
+		t.Errorf("replay got err %v, want %v", err, ErrWebAuthnSignCount)
+	}
+
+	clientDataJSON, authData, sig = a.get("login")
+	sig[len(sig)-1] ^= 0xff
+	_, err = testRP.VerifyAssertion("login", cred, clientDataJSON, authData, sig, true)
+	if !errors.Is(err, ErrWebAuthnSignature) {
+		t.Errorf("bad signature got err %v, want %v", err, ErrWebAuthnSignature)
+	}
+
+	a.flags = authFlagUserPresent
+	clientDataJSON, authData, sig = a.get("login")
+	_, err = testRP.VerifyAssertion("login", cred, clientDataJSON, authData, sig, true)
+	if !errors.Is(err, ErrWebAuthnUserVerified) {
+		t.Errorf("without UV got err %v, want %v", err, ErrWebAuthnUserVerified)
+	}
+	_, err = testRP.VerifyAssertion("login", cred, clientDataJSON, authData, sig, false)
+	if err != nil {
+		t.Errorf("without UV not required got err %v", err)
+	}
+
+	clientDataJSON, authData, sig = a.get("login")
+	_, err = testRP.VerifyAssertion("other", cred, clientDataJSON, authData, sig, false)
+	if !errors.Is(err, ErrWebAuthnChallenge) {
+		t.Errorf("wrong challenge got err %v, want %v", err, ErrWebAuthnChallenge)
+	}
+}
@@ -21,12 +21,15 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	weblogin "github.com/bnixon67/go-weblogin"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 // keys returns a slice of the keys in the map m.
@@ -40,6 +43,78 @@ func keys[K comparable, V any](m map[K]V) []K {
 	return keys
 }
 
+// migrate runs the migrate subcommand with args and returns the exit code.
+func migrate(configFilename string, args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dryrun", false, "print pending SQL without applying it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -config file migrate [-dryrun] up|down|status [version]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "up migrates to version or the latest, down reverts to version or the previous.\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args) //nolint:errcheck
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := weblogin.GetConfigFromFile(configFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	store, err := weblogin.NewStore(cfg.SQL.DriverName, cfg.SQL.DataSourceName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	s, ok := store.(*weblogin.SQLStore)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s store does not use migrations\n", cfg.SQL.DriverName)
+		return 1
+	}
+
+	current, latest, err := s.CheckSchema()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var target int
+	switch fs.Arg(0) {
+	case "status":
+		fmt.Printf("schema version %d, latest %d\n", current, latest)
+		return 0
+	case "up":
+		target = latest
+	case "down":
+		target = current - 1
+	default:
+		fs.Usage()
+		return 2
+	}
+
+	if fs.NArg() == 2 {
+		target, err = strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			fs.Usage()
+			return 2
+		}
+	}
+
+	err = s.Migrate(target, *dryRun, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
 func main() {
 	// map of log levels
 	logLevels := map[string]slog.Level{
@@ -60,7 +135,7 @@ func main() {
 
 	// define custom usage message
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [migrate [-dryrun] up|down|status [version]]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "The flags are:\n")
 		flag.PrintDefaults()
 	}
@@ -82,14 +157,17 @@ func main() {
 		os.Exit(2)
 	}
 
-	// check for additional command-line arguments
+	weblogin.InitLog(*logFilename, level, *logAddSource)
+
+	// run migrate subcommand, if provided
 	if flag.NArg() > 0 {
-		flag.Usage()
-		os.Exit(2)
+		if flag.Arg(0) != "migrate" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		os.Exit(migrate(*configFilename, flag.Args()[1:]))
 	}
 
-	weblogin.InitLog(*logFilename, level, *logAddSource)
-
 	app, err := weblogin.NewApp(*configFilename)
 	if err != nil {
 		slog.Error("failed to create app", "err", err)
@@ -104,7 +182,12 @@ func main() {
 	srv := &http.Server{
 		Addr: ":" + app.Cfg.Server.Port,
 		Handler: weblogin.RequestIDHandler(
-			weblogin.LogRequestHandler(mux),
+			weblogin.LogRequestHandler(
+				weblogin.SecurityHeadersHandler(app.Cfg.Headers,
+					// endpoints called by clients and proxies are exempt
+					app.CSRFHandler(mux, "/token", "/userinfo", "/auth"),
+				),
+			),
 		),
 		ReadTimeout:       10 * time.Second,
 		WriteTimeout:      10 * time.Second,
@@ -114,16 +197,39 @@ func main() {
 	}
 
 	// register handlers
-	mux.HandleFunc("/login", app.LoginHandler)
-	mux.HandleFunc("/register", app.RegisterHandler)
+	mux.HandleFunc("/login", app.RateLimitHandler("/login", app.LoginHandler))
+	mux.HandleFunc("/magic", app.RateLimitHandler("/magic", app.MagicHandler))
+	mux.HandleFunc("/mfa", app.RateLimitHandler("/mfa", app.MFAHandler))
+	mux.Handle("/totp", app.RequireLogin(http.HandlerFunc(app.TOTPHandler)))
+	mux.Handle("/recovery", app.RequireLogin(http.HandlerFunc(app.RecoveryHandler)))
+	mux.Handle("/webauthn", app.RequireLogin(http.HandlerFunc(app.WebAuthnHandler)))
+	mux.HandleFunc("/webauthn/register/begin", app.WebAuthnRegisterBeginHandler)
+	mux.HandleFunc("/webauthn/register/finish", app.WebAuthnRegisterFinishHandler)
+	mux.HandleFunc("/webauthn/login/begin", app.RateLimitHandler("/webauthn/login/begin", app.WebAuthnLoginBeginHandler))
+	mux.HandleFunc("/webauthn/login/finish", app.WebAuthnLoginFinishHandler)
+	mux.HandleFunc("/authorize", app.OIDCAuthorizeHandler)
+	mux.HandleFunc("/token", app.OIDCTokenHandler)
+	mux.HandleFunc("/userinfo", app.OIDCUserInfoHandler)
+	mux.HandleFunc("/.well-known/openid-configuration", app.OIDCDiscoveryHandler)
+	mux.HandleFunc("/jwks.json", app.OIDCJWKSHandler)
+	mux.HandleFunc("/auth", app.ForwardAuthHandler)
+	mux.HandleFunc("/register", app.RateLimitHandler("/register", app.RegisterHandler))
 	mux.HandleFunc("/logout", app.LogoutHandler)
-	mux.HandleFunc("/forgot", app.ForgotHandler)
-	mux.HandleFunc("/reset", app.ResetHandler)
-	mux.HandleFunc("/hello", app.HelloHandler)
-	mux.HandleFunc("/users", app.UsersHandler)
+	mux.HandleFunc("/forgot", app.RateLimitHandler("/forgot", app.ForgotHandler))
+	mux.HandleFunc("/reset", app.RateLimitHandler("/reset", app.ResetHandler))
+	mux.HandleFunc("/verify", app.RateLimitHandler("/verify", app.VerifyHandler))
+	mux.HandleFunc("/expired", app.ExpiredHandler)
+	mux.Handle("/password", app.RequireLogin(http.HandlerFunc(app.PasswordHandler)))
+	mux.Handle("/profile", app.RequireLogin(http.HandlerFunc(app.ProfileHandler)))
+	mux.HandleFunc("/email", app.EmailLinkHandler)
+	mux.Handle("/sessions", app.RequireLogin(http.HandlerFunc(app.SessionsHandler)))
+	mux.Handle("/hello", app.RequireLogin(http.HandlerFunc(app.HelloHandler)))
+	mux.Handle("/users", app.RequirePermission(weblogin.PermUsersRead, http.HandlerFunc(app.UsersHandler)))
+	mux.Handle("/roles", app.RequireLogin(http.HandlerFunc(app.RolesHandler)))
 	// TODO: define base html directory in config
 	mux.HandleFunc("/w3.css", weblogin.ServeFileHandler("../html/w3.css"))
 	mux.HandleFunc("/favicon.ico", weblogin.ServeFileHandler("../html/favicon.ico"))
+	mux.HandleFunc("/webauthn.js", weblogin.ServeFileHandler("../html/webauthn.js"))
 	mux.Handle("/",
 		http.RedirectHandler("/hello", http.StatusMovedPermanently))
 
@@ -164,5 +270,8 @@ func main() {
 		slog.Error("server shutdown error", "err", err)
 	}
 
+	// finish sending emails for requests that were handled
+	weblogin.WaitForEmails()
+
 	slog.Info("server closed")
 }